@@ -0,0 +1,150 @@
+package txmpg
+
+import (
+	"context"
+	"sync"
+)
+
+// AsyncCommitter commits finalized transactions on
+// background goroutines, so that callers that don't need
+// to wait for the outcome can return as soon as Finalize()
+// has succeeded. Results are reported through the channel
+// returned by Submit(), and through the finalizers' own
+// Observer and Metrics as usual.
+//
+// The finalizer's context is used for the commit, so it
+// must not be cancelled when the caller returns.
+type AsyncCommitter struct {
+	jobs chan asyncCommit
+	// abort is closed when Close() gives up waiting, to
+	// make the workers abort the queued finalizers
+	abort     chan struct{}
+	abortOnce sync.Once
+	workers   sync.WaitGroup
+	// mu guards closed and sending on jobs
+	mu     sync.RWMutex
+	closed bool
+}
+
+// asyncCommit is a finalizer waiting to be committed and
+// the channel for its result
+type asyncCommit struct {
+	f      TxFinalizer
+	result chan error
+}
+
+// handOffer is implemented by the finalizers that can
+// stop their transaction being used once submitted
+type handOffer interface {
+	handOff() error
+}
+
+// NewAsyncCommitter starts workers goroutines committing
+// the finalizers passed to Submit(). Up to queue
+// finalizers can wait for a worker before Submit() blocks.
+func NewAsyncCommitter(workers, queue int) *AsyncCommitter {
+	if workers < 1 {
+		workers = 1
+	}
+	c := &AsyncCommitter{
+		jobs:  make(chan asyncCommit, queue),
+		abort: make(chan struct{}),
+	}
+	c.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go c.work()
+	}
+	return c
+}
+
+// Submit queues f to be committed and returns a channel
+// that receives the error from Commit(), or nil, once it
+// has run. Submit takes ownership of f, which must have
+// been finalized: after Submit the caller must not use
+// its transaction, and Finalizer.PgTx() returns nil to
+// enforce this. A finalizer that can't be committed, as it
+// isn't finalized or the AsyncCommitter is closed, is
+// aborted and its error delivered on the channel.
+func (c *AsyncCommitter) Submit(f TxFinalizer) <-chan error {
+	job := asyncCommit{f: f, result: make(chan error, 1)}
+	if h, ok := f.(handOffer); ok {
+		err := h.handOff()
+		if err != nil {
+			f.Abort()
+			job.result <- err
+			return job.result
+		}
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		f.SetAbortReason("AsyncCommitter is closed")
+		f.Abort()
+		job.result <- ErrCommitterClosed
+		return job.result
+	}
+	c.jobs <- job
+	return job.result
+}
+
+// work commits queued finalizers until the queue is
+// closed, aborting them instead once abort is closed
+func (c *AsyncCommitter) work() {
+	defer c.workers.Done()
+	for job := range c.jobs {
+		select {
+		case <-c.abort:
+			job.f.SetAbortReason("AsyncCommitter is closed")
+			job.f.Abort()
+			job.result <- ErrCommitterClosed
+			continue
+		default:
+		}
+		job.result <- job.f.Commit()
+	}
+}
+
+// Close stops accepting finalizers and waits for the
+// queued ones to be committed. If ctx finishes first, the
+// finalizers still queued are aborted, commits already
+// under way are waited for, and ctx's error is returned.
+func (c *AsyncCommitter) Close(ctx context.Context) error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.jobs)
+	}
+	c.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		c.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	c.abortOnce.Do(func() { close(c.abort) })
+	<-done
+	return ctx.Err()
+}
+
+// handOff marks the transaction as belonging to an
+// AsyncCommitter, so that PgTx() stops returning it. A
+// two-phase transaction is no longer available after
+// Finalize(), so it only has to be prepared.
+func (m *engine) handOff() error {
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+	if m.state != StateFinalized {
+		return m.finalizerError(ErrNotFinalized)
+	}
+	if !m.twoPhase {
+		m.mu.Lock()
+		m.handedOff = true
+		m.mu.Unlock()
+	}
+	m.logf(LevelInfo, "Handed off for asynchronous commit")
+	return nil
+}
@@ -0,0 +1,103 @@
+package txmpg
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// txMethods calls each method of a finalizer that needs
+// its open transaction, returning the errors by name
+func txMethods(ctx context.Context, f interface {
+	ExportSnapshot() (string, error)
+	CopyFrom(context.Context, string, []string, RowSource) (int64, error)
+	ClaimIdempotencyKey(context.Context, string, string) (bool, error)
+}) map[string]error {
+	errs := map[string]error{}
+	_, errs["ExportSnapshot"] = f.ExportSnapshot()
+	_, errs["CopyFrom"] = f.CopyFrom(ctx, "t", []string{"a"}, CopyFromRows(nil))
+	_, errs["ClaimIdempotencyKey"] = f.ClaimIdempotencyKey(ctx, "keys", "k")
+	return errs
+}
+
+func TestHandedOffFinalizerRefusesStatements(t *testing.T) {
+	ctx := context.Background()
+	_, factory := fakeFactory(t, "orders")
+	f, err := factory.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	err = f.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.handOff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := txMethods(ctx, f)
+	_, errs["PrepareCached"] = f.PrepareCached(ctx, "SELECT 1")
+	_, errs["ExecContext"] = f.ExecContext(ctx, "SELECT 1")
+	_, errs["QueryContext"] = f.QueryContext(ctx, "SELECT 1")
+	var n int
+	errs["QueryRowContext"] = f.QueryRowContext(ctx, "SELECT 1").Scan(&n)
+	for name, err := range errs {
+		if !errors.Is(err, ErrHandedOff) {
+			t.Errorf("%s() = %v, want ErrHandedOff", name, err)
+		}
+	}
+	err = f.Commit()
+	if err != nil {
+		t.Errorf("Commit() = %v", err)
+	}
+}
+
+func TestFinalizedFinalizer2PRefusesStatements(t *testing.T) {
+	ctx := context.Background()
+	_, factory := fakeFactory(t, "orders")
+	f, err := factory.Begin2P(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	err = f.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := txMethods(ctx, f)
+	_, errs["PrepareCached"] = f.PrepareCached(ctx, "SELECT 1")
+	_, errs["ExecContext"] = f.ExecContext(ctx, "SELECT 1")
+	_, errs["QueryContext"] = f.QueryContext(ctx, "SELECT 1")
+	var n int
+	errs["QueryRowContext"] = f.QueryRowContext(ctx, "SELECT 1").Scan(&n)
+	errs["Row.Err"] = f.QueryRowContext(ctx, "SELECT 1").Err()
+	for name, err := range errs {
+		if !errors.Is(err, ErrFinalized) {
+			t.Errorf("%s() = %v, want ErrFinalized", name, err)
+		}
+	}
+}
+
+func TestQueryRowContext(t *testing.T) {
+	ctx := context.Background()
+	_, factory := fakeFactory(t, "orders")
+	f, err := factory.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	row := f.QueryRowContext(ctx, "SELECT 1")
+	if row.Err() != nil {
+		t.Fatalf("Err() = %v", row.Err())
+	}
+	var n int
+	err = row.Scan(&n)
+	if err != nil || n != 1 {
+		t.Errorf("Scan() = %d, %v", n, err)
+	}
+	err = f.TracedTx().QueryRow("SELECT 1").Scan(&n)
+	if err != nil {
+		t.Errorf("TracedTx().QueryRow().Scan() = %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package txmpg
+
+import (
+	"context"
+	"time"
+
+	"github.com/williammoran/txmpg/v2/internal/driver"
+)
+
+// beginTx starts the finalizer's transaction, retrying
+// on connection errors as configured by WithBeginRetry()
+func (c *config) beginTx(ctx context.Context, pool driver.Pool) (driver.Tx, error) {
+	var tx driver.Tx
+	err := c.retryBegin(ctx, func() error {
+		var err error
+		tx, err = pool.Begin(ctx, c.txOptions())
+		return err
+	})
+	return tx, err
+}
+
+// abandonTx rolls back a transaction that the constructor
+// failed to set up
+func (c *config) abandonTx(tx driver.Tx) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.maintenanceTimeout)
+	defer cancel()
+	tx.Rollback(ctx)
+}
+
+// retryBegin calls begin until it succeeds, retrying on
+// connection errors as configured by WithBeginRetry().
+// Every attempt should get a connection from the pool,
+// and retrying stops as soon as ctx is finished.
+func (c *config) retryBegin(ctx context.Context, begin func() error) error {
+	delay := c.beginBackoff
+	for attempt := 1; ; attempt++ {
+		err := begin()
+		if err == nil {
+			return nil
+		}
+		if attempt >= c.beginAttempts || !IsConnectionError(err) {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// WithBeginRetry makes the constructors retry BeginTx up
+// to attempts times when it fails with a connection error
+// (see IsConnectionError()), such as the stale pooled
+// connections left behind by a server failover. The delay
+// before the first retry is backoff, and doubles after
+// each failed attempt. Other errors, and a finished
+// context, end the retries immediately. The default is a
+// single attempt.
+func WithBeginRetry(attempts int, backoff time.Duration) Option {
+	return func(c *config) {
+		if attempts < 1 {
+			attempts = 1
+		}
+		c.beginAttempts = attempts
+		c.beginBackoff = backoff
+	}
+}
@@ -0,0 +1,249 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+// benchLatency is the time each round trip to the fake
+// server takes in the benchmarks, roughly that of a
+// server in another availability zone
+const benchLatency = time.Millisecond
+
+// benchFactory returns a Factory on a fake server with
+// benchLatency
+func benchFactory(b *testing.B, opts ...Option) (*fakepg.Server, *Factory) {
+	server, factory := fakeFactory(b, "bench", opts...)
+	server.SetLatency(benchLatency)
+	return server, factory
+}
+
+// reportRoundTrips reports the round trips made to server
+// per operation since the timer was last reset
+func reportRoundTrips(b *testing.B, server *fakepg.Server, before int) {
+	b.ReportMetric(float64(server.RoundTrips()-before)/float64(b.N), "round-trips/op")
+}
+
+// BenchmarkCommit compares committing a transaction that
+// wrote a row with and without WithFastCommit()
+func BenchmarkCommit(b *testing.B) {
+	for _, bm := range []struct {
+		name string
+		fast bool
+	}{
+		{"status check", false},
+		{"fast commit", true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			ctx := context.Background()
+			server, factory := benchFactory(b, WithFastCommit(bm.fast))
+			before := server.RoundTrips()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f, err := factory.Begin(ctx)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, err = f.ExecContext(ctx, "INSERT INTO orders VALUES (1)")
+				if err == nil {
+					err = f.Finalize()
+				}
+				if err == nil {
+					err = f.Commit()
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			reportRoundTrips(b, server, before)
+		})
+	}
+}
+
+// BenchmarkBegin compares starting a Finalizer, which
+// looks up the transaction ID and backend PID in one
+// query, with a plain BeginTx() and with looking them up
+// in separate queries. Each transaction is rolled back
+// without a status check.
+func BenchmarkBegin(b *testing.B) {
+	ctx := context.Background()
+	for _, bm := range []struct {
+		name  string
+		begin func(*Factory) (func(), error)
+	}{
+		{"BeginTx", func(factory *Factory) (func(), error) {
+			tx, err := factory.pool.BeginTx(ctx, nil)
+			if err != nil {
+				return nil, err
+			}
+			return func() { tx.Rollback() }, nil
+		}},
+		{"separate queries", func(factory *Factory) (func(), error) {
+			tx, err := factory.pool.BeginTx(ctx, nil)
+			if err != nil {
+				return nil, err
+			}
+			var txid, pid int64
+			err = tx.QueryRowContext(ctx, "SELECT txid_current()").Scan(&txid)
+			if err == nil {
+				err = tx.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid)
+			}
+			return func() { tx.Rollback() }, err
+		}},
+		{"Begin", func(factory *Factory) (func(), error) {
+			f, err := factory.Begin(ctx)
+			if err != nil {
+				return nil, err
+			}
+			// Abort() checks the transaction status first,
+			// which isn't part of construction
+			return func() { f.PgTx().Rollback() }, nil
+		}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			server, factory := benchFactory(b)
+			before := server.RoundTrips()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				end, err := bm.begin(factory)
+				if err != nil {
+					b.Fatal(err)
+				}
+				end()
+			}
+			reportRoundTrips(b, server, before)
+		})
+	}
+}
+
+// BenchmarkSlowQueryThreshold measures the cost of
+// timing statements run through the finalizer, without
+// latency, against running them on PgTx() directly
+func BenchmarkSlowQueryThreshold(b *testing.B) {
+	for _, bm := range []struct {
+		name      string
+		threshold time.Duration
+		direct    bool
+	}{
+		{name: "PgTx", direct: true},
+		{name: "disabled"},
+		{name: "below threshold", threshold: time.Hour},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			ctx := context.Background()
+			_, factory := fakeFactory(b, "bench", WithSlowQueryThreshold(bm.threshold))
+			f, err := factory.Begin(ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer f.Abort()
+			exec := f.ExecContext
+			if bm.direct {
+				exec = f.PgTx().ExecContext
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err = exec(ctx, "UPDATE orders SET total = 1")
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkLazyMetadata compares whole transactions,
+// which either write a row or only read, with the
+// metadata looked up by the constructor and with
+// WithLazyTxid() and WithLazyMetadata()
+func BenchmarkLazyMetadata(b *testing.B) {
+	for _, bm := range []struct {
+		name string
+		opt  Option
+	}{
+		{"eager", WithLazyMetadata(false)},
+		{"lazy txid", WithLazyTxid(true)},
+		{"lazy metadata", WithLazyMetadata(true)},
+	} {
+		for _, query := range []string{"INSERT INTO orders VALUES (1)", "SELECT 1"} {
+			name := bm.name + "/write"
+			if query == "SELECT 1" {
+				name = bm.name + "/read"
+			}
+			b.Run(name, func(b *testing.B) {
+				ctx := context.Background()
+				server, factory := benchFactory(b, bm.opt)
+				before := server.RoundTrips()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					f, err := factory.Begin(ctx)
+					if err != nil {
+						b.Fatal(err)
+					}
+					_, err = f.ExecContext(ctx, query)
+					if err == nil {
+						err = f.Finalize()
+					}
+					if err == nil {
+						err = f.Commit()
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				reportRoundTrips(b, server, before)
+			})
+		}
+	}
+}
+
+// BenchmarkStatementCache compares running a hot
+// statement with arguments through the finalizer with and
+// without WithStatementCache(), and through
+// PrepareCached()
+func BenchmarkStatementCache(b *testing.B) {
+	for _, bm := range []struct {
+		name     string
+		cache    bool
+		prepared bool
+	}{
+		{name: "uncached"},
+		{name: "WithStatementCache", cache: true},
+		{name: "PrepareCached", prepared: true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			ctx := context.Background()
+			server, factory := benchFactory(b, WithStatementCache(bm.cache))
+			f, err := factory.Begin(ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer f.Abort()
+			const query = "UPDATE orders SET total = $1 WHERE id = $2"
+			exec := f.ExecContext
+			if bm.prepared {
+				exec = func(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+					stmt, err := f.PrepareCached(ctx, query)
+					if err != nil {
+						return nil, err
+					}
+					return stmt.ExecContext(ctx, args...)
+				}
+			}
+			before := server.RoundTrips()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err = exec(ctx, query, i, 1)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			reportRoundTrips(b, server, before)
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package txmpg
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/williammoran/txmpg/v2/internal/driver"
+)
+
+// capabilities records which optional server features
+// the finalizers can rely on
+type capabilities struct {
+	// txidStatus is true if txid_status() can be used to
+	// check the transaction before commit and rollback.
+	// It was added in PostgreSQL 10.
+	txidStatus bool
+	// xid8 is true if the xid8 functions that replace
+	// the deprecated txid functions are available. They
+	// were added in PostgreSQL 13.
+	xid8 bool
+}
+
+// metadataQuery returns the query that assigns and
+// returns the 64 bit ID of the current transaction along
+// with the backend PID, in a single round trip
+func (c capabilities) metadataQuery() string {
+	if c.xid8 {
+		return "SELECT pg_current_xact_id()::text::bigint, pg_backend_pid()"
+	}
+	return "SELECT txid_current(), pg_backend_pid()"
+}
+
+// lazyMetadataQuery is like metadataQuery, but does not
+// force the server to assign a transaction ID. The ID is
+// NULL if none has been assigned yet.
+func (c capabilities) lazyMetadataQuery() string {
+	if c.xid8 {
+		return "SELECT pg_current_xact_id_if_assigned()::text::bigint, pg_backend_pid()"
+	}
+	return "SELECT txid_current_if_assigned(), pg_backend_pid()"
+}
+
+// assignedTxidQuery returns the query that returns the ID
+// of the current transaction, or NULL if none has been
+// assigned
+func (c capabilities) assignedTxidQuery() string {
+	if c.xid8 {
+		return "SELECT pg_current_xact_id_if_assigned()::text::bigint"
+	}
+	return "SELECT txid_current_if_assigned()"
+}
+
+// txidStatusQuery returns the query that reports the
+// status of the transaction ID passed as $1, an int64 for
+// every driver
+func (c capabilities) txidStatusQuery() string {
+	if c.xid8 {
+		return "SELECT pg_xact_status($1::bigint::text::xid8)"
+	}
+	return "SELECT txid_status($1)"
+}
+
+// poolCapabilities caches the capabilities detected for
+// each pool. An entry is dropped when a query that relies
+// on them finds a function missing, which means that the
+// server behind the pool has changed, such as after a
+// failover to an older version, and by ForgetServer().
+var poolCapabilities sync.Map
+
+// forgetCapabilities drops the capabilities cached for
+// pool if err shows that they don't match the server, so
+// that the next finalizer detects them again
+func forgetCapabilities(pool driver.Querier, err error) {
+	if isUndefinedFunction(err) {
+		poolCapabilities.Delete(pool)
+	}
+}
+
+// detectCapabilities checks which features the server
+// behind pool supports. Detection runs on the pool rather
+// than in a transaction, so that a failed probe can't
+// abort the finalizer's transaction.
+func detectCapabilities(ctx context.Context, pool driver.Querier) (capabilities, error) {
+	cached, ok := poolCapabilities.Load(pool)
+	if ok {
+		return cached.(capabilities), nil
+	}
+	var version string
+	var hasTxidStatus bool
+	err := pool.QueryRow(
+		ctx,
+		`SELECT current_setting('server_version_num'),
+			to_regproc('pg_catalog.txid_status') IS NOT NULL`,
+	).Scan(&version, &hasTxidStatus)
+	if err != nil {
+		return capabilities{}, wrapError(err, "Detecting server capabilities")
+	}
+	caps, err := parseCapabilities(version, hasTxidStatus)
+	if err != nil {
+		return caps, wrapError(err, "Detecting server capabilities")
+	}
+	poolCapabilities.Store(pool, caps)
+	return caps, nil
+}
+
+// parseCapabilities returns the capabilities of a server
+// that reports version as server_version_num, with
+// hasTxidStatus telling whether txid_status() exists.
+// It can be missing on forks that report a PostgreSQL 10
+// or later version.
+func parseCapabilities(version string, hasTxidStatus bool) (capabilities, error) {
+	num, err := parseServerVersion(version)
+	if err != nil {
+		return capabilities{}, err
+	}
+	return capabilities{
+		txidStatus: num >= 100000 && hasTxidStatus,
+		xid8:       num >= 130000,
+	}, nil
+}
+
+// parseServerVersion parses server_version_num, such as
+// 90624 for 9.6.24 or 160002 for 16.2
+func parseServerVersion(version string) (int, error) {
+	num, err := strconv.Atoi(strings.TrimSpace(version))
+	if err != nil || num < 10000 {
+		return 0, fmt.Errorf("Unrecognized server_version_num %q", version)
+	}
+	return num, nil
+}
@@ -0,0 +1,112 @@
+package txmpg
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	tests := []struct {
+		version       string
+		hasTxidStatus bool
+		want          capabilities
+		wantErr       bool
+	}{
+		{version: "90624", hasTxidStatus: false, want: capabilities{}},
+		// A 9.6 server can't have txid_status(), whatever
+		// to_regproc() says
+		{version: "90624", hasTxidStatus: true, want: capabilities{}},
+		{version: "100000", hasTxidStatus: true, want: capabilities{txidStatus: true}},
+		{version: "100023", hasTxidStatus: false, want: capabilities{}},
+		{version: "120017", hasTxidStatus: true, want: capabilities{txidStatus: true}},
+		{version: "130000", hasTxidStatus: true, want: capabilities{txidStatus: true, xid8: true}},
+		{version: "160002", hasTxidStatus: true, want: capabilities{txidStatus: true, xid8: true}},
+		{version: "160002", hasTxidStatus: false, want: capabilities{xid8: true}},
+		{version: " 170000\n", hasTxidStatus: true, want: capabilities{txidStatus: true, xid8: true}},
+		{version: "", wantErr: true},
+		{version: "16.2", wantErr: true},
+		{version: "PostgreSQL 16.2", wantErr: true},
+		{version: "906", wantErr: true},
+		{version: "-100000", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCapabilities(tt.version, tt.hasTxidStatus)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseCapabilities(%q) = %+v, want an error", tt.version, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf(
+				"parseCapabilities(%q, %t) = %+v, %v, want %+v",
+				tt.version, tt.hasTxidStatus, got, err, tt.want,
+			)
+		}
+	}
+}
+
+func TestDetectCapabilities(t *testing.T) {
+	server, factory := fakeFactory(t, "orders")
+	server.SetVersion(90624)
+	f, err := factory.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	if f.caps != (capabilities{}) {
+		t.Errorf("capabilities of 9.6 = %+v", f.caps)
+	}
+	if server.Count("SELECT txid_current(), pg_backend_pid()") != 1 {
+		t.Errorf("metadata not queried with txid_current(): %q", server.Statements())
+	}
+}
+
+func TestCapabilitiesRedetectedAfterFailover(t *testing.T) {
+	ctx := context.Background()
+	server, factory := fakeFactory(t, "orders")
+	t.Cleanup(func() { ForgetServer(factory.Pool()) })
+	f, err := factory.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Abort()
+	// The pool now reaches a PostgreSQL 12 server, which
+	// doesn't have the xid8 functions
+	server.SetVersion(120000)
+	_, err = factory.Begin(ctx)
+	if err == nil {
+		t.Fatal("Begin() succeeded with stale capabilities")
+	}
+	f, err = factory.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Begin() = %v, want the capabilities detected again", err)
+	}
+	defer f.Abort()
+	if f.caps != (capabilities{txidStatus: true}) {
+		t.Errorf("capabilities of 12 = %+v", f.caps)
+	}
+	if server.Count("SELECT current_setting('server_version_num')") != 2 {
+		t.Errorf("capabilities detected %d times", server.Count("SELECT current_setting('server_version_num')"))
+	}
+}
+
+func TestForgetServerCapabilities(t *testing.T) {
+	ctx := context.Background()
+	server, factory := fakeFactory(t, "orders")
+	f, err := factory.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Abort()
+	ForgetServer(factory.Pool())
+	server.SetVersion(90624)
+	f, err = factory.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	if f.caps != (capabilities{}) {
+		t.Errorf("capabilities after ForgetServer() = %+v, want those of 9.6", f.caps)
+	}
+}
@@ -0,0 +1,60 @@
+package txmpg
+
+import (
+	"database/sql/driver"
+	"errors"
+	"strings"
+)
+
+// SQLState returns the SQLSTATE code of the server error
+// wrapped in err, or an empty string if err does not wrap
+// a server error. Errors from both lib/pq and pgx are
+// recognized.
+func SQLState(err error) string {
+	se, ok := asServerError(err)
+	if !ok {
+		return ""
+	}
+	return se.Code
+}
+
+// IsRetryable reports whether err is a conflict between
+// concurrent transactions (serialization_failure or
+// deadlock_detected) that is likely to succeed if the
+// whole transaction is retried
+func IsRetryable(err error) bool {
+	switch SQLState(err) {
+	case "40001", "40P01":
+		return true
+	}
+	return false
+}
+
+// IsConnectionError reports whether err indicates that
+// the connection to the server was lost or refused, as
+// opposed to a logical conflict. The transaction is gone
+// in this case, and it may be worth retrying on a new
+// connection.
+func IsConnectionError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+	state := SQLState(err)
+	switch state {
+	case "57P01", "57P02", "57P03":
+		// admin_shutdown, crash_shutdown, cannot_connect_now
+		return true
+	}
+	// Class 08 is connection_exception
+	return strings.HasPrefix(state, "08")
+}
+
+// IsAmbiguousCommitError reports whether err from a
+// COMMIT or COMMIT PREPARED leaves the outcome unknown: a
+// lost connection, a cancelled statement (57014, which
+// the driver causes when the context ends) or an error
+// that isn't from the server at all
+func IsAmbiguousCommitError(err error) bool {
+	state := SQLState(err)
+	return state == "" || state == "57014" || IsConnectionError(err)
+}
@@ -0,0 +1,207 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// The tests in this file are meant to be run with
+// go test -race, as CI does
+
+const raceIterations = 50
+
+// lifecycle is what the race tests need from both
+// finalizers
+type lifecycle interface {
+	Defer(func() error)
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+	Finalize() error
+	Commit() error
+	Abort()
+	State() State
+	Info() FinalizerInfo
+	Stats() Stats
+	AbortError() error
+	Trace(string, ...interface{})
+}
+
+// begin starts a Finalizer or a Finalizer2P
+func begin(t *testing.T, factory *Factory, twoPhase bool) lifecycle {
+	t.Helper()
+	var f lifecycle
+	var err error
+	if twoPhase {
+		f, err = factory.Begin2P(context.Background())
+	} else {
+		f, err = factory.Begin(context.Background())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestWatchdogRacesCommit(t *testing.T) {
+	server, factory := fakeFactory(t, "orders", WithAbortOnContextDone(true))
+	committed := 0
+	for i := 0; i < raceIterations; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		f, err := factory.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Finalize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go cancel()
+		err = f.Commit()
+		f.Abort()
+		switch {
+		case err == nil:
+			committed++
+			if f.State() != StateCommitted {
+				t.Fatalf("Commit() = nil in state %s", f.State())
+			}
+		case errors.Is(err, ErrAborted), errors.Is(err, context.Canceled):
+			if f.State() != StateAborted {
+				t.Fatalf("Commit() = %v in state %s", err, f.State())
+			}
+		default:
+			t.Fatalf("Commit() = %v", err)
+		}
+		cancel()
+	}
+	// Exactly one of the watchdog and Commit() ended each
+	// transaction
+	commits, rollbacks := server.Count("COMMIT"), server.Count("ROLLBACK")
+	if commits != committed || commits+rollbacks != raceIterations {
+		t.Errorf("%d commits and %d rollbacks for %d committed of %d",
+			commits, rollbacks, committed, raceIterations)
+	}
+}
+
+func TestCommitRacesAbort(t *testing.T) {
+	for _, twoPhase := range []bool{false, true} {
+		name := "Finalizer"
+		if twoPhase {
+			name = "Finalizer2P"
+		}
+		t.Run(name, func(t *testing.T) {
+			server, factory := fakeFactory(t, "orders")
+			committed := 0
+			for i := 0; i < raceIterations; i++ {
+				f := begin(t, factory, twoPhase)
+				_, err := f.ExecContext(context.Background(), "INSERT INTO orders VALUES (1)")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = f.Finalize()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var wg sync.WaitGroup
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					f.Abort()
+				}()
+				err = f.Commit()
+				wg.Wait()
+				// Whichever ran first wins
+				switch {
+				case err == nil:
+					committed++
+					if f.State() != StateCommitted {
+						t.Fatalf("Commit() = nil in state %s", f.State())
+					}
+				case errors.Is(err, ErrAborted):
+					if f.State() != StateAborted {
+						t.Fatalf("Commit() = %v in state %s", err, f.State())
+					}
+				default:
+					t.Fatalf("Commit() = %v", err)
+				}
+			}
+			commits, rollbacks := server.Count("COMMIT"), server.Count("ROLLBACK")
+			if commits != committed || commits+rollbacks != raceIterations {
+				t.Errorf("%d commits and %d rollbacks for %d committed of %d",
+					commits, rollbacks, committed, raceIterations)
+			}
+		})
+	}
+}
+
+func TestSharedFinalizer(t *testing.T) {
+	const goroutines = 8
+	for _, twoPhase := range []bool{false, true} {
+		name := "Finalizer"
+		if twoPhase {
+			name = "Finalizer2P"
+		}
+		t.Run(name, func(t *testing.T) {
+			_, factory := fakeFactory(t, "orders")
+			f := begin(t, factory, twoPhase)
+			defer f.Abort()
+			var ran atomic.Int32
+			var wg sync.WaitGroup
+			for i := 0; i < goroutines; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					f.Defer(func() error {
+						ran.Add(1)
+						return nil
+					})
+					_, err := f.ExecContext(context.Background(), "INSERT INTO orders VALUES (1)")
+					if err != nil {
+						t.Error(err)
+					}
+					f.Trace("inserted")
+					_ = f.Info()
+					_ = f.Stats()
+				}()
+			}
+			wg.Wait()
+			// The accessors may be called while the
+			// transaction finishes
+			done := make(chan struct{})
+			for i := 0; i < goroutines; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						_ = f.State()
+						_ = f.Info()
+						_ = f.Stats()
+						f.Trace("watching")
+					}
+				}()
+			}
+			err := f.Finalize()
+			if err == nil {
+				err = f.Commit()
+			}
+			close(done)
+			wg.Wait()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ran.Load() != goroutines {
+				t.Errorf("%d deferred commits ran, want %d", ran.Load(), goroutines)
+			}
+			if f.Stats().DeferredCommits != goroutines {
+				t.Errorf("Stats().DeferredCommits = %d", f.Stats().DeferredCommits)
+			}
+		})
+	}
+}
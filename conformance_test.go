@@ -0,0 +1,75 @@
+package txmpg_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/williammoran/txmanager/v2"
+	"github.com/williammoran/txmpg/v2"
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+	"github.com/williammoran/txmpg/v2/txmpgtest"
+)
+
+// runConformance checks the finalizers made by Begin()
+// and Begin2P() on pool, and those of the driver modules'
+// engine. The factory can't fail the subtest it is called
+// from, so it panics instead.
+func runConformance(t *testing.T, pool *sql.DB) {
+	factory := txmpg.NewFactory("conformance", pool)
+	for _, twoPhase := range []bool{false, true} {
+		name := "BeginDriver"
+		if twoPhase {
+			name = "BeginDriver2P"
+		}
+		t.Run(name, func(t *testing.T) {
+			txmpgtest.RunFinalizerConformance(t, func(ctx context.Context) txmanager.TxFinalizer {
+				f, err := txmpg.BeginSQLDriver(ctx, "conformance", pool, twoPhase)
+				if err != nil {
+					panic(err)
+				}
+				return f
+			})
+		})
+	}
+	t.Run("Begin", func(t *testing.T) {
+		txmpgtest.RunFinalizerConformance(t, func(ctx context.Context) txmanager.TxFinalizer {
+			f, err := factory.Begin(ctx)
+			if err != nil {
+				panic(err)
+			}
+			return f
+		})
+	})
+	t.Run("Begin2P", func(t *testing.T) {
+		txmpgtest.RunFinalizerConformance(t, func(ctx context.Context) txmanager.TxFinalizer {
+			f, err := factory.Begin2P(ctx)
+			if err != nil {
+				panic(err)
+			}
+			return f
+		})
+	})
+}
+
+func TestConformanceFake(t *testing.T) {
+	_, pool := fakepg.Open()
+	defer pool.Close()
+	runConformance(t, pool)
+}
+
+// TestConformance needs a server with prepared
+// transactions enabled at TXMPG_TEST_DSN
+func TestConformance(t *testing.T) {
+	dsn := os.Getenv("TXMPG_TEST_DSN")
+	if dsn == "" {
+		t.Skip("TXMPG_TEST_DSN is not set")
+	}
+	pool, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	runConformance(t, pool)
+}
@@ -0,0 +1,67 @@
+package txmpg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+func TestConstraintCheckStatement(t *testing.T) {
+	server, factory := fakeFactory(t, "orders", WithConstraintCheck(true))
+	f, err := factory.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	server.FailNext("SET CONSTRAINTS ALL IMMEDIATE", fakepg.ServerError("23503", "foreign key violation"))
+	err = f.Finalize()
+	if SQLState(err) != "23503" {
+		t.Fatalf("Finalize() = %v, want the violation", err)
+	}
+	if f.State() != StateFailed || server.Count("COMMIT") != 0 {
+		t.Errorf("State() = %s after a violation", f.State())
+	}
+}
+
+// TestConstraintCheck inserts a row that violates a
+// deferred foreign key, which the server reports at
+// Finalize() with WithConstraintCheck() and only at
+// Commit() without it
+func TestConstraintCheck(t *testing.T) {
+	db := serverDB(t)
+	_, err := db.Exec(`
+		DROP TABLE IF EXISTS txmpg_child, txmpg_parent;
+		CREATE TABLE txmpg_parent (id int PRIMARY KEY);
+		CREATE TABLE txmpg_child (
+			parent int REFERENCES txmpg_parent DEFERRABLE INITIALLY DEFERRED
+		)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec("DROP TABLE txmpg_child, txmpg_parent") })
+	for _, check := range []bool{false, true} {
+		factory := NewFactory("orders", db, WithConstraintCheck(check))
+		f, err := factory.Begin(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.ExecContext(context.Background(), "INSERT INTO txmpg_child VALUES (1)")
+		if err != nil {
+			f.Abort()
+			t.Fatal(err)
+		}
+		finalizeErr := f.Finalize()
+		commitErr := f.Commit()
+		f.Abort()
+		if check {
+			if SQLState(finalizeErr) != "23503" {
+				t.Errorf("with the check, Finalize() = %v, want the violation", finalizeErr)
+			}
+			continue
+		}
+		if finalizeErr != nil || SQLState(commitErr) != "23503" {
+			t.Errorf("without the check, Finalize() = %v and Commit() = %v", finalizeErr, commitErr)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// RowSource supplies the rows for CopyFrom(). It has the
+// same methods as pgx.CopyFromSource, so a source written
+// for one can be used with the other.
+type RowSource interface {
+	// Next advances to the next row, returning false
+	// when there are no more rows or an error occurred
+	Next() bool
+	// Values returns the values of the current row
+	Values() ([]interface{}, error)
+	// Err returns any error that stopped Next()
+	Err() error
+}
+
+// CopyFromRows returns a RowSource that supplies rows
+func CopyFromRows(rows [][]interface{}) RowSource {
+	return &sliceRows{rows: rows, i: -1}
+}
+
+// sliceRows is the RowSource returned by CopyFromRows()
+type sliceRows struct {
+	rows [][]interface{}
+	i    int
+}
+
+func (s *sliceRows) Next() bool {
+	s.i++
+	return s.i < len(s.rows)
+}
+
+func (s *sliceRows) Values() ([]interface{}, error) {
+	return s.rows[s.i], nil
+}
+
+func (s *sliceRows) Err() error {
+	return nil
+}
+
+// CopyFrom bulk loads rows into columns of table with
+// COPY, returning the number of rows loaded. The load is
+// part of the transaction, so it is discarded if the
+// transaction is aborted. table may be qualified with a
+// schema as "schema.table". Once the transaction of a
+// Finalizer has been submitted to an AsyncCommitter it
+// returns ErrHandedOff, and once that of a Finalizer2P has
+// been prepared ErrFinalized.
+func (m sqlFinalizer) CopyFrom(
+	ctx context.Context, table string, columns []string, rows RowSource,
+) (int64, error) {
+	tx := m.PgTx()
+	if tx == nil {
+		return 0, m.finalizerError(wrapError(m.errNoTransaction(), "CopyFrom()"))
+	}
+	n, err := copyFrom(ctx, tx, &m.statements, table, columns, rows)
+	if err != nil {
+		return n, m.finalizerError(err)
+	}
+	return n, nil
+}
+
+// copyFrom does the work of CopyFrom() using lib/pq's
+// COPY support, which sends each row with an Exec() on
+// the COPY statement and completes the COPY with a final
+// Exec() without arguments
+func copyFrom(
+	ctx context.Context, tx *sql.Tx, log *statementLog,
+	table string, columns []string, rows RowSource,
+) (n int64, err error) {
+	query := copyInQuery(table, columns)
+	start := log.now()
+	defer func() {
+		log.done(start, query, nil, n, err)
+	}()
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return 0, wrapError(err, "Starting COPY into "+table)
+	}
+	defer stmt.Close()
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return n, wrapError(err, "Reading row for COPY into "+table)
+		}
+		_, err = stmt.ExecContext(ctx, values...)
+		if err != nil {
+			return n, wrapError(err, "Sending row for COPY into "+table)
+		}
+		n++
+	}
+	err = rows.Err()
+	if err != nil {
+		return n, wrapError(err, "Reading rows for COPY into "+table)
+	}
+	_, err = stmt.ExecContext(ctx)
+	if err != nil {
+		return n, wrapError(err, "Completing COPY into "+table)
+	}
+	return n, nil
+}
+
+// copyInQuery returns the lib/pq COPY statement for table,
+// which may be qualified with a schema
+func copyInQuery(table string, columns []string) string {
+	schema, name, ok := strings.Cut(table, ".")
+	if !ok {
+		return pq.CopyIn(table, columns...)
+	}
+	return pq.CopyInSchema(schema, name, columns...)
+}
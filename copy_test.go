@@ -0,0 +1,172 @@
+package txmpg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+// stagingRows returns n rows for the staging table
+func stagingRows(n int) [][]interface{} {
+	rows := make([][]interface{}, n)
+	for i := range rows {
+		rows[i] = []interface{}{int64(i), fmt.Sprintf("row %d", i)}
+	}
+	return rows
+}
+
+// failingRows is a RowSource that fails after its rows
+type failingRows struct {
+	RowSource
+	err error
+}
+
+func (f failingRows) Err() error {
+	return f.err
+}
+
+func TestCopyFrom(t *testing.T) {
+	ctx := context.Background()
+	for _, commit := range []bool{true, false} {
+		t.Run(fmt.Sprintf("commit=%t", commit), func(t *testing.T) {
+			var traces []string
+			server, factory := fakeFactory(t, "orders", WithTraceHook(func(e TraceEvent) {
+				traces = append(traces, e.Message)
+			}))
+			f, err := factory.Begin(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Abort()
+			n, err := f.CopyFrom(ctx, "staging", []string{"id", "name"}, CopyFromRows(stagingRows(3000)))
+			if err != nil || n != 3000 {
+				t.Fatalf("CopyFrom() = %d, %v", n, err)
+			}
+			// One Exec per row and one to complete the COPY
+			copyIn := pq.CopyIn("staging", "id", "name")
+			if c := server.Count(copyIn); c != 3001 {
+				t.Errorf("%d COPY statements, want 3001", c)
+			}
+			if !strings.Contains(strings.Join(traces, "\n"), "affected 3000 rows") {
+				t.Errorf("traces %q lack the row count", traces)
+			}
+			if commit {
+				err = f.Finalize()
+				if err == nil {
+					err = f.Commit()
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				f.Abort()
+			}
+			statements := server.Statements()
+			last := statements[len(statements)-1]
+			if want := map[bool]string{true: "COMMIT", false: "ROLLBACK"}[commit]; last != want {
+				t.Errorf("transaction ended with %s, want %s", last, want)
+			}
+		})
+	}
+}
+
+func TestCopyFromSchema(t *testing.T) {
+	if q := copyInQuery("audit.staging", []string{"id"}); q != pq.CopyInSchema("audit", "staging", "id") {
+		t.Errorf("copyInQuery() = %s", q)
+	}
+	if q := copyInQuery("staging", []string{"id"}); q != pq.CopyIn("staging", "id") {
+		t.Errorf("copyInQuery() = %s", q)
+	}
+}
+
+func TestCopyFromErrors(t *testing.T) {
+	ctx := context.Background()
+	t.Run("row fails", func(t *testing.T) {
+		server, factory := fakeFactory(t, "orders")
+		f, err := factory.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Abort()
+		server.FailNext("COPY", fakepg.ServerError("22P02", "invalid input syntax"))
+		n, err := f.CopyFrom(ctx, "staging", []string{"id", "name"}, CopyFromRows(stagingRows(3)))
+		if n != 0 || SQLState(err) != "22P02" || !strings.Contains(err.Error(), "Sending row for COPY into staging") {
+			t.Errorf("CopyFrom() = %d, %v", n, err)
+		}
+	})
+	t.Run("source fails", func(t *testing.T) {
+		_, factory := fakeFactory(t, "orders")
+		f, err := factory.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Abort()
+		broken := errors.New("source broken")
+		rows := failingRows{CopyFromRows(stagingRows(2)), broken}
+		n, err := f.CopyFrom(ctx, "staging", []string{"id", "name"}, rows)
+		if n != 2 || !errors.Is(err, broken) || !strings.Contains(err.Error(), "NAME: orders") {
+			t.Errorf("CopyFrom() = %d, %v", n, err)
+		}
+	})
+	t.Run("finalized", func(t *testing.T) {
+		_, factory := fakeFactory(t, "orders")
+		f, err := factory.Begin2P(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Abort()
+		err = f.Finalize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.CopyFrom(ctx, "staging", []string{"id"}, CopyFromRows(nil))
+		if !errors.Is(err, ErrFinalized) {
+			t.Errorf("CopyFrom() = %v, want ErrFinalized", err)
+		}
+	})
+}
+
+func TestCopyFromServer(t *testing.T) {
+	db := serverDB(t)
+	ctx := context.Background()
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS txmpg_test_copy (id bigint, name text)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DROP TABLE txmpg_test_copy")
+	factory := NewFactory("copy", db)
+	load := func(commit bool) {
+		t.Helper()
+		f, err := factory.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Abort()
+		n, err := f.CopyFrom(ctx, "public.txmpg_test_copy", []string{"id", "name"}, CopyFromRows(stagingRows(5000)))
+		if err != nil || n != 5000 {
+			t.Fatalf("CopyFrom() = %d, %v", n, err)
+		}
+		if !commit {
+			return
+		}
+		err = f.Finalize()
+		if err == nil {
+			err = f.Commit()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	load(true)
+	load(false)
+	var n int
+	err = db.QueryRow("SELECT count(*) FROM txmpg_test_copy").Scan(&n)
+	if err != nil || n != 5000 {
+		t.Errorf("%d rows loaded, %v, want only the committed 5000", n, err)
+	}
+}
@@ -0,0 +1,57 @@
+package txmpg
+
+import "fmt"
+
+// maxCorrelationIDLength leaves room for the UUID and
+// separator in a generated GID
+const maxCorrelationIDLength = MaxGIDLength - 37
+
+// validateCorrelationID checks that id fits in a GID
+func validateCorrelationID(id string) error {
+	if len(id) > maxCorrelationIDLength {
+		return fmt.Errorf(
+			"%w: correlation ID of %d bytes is longer than %d",
+			ErrInvalidGID, len(id), maxCorrelationIDLength,
+		)
+	}
+	if id == "" {
+		return nil
+	}
+	return ValidateGID(id)
+}
+
+// WithCorrelationID stamps the finalizer with an ID from
+// the application, such as a request ID, as if
+// SetCorrelationID() had been called right after
+// construction
+func WithCorrelationID(id string) Option {
+	return func(c *config) {
+		c.correlationID = id
+	}
+}
+
+// SetCorrelationID stamps the finalizer with an ID from
+// the application, such as a request ID. It appears in
+// traces and errors, and a Finalizer2P that generates its
+// GID appends it, so that a prepared transaction left on
+// the server can be traced back to its request. The ID
+// must not be longer than 162 bytes, or 141 with
+// WithReadableGID(), and has no effect on the GID after
+// Finalize().
+func (m *engine) SetCorrelationID(id string) error {
+	err := m.cfg.checkCorrelationID(id, m.twoPhase)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.correlationID = id
+	return nil
+}
+
+// CorrelationID returns the ID set by SetCorrelationID()
+func (m *engine) CorrelationID() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.correlationID
+}
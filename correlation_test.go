@@ -0,0 +1,141 @@
+package txmpg
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateCorrelationID(t *testing.T) {
+	tests := []struct {
+		name  string
+		id    string
+		valid bool
+	}{
+		{"empty", "", true},
+		{"request ID", "req-42", true},
+		{"at the limit", strings.Repeat("a", maxCorrelationIDLength), true},
+		{"over the limit", strings.Repeat("a", maxCorrelationIDLength+1), false},
+		// 81 two byte characters are exactly the limit,
+		// and one more byte is over it
+		{"multibyte at the limit", strings.Repeat("é", maxCorrelationIDLength/2), true},
+		{"multibyte over the limit", strings.Repeat("é", maxCorrelationIDLength/2) + "a", false},
+		{"invalid UTF-8", "req-\xc3", false},
+		{"NUL", "req\x0042", false},
+		// The server accepts any other character in a GID,
+		// and QuoteGID() escapes them
+		{"tab and newline", "req\t42\n", true},
+		{"escape", "req\x1b[31m", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCorrelationID(tt.id)
+			if tt.valid && err != nil {
+				t.Errorf("validateCorrelationID() = %v, want nil", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidGID) {
+				t.Errorf("validateCorrelationID() = %v, want ErrInvalidGID", err)
+			}
+			if !tt.valid {
+				return
+			}
+			// Every valid ID fits in a generated GID
+			gid, err := NewGID("orders", tt.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ValidateGID(gid)
+			if err != nil {
+				t.Fatalf("GID %q is invalid: %v", gid, err)
+			}
+			info, err := ParseGID(gid)
+			if err != nil || info.CorrelationID != tt.id {
+				t.Errorf("ParseGID(%q) = %+v, %v", gid, info, err)
+			}
+		})
+	}
+}
+
+func TestReadableGIDRejectsLongCorrelationID(t *testing.T) {
+	room := MaxGIDLength - readableGIDOverhead - len(gidSeparator)
+	tests := []struct {
+		name  string
+		id    string
+		valid bool
+	}{
+		{"fits", strings.Repeat("a", room), true},
+		{"one byte over", strings.Repeat("a", room+1), false},
+		{"straddling character", strings.Repeat("a", room-1) + "€", false},
+		{"control characters", "req\t42\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gid, err := NewGID("", tt.id, WithReadableGID(""))
+			if !tt.valid {
+				if !errors.Is(err, ErrInvalidGID) {
+					t.Errorf("NewGID() = %q, %v, want ErrInvalidGID", gid, err)
+				}
+				_, factory := fakeFactory(t, "orders", WithReadableGID(""))
+				_, err = factory.Begin2P(context.Background(), WithCorrelationID(tt.id))
+				if !errors.Is(err, ErrInvalidGID) {
+					t.Errorf("Begin2P() = %v, want ErrInvalidGID", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(gid) > MaxGIDLength {
+				t.Fatalf("GID of %d bytes is over the limit", len(gid))
+			}
+			info, err := ParseGID(gid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.CorrelationID != tt.id {
+				t.Errorf("correlation ID in GID = %q, want %q", info.CorrelationID, tt.id)
+			}
+		})
+	}
+}
+
+func TestSetCorrelationIDReadableGID(t *testing.T) {
+	_, factory := fakeFactory(t, "orders", WithReadableGID(""))
+	long := strings.Repeat("a", maxReadableCorrelationIDLength+1)
+	f2p, err := factory.Begin2P(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2p.Abort()
+	err = f2p.SetCorrelationID(long)
+	if !errors.Is(err, ErrInvalidGID) {
+		t.Errorf("Finalizer2P.SetCorrelationID() = %v, want ErrInvalidGID", err)
+	}
+	// A single phase finalizer generates no GID
+	f, err := factory.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	err = f.SetCorrelationID(long)
+	if err != nil {
+		t.Errorf("Finalizer.SetCorrelationID() = %v", err)
+	}
+}
+
+func TestSetCorrelationIDRejectsInvalid(t *testing.T) {
+	_, factory := fakeFactory(t, "orders")
+	f, err := factory.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	err = f.SetCorrelationID(strings.Repeat("a", maxCorrelationIDLength+1))
+	if !errors.Is(err, ErrInvalidGID) {
+		t.Errorf("SetCorrelationID() = %v, want ErrInvalidGID", err)
+	}
+	if f.CorrelationID() != "" {
+		t.Errorf("CorrelationID() = %q after a rejected ID", f.CorrelationID())
+	}
+}
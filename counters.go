@@ -0,0 +1,93 @@
+package txmpg
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+// counters are the process wide totals published by
+// EnableExpvar(). They are updated alongside the
+// Metrics calls.
+var counters struct {
+	active          atomic.Int64
+	commits         atomic.Int64
+	aborts          atomic.Int64
+	prepareFailures atomic.Int64
+	inDoubt         atomic.Int64
+	prepared        atomic.Int64
+	serverPrepared  atomic.Int64
+	poolExhausted   atomic.Int64
+}
+
+// countState updates the counters for a change of state
+// from was to s
+func countState(was, s State) {
+	switch s {
+	case StateCommitted:
+		counters.commits.Add(1)
+	case StateAborted:
+		counters.aborts.Add(1)
+	}
+	if s.terminal() && !was.terminal() {
+		counters.active.Add(-1)
+	}
+}
+
+// countPrepared updates the count of outstanding
+// prepared transactions when a Finalizer2P that prepared
+// its transaction changes state from was to s. A failed
+// abort leaves the prepared transaction on the server, so
+// it is still counted.
+func countPrepared(was, s State) {
+	resolved := func(s State) bool {
+		return s == StateCommitted || s == StateAborted
+	}
+	if resolved(s) && !resolved(was) {
+		counters.prepared.Add(-1)
+	}
+}
+
+// OutstandingPrepared returns the number of prepared
+// transactions created by Finalizer2Ps in this process
+// that have not yet been committed or rolled back. The
+// server's max_prepared_transactions caps it.
+func OutstandingPrepared() int {
+	return int(counters.prepared.Load())
+}
+
+// ServerPrepared returns the number of prepared
+// transactions seen on the server by the last poll of
+// MonitorPrepared(), including those left by other
+// processes. It is 0 if no monitor is running.
+func ServerPrepared() int {
+	return int(counters.serverPrepared.Load())
+}
+
+var expvarOnce sync.Once
+
+// EnableExpvar publishes the counters of all finalizers
+// in the process as the expvar variable "txmpg": the
+// number of active transactions, and the totals of
+// commits, aborts, PREPARE TRANSACTION failures, in
+// doubt COMMIT PREPARED outcomes and commits that found
+// the pool exhausted, and the number of
+// outstanding prepared transactions. Importing the package
+// doesn't publish anything until this is called, and
+// calling it more than once has no further effect.
+func EnableExpvar() {
+	expvarOnce.Do(func() {
+		expvar.Publish("txmpg", expvar.Func(func() interface{} {
+			return map[string]int64{
+				"active":           counters.active.Load(),
+				"commits":          counters.commits.Load(),
+				"aborts":           counters.aborts.Load(),
+				"prepare_failures": counters.prepareFailures.Load(),
+				"in_doubt":         counters.inDoubt.Load(),
+				"prepared":         counters.prepared.Load(),
+				"server_prepared":  counters.serverPrepared.Load(),
+				"pool_exhausted":   counters.poolExhausted.Load(),
+			}
+		}))
+	})
+}
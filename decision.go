@@ -0,0 +1,164 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// Decision records are a lighter alternative to a Journal
+// for transactions where one participant, the decider,
+// can hold the coordinator's decision. The protocol is
+// presumed abort:
+//
+//   - RecordDecision() on the decider inserts a row keyed
+//     by the transaction's correlation ID, inside the
+//     decider's own transaction, so the row exists if and
+//     only if the decider commits
+//   - SetDecider() on every other participant makes its
+//     Commit() commit the decider first, whatever order
+//     txmanager commits in
+//   - After a crash, RecoverDecisions() commits the
+//     prepared transactions whose decision row exists and
+//     rolls back the rest
+//
+// So a crash before any PREPARE leaves nothing to
+// recover, a crash between PREPAREs or before the
+// decider commits rolls everything back, and a crash
+// after the decider commits commits everything. The
+// decision table needs a unique text column named key,
+// for example:
+//
+//	CREATE TABLE txmpg_decision (
+//		key text PRIMARY KEY,
+//		decided timestamptz NOT NULL DEFAULT now()
+//	)
+//
+// Rows can be deleted once every participant has
+// committed.
+
+// RecordDecision makes this finalizer the decider for its
+// transaction by inserting key into table as a deferred
+// commit. key must be the correlation ID shared by every
+// participant, since that is what RecoverDecisions() looks
+// up. table is quoted as a single identifier.
+func (m *Finalizer2P) RecordDecision(table, key string) {
+	m.Defer(func() error {
+		tx := m.transaction("RecordDecision()")
+		if tx == nil {
+			return ErrFinalized
+		}
+		err := tx.Exec(
+			m.ctx,
+			"INSERT INTO "+pq.QuoteIdentifier(table)+" (key) VALUES ($1)",
+			key,
+		)
+		if err != nil {
+			return wrapError(err, "Recording decision")
+		}
+		return nil
+	})
+}
+
+// SetDecider makes Commit() commit decider, the finalizer
+// that called RecordDecision(), before committing this
+// finalizer's prepared transaction. If decider fails to
+// commit, so does this finalizer's Commit().
+func (m *Finalizer2P) SetDecider(decider *Finalizer2P) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.decider = decider.engine
+}
+
+// commitDecider commits the decider, if there is one.
+// The caller must not hold opMu.
+func (m *engine) commitDecider(ctx context.Context) error {
+	m.mu.Lock()
+	decider := m.decider
+	m.mu.Unlock()
+	if decider == nil || decider == m {
+		return nil
+	}
+	err := decider.commitAsDecider(ctx)
+	if err == nil || errors.Is(err, ErrAlreadyCommitted) || errors.Is(err, ErrAlreadyResolved) {
+		return nil
+	}
+	return wrapError(err, "Committing decider")
+}
+
+// commitAsDecider commits the decider on behalf of a
+// participant. If that commits it, the decider's own next
+// Commit() returns nil instead of ErrAlreadyCommitted.
+// The decider's own decider, if any, is left alone, so
+// that mutual deciders don't commit each other in turn.
+func (m *engine) commitAsDecider(ctx context.Context) error {
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+	if m.state == StateCommitted {
+		return nil
+	}
+	err := m.commitContext(ctx)
+	if m.state == StateCommitted {
+		m.committedByParticipant = true
+	}
+	return err
+}
+
+// lookupDecision returns Commit if key is in table in
+// the database behind decider, and Rollback if not
+func lookupDecision(ctx context.Context, decider *sql.DB, table, key string) (Decision, error) {
+	var decided bool
+	err := decider.QueryRowContext(
+		ctx,
+		"SELECT EXISTS (SELECT 1 FROM "+pq.QuoteIdentifier(table)+" WHERE key = $1)",
+		key,
+	).Scan(&decided)
+	if err != nil {
+		return Skip, wrapError(err, "Looking up decision")
+	}
+	if decided {
+		return Commit, nil
+	}
+	return Rollback, nil
+}
+
+// RecoverDecisions resolves the prepared transactions left
+// on participants by finalizers that used RecordDecision()
+// with table in the database behind decider. Transactions
+// are committed if their correlation ID is in the table
+// and rolled back if not; those without a correlation ID
+// are skipped. decider should be one of participants, as
+// its own prepared transaction has to be rolled back.
+//
+// Like ResolveInDoubt(), it must only be run when no
+// coordinator is between PREPARE and COMMIT PREPARED.
+func RecoverDecisions(
+	ctx context.Context, decider *sql.DB, table string, participants []*sql.DB,
+) (Report, error) {
+	var report Report
+	var errs []error
+	for _, db := range participants {
+		list, err := listLocalPrepared(ctx, db, "")
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, p := range list {
+			info, err := ParseGID(p.GID)
+			if err != nil || info.CorrelationID == "" {
+				continue
+			}
+			decision, err := lookupDecision(ctx, decider, table, info.CorrelationID)
+			if err != nil {
+				report.Results = append(report.Results, ReapResult{
+					Tx: p, Decision: Skip, Err: err,
+				})
+				continue
+			}
+			report.Results = append(report.Results, resolvePrepared(ctx, db, p, decision))
+		}
+	}
+	return report, errors.Join(errs...)
+}
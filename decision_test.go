@@ -0,0 +1,233 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/williammoran/txmanager/v2"
+)
+
+func TestDeciderCommittedByParticipant(t *testing.T) {
+	// txmanager commits in map order, so repeat to cover
+	// the participant committing the decider first
+	for i := 0; i < 20; i++ {
+		ctx := context.Background()
+		deciderServer, deciderFactory := fakeFactory(t, "decider")
+		participantServer, participantFactory := fakeFactory(t, "participant")
+		decider, err := deciderFactory.Begin2P(ctx, WithCorrelationID("order-1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		participant, err := participantFactory.Begin2P(ctx, WithCorrelationID("order-1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decider.RecordDecision("txmpg_decision", "order-1")
+		participant.SetDecider(decider)
+		var tx txmanager.Transaction
+		tx.Add("decider", decider)
+		tx.Add("participant", participant)
+
+		err = tx.Commit()
+		if err != nil {
+			t.Fatalf("Commit() = %v", err)
+		}
+		if decider.State() != StateCommitted || participant.State() != StateCommitted {
+			t.Fatalf("states %s and %s, want committed", decider.State(), participant.State())
+		}
+		if n := len(deciderServer.Committed()); n != 1 {
+			t.Errorf("decider committed %d times", n)
+		}
+		if n := len(participantServer.Committed()); n != 1 {
+			t.Errorf("participant committed %d times", n)
+		}
+		// Once txmanager's Commit() has been absorbed, the
+		// usual answer applies
+		err = decider.Commit()
+		if !errors.Is(err, ErrAlreadyCommitted) {
+			t.Errorf("decider Commit() after the transaction = %v, want ErrAlreadyCommitted", err)
+		}
+	}
+}
+
+func TestDeciderSharedByParticipants(t *testing.T) {
+	ctx := context.Background()
+	_, deciderFactory := fakeFactory(t, "decider")
+	decider, err := deciderFactory.Begin2P(ctx, WithCorrelationID("order-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decider.RecordDecision("txmpg_decision", "order-2")
+	var tx txmanager.Transaction
+	tx.Add("decider", decider)
+	for _, name := range []string{"a", "b", "c"} {
+		_, factory := fakeFactory(t, name)
+		participant, err := factory.Begin2P(ctx, WithCorrelationID("order-2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		participant.SetDecider(decider)
+		tx.Add(name, participant)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatalf("Commit() = %v", err)
+	}
+}
+
+func TestDeciderConcurrentParticipants(t *testing.T) {
+	ctx := context.Background()
+	deciderServer, deciderFactory := fakeFactory(t, "decider")
+	decider, err := deciderFactory.Begin2P(ctx, WithCorrelationID("order-3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decider.RecordDecision("txmpg_decision", "order-3")
+	var participants []*Finalizer2P
+	for _, name := range []string{"a", "b", "c", "d"} {
+		_, factory := fakeFactory(t, name)
+		participant, err := factory.Begin2P(ctx, WithCorrelationID("order-3"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		participant.SetDecider(decider)
+		participants = append(participants, participant)
+	}
+	for _, f := range append(participants, decider) {
+		err = f.Finalize()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(participants))
+	for i, participant := range participants {
+		wg.Add(1)
+		go func(i int, participant *Finalizer2P) {
+			defer wg.Done()
+			errs[i] = participant.Commit()
+		}(i, participant)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("participant %d Commit() = %v", i, err)
+		}
+	}
+	if n := len(deciderServer.Committed()); n != 1 {
+		t.Errorf("decider committed %d times", n)
+	}
+}
+
+func TestMutualDeciders(t *testing.T) {
+	ctx := context.Background()
+	_, factory := fakeFactory(t, "orders")
+	a, err := factory.Begin2P(ctx, WithCorrelationID("order-4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := factory.Begin2P(ctx, WithCorrelationID("order-4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.SetDecider(b)
+	b.SetDecider(a)
+	for _, f := range []*Finalizer2P{a, b} {
+		err = f.Finalize()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := make(chan [2]error)
+	go func() {
+		var errs [2]error
+		var wg sync.WaitGroup
+		for i, f := range []*Finalizer2P{a, b} {
+			wg.Add(1)
+			go func(i int, f *Finalizer2P) {
+				defer wg.Done()
+				errs[i] = f.Commit()
+			}(i, f)
+		}
+		wg.Wait()
+		done <- errs
+	}()
+	select {
+	case errs := <-done:
+		if errs[0] != nil || errs[1] != nil {
+			t.Errorf("Commit() = %v, %v", errs[0], errs[1])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("mutual deciders deadlocked")
+	}
+	if a.State() != StateCommitted || b.State() != StateCommitted {
+		t.Errorf("states %s and %s, want committed", a.State(), b.State())
+	}
+}
+
+func TestRecoverDecisionsLongCorrelationID(t *testing.T) {
+	ctx := context.Background()
+	deciderServer, deciderFactory := fakeFactory(t, "decider")
+	participantServer, participantFactory := fakeFactory(t, "participant")
+	// Long enough that a readable GID would have had to
+	// shorten it
+	decided := strings.Repeat("d", 150)
+	undecided := strings.Repeat("u", 150)
+	begin := func(id string) (*Finalizer2P, *Finalizer2P) {
+		decider, err := deciderFactory.Begin2P(ctx, WithCorrelationID(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		participant, err := participantFactory.Begin2P(ctx, WithCorrelationID(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decider.RecordDecision("txmpg_decision", id)
+		participant.SetDecider(decider)
+		for _, f := range []*Finalizer2P{decider, participant} {
+			err = f.Finalize()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return decider, participant
+	}
+	// The process crashes after the decider commits, and
+	// before the participant's COMMIT PREPARED
+	decider, participant := begin(decided)
+	err := decider.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed := participant.GID()
+	// and before the decider of another transaction commits
+	_, participant = begin(undecided)
+	rolledBack := participant.GID()
+
+	report, err := RecoverDecisions(
+		ctx, deciderFactory.Pool(), "txmpg_decision",
+		[]*sql.DB{deciderFactory.Pool(), participantFactory.Pool()},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range report.Results {
+		if result.Err != nil {
+			t.Errorf("resolving %s: %v", result.Tx.GID, result.Err)
+		}
+	}
+	if got := participantServer.Committed(); len(got) != 1 || got[0] != committed {
+		t.Errorf("participant committed %q, want %q", got, committed)
+	}
+	if got := participantServer.RolledBack(); len(got) != 1 || got[0] != rolledBack {
+		t.Errorf("participant rolled back %q, want %q", got, rolledBack)
+	}
+	if n := len(deciderServer.Prepared()) + len(participantServer.Prepared()); n != 0 {
+		t.Errorf("%d prepared transactions left", n)
+	}
+}
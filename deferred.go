@@ -0,0 +1,222 @@
+package txmpg
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/williammoran/txmpg/v2/internal/driver"
+)
+
+// DeferPolicy controls what Finalize() does when a
+// deferred commit fails
+type DeferPolicy int
+
+const (
+	// StopOnError makes Finalize() return the first error
+	// from a deferred commit without running the rest.
+	// This is the default.
+	StopOnError DeferPolicy = iota
+	// RunAll makes Finalize() run every deferred commit
+	// and return all of their errors combined with
+	// errors.Join()
+	RunAll
+)
+
+// WithMaxDeferredCommits limits the number of deferred
+// commits Finalize() will run, including commits
+// registered with Defer() by other deferred commits while
+// Finalize() is running. Finalize() fails with
+// ErrTooManyDeferredCommits if the limit is exceeded. The
+// default is 1000.
+func WithMaxDeferredCommits(max int) Option {
+	return func(c *config) {
+		c.maxDeferredCommits = max
+	}
+}
+
+// WithDeferPolicy sets how Finalize() handles failures of
+// deferred commits
+func WithDeferPolicy(p DeferPolicy) Option {
+	return func(c *config) {
+		c.deferPolicy = p
+	}
+}
+
+// deferredCommit is a function registered with Defer()
+// and where it was registered
+type deferredCommit struct {
+	exec func() error
+	site string
+	// query is set for statements registered with
+	// DeferStatement() without arguments, which can be
+	// sent together
+	query string
+}
+
+// DeferError is returned by Finalize() when a deferred
+// commit fails. It describes how far Finalize() got, to
+// help decide whether the failure left side effects
+// behind. Use errors.As() to find it; with the RunAll
+// policy there is one for each failed commit.
+type DeferError struct {
+	// Index is the position of the failed commit in the
+	// order they were registered
+	Index int
+	// Site is the file and line of the Defer() call that
+	// registered it
+	Site string
+	// Succeeded is the number of deferred commits that
+	// had already succeeded
+	Succeeded int
+	// Duration is how long the failed commit ran
+	Duration time.Duration
+	Err      error
+}
+
+func (e *DeferError) Error() string {
+	return fmt.Sprintf(
+		"deferred commit %d registered at %s failed after %s (%d succeeded): %s",
+		e.Index, e.Site, e.Duration, e.Succeeded, e.Err.Error(),
+	)
+}
+
+// Unwrap returns the error from the deferred commit
+func (e *DeferError) Unwrap() error {
+	return e.Err
+}
+
+// runDeferredCommits runs the deferred commits in order,
+// following policy when one fails. next returns the i'th
+// deferred commit, if there is one; it is consulted on
+// each iteration so that commits registered by a running
+// commit are run as well, up to max in total. Consecutive
+// statements without arguments are passed to batch to be
+// sent in one round trip; if it returns a
+// *driver.BatchError, the failure is reported against the
+// statement that failed.
+func runDeferredCommits(
+	next func(i int) (deferredCommit, bool),
+	policy DeferPolicy,
+	max int,
+	now func() time.Time,
+	trace func(format string, args ...interface{}),
+	batch func(queries []string) error,
+) error {
+	var errs []error
+	succeeded := 0
+	for i := 0; ; i++ {
+		commit, ok := next(i)
+		if !ok {
+			break
+		}
+		if i >= max {
+			trace("more than %d deferred commits", max)
+			errs = append(errs, ErrTooManyDeferredCommits)
+			break
+		}
+		queries := batchedQueries(next, i, max)
+		if len(queries) > 1 {
+			start := now()
+			err := batch(queries)
+			last := i + len(queries) - 1
+			if err == nil {
+				succeeded += len(queries)
+				trace("deferred statements %d to %d succeeded", i, last)
+				i = last
+				continue
+			}
+			deferErr := batchError(next, i, last, succeeded, err)
+			deferErr.Duration = now().Sub(start)
+			trace("deferred statement %d from %s failed: %s", deferErr.Index, deferErr.Site, err.Error())
+			if policy != RunAll {
+				return deferErr
+			}
+			errs = append(errs, deferErr)
+			i = last
+			continue
+		}
+		start := now()
+		err := runDeferred(commit.exec)
+		if err == nil {
+			succeeded++
+			trace("deferred commit %d succeeded", i)
+			continue
+		}
+		trace("deferred commit %d from %s failed: %s", i, commit.site, err.Error())
+		deferErr := &DeferError{
+			Index:     i,
+			Site:      commit.site,
+			Succeeded: succeeded,
+			Duration:  now().Sub(start),
+			Err:       err,
+		}
+		if policy != RunAll {
+			return deferErr
+		}
+		errs = append(errs, deferErr)
+	}
+	return errors.Join(errs...)
+}
+
+// batchError describes the failure of the batch of
+// deferred statements i to last
+func batchError(
+	next func(i int) (deferredCommit, bool), i, last, succeeded int, err error,
+) *DeferError {
+	var stmtErr *driver.BatchError
+	if !errors.As(err, &stmtErr) {
+		commit, _ := next(i)
+		return &DeferError{
+			Index:     i,
+			Site:      commit.site,
+			Succeeded: succeeded,
+			Err:       fmt.Errorf("one of deferred statements %d to %d: %w", i, last, err),
+		}
+	}
+	commit, _ := next(i + stmtErr.Index)
+	return &DeferError{
+		Index:     i + stmtErr.Index,
+		Site:      commit.site,
+		Succeeded: succeeded + stmtErr.Index,
+		Err:       stmtErr.Err,
+	}
+}
+
+// batchedQueries returns the queries of the run of
+// deferred statements without arguments starting at i,
+// up to the max'th deferred commit
+func batchedQueries(next func(i int) (deferredCommit, bool), i, max int) []string {
+	var queries []string
+	for ; i < max; i++ {
+		commit, ok := next(i)
+		if !ok || commit.query == "" {
+			break
+		}
+		queries = append(queries, commit.query)
+	}
+	return queries
+}
+
+// batchStatement joins queries into a multi-statement
+// query
+func batchStatement(queries []string) string {
+	return strings.Join(queries, ";\n")
+}
+
+// runDeferred calls a deferred commit, converting a panic
+// into an error so that the coordinator can still abort
+// every participant
+func runDeferred(commit func() error) (err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = fmt.Errorf(
+				"deferred commit panicked: %v\n%s", r, debug.Stack(),
+			)
+		}
+	}()
+	return commit()
+}
@@ -0,0 +1,178 @@
+package txmpg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/williammoran/txmanager/v2"
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+func TestDeferStatementBatchFailure(t *testing.T) {
+	for _, twoPhase := range []bool{false, true} {
+		server, f := beginDriver(t, twoPhase)
+		f.DeferStatement("INSERT INTO orders VALUES (1)")
+		_, _, line, _ := runtime.Caller(0)
+		f.DeferStatement("INSERT INTO orders VALUES (2)")
+		f.DeferStatement("INSERT INTO orders VALUES (3)")
+		// The statement fails in the batch and again when
+		// it is run on its own
+		for i := 0; i < 2; i++ {
+			server.FailNext("INSERT INTO orders VALUES (2)", fakepg.ServerError("23505", "duplicate key"))
+		}
+		err := f.Finalize()
+		var deferErr *DeferError
+		if !errors.As(err, &deferErr) {
+			t.Fatalf("Finalize() = %v, want a *DeferError", err)
+		}
+		if deferErr.Index != 1 || deferErr.Succeeded != 1 ||
+			!strings.HasSuffix(deferErr.Site, fmt.Sprintf(":%d", line+1)) {
+			t.Errorf("DeferError = %+v, want statement 1 from line %d", deferErr, line+1)
+		}
+		// Statements after the failed one aren't sent again
+		if server.Count("ROLLBACK TO SAVEPOINT") != 1 || server.Count("INSERT INTO orders VALUES (3)") != 0 {
+			t.Errorf("statements %q", server.Statements())
+		}
+	}
+}
+
+func TestDeferStatementBatchFailureNotRepeated(t *testing.T) {
+	server, f := beginDriver(t, false)
+	f.DeferStatement("INSERT INTO orders VALUES (1)")
+	f.DeferStatement("INSERT INTO orders VALUES (2)")
+	server.FailNext("INSERT INTO orders VALUES (2)", errors.New("connection reset"))
+	err := f.Finalize()
+	var deferErr *DeferError
+	if !errors.As(err, &deferErr) || deferErr.Index != 0 {
+		t.Fatalf("Finalize() = %v, want a *DeferError for the whole batch", err)
+	}
+	if !strings.Contains(deferErr.Error(), "one of deferred statements 0 to 1") {
+		t.Errorf("DeferError = %q", deferErr)
+	}
+}
+
+func TestDeferStatementBatch(t *testing.T) {
+	server, f := beginDriver(t, false)
+	f.DeferStatement("INSERT INTO orders VALUES (1)")
+	f.DeferStatement("INSERT INTO orders VALUES (2)")
+	before := server.RoundTrips()
+	err := f.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Count("INSERT") != 2 || server.Count("RELEASE SAVEPOINT") != 1 {
+		t.Errorf("statements %q", server.Statements())
+	}
+	if n := server.RoundTrips() - before; n != 1 {
+		t.Errorf("Finalize() made %d round trips, want 1", n)
+	}
+}
+
+func TestDeferStatementBatchFailureServer(t *testing.T) {
+	db := serverDB(t)
+	f, err := newFinalizer(context.Background(), "batch", db, newConfig(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	f.DeferStatement("SELECT 1")
+	f.DeferStatement("SELECT 1/0")
+	f.DeferStatement("SELECT 2")
+	err = f.Finalize()
+	var deferErr *DeferError
+	if !errors.As(err, &deferErr) || deferErr.Index != 1 || deferErr.Succeeded != 1 {
+		t.Fatalf("Finalize() = %v, want a *DeferError for statement 1", err)
+	}
+}
+
+func TestDeferPanicRollsBackEveryParticipant(t *testing.T) {
+	for _, twoPhase := range []bool{false, true} {
+		serverA, factoryA := fakeFactory(t, "a")
+		serverB, factoryB := fakeFactory(t, "b")
+		a := begin(t, factoryA, twoPhase)
+		b := begin(t, factoryB, twoPhase)
+		a.Defer(func() error { return nil })
+		b.Defer(func() error { panic("boom") })
+		var tx txmanager.Transaction
+		tx.Add("a", a)
+		tx.Add("b", b)
+		err := tx.Commit()
+		var deferErr *DeferError
+		if !errors.As(err, &deferErr) {
+			t.Fatalf("twoPhase %t: Commit() = %v, want a *DeferError", twoPhase, err)
+		}
+		if !strings.Contains(err.Error(), "deferred commit panicked: boom") ||
+			!strings.Contains(err.Error(), "goroutine ") {
+			t.Errorf("twoPhase %t: error %q lacks the panic and its stack", twoPhase, err)
+		}
+		if a.State() != StateAborted || b.State() != StateAborted {
+			t.Errorf("twoPhase %t: states %s and %s, want aborted", twoPhase, a.State(), b.State())
+		}
+		for _, server := range []*fakepg.Server{serverA, serverB} {
+			if server.Count("COMMIT") != 0 || len(server.Prepared()) != 0 {
+				t.Errorf("twoPhase %t: %q left committed or prepared", twoPhase, server.Statements())
+			}
+		}
+	}
+}
+
+func TestDeferFromDeferredCommit(t *testing.T) {
+	for _, twoPhase := range []bool{false, true} {
+		_, factory := fakeFactory(t, "orders")
+		f := begin(t, factory, twoPhase)
+		var order []string
+		record := func(name string) func() error {
+			return func() error {
+				order = append(order, name)
+				return nil
+			}
+		}
+		f.Defer(func() error {
+			order = append(order, "outbox")
+			f.Defer(record("follow-up 1"))
+			f.Defer(record("follow-up 2"))
+			return nil
+		})
+		f.Defer(record("last"))
+		err := f.Finalize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "outbox,last,follow-up 1,follow-up 2"
+		if got := strings.Join(order, ","); got != want {
+			t.Errorf("twoPhase %t: deferred commits ran as %s, want %s", twoPhase, got, want)
+		}
+		err = f.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDeferFromDeferredCommitCap(t *testing.T) {
+	server, factory := fakeFactory(t, "orders", WithMaxDeferredCommits(10))
+	f := begin(t, factory, false)
+	defer f.Abort()
+	runs := 0
+	var again func() error
+	again = func() error {
+		runs++
+		f.Defer(again)
+		return nil
+	}
+	f.Defer(again)
+	err := f.Finalize()
+	if !errors.Is(err, ErrTooManyDeferredCommits) {
+		t.Fatalf("Finalize() = %v, want ErrTooManyDeferredCommits", err)
+	}
+	if runs != 10 {
+		t.Errorf("%d deferred commits ran, want the cap of 10", runs)
+	}
+	if f.State() != StateFailed || server.Count("COMMIT") != 0 {
+		t.Errorf("State() = %s after exceeding the cap", f.State())
+	}
+}
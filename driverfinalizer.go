@@ -0,0 +1,76 @@
+package txmpg
+
+import (
+	"context"
+
+	"github.com/williammoran/txmpg/v2/internal/driver"
+)
+
+// DriverFinalizer implements the finalizers of txmpg's
+// driver modules, such as txmpgpgx, which embed it. It
+// runs the engine of Finalizer, or of Finalizer2P when it
+// is two-phase, on a driver other than database/sql, so it
+// has the same contract, options and errors. Its
+// constructor takes a pool from an internal package, so
+// only those modules can create one; applications use
+// theirs.
+type DriverFinalizer struct {
+	*engine
+}
+
+// BeginDriver begins a transaction on pool for a driver
+// module's finalizer, which is two-phase if twoPhase is
+// set. The options tied to database/sql transactions,
+// which the driver module's documentation lists, are
+// ignored.
+func BeginDriver(
+	ctx context.Context, name string, pool driver.Pool, twoPhase bool, opts ...Option,
+) (*DriverFinalizer, error) {
+	finalizer := &DriverFinalizer{}
+	m, err := newEngine(ctx, name, pool, twoPhase, newConfig(opts), finalizer)
+	if err != nil {
+		return nil, err
+	}
+	finalizer.engine = m
+	return finalizer, nil
+}
+
+// DriverTx returns the driver's transaction, for the
+// driver module to unwrap. Like Finalizer.PgTx() and
+// Finalizer2P.PgTx(), it returns nil once the transaction
+// has been handed off to an AsyncCommitter or prepared.
+func (m *DriverFinalizer) DriverTx() driver.Tx {
+	return m.transaction("DriverTx()")
+}
+
+// WrapError annotates err with msg and the finalizer's
+// IDs, for the errors of the driver module's own methods
+func (m *DriverFinalizer) WrapError(err error, msg string) *Error {
+	return m.finalizerError(wrapError(err, msg))
+}
+
+// ErrNoTransaction returns the error for using the
+// transaction once DriverTx() returns nil: ErrHandedOff
+// for a single phase finalizer and ErrFinalized for a
+// two-phase one
+func (m *DriverFinalizer) ErrNoTransaction() error {
+	return m.errNoTransaction()
+}
+
+// GID returns the global identifier of the prepared
+// transaction of a two-phase finalizer, or an empty
+// string if the transaction has not been prepared
+func (m *DriverFinalizer) GID() string {
+	return m.gid()
+}
+
+// CommitContext commits a two-phase finalizer's prepared
+// transaction like Finalizer2P.CommitContext(). A single
+// phase finalizer ignores ctx and commits as Commit()
+// does.
+func (m *DriverFinalizer) CommitContext(ctx context.Context) error {
+	if !m.twoPhase {
+		return m.Commit()
+	}
+	return m.commitPrepared(ctx)
+}
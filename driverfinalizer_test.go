@@ -0,0 +1,227 @@
+package txmpg
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+// beginDriver begins a DriverFinalizer on a fake server
+func beginDriver(t *testing.T, twoPhase bool, opts ...Option) (*fakepg.Server, *DriverFinalizer) {
+	t.Helper()
+	server, pool := fakepg.Open()
+	t.Cleanup(func() { pool.Close() })
+	f, err := BeginDriver(context.Background(), "orders", sqlPool{pool}, twoPhase, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(f.Abort)
+	return server, f
+}
+
+func TestDriverFinalizerCommit(t *testing.T) {
+	for _, twoPhase := range []bool{false, true} {
+		name := "Finalizer"
+		if twoPhase {
+			name = "Finalizer2P"
+		}
+		t.Run(name, func(t *testing.T) {
+			server, f := beginDriver(t, twoPhase)
+			f.DeferStatement("INSERT INTO orders VALUES (1)")
+			err := f.Finalize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if twoPhase && (f.GID() == "" || f.DriverTx() != nil) {
+				t.Errorf("GID() = %q, DriverTx() = %v after PREPARE", f.GID(), f.DriverTx())
+			}
+			err = f.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.State() != StateCommitted || server.Count("INSERT") != 1 {
+				t.Errorf("State() = %s, %d inserts", f.State(), server.Count("INSERT"))
+			}
+			if twoPhase && len(server.Committed()) != 1 {
+				t.Errorf("%d prepared transactions committed", len(server.Committed()))
+			}
+		})
+	}
+}
+
+func TestDriverFinalizerStatusQuery(t *testing.T) {
+	tests := []struct {
+		version int
+		want    string
+	}{
+		{160000, "SELECT pg_xact_status("},
+		{110000, "SELECT txid_status("},
+	}
+	for _, tt := range tests {
+		server, pool := fakepg.Open()
+		defer pool.Close()
+		server.SetVersion(tt.version)
+		f, err := BeginDriver(context.Background(), "orders", sqlPool{pool}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Finalize()
+		if err == nil {
+			err = f.Commit()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if server.Count(tt.want) != 1 {
+			t.Errorf("version %d: no %s...) in %q", tt.version, tt.want, server.Statements())
+		}
+	}
+}
+
+func TestDriverFinalizerDeferPanic(t *testing.T) {
+	_, f := beginDriver(t, false)
+	f.Defer(func() error { panic("boom") })
+	err := f.Finalize()
+	var deferErr *DeferError
+	var txErr *Error
+	if !errors.As(err, &deferErr) || !errors.As(err, &txErr) {
+		t.Fatalf("Finalize() = %v, want an *Error wrapping a *DeferError", err)
+	}
+	if f.State() != StateFailed {
+		t.Errorf("State() = %s after a failed Finalize()", f.State())
+	}
+}
+
+func TestDriverFinalizerCommitPreparedLost(t *testing.T) {
+	server, f := beginDriver(t, true)
+	err := f.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.FailNext("COMMIT PREPARED", errors.New("connection reset"))
+	err = f.Commit()
+	if !errors.Is(err, ErrCommitNotApplied) {
+		t.Fatalf("Commit() = %v, want ErrCommitNotApplied", err)
+	}
+	if !strings.Contains(err.Error(), "NAME: orders") {
+		t.Errorf("Commit() error %q doesn't identify the finalizer", err)
+	}
+	err = f.Commit()
+	if err != nil {
+		t.Fatalf("second Commit() = %v", err)
+	}
+}
+
+func TestDriverFinalizerCommitPreparedInDoubt(t *testing.T) {
+	server, f := beginDriver(t, true)
+	err := f.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.FailNext("COMMIT PREPARED", errors.New("connection reset"))
+	server.FailNext("SELECT EXISTS (SELECT 1 FROM pg_prepared_xacts", errors.New("connection refused"))
+	err = f.Commit()
+	var inDoubt *InDoubtError
+	if !errors.As(err, &inDoubt) || !errors.Is(err, ErrInDoubt) {
+		t.Fatalf("Commit() = %v, want an *InDoubtError", err)
+	}
+	if inDoubt.GID != f.GID() {
+		t.Errorf("InDoubtError.GID = %q, want %q", inDoubt.GID, f.GID())
+	}
+	if !strings.Contains(err.Error(), "NAME: orders") {
+		t.Errorf("Commit() error %q doesn't identify the finalizer", err)
+	}
+}
+
+func TestDriverFinalizerCommitAlreadyResolved(t *testing.T) {
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	f, err := BeginDriver(context.Background(), "orders", sqlPool{pool}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pool.Exec("COMMIT PREPARED " + QuoteGID(f.GID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Commit()
+	if !errors.Is(err, ErrAlreadyResolved) {
+		t.Fatalf("Commit() = %v, want ErrAlreadyResolved", err)
+	}
+	if !strings.Contains(err.Error(), "NAME: orders") || !strings.Contains(err.Error(), f.GID()) {
+		t.Errorf("Commit() error %q doesn't identify the finalizer and GID", err)
+	}
+	if f.State() != StateCommitted || len(server.Committed()) != 1 {
+		t.Errorf("State() = %s, %d committed", f.State(), len(server.Committed()))
+	}
+}
+
+func TestDriverFinalizerRollbackPreparedRetry(t *testing.T) {
+	server, f := beginDriver(t, true, WithRollbackPreparedRetry(2, time.Millisecond))
+	err := f.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.FailNext("ROLLBACK PREPARED", fakepg.ServerError("53300", "too many connections"))
+	f.Abort()
+	if f.State() != StateAborted || len(server.Prepared()) != 0 {
+		t.Errorf("State() = %s, %d prepared after Abort()", f.State(), len(server.Prepared()))
+	}
+	if server.Count("ROLLBACK PREPARED") != 2 {
+		t.Errorf("%d attempts at ROLLBACK PREPARED", server.Count("ROLLBACK PREPARED"))
+	}
+}
+
+func TestDriverFinalizerUnassignedTxid(t *testing.T) {
+	_, f := beginDriver(t, false, WithLazyTxid(true))
+	f.Defer(func() error { return errors.New("boom") })
+	err := f.Finalize()
+	if err == nil || !strings.Contains(err.Error(), "PGTXID: - ") {
+		t.Errorf("Finalize() = %v, want the unassigned txid traced as -", err)
+	}
+}
+
+func TestDriverFinalizerEventsAndHooks(t *testing.T) {
+	_, f := beginDriver(t, true)
+	events := f.Events()
+	committed := false
+	f.OnCommit(func() { committed = true })
+	err := f.Finalize()
+	if err == nil {
+		err = f.Commit()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []EventKind
+	for event := range events {
+		kinds = append(kinds, event.Kind)
+	}
+	if !committed || len(kinds) == 0 || kinds[len(kinds)-1] != EventCommitted {
+		t.Errorf("OnCommit ran: %v, events %v", committed, kinds)
+	}
+}
+
+func TestDriverFinalizerPreparedLifetime(t *testing.T) {
+	server, f := beginDriver(t, true, WithMaxPreparedLifetime(time.Millisecond))
+	err := f.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for f.State() != StateAborted && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	err = f.Commit()
+	if !errors.Is(err, ErrExpired) || len(server.Prepared()) != 0 {
+		t.Errorf("Commit() = %v with %d prepared, want ErrExpired", err, len(server.Prepared()))
+	}
+}
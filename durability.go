@@ -0,0 +1,115 @@
+package txmpg
+
+import (
+	"context"
+
+	"github.com/williammoran/txmpg/v2/internal/driver"
+)
+
+// Durability is how far a commit must be replicated
+// before it is reported as successful. It is applied by
+// setting synchronous_commit for the transaction.
+type Durability int
+
+const (
+	// DurabilityDefault leaves synchronous_commit at the
+	// server's setting
+	DurabilityDefault Durability = iota
+	// DurabilityLocal waits for the commit to be flushed
+	// to disk on the primary only
+	DurabilityLocal
+	// DurabilityRemote also waits for the synchronous
+	// standbys to flush the commit to disk
+	DurabilityRemote
+	// DurabilityRemoteApply also waits for the synchronous
+	// standbys to apply the commit, so that it is visible
+	// to queries on them
+	DurabilityRemoteApply
+)
+
+var durabilityModes = map[Durability]string{
+	DurabilityLocal:       "local",
+	DurabilityRemote:      "on",
+	DurabilityRemoteApply: "remote_apply",
+}
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityDefault:
+		return "default"
+	case DurabilityLocal:
+		return "local"
+	case DurabilityRemote:
+		return "remote"
+	case DurabilityRemoteApply:
+		return "remote apply"
+	}
+	return "unknown"
+}
+
+// WithReplicationDurability sets how far each commit must
+// be replicated before Commit() returns, by running
+// SET LOCAL synchronous_commit right after beginning the
+// transaction. It replaces WithSynchronousCommit(), and
+// the last of the two used wins.
+//
+// For a Finalizer2P, the level applies to PREPARE
+// TRANSACTION, which is the point at which the transaction
+// becomes durable; COMMIT PREPARED runs outside the
+// transaction with the server's setting.
+// DurabilityRemoteApply is rejected with
+// ErrRemoteApply2P, because the prepared transaction is
+// only visible on the standbys after COMMIT PREPARED.
+func WithReplicationDurability(d Durability) Option {
+	return func(c *config) {
+		c.durability = d
+		c.synchronousCommit = durabilityModes[d]
+	}
+}
+
+// WithStandbyCheck makes the constructors fail with
+// ErrNoSynchronousStandby if DurabilityRemote or
+// DurabilityRemoteApply was requested and
+// pg_stat_replication shows no synchronous standby, in
+// which case the server would commit without waiting for
+// any. Reading the standbys' state requires the
+// pg_read_all_stats role or superuser. It costs a query
+// per transaction.
+func WithStandbyCheck(check bool) Option {
+	return func(c *config) {
+		c.standbyCheck = check
+	}
+}
+
+// checkStandbys returns ErrNoSynchronousStandby if
+// WithStandbyCheck() is on, the durability requires a
+// synchronous standby and the server behind pool has none
+func (c *config) checkStandbys(ctx context.Context, pool driver.Querier) error {
+	if !c.standbyCheck || c.durability < DurabilityRemote {
+		return nil
+	}
+	var standbys int
+	err := pool.QueryRow(
+		ctx,
+		"SELECT count(*) FROM pg_stat_replication WHERE sync_state IN ('sync', 'quorum')",
+	).Scan(&standbys)
+	if err != nil {
+		return wrapError(err, "Checking synchronous standbys")
+	}
+	if standbys == 0 {
+		return ErrNoSynchronousStandby
+	}
+	return nil
+}
+
+// traceDurability traces the durability or
+// synchronous_commit setting applied to the transaction,
+// if any
+func (c *config) traceDurability(logf func(level Level, format string, args ...interface{})) {
+	switch {
+	case c.durability != DurabilityDefault:
+		logf(LevelInfo, "replication durability %s (synchronous_commit = %s)", c.durability, c.synchronousCommit)
+	case c.synchronousCommit != "":
+		logf(LevelInfo, "synchronous_commit = %s", c.synchronousCommit)
+	}
+}
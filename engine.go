@@ -0,0 +1,1070 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/williammoran/txmpg/v2/internal/driver"
+)
+
+// engine is the state machine shared by every finalizer:
+// Finalizer and Finalizer2P on database/sql, and the
+// driver modules' finalizers through DriverFinalizer.
+// It runs on the driver through the interfaces of
+// internal/driver, and is two-phase if twoPhase is set.
+// Its exported methods are promoted to the finalizers
+// that embed it.
+//
+// An engine may be shared between goroutines: Defer(),
+// the transaction accessors and the other accessors are
+// safe to call concurrently with each other and with
+// Finalize(), Commit() and Abort(), which are serialized.
+type engine struct {
+	ctx    context.Context
+	cfg    config
+	caps   capabilities
+	logger *log.Logger
+	// traceHook and phase are guarded by mu
+	traceHook TraceHook
+	phase     Phase
+	name      string
+	twoPhase  bool
+	pool      driver.Pool
+	// tx is the open transaction. It is nil once a
+	// two-phase transaction is prepared, or committed by
+	// Finalize() because it never wrote.
+	tx driver.Tx
+	// Deprecated: TX is not safe for concurrent use and
+	// is set to nil by Finalizer2P.Finalize(). Use PgTx().
+	TX              *sql.Tx
+	serverTXID      int64
+	serverConnID    int64
+	id              string
+	deferredCommits []deferredCommit
+	abortErr        *Error
+	abortReason     string
+	state           State
+	started         time.Time
+	// spanCtx is the context of txSpan, the span
+	// covering the transaction
+	spanCtx context.Context
+	txSpan  Span
+	// prepared is when PREPARE TRANSACTION succeeded, and
+	// committed when the transaction committed
+	prepared  time.Time
+	committed time.Time
+	leakKey   uint64
+	// warnTimer is set by WithWarnWhileOpen()
+	warnTimer *time.Timer
+	// handedOff is set by AsyncCommitter.Submit() on a
+	// single phase transaction
+	handedOff bool
+	// lsn is set by WithCommitLSN()
+	lsn         string
+	statements  statementLog
+	stmts       stmtCache
+	notifies    notifyQueue
+	commitHooks commitHooks
+	// correlationID is guarded by mu
+	correlationID string
+	// decider is set by Finalizer2P.SetDecider()
+	decider *engine
+	// sampled is set by WithTraceSampler()
+	sampled bool
+	events  eventStream
+	// prepareFailed is set when PREPARE TRANSACTION
+	// fails. Only accessed while holding opMu.
+	prepareFailed bool
+	// expired is set when the watchdog rolls back a
+	// prepared transaction that outlived its maximum
+	// lifetime. Only accessed while holding opMu.
+	expired bool
+	// journaled is the GID recorded in the journal, if
+	// any. Only accessed while holding opMu.
+	journaled string
+	// readOnly is set when Finalize() committed a
+	// transaction that never wrote instead of preparing
+	// it. Only accessed while holding opMu.
+	readOnly bool
+	// committedByParticipant is set when this finalizer
+	// is a decider committed by another participant's
+	// Commit(). Only accessed while holding opMu.
+	committedByParticipant bool
+	// opMu serializes Finalize(), Commit(), Abort() and
+	// the watchdogs. mu guards the fields above against
+	// concurrent readers; they are only modified while
+	// holding both.
+	opMu         sync.Mutex
+	mu           sync.Mutex
+	watchdogStop chan struct{}
+	watchdogOnce sync.Once
+}
+
+// newEngine begins a transaction on pool for a new finalizer,
+// which is two-phase if twoPhase is set. owner is the
+// finalizer handed to the application, which leak
+// tracking watches.
+func newEngine(
+	ctx context.Context, name string, pool driver.Pool, twoPhase bool, cfg config, owner interface{},
+) (*engine, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, wrapError(err, "Context finished before BeginTx")
+	}
+	if twoPhase && cfg.gid != "" {
+		err = ValidateGID(cfg.gid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = cfg.checkCorrelationID(cfg.correlationID, twoPhase)
+	if err != nil {
+		return nil, err
+	}
+	if twoPhase {
+		switch {
+		case cfg.durability == DurabilityRemoteApply:
+			return nil, ErrRemoteApply2P
+		case cfg.durability == DurabilityDefault && cfg.synchronousCommit != "":
+			return nil, ErrSynchronousCommit2P
+		}
+		if !cfg.skipPreparedCheck {
+			err = checkPreparedTransactions(ctx, pool)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	caps, err := detectCapabilities(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+	if !twoPhase && !caps.txidStatus && cfg.requireTxidStatus {
+		return nil, ErrTxidStatusUnavailable
+	}
+	err = cfg.prepareSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.validateSynchronousCommit()
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.checkStandbys(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := cfg.beginTx(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.importSnapshot(ctx, tx)
+	if err != nil {
+		cfg.abandonTx(tx)
+		return nil, err
+	}
+	err = cfg.setSynchronousCommit(ctx, tx)
+	if err != nil {
+		cfg.abandonTx(tx)
+		return nil, err
+	}
+	// The lazy queries need txid_status()'s PostgreSQL 10
+	query := caps.metadataQuery()
+	if cfg.lazyTxid && caps.txidStatus {
+		query = caps.lazyMetadataQuery()
+	}
+	var id sql.NullInt64
+	var pid int64
+	if !cfg.skipMetadata(caps) {
+		err = tx.QueryRow(ctx, query).Scan(&id, &pid)
+		if err != nil {
+			forgetCapabilities(pool, err)
+			cfg.abandonTx(tx)
+			return nil, err
+		}
+	}
+	m := &engine{
+		ctx:           ctx,
+		logger:        cfg.logger,
+		traceHook:     cfg.traceHook,
+		phase:         PhaseBegin,
+		cfg:           cfg,
+		caps:          caps,
+		name:          name,
+		twoPhase:      twoPhase,
+		pool:          pool,
+		tx:            tx,
+		serverTXID:    id.Int64,
+		serverConnID:  pid,
+		started:       cfg.now(),
+		correlationID: cfg.correlationID,
+		sampled:       cfg.sampled(name),
+	}
+	if t, ok := tx.(sqlTx); ok {
+		m.TX = t.tx
+	}
+	m.statements.slow = cfg.slowQuery
+	m.statements.now = cfg.now
+	m.statements.trace = m.logf
+	m.spanCtx, m.txSpan = cfg.startTxSpan(ctx, m.Info())
+	m.startWarnTimer()
+	if cfg.trackLeaks {
+		m.leakKey = trackLeaks(owner, m.Info(), m.currentLogger)
+	}
+	if cfg.abortOnContextDone && !twoPhase {
+		m.startWatchdog()
+	}
+	counters.active.Add(1)
+	cfg.metrics.Begun(name, twoPhase)
+	cfg.observer.TxBegan(m.Info())
+	m.logf(LevelInfo, "Transaction began")
+	cfg.traceDurability(m.logf)
+	return m, nil
+}
+
+// State returns the current lifecycle state of the
+// finalizer
+func (m *engine) State() State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// setState changes the lifecycle state. The caller must
+// hold opMu.
+func (m *engine) setState(s State) {
+	m.mu.Lock()
+	was := m.state
+	m.state = s
+	m.mu.Unlock()
+	countState(was, s)
+	if !m.prepared.IsZero() {
+		countPrepared(was, s)
+	}
+	if s == StateCommitted || s == StateAborted {
+		m.journalForget()
+	}
+	switch s {
+	case StateFailed:
+		m.cfg.metrics.FinalizeFailed(m.name, m.twoPhase)
+	case StateCommitted:
+		now := m.cfg.now()
+		m.mu.Lock()
+		m.committed = now
+		m.mu.Unlock()
+		m.emit(EventCommitted, nil)
+		m.cfg.observer.TxCommitted(m.Info(), now.Sub(m.started))
+		// A read-only transaction committed by Finalize()
+		// was never prepared
+		var sincePrepare time.Duration
+		if !m.prepared.IsZero() {
+			sincePrepare = now.Sub(m.prepared)
+			m.warnIfPreparedLong(sincePrepare)
+		}
+		m.cfg.metrics.Committed(m.name, m.twoPhase, now.Sub(m.started), sincePrepare)
+	case StateAborted:
+		m.emit(EventAborted, nil)
+		m.cfg.observer.TxAborted(m.Info(), m.AbortReason())
+		m.cfg.metrics.Aborted(m.name, m.twoPhase)
+	}
+	if s.terminal() {
+		untrackLeaks(m.leakKey)
+		m.stmts.reset()
+		var err error
+		if s == StateAbortFailed {
+			err = m.AbortError()
+			m.emit(EventFailed, err)
+		}
+		if !was.terminal() {
+			m.warnIfLong()
+			m.txSpan.End(m.Info(), err)
+			m.events.close()
+		}
+	}
+}
+
+// setID changes the prepared transaction ID. The caller
+// must hold opMu.
+func (m *engine) setID(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.id = id
+}
+
+// gid returns the prepared transaction ID, if any
+func (m *engine) gid() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.id
+}
+
+// SetLogger sets the logger that all status messages will
+// be delivered to. Without a logger, traces are discarded
+// and errors go to the standard logger.
+func (m *engine) SetLogger(l *log.Logger) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.logger = l
+}
+
+// currentLogger returns the logger set by SetLogger(), if
+// any
+func (m *engine) currentLogger() *log.Logger {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.logger
+}
+
+// Started returns when the finalizer began its
+// transaction, as measured by the clock set with
+// WithClock()
+func (m *engine) Started() time.Time {
+	return m.started
+}
+
+// elapsed formats the time since the transaction began
+// for traces
+func (m *engine) elapsed() string {
+	return formatElapsed(m.cfg.now().Sub(m.started))
+}
+
+// errorLogger returns the logger for errors and panics,
+// which unlike traces are never discarded: without a
+// logger set they go to the standard logger
+func (m *engine) errorLogger() *log.Logger {
+	logger := m.currentLogger()
+	if logger == nil {
+		return log.Default()
+	}
+	return logger
+}
+
+// transaction returns the open transaction for op, or
+// nil with a warning if it has been prepared, committed
+// or handed off to an AsyncCommitter
+func (m *engine) transaction(op string) driver.Tx {
+	m.mu.Lock()
+	tx, handedOff, state := m.tx, m.handedOff, m.state
+	m.mu.Unlock()
+	switch {
+	case handedOff:
+		m.logf(LevelWarn, "warning: %s on handed off transaction returns nil", op)
+		return nil
+	case tx == nil:
+		m.logf(LevelWarn, "warning: %s on %s transaction returns nil", op, state)
+	}
+	return tx
+}
+
+// errNoTransaction is the error for using the
+// transaction once transaction() returns nil: a single
+// phase transaction is only unavailable once handed off,
+// and a two-phase one once it is prepared
+func (m *engine) errNoTransaction() error {
+	if m.twoPhase {
+		return ErrFinalized
+	}
+	return ErrHandedOff
+}
+
+// releaseTx ends the driver's transaction once the server
+// has detached it from the connection by preparing or
+// committing it, so that the connection goes back to the
+// pool. The caller must hold opMu.
+func (m *engine) releaseTx() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.cfg.maintenanceTimeout)
+	defer cancel()
+	// The server only warns that there is no transaction
+	// in progress
+	m.tx.Rollback(ctx)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tx = nil
+	m.TX = nil
+}
+
+// Defer registers a function to execute at Finalize time.
+// A deferred commit may itself call Defer(); the new
+// commit runs after the ones already registered, before
+// Finalize() returns.
+func (m *engine) Defer(exec func() error) {
+	m.addDeferred(deferredCommit{exec: exec})
+}
+
+// DeferStatement registers a statement to execute at
+// Finalize time, like Defer(). Consecutive statements
+// without arguments are sent to the server together, in
+// one round trip; if one of them fails, the DeferError
+// identifies it. On database/sql, finding it takes
+// running the statements again one at a time.
+func (m *engine) DeferStatement(query string, args ...interface{}) {
+	commit := deferredCommit{
+		exec: func() error {
+			return m.execDeferred(query, args...)
+		},
+	}
+	if len(args) == 0 {
+		commit.query = query
+	}
+	m.addDeferred(commit)
+}
+
+// execDeferred runs a statement registered with
+// DeferStatement(), timed and traced like the statements
+// run through TracedTx
+func (m *engine) execDeferred(query string, args ...interface{}) error {
+	tx := m.transaction("DeferStatement()")
+	if tx == nil {
+		return m.finalizerError(m.errNoTransaction())
+	}
+	start := m.statements.now()
+	err := tx.Exec(m.ctx, query, args...)
+	m.statements.done(start, query, args, -1, err)
+	return err
+}
+
+// addDeferred registers commit, recording where Defer()
+// or DeferStatement() was called from
+func (m *engine) addDeferred(commit deferredCommit) {
+	_, file, line, _ := runtime.Caller(2)
+	commit.site = fmt.Sprintf("%s:%d", file, line)
+	m.trace(PhaseDefer, LevelDebug, "Defer() from %s", commit.site)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deferredCommits = append(m.deferredCommits, commit)
+}
+
+// Finalize executes any deferred commits. A single phase
+// finalizer then checks deferred constraints if
+// WithConstraintCheck() is set; a two-phase one prepares
+// the transaction. If Finalize returns without error, the
+// data changes of a prepared transaction have been
+// written to disk on the PostgreSQL server and will not
+// be lost in the event of a crash of the server. However,
+// if Commit() is not called, the changes will not be
+// visible until the prepared transaction is commited
+// manually, so be aware that extra DB administration may
+// be necessary.
+// Calling Finalize again after it succeeded does nothing,
+// so deferred commits never run more than once.
+func (m *engine) Finalize() (err error) {
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+	m.setPhase(PhaseFinalize)
+	span := m.cfg.startSpan(m.spanCtx, "finalize", m.Info())
+	defer func() { span.End(m.Info(), err) }()
+	err = m.checkFinalize()
+	if err != nil || m.state != StateActive {
+		return err
+	}
+	m.emit(EventFinalizeStarted, nil)
+	err = m.finalize()
+	m.emit(EventFinalized, err)
+	m.cfg.observer.TxFinalized(m.Info(), err)
+	if err != nil {
+		m.emit(EventFailed, err)
+		if m.state == StateActive {
+			m.setState(StateFailed)
+		}
+		return err
+	}
+	m.setState(StateFinalized)
+	if m.twoPhase && m.cfg.preparedWatchdog() && !m.readOnly {
+		m.startPreparedWatchdog()
+	}
+	return nil
+}
+
+// deferredCommit returns the i'th deferred commit, if it
+// exists
+func (m *engine) deferredCommit(i int) (deferredCommit, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i >= len(m.deferredCommits) {
+		return deferredCommit{}, false
+	}
+	return m.deferredCommits[i], true
+}
+
+// checkFinalize decides what a call to Finalize() should
+// do when the transaction is no longer active
+func (m *engine) checkFinalize() error {
+	switch m.state {
+	case StateActive:
+		return nil
+	case StateFinalized, StateCommitted:
+		m.Trace("Finalize() on %s transaction", m.state)
+		return nil
+	case StateFailed:
+		return m.finalizerError(ErrFinalizeFailed)
+	}
+	return m.finalizerError(ErrAborted)
+}
+
+// finalize does the work of Finalize()
+func (m *engine) finalize() error {
+	err := runDeferredCommits(
+		m.deferredCommit, m.cfg.deferPolicy, m.cfg.maxDeferredCommits,
+		m.cfg.now, m.Trace,
+		func(queries []string) error { return m.tx.ExecBatch(m.ctx, queries) },
+	)
+	if err != nil {
+		return m.finalizerError(
+			wrapError(
+				err, "Running deferred commits",
+			))
+	}
+	if m.twoPhase {
+		return m.prepare()
+	}
+	err = flushNotifications(m.ctx, &m.notifies, m.tx.Exec, m.Trace)
+	if m.pool.TxDone(err) {
+		return m.driverFinished("Sending notifications", err)
+	}
+	if err != nil {
+		return m.finalizerError(err)
+	}
+	if m.cfg.constraintCheck {
+		m.Trace("Checking deferred constraints")
+		err := m.tx.Exec(m.ctx, "SET CONSTRAINTS ALL IMMEDIATE")
+		if m.pool.TxDone(err) {
+			return m.driverFinished("Checking deferred constraints", err)
+		}
+		if err != nil {
+			return m.finalizerError(
+				wrapError(err, "Checking deferred constraints"),
+			)
+		}
+	}
+	return nil
+}
+
+// Commit finishes the transaction. A single phase
+// finalizer first checks with txid_status() that the
+// transaction can still be committed, unless
+// WithFastCommit() is set; a two-phase one commits the
+// prepared transaction using the finalizer's context, as
+// Finalizer2P.CommitContext() describes.
+// Commit returns ErrNotFinalized unless Finalize()
+// succeeded. Calling Commit again after it succeeded
+// returns ErrAlreadyCommitted without contacting the
+// server.
+func (m *engine) Commit() (err error) {
+	if m.twoPhase {
+		return m.commitPrepared(m.ctx)
+	}
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+	// Checked before anything else, so that the
+	// transaction is left as it was
+	if m.state == StateActive || m.state == StateFailed {
+		return m.finalizerError(ErrNotFinalized)
+	}
+	m.setPhase(PhaseCommit)
+	defer m.stopWatchdog()
+	span := m.cfg.startSpan(m.spanCtx, "commit", m.Info())
+	defer func() { span.End(m.Info(), err) }()
+	if m.state == StateCommitted {
+		m.Trace("Commit() on committed transaction")
+		return ErrAlreadyCommitted
+	}
+	if m.state == StateAborted || m.state == StateAbortFailed {
+		return m.finalizerError(ErrAborted)
+	}
+	err = m.ctx.Err()
+	if err != nil {
+		return m.finalizerError(
+			wrapError(err, "Commit() with finished context"),
+		)
+	}
+	switch {
+	case m.cfg.fastCommit:
+		m.Trace("fast commit, skipping status check")
+	case m.caps.txidStatus:
+		assigned, err := m.resolveTxid(m.ctx)
+		if m.pool.TxDone(err) {
+			return m.driverFinished("Commit()", err)
+		}
+		if err != nil {
+			return m.finalizerError(err)
+		}
+		if !assigned {
+			m.Trace("no transaction ID assigned, committing without status check")
+			break
+		}
+		err = m.checkCommitStatus()
+		if err != nil {
+			return err
+		}
+	default:
+		m.Trace("txid_status() unavailable, committing without status check")
+	}
+	err = m.cfg.inject(FaultBeforeCommit, m.gid())
+	if err == nil {
+		err = m.tx.Commit(m.ctx)
+	}
+	if m.pool.TxDone(err) {
+		return m.driverFinished("Commit()", err)
+	}
+	if err != nil {
+		return m.finalizerError(wrapError(err, "Failed to commit"))
+	}
+	m.setState(StateCommitted)
+	m.logf(LevelInfo, "Transaction committed")
+	m.recordCommitLSN()
+	m.commitHooks.run(m.logf)
+	return nil
+}
+
+// startWatchdog starts a goroutine that rolls back a
+// single phase transaction as soon as the finalizer's
+// context is finished, instead of waiting for Abort()
+func (m *engine) startWatchdog() {
+	m.watchdogStop = make(chan struct{})
+	go func() {
+		select {
+		case <-m.watchdogStop:
+		case <-m.ctx.Done():
+			m.opMu.Lock()
+			defer m.opMu.Unlock()
+			if m.state != StateActive && m.state != StateFinalized {
+				return
+			}
+			m.setPhase(PhaseAbort)
+			m.logf(LevelInfo, "context finished before Commit(), aborting: %s", m.ctx.Err().Error())
+			m.rollback()
+		}
+	}()
+}
+
+// stopWatchdog shuts down the watchdog goroutine, if
+// there is one
+func (m *engine) stopWatchdog() {
+	if m.watchdogStop == nil {
+		return
+	}
+	m.watchdogOnce.Do(func() { close(m.watchdogStop) })
+}
+
+// resolveTxid looks up the transaction ID if it wasn't
+// known when the finalizer was constructed, returning
+// false if the server still hasn't assigned one. The
+// caller must hold opMu.
+func (m *engine) resolveTxid(ctx context.Context) (bool, error) {
+	if m.serverTXID != 0 {
+		return true, nil
+	}
+	var id sql.NullInt64
+	var err error
+	if m.serverConnID == 0 {
+		// The constructor skipped the metadata query
+		err = m.loadMetadata(ctx)
+		id = sql.NullInt64{Int64: m.serverTXID, Valid: m.serverTXID != 0}
+	} else {
+		err = m.tx.QueryRow(ctx, m.caps.assignedTxidQuery()).Scan(&id)
+	}
+	if err != nil {
+		forgetCapabilities(m.pool, err)
+		return false, wrapError(err, "Failed to get transaction ID")
+	}
+	if !id.Valid {
+		return false, nil
+	}
+	m.mu.Lock()
+	m.serverTXID = id.Int64
+	m.mu.Unlock()
+	m.Trace("transaction ID assigned")
+	return true, nil
+}
+
+// LoadMetadata looks up the transaction ID, if the server
+// has assigned one, and the backend PID when the
+// constructor skipped them because of WithLazyMetadata(),
+// so that Info() and traces include them. It does nothing
+// if they are already known or the transaction is over.
+func (m *engine) LoadMetadata(ctx context.Context) error {
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+	if m.serverConnID != 0 || m.state != StateActive || m.tx == nil {
+		return nil
+	}
+	return m.loadMetadata(ctx)
+}
+
+// loadMetadata does the work of LoadMetadata(). The
+// caller must hold opMu.
+func (m *engine) loadMetadata(ctx context.Context) error {
+	var id sql.NullInt64
+	var pid int64
+	err := m.tx.QueryRow(ctx, m.caps.lazyMetadataQuery()).Scan(&id, &pid)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.serverConnID = pid
+	if id.Valid {
+		m.serverTXID = id.Int64
+	}
+	return nil
+}
+
+// checkCommitStatus verifies with txid_status() that the
+// transaction can still be committed
+func (m *engine) checkCommitStatus() error {
+	var status string
+	err := m.tx.QueryRow(
+		m.ctx, m.caps.txidStatusQuery(), m.serverTXID,
+	).Scan(&status)
+	if m.pool.TxDone(err) {
+		return m.driverFinished("Commit()", err)
+	}
+	if err != nil {
+		forgetCapabilities(m.pool, err)
+		return m.finalizerError(
+			wrapError(err, "Commit() failed to get txid_status()"),
+		)
+	}
+	m.Trace("transaction status at Commit() '%s'", status)
+	err = checkTxStatus(status)
+	if errors.Is(err, ErrAborted) {
+		m.setState(StateAborted)
+	}
+	if err != nil {
+		return m.finalizerError(err)
+	}
+	return nil
+}
+
+// Abort rolls back the transaction, or the prepared
+// transaction once a two-phase finalizer has prepared it,
+// retrying ROLLBACK PREPARED as configured by
+// WithRollbackPreparedRetry().
+// Abort is a NOOP if the transaction is already committed,
+// so it's good practice to defer it to ensure
+// transactions are never left hanging.
+func (m *engine) Abort() {
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+	m.setPhase(PhaseAbort)
+	defer m.stopWatchdog()
+	reason := m.AbortReason()
+	if reason != "" {
+		m.logf(LevelInfo, "Abort() reason: %s", reason)
+	}
+	if m.state == StateCommitted || m.state == StateAborted {
+		m.Trace("Abort() on %s transaction", m.state)
+		return
+	}
+	if m.tx != nil {
+		if !m.twoPhase {
+			m.traceAbortStatus()
+		}
+		m.rollback()
+		return
+	}
+	if m.readOnly {
+		m.setState(StateAborted)
+		m.Trace("Abort() on read-only transaction, nothing to roll back")
+		return
+	}
+	if m.id == "" {
+		m.Trace("Abort() on transaction that was never finalized")
+		return
+	}
+	err := m.cfg.rollbackPrepared(m.finalizePool(), m.id, m.logf)
+	if err != nil {
+		m.logf(LevelError, "prepared transaction %s left for recovery", m.id)
+		m.abortFailed(err, "Failed ROLLBACK PREPARED")
+		return
+	}
+	m.setState(StateAborted)
+	m.logf(LevelInfo, "ROLLBACK PREPARED")
+}
+
+// traceAbortStatus traces the server's view of a single
+// phase transaction before Abort() rolls it back. It's
+// only informative: whatever the status, the transaction
+// is rolled back so that the driver releases the
+// connection.
+func (m *engine) traceAbortStatus() {
+	if !m.caps.txidStatus {
+		m.Trace("txid_status() unavailable, rolling back without status check")
+		return
+	}
+	// The finalizer's context is likely finished if we're
+	// aborting, so the status check gets its own deadline
+	ctx, cancel := context.WithTimeout(context.Background(), m.cfg.maintenanceTimeout)
+	defer cancel()
+	assigned, err := m.resolveTxid(ctx)
+	if err != nil || !assigned {
+		m.Trace("no transaction ID to check, rolling back without status check")
+		return
+	}
+	var status string
+	err = m.tx.QueryRow(
+		ctx, m.caps.txidStatusQuery(), m.serverTXID,
+	).Scan(&status)
+	if err != nil {
+		forgetCapabilities(m.pool, err)
+		m.logf(LevelWarn, "Abort() failed to get txid_status(): %s", err.Error())
+		return
+	}
+	m.Trace("transaction status at Abort() '%s'", status)
+}
+
+// rollback rolls back the open transaction, tolerating
+// the cases where it is already finished. The caller
+// must hold opMu.
+func (m *engine) rollback() {
+	// The finalizer's context is likely finished if we're
+	// aborting, so the rollback gets its own deadline
+	ctx, cancel := context.WithTimeout(context.Background(), m.cfg.maintenanceTimeout)
+	defer cancel()
+	err := m.tx.Rollback(ctx)
+	ctxErr := m.ctx.Err()
+	switch {
+	case err == nil:
+		m.logf(LevelInfo, "Transaction rolled back")
+	case m.pool.TxDone(err) && ctxErr != nil:
+		// If the context was cancelled for any reason,
+		// the transaction is already rolled back by the
+		// driver
+		m.logf(LevelInfo, "Transaction rolled back by driver: %s", ctxErr.Error())
+	case m.pool.TxDone(err):
+		// Commit() would have set the state, so the
+		// driver rolled the transaction back
+		m.Trace("Abort() on transaction that is already done")
+	case m.prepareFailed:
+		// A failed PREPARE TRANSACTION already rolled
+		// the transaction back on the server
+		m.logf(LevelWarn, "Rollback() after failed PREPARE: %s", err.Error())
+	default:
+		m.abortFailed(err, "Failed to roll back")
+		return
+	}
+	m.setState(StateAborted)
+}
+
+// driverFinished records that the driver had already
+// finished the transaction when op tried to use it. The
+// finalizer never commits behind its own back, so this
+// means the transaction was rolled back, usually because
+// the context was cancelled.
+func (m *engine) driverFinished(op string, err error) error {
+	m.setState(StateAborted)
+	m.logf(LevelWarn, "%s on transaction already finished by the driver", op)
+	return m.finalizerError(fmt.Errorf("%w: %s: %w", ErrAborted, op, err))
+}
+
+// abortFailed records a failure to roll back, panicking
+// only if configured to do so
+func (m *engine) abortFailed(err error, msg string) {
+	abortErr := m.finalizerError(wrapError(err, msg))
+	m.mu.Lock()
+	m.abortErr = abortErr
+	m.mu.Unlock()
+	m.setState(StateAbortFailed)
+	m.logf(LevelError, "Abort() failed: %s", err.Error())
+	m.handleError(msg, err)
+}
+
+// AbortError returns the error encountered by Abort(), or
+// nil if Abort() has not failed. Abort() does not panic
+// on failure unless WithErrorHandler(PanicOnError()) is set,
+// so this is the way to learn that the transaction may
+// not have been rolled back, or that a prepared
+// transaction may have been left on the server.
+func (m *engine) AbortError() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.abortErr == nil {
+		return nil
+	}
+	return m.abortErr
+}
+
+// SetAbortReason records why the transaction is being
+// aborted, so that the reason appears in the trace output
+// of Abort(). txmanager does not pass its abort reason to
+// the finalizers, so call this before txmanager's Abort().
+func (m *engine) SetAbortReason(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.abortReason = reason
+}
+
+// AbortReason returns the reason set by SetAbortReason()
+func (m *engine) AbortReason() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.abortReason
+}
+
+// idPrefix formats the name and IDs of the finalizer
+// for traces and errors. Until the server assigns a
+// transaction ID, only the backend PID identifies it.
+func (m *engine) idPrefix() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	txid := "-"
+	if m.serverTXID != 0 {
+		txid = strconv.FormatInt(m.serverTXID, 10)
+	}
+	prefix := fmt.Sprintf(
+		"NAME: %s TX: %s PGTXID: %s PGPID: %d",
+		m.name, m.id, txid, m.serverConnID,
+	)
+	if m.correlationID != "" {
+		prefix += " CORRELATION: " + m.correlationID
+	}
+	return prefix
+}
+
+// finalizerError is a helper to include detailed
+// information in errors
+func (m *engine) finalizerError(err error) *Error {
+	return wrapError(
+		err,
+		m.idPrefix(),
+	)
+}
+
+// handleError passes an error that the finalizer can't
+// manage to the configured ErrorHandler
+func (m *engine) handleError(msg string, err error) {
+	h := m.cfg.errorHandler()
+	switch {
+	case h.callback != nil:
+		h.callback(m.Info(), m.finalizerError(wrapError(err, msg)))
+	case h.panic:
+		m.panicf(msg, err)
+	default:
+		logError(m.errorLogger(), m.idPrefix(), msg, err)
+	}
+}
+
+// panicf handles the rare event that this finalizer
+// encounters an error condition that it can't manage. The
+// full details go to the logger (or the standard logger
+// if there isn't one) and the trace hook before it panics
+// with a concise message, so that a crash handler doesn't
+// have to be the only place they end up. A single phase
+// finalizer whose context is finished panics with the
+// context's error.
+func (m *engine) panicf(msg string, err error, args ...interface{}) {
+	_, f, l, _ := runtime.Caller(2)
+	message := fmt.Sprintf(msg, args...)
+	details := panicDetails(
+		fmt.Sprintf("%s:%d", f, l), m.State(), message, err,
+	)
+	m.errorLogger().Printf("PANIC: %s %s", m.idPrefix(), details)
+	m.mu.Lock()
+	hook := m.traceHook
+	m.mu.Unlock()
+	if hook != nil {
+		hook(m.traceEvent(m.currentPhase(), LevelError, details))
+	}
+	ctxErr := m.ctx.Err()
+	if ctxErr != nil && !m.twoPhase {
+		panic(ctxErr)
+	}
+	panic(panicMessage(m.name, message, err))
+}
+
+// Trace logs a message with details about the IDs
+// associated with the finalizer, at LevelDebug
+func (m *engine) Trace(format string, args ...interface{}) {
+	m.trace(m.currentPhase(), LevelDebug, format, args...)
+}
+
+// logf logs a message at level
+func (m *engine) logf(level Level, format string, args ...interface{}) {
+	m.trace(m.currentPhase(), level, format, args...)
+}
+
+// trace delivers a message for phase to the logger, if
+// it is at or above the log level, and the trace hook
+func (m *engine) trace(phase Phase, level Level, format string, args ...interface{}) {
+	m.mu.Lock()
+	logger := m.logger
+	hook := m.traceHook
+	m.mu.Unlock()
+	if level < m.cfg.logLevel {
+		logger = nil
+	}
+	if !m.sampled && level < LevelWarn {
+		return
+	}
+	if logger == nil && hook == nil {
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+	switch {
+	case logger == nil:
+	case m.cfg.traceFormatter != nil:
+		logger.Print(m.cfg.traceFormatter(m.traceEvent(phase, level, message)))
+	case m.twoPhase:
+		logger.Printf(
+			"%s t=+%s message: %s",
+			m.idPrefix(), m.elapsed(), message,
+		)
+	default:
+		logger.Printf(
+			"trace: %s t=+%s message: %s",
+			m.idPrefix(), m.elapsed(), message,
+		)
+	}
+	if hook != nil {
+		hook(m.traceEvent(phase, level, message))
+	}
+}
+
+// traceEvent describes a trace message for the trace hook
+func (m *engine) traceEvent(phase Phase, level Level, message string) TraceEvent {
+	now := m.cfg.now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return TraceEvent{
+		Time:          now,
+		Elapsed:       now.Sub(m.started),
+		Name:          m.name,
+		TXID:          m.serverTXID,
+		PID:           m.serverConnID,
+		GID:           m.id,
+		Phase:         phase,
+		Level:         level,
+		CorrelationID: m.correlationID,
+		Message:       message,
+	}
+}
+
+// SetTraceHook sets the hook that receives every trace
+// event. See TraceHook for the constraints on the hook.
+func (m *engine) SetTraceHook(hook TraceHook) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.traceHook = hook
+}
+
+// currentPhase returns the lifecycle phase for traces
+func (m *engine) currentPhase() Phase {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.phase
+}
+
+// setPhase records the lifecycle phase for traces. The
+// caller must hold opMu.
+func (m *engine) setPhase(p Phase) {
+	m.mu.Lock()
+	m.phase = p
+	m.mu.Unlock()
+}
@@ -0,0 +1,338 @@
+package txmpg
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/williammoran/txmpg/v2/internal/driver"
+)
+
+// prepare does the work of Finalize() for a two-phase
+// finalizer once the deferred commits have run: it
+// prepares the transaction, or commits it if it never
+// wrote and WithReadOnlySkipPrepare() is set
+func (m *engine) prepare() error {
+	assigned, err := m.resolveTxid(m.ctx)
+	if m.pool.TxDone(err) {
+		return m.driverFinished("Finalize()", err)
+	}
+	if err != nil {
+		return m.finalizerError(err)
+	}
+	if !assigned && m.cfg.skipReadOnly {
+		return m.commitReadOnly()
+	}
+	m.setPhase(PhasePrepare)
+	gid, err := m.cfg.newGID(m.name, m.CorrelationID())
+	if err != nil {
+		return m.finalizerError(err)
+	}
+	m.setID(gid)
+	m.Trace("Create Finalizer2P ID")
+	err = m.journalPrepare()
+	if err != nil {
+		m.setID("")
+		return m.finalizerError(err)
+	}
+	ctx := m.ctx
+	if m.cfg.prepareTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.cfg.prepareTimeout)
+		defer cancel()
+	}
+	err = m.cfg.inject(FaultBeforePrepare, m.id)
+	if err == nil {
+		err = m.tx.Exec(ctx, "PREPARE TRANSACTION "+QuoteGID(m.id))
+		if err == nil {
+			err = m.cfg.inject(FaultAfterPrepare, m.id)
+		}
+	}
+	if m.pool.TxDone(err) {
+		m.setID("")
+		return m.driverFinished("Doing PREPARE", err)
+	}
+	if err != nil {
+		// m.tx is left in place so that Abort() rolls back
+		// the transaction that failed to prepare
+		defer m.setID("")
+		m.prepareFailed = true
+		counters.prepareFailures.Add(1)
+		m.cfg.metrics.PrepareFailed(m.name)
+		if isDuplicateObject(err) {
+			// A failed PREPARE rolls back the transaction on
+			// the server, so it can't be retried with a new
+			// GID; the caller has to start over.
+			m.logf(LevelWarn, "GID %s is already in use", m.id)
+			err = &GIDInUseError{GID: m.id, Err: err}
+		}
+		if isObjectNotInPrerequisiteState(err) {
+			// Most likely prepared transactions were
+			// disabled since they were checked, so check
+			// again next time
+			preparedEnabled.Delete(m.pool)
+		}
+		return m.finalizerError(
+			wrapError(err, "Doing PREPARE"),
+		)
+	}
+	m.logf(LevelInfo, "Transaction prepared")
+	m.releaseTx()
+	m.mu.Lock()
+	m.prepared = m.cfg.now()
+	m.mu.Unlock()
+	counters.prepared.Add(1)
+	m.cfg.observer.TxPrepared(m.Info(), m.id)
+	m.emit(EventPrepared, nil)
+	return nil
+}
+
+// commitReadOnly commits a transaction that was never
+// assigned a transaction ID instead of preparing it. It
+// wrote nothing, so committing it early is not visible to
+// anyone.
+func (m *engine) commitReadOnly() error {
+	err := m.tx.Commit(m.ctx)
+	if m.pool.TxDone(err) {
+		return m.driverFinished("Finalize()", err)
+	}
+	if err != nil {
+		return m.finalizerError(
+			wrapError(err, "Committing read-only transaction"),
+		)
+	}
+	m.mu.Lock()
+	m.tx = nil
+	m.TX = nil
+	m.mu.Unlock()
+	m.readOnly = true
+	m.logf(LevelInfo, "read-only transaction committed without PREPARE")
+	return nil
+}
+
+// commitPrepared does the work of Commit() for a
+// two-phase finalizer, as Finalizer2P.CommitContext()
+// describes
+func (m *engine) commitPrepared(ctx context.Context) error {
+	// The decider is committed before taking opMu, so that
+	// participants that are each other's decider, or share
+	// one, never wait for each other's lock
+	if m.awaitsDecider(ctx) {
+		err := m.commitDecider(ctx)
+		if err != nil {
+			return m.finalizerError(err)
+		}
+	}
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+	if m.state == StateCommitted && m.committedByParticipant {
+		m.committedByParticipant = false
+		m.Trace("Commit() on transaction committed as decider")
+		return nil
+	}
+	return m.commitContext(ctx)
+}
+
+// awaitsDecider reports whether Commit() would send
+// COMMIT PREPARED, so that the decider has to be
+// committed first
+func (m *engine) awaitsDecider(ctx context.Context) bool {
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+	return m.state == StateFinalized && m.tx == nil && !m.readOnly && ctx.Err() == nil
+}
+
+// commitContext commits the prepared transaction. The
+// caller must hold opMu and have committed the decider.
+func (m *engine) commitContext(ctx context.Context) (err error) {
+	m.setPhase(PhaseCommit)
+	defer m.stopWatchdog()
+	span := m.cfg.startSpan(m.spanCtx, "commit", m.Info())
+	defer func() { span.End(m.Info(), err) }()
+	if m.state == StateCommitted {
+		m.Trace("Commit() on committed transaction")
+		return ErrAlreadyCommitted
+	}
+	if m.expired {
+		return m.finalizerError(ErrExpired)
+	}
+	if m.state == StateAborted || m.state == StateAbortFailed {
+		return m.finalizerError(ErrAborted)
+	}
+	if m.state == StateActive || m.state == StateFailed || m.tx != nil {
+		return m.finalizerError(ErrNotFinalized)
+	}
+	if m.readOnly {
+		m.setState(StateCommitted)
+		m.logf(LevelInfo, "Transaction committed (read-only)")
+		m.sendNotifications()
+		m.commitHooks.run(m.logf)
+		return nil
+	}
+	ctxErr := ctx.Err()
+	if ctxErr != nil {
+		m.Trace("Commit() with finished context: %s", ctxErr.Error())
+		return ctxErr
+	}
+	if m.journaled != "" {
+		err = m.cfg.journal.decideCommit(ctx, m.CorrelationID())
+		if err != nil {
+			return m.finalizerError(err)
+		}
+	}
+	err = m.cfg.inject(FaultBeforeCommitPrepared, m.id)
+	if err == nil {
+		var conn driver.Conn
+		conn, err = m.commitConn(ctx)
+		if errors.Is(err, ErrPoolExhausted) {
+			// COMMIT PREPARED wasn't sent, so the outcome
+			// isn't in doubt
+			m.logf(LevelWarn, "COMMIT PREPARED not attempted: %s", err.Error())
+			return m.finalizerError(err)
+		}
+		if err == nil {
+			err = conn.Exec(ctx, "COMMIT PREPARED "+QuoteGID(m.id))
+			conn.Close()
+		}
+		if err == nil {
+			err = m.cfg.inject(FaultAfterCommitPrepared, m.id)
+		}
+	}
+	if err != nil {
+		committed, err := m.cfg.commitPreparedFailed(
+			ctx, m.finalizePool(), m.name, m.id, err, m.logf,
+			func(err error) error { return m.finalizerError(err) },
+		)
+		if committed {
+			m.setState(StateCommitted)
+		}
+		return err
+	}
+	m.setState(StateCommitted)
+	m.logf(LevelInfo, "Transaction committed")
+	m.recordCommitLSN()
+	m.sendNotifications()
+	m.commitHooks.run(m.logf)
+	return nil
+}
+
+// startPreparedWatchdog starts a goroutine that reports a
+// prepared transaction that is still waiting for Commit()
+// when the finalizer's context finishes or it exceeds
+// the configured maximum age, and rolls it back if
+// configured to do so or if it outlives its maximum
+// lifetime
+func (m *engine) startPreparedWatchdog() {
+	m.watchdogStop = make(chan struct{})
+	go func() {
+		var expired, lifetime <-chan time.Time
+		if m.cfg.maxPreparedAge > 0 {
+			timer := time.NewTimer(m.cfg.maxPreparedAge)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		if m.cfg.maxPreparedLifetime > 0 {
+			timer := time.NewTimer(m.cfg.maxPreparedLifetime)
+			defer timer.Stop()
+			lifetime = timer.C
+		}
+		done := m.ctx.Done()
+		if !m.cfg.preparedAutoRollback && m.cfg.onPreparedStale == nil {
+			// Only the lifetime matters
+			done, expired = nil, nil
+		}
+		select {
+		case <-m.watchdogStop:
+			return
+		case <-done:
+			m.logf(LevelWarn, "context finished before Commit() of prepared transaction")
+		case <-expired:
+			m.logf(LevelWarn, "prepared transaction exceeded %s", m.cfg.maxPreparedAge)
+		case <-lifetime:
+			m.logf(LevelWarn, "prepared transaction outlived %s", m.cfg.maxPreparedLifetime)
+			m.watchdogRollback(true)
+			return
+		}
+		if m.cfg.onPreparedStale != nil {
+			m.opMu.Lock()
+			stale, gid := m.state == StateFinalized, m.id
+			m.opMu.Unlock()
+			// Called without holding the lock, so the
+			// callback may itself Commit() or Abort()
+			if stale {
+				m.cfg.onPreparedStale(gid)
+			}
+		}
+		if m.cfg.preparedAutoRollback {
+			m.watchdogRollback(false)
+			return
+		}
+		if lifetime == nil {
+			return
+		}
+		select {
+		case <-m.watchdogStop:
+		case <-lifetime:
+			m.logf(LevelWarn, "prepared transaction outlived %s", m.cfg.maxPreparedLifetime)
+			m.watchdogRollback(true)
+		}
+	}()
+}
+
+// watchdogRollback rolls back the prepared transaction if
+// it is still waiting for Commit(). expired means that it
+// outlived its maximum lifetime, so a later Commit()
+// returns ErrExpired. Commit() holds opMu for its whole
+// duration, so whichever of the two takes it first wins.
+func (m *engine) watchdogRollback(expired bool) {
+	m.opMu.Lock()
+	defer m.opMu.Unlock()
+	if m.state != StateFinalized {
+		return
+	}
+	m.setPhase(PhaseAbort)
+	err := m.cfg.rollbackPrepared(m.finalizePool(), m.id, m.logf)
+	if err != nil {
+		m.logf(LevelError, "prepared transaction %s left for recovery", m.id)
+		m.abortFailed(err, "Watchdog failed ROLLBACK PREPARED")
+		return
+	}
+	m.expired = expired
+	m.setState(StateAborted)
+	m.logf(LevelInfo, "Watchdog did ROLLBACK PREPARED")
+}
+
+// journalPrepare records the GID in the journal, if
+// there is one, before it is prepared
+func (m *engine) journalPrepare() error {
+	if m.cfg.journal == nil {
+		return nil
+	}
+	txn := m.CorrelationID()
+	if txn == "" {
+		return ErrNoCorrelationID
+	}
+	err := m.cfg.journal.prepare(m.ctx, m.id, txn, m.name)
+	if err != nil {
+		return err
+	}
+	m.journaled = m.id
+	return nil
+}
+
+// journalForget removes the resolved transaction from
+// the journal. If that fails, recovery will find it
+// already resolved and remove it then.
+func (m *engine) journalForget() {
+	if m.journaled == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), m.cfg.maintenanceTimeout)
+	defer cancel()
+	err := m.cfg.journal.forget(ctx, m.journaled)
+	if err != nil {
+		m.logf(LevelWarn, "%s", err.Error())
+		return
+	}
+	m.journaled = ""
+}
@@ -0,0 +1,102 @@
+package txmpg
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// ErrorHandler decides what a finalizer does when it
+// encounters an error it can't manage, such as failing to
+// roll back a transaction. Use PanicOnError(), LogErrors()
+// or ErrorCallback() to create one.
+type ErrorHandler struct {
+	panic    bool
+	callback func(FinalizerInfo, error)
+}
+
+// PanicOnError makes the finalizer panic with a detailed
+// message, which was the only behavior in earlier
+// versions
+func PanicOnError() ErrorHandler {
+	return ErrorHandler{panic: true}
+}
+
+// LogErrors makes the finalizer log the error and carry
+// on. The error is still available from AbortError().
+// This is the default.
+func LogErrors() ErrorHandler {
+	return ErrorHandler{}
+}
+
+// ErrorCallback makes the finalizer call f with a
+// description of itself and the error, e.g. to raise an
+// alert. f is called while the finalizer is in the middle
+// of Abort(), so it must not call Finalize(), Commit() or
+// Abort() on the same finalizer.
+func ErrorCallback(f func(FinalizerInfo, error)) ErrorHandler {
+	return ErrorHandler{callback: f}
+}
+
+var (
+	defaultErrorHandlerMu sync.Mutex
+	defaultErrorHandler   = LogErrors()
+)
+
+// SetDefaultErrorHandler sets the ErrorHandler used by
+// finalizers constructed without WithErrorHandler()
+func SetDefaultErrorHandler(h ErrorHandler) {
+	defaultErrorHandlerMu.Lock()
+	defer defaultErrorHandlerMu.Unlock()
+	defaultErrorHandler = h
+}
+
+// errorHandler returns the configured ErrorHandler, or the
+// package default
+func (c *config) errorHandler() ErrorHandler {
+	if c.onError != nil {
+		return *c.onError
+	}
+	defaultErrorHandlerMu.Lock()
+	defer defaultErrorHandlerMu.Unlock()
+	return defaultErrorHandler
+}
+
+// WithErrorHandler sets what the finalizer does when it
+// encounters an error it can't manage, overriding the
+// package default set by SetDefaultErrorHandler()
+func WithErrorHandler(h ErrorHandler) Option {
+	return func(c *config) {
+		c.onError = &h
+	}
+}
+
+// logError writes an unmanageable error to logger
+func logError(logger *log.Logger, prefix, msg string, err error) {
+	logger.Printf("ERROR: %s message: %s Error: %s", prefix, msg, err.Error())
+}
+
+// panicDetails describes an error that is about to panic
+// the finalizer in full: where panicf was called from,
+// the finalizer's state, and the server's error details
+// when there are any.
+func panicDetails(caller string, state State, message string, err error) string {
+	details := fmt.Sprintf("called from %s state: %s message: %s", caller, state, message)
+	if err == nil {
+		return details
+	}
+	se, ok := asServerError(err)
+	if ok {
+		return fmt.Sprintf("%s server error: %s", details, se)
+	}
+	return fmt.Sprintf("%s error: %T: %+v", details, err, err)
+}
+
+// panicMessage is the concise value panicf panics with;
+// the details have already been logged
+func panicMessage(name, message string, err error) string {
+	if err == nil {
+		return fmt.Sprintf("txmpg: %s: %s", name, message)
+	}
+	return fmt.Sprintf("txmpg: %s: %s: %s", name, message, err.Error())
+}
@@ -0,0 +1,205 @@
+package txmpg
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+func TestWithPanicOnAbortFailurePrecedence(t *testing.T) {
+	callback := ErrorCallback(func(FinalizerInfo, error) {})
+	tests := []struct {
+		name         string
+		defaultPanic bool
+		opts         []Option
+		wantPanic    bool
+		wantCallback bool
+	}{
+		{name: "true", opts: []Option{WithPanicOnAbortFailure(true)}, wantPanic: true},
+		{name: "false", opts: []Option{WithPanicOnAbortFailure(false)}},
+		{
+			name:         "false keeps an earlier callback",
+			opts:         []Option{WithErrorHandler(callback), WithPanicOnAbortFailure(false)},
+			wantCallback: true,
+		},
+		{
+			name:      "true replaces an earlier callback",
+			opts:      []Option{WithErrorHandler(callback), WithPanicOnAbortFailure(true)},
+			wantPanic: true,
+		},
+		{
+			name: "false undoes an earlier true",
+			opts: []Option{WithPanicOnAbortFailure(true), WithPanicOnAbortFailure(false)},
+		},
+		{
+			name:         "false overrides a panicking default",
+			defaultPanic: true,
+			opts:         []Option{WithPanicOnAbortFailure(false)},
+		},
+		{
+			name:         "later handler wins",
+			opts:         []Option{WithPanicOnAbortFailure(false), WithErrorHandler(callback)},
+			wantCallback: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.defaultPanic {
+				SetDefaultErrorHandler(PanicOnError())
+				defer SetDefaultErrorHandler(LogErrors())
+			}
+			cfg := newConfig(tt.opts)
+			h := cfg.errorHandler()
+			if h.panic != tt.wantPanic || (h.callback != nil) != tt.wantCallback {
+				t.Errorf("handler panics %t, has callback %t", h.panic, h.callback != nil)
+			}
+		})
+	}
+}
+
+func TestErrorHandlerModes(t *testing.T) {
+	sites := []struct {
+		name     string
+		twoPhase bool
+		fail     string
+	}{
+		{"Abort", false, "ROLLBACK"},
+		{"ROLLBACK PREPARED", true, "ROLLBACK PREPARED"},
+	}
+	for _, site := range sites {
+		t.Run(site.name, func(t *testing.T) {
+			run := func(t *testing.T, h ErrorHandler, logger *log.Logger) (f lifecycle, panicked interface{}) {
+				server, factory := fakeFactory(
+					t, "orders", WithErrorHandler(h), WithLogger(logger),
+					WithRollbackPreparedRetry(1, time.Millisecond),
+				)
+				f = begin(t, factory, site.twoPhase)
+				if site.twoPhase {
+					err := f.Finalize()
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				server.FailNext(site.fail, fakepg.ServerError("57P01", "terminating connection"))
+				defer func() { panicked = recover() }()
+				f.Abort()
+				return f, nil
+			}
+			t.Run("panic", func(t *testing.T) {
+				var buf bytes.Buffer
+				_, panicked := run(t, PanicOnError(), log.New(&buf, "", 0))
+				if panicked == nil {
+					t.Fatal("Abort() didn't panic")
+				}
+				if !strings.Contains(buf.String(), "terminating connection") {
+					t.Errorf("log %q lacks the error", buf.String())
+				}
+			})
+			t.Run("log", func(t *testing.T) {
+				var buf bytes.Buffer
+				f, panicked := run(t, LogErrors(), log.New(&buf, "", 0))
+				if panicked != nil {
+					t.Fatalf("Abort() panicked: %v", panicked)
+				}
+				if !strings.Contains(buf.String(), "ERROR: NAME: orders") ||
+					!strings.Contains(buf.String(), "terminating connection") {
+					t.Errorf("log %q lacks the error", buf.String())
+				}
+				if f.State() != StateAbortFailed || f.AbortError() == nil {
+					t.Errorf("State() = %s, AbortError() = %v", f.State(), f.AbortError())
+				}
+			})
+			t.Run("callback", func(t *testing.T) {
+				var calls []error
+				var infos []FinalizerInfo
+				h := ErrorCallback(func(info FinalizerInfo, err error) {
+					infos = append(infos, info)
+					calls = append(calls, err)
+				})
+				f, panicked := run(t, h, nil)
+				if panicked != nil {
+					t.Fatalf("Abort() panicked: %v", panicked)
+				}
+				if len(calls) != 1 || SQLState(calls[0]) != "57P01" {
+					t.Fatalf("callback got %v, want the rollback error once", calls)
+				}
+				if infos[0].Name != "orders" || infos[0].TwoPhase != site.twoPhase {
+					t.Errorf("callback got %+v", infos[0])
+				}
+				if f.State() != StateAbortFailed {
+					t.Errorf("State() = %s", f.State())
+				}
+			})
+		})
+	}
+}
+
+func TestPanicDiagnostics(t *testing.T) {
+	for _, twoPhase := range []bool{false, true} {
+		t.Run(fmt.Sprintf("twoPhase=%t", twoPhase), func(t *testing.T) {
+			var buf bytes.Buffer
+			var events []TraceEvent
+			server, factory := fakeFactory(
+				t, "orders", WithErrorHandler(PanicOnError()),
+				WithLogger(log.New(&buf, "", 0)),
+				WithTraceHook(func(e TraceEvent) { events = append(events, e) }),
+				WithRollbackPreparedRetry(1, time.Millisecond),
+			)
+			f := begin(t, factory, twoPhase)
+			fail := "ROLLBACK"
+			if twoPhase {
+				err := f.Finalize()
+				if err != nil {
+					t.Fatal(err)
+				}
+				fail = "ROLLBACK PREPARED"
+			}
+			server.FailNext(fail, fakepg.ServerError("57P01", "terminating connection"))
+			var panicked interface{}
+			func() {
+				defer func() { panicked = recover() }()
+				f.Abort()
+			}()
+			if panicked == nil {
+				t.Fatal("Abort() didn't panic")
+			}
+			msg := fmt.Sprint(panicked)
+			if !strings.HasPrefix(msg, "txmpg: orders: ") || strings.Contains(msg, "called from") {
+				t.Errorf("panicked with %q, want a concise message", msg)
+			}
+			record := buf.String()
+			want := []string{
+				"PANIC: NAME: orders",
+				"PGTXID: ",
+				"called from ",
+				"engine.go:",
+				"state: ",
+				"server error: ",
+				"57P01",
+				"terminating connection",
+			}
+			if twoPhase {
+				want = append(want, "TX: "+f.(*Finalizer2P).GID())
+			}
+			for _, w := range want {
+				if !strings.Contains(record, w) {
+					t.Errorf("log %q lacks %q", record, w)
+				}
+			}
+			var traced bool
+			for _, e := range events {
+				if e.Level == LevelError && strings.Contains(e.Message, "called from ") {
+					traced = true
+				}
+			}
+			if !traced {
+				t.Errorf("trace hook got %+v, want the diagnostics", events)
+			}
+		})
+	}
+}
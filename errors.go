@@ -0,0 +1,241 @@
+package txmpg
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Error is the error type returned by the finalizers. It
+// annotates the underlying error with a message, and
+// supports errors.Is() and errors.As() all the way down
+// to the driver's error.
+type Error struct {
+	msg string
+	err error
+}
+
+// wrapError annotates err with msg
+func wrapError(err error, msg string) *Error {
+	return &Error{msg: msg, err: err}
+}
+
+func (e *Error) Error() string {
+	return e.msg + ": " + e.err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// ErrNotFinalized is returned when an operation requires
+// the transaction to be finalized first, such as calling
+// Commit() before Finalize() or after it failed
+var ErrNotFinalized = errors.New("transaction is not finalized")
+
+// ErrFinalized is returned when an operation requires an
+// open transaction but the transaction has already been
+// finalized
+var ErrFinalized = errors.New("transaction is finalized")
+
+// ErrHandedOff is returned when a Finalizer's transaction
+// is used after it was submitted to an AsyncCommitter
+var ErrHandedOff = errors.New("transaction was handed off for asynchronous commit")
+
+// ErrCommitterClosed is returned by AsyncCommitter for a
+// finalizer that it aborted instead of committing because
+// it was closed
+var ErrCommitterClosed = errors.New("AsyncCommitter is closed")
+
+// ErrFinalizeFailed is returned by Finalize() when it is
+// called again after a previous call failed
+var ErrFinalizeFailed = errors.New("Finalize() already failed")
+
+// ErrTooManyDeferredCommits is returned by Finalize() when
+// more deferred commits are registered than allowed by
+// WithMaxDeferredCommits(), usually because deferred
+// commits keep registering new ones
+var ErrTooManyDeferredCommits = errors.New("too many deferred commits")
+
+// ErrAlreadyCommitted is returned by Commit() when the
+// transaction has already been committed, so callers can
+// safely retry Commit()
+var ErrAlreadyCommitted = errors.New("transaction already committed")
+
+// ErrExpired is returned by Finalizer2P.Commit() when the
+// prepared transaction was rolled back because it outlived
+// WithMaxPreparedLifetime(). It wraps ErrAborted.
+var ErrExpired = fmt.Errorf("prepared transaction expired: %w", ErrAborted)
+
+// ErrNoCorrelationID is returned by Finalize() when a
+// Finalizer2P with a Journal has no correlation ID to
+// group its participants by
+var ErrNoCorrelationID = errors.New("journal requires a correlation ID")
+
+// ErrAborted is returned when an operation is attempted
+// on a transaction that has been aborted
+var ErrAborted = errors.New("transaction is aborted")
+
+// ErrPreparedTransactionsDisabled is returned when
+// constructing a Finalizer2P on a server that does not
+// allow prepared transactions
+var ErrPreparedTransactionsDisabled = errors.New(
+	"prepared transactions are disabled on the server: " +
+		"set max_prepared_transactions to a value greater than 0 " +
+		"(usually at least max_connections) and restart PostgreSQL",
+)
+
+// ErrTxidStatusUnavailable is returned when constructing
+// a Finalizer with WithRequireTxidStatus(true) on a server
+// that doesn't provide txid_status()
+var ErrTxidStatusUnavailable = errors.New("txid_status() is not available on the server")
+
+// ErrSynchronousCommit2P is returned by the Finalizer2P
+// constructors when WithSynchronousCommit() is used.
+// PREPARE TRANSACTION always flushes to disk, so the
+// setting would have no effect on durability.
+var ErrSynchronousCommit2P = errors.New("WithSynchronousCommit() is not supported by Finalizer2P")
+
+// ErrRemoteApply2P is returned by the Finalizer2P
+// constructors for
+// WithReplicationDurability(DurabilityRemoteApply), which
+// can't be honored because it would only apply to
+// PREPARE TRANSACTION, not to COMMIT PREPARED
+var ErrRemoteApply2P = errors.New("DurabilityRemoteApply is not supported by Finalizer2P")
+
+// ErrNoSynchronousStandby is returned by the constructors
+// when WithStandbyCheck() finds no synchronous standby to
+// provide the requested durability
+var ErrNoSynchronousStandby = errors.New("no synchronous standby is connected")
+
+// ErrPoolExhausted is matched by the *PoolExhaustedError
+// that Finalizer2P.Commit() returns when it can't get a
+// connection for COMMIT PREPARED in time
+var ErrPoolExhausted = errors.New("connection pool exhausted")
+
+// ErrInDoubt indicates that a commit was interrupted in a
+// way that makes it impossible to know whether it took
+// effect on the server. Use errors.Is() to test for it.
+var ErrInDoubt = errors.New("transaction outcome is in doubt")
+
+// ErrAlreadyResolved is returned by Finalizer2P.Commit()
+// when the prepared transaction no longer exists on the
+// server, wrapped with its GID, so use errors.Is() to
+// test for it. This usually means that an earlier
+// Commit() succeeded even though it reported an error,
+// and most callers can treat it as success. It can not, however,
+// rule out that the prepared transaction was rolled back
+// by someone else.
+var ErrAlreadyResolved = errors.New("prepared transaction already resolved")
+
+// ErrCommitConfirmedGone is returned by Finalizer2P.Commit()
+// when COMMIT PREPARED failed in a way that left the
+// outcome unclear, and the prepared transaction turned
+// out to be gone. Like ErrAlreadyResolved, which it
+// wraps, it almost always means the commit succeeded,
+// but only a journal can rule out that someone else
+// rolled it back. Don't retry.
+var ErrCommitConfirmedGone = fmt.Errorf("prepared transaction gone after COMMIT PREPARED error: %w", ErrAlreadyResolved)
+
+// ErrCommitNotApplied is returned by Finalizer2P.Commit()
+// when COMMIT PREPARED failed in a way that left the
+// outcome unclear, and the prepared transaction turned
+// out to still exist. Commit() is safe to retry.
+var ErrCommitNotApplied = errors.New("COMMIT PREPARED did not take effect")
+
+// ErrGIDInUse is returned when PREPARE TRANSACTION fails
+// because another prepared transaction already has the
+// same identifier. Use errors.As() with *GIDInUseError to
+// find the conflicting GID.
+var ErrGIDInUse = errors.New("transaction identifier already in use")
+
+// ErrInvalidGID is returned when a prepared transaction
+// identifier can't be used with PostgreSQL
+var ErrInvalidGID = errors.New("invalid GID")
+
+// GIDInUseError reports the GID that collided with an
+// existing prepared transaction
+type GIDInUseError struct {
+	GID string
+	Err error
+}
+
+func (e *GIDInUseError) Error() string {
+	return fmt.Sprintf("%s: GID %s", ErrGIDInUse.Error(), e.GID)
+}
+
+// Unwrap returns the server error
+func (e *GIDInUseError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, ErrGIDInUse) true
+func (e *GIDInUseError) Is(target error) bool {
+	return target == ErrGIDInUse
+}
+
+// InDoubtError is returned when the outcome of a
+// COMMIT PREPARED is unknown. The prepared transaction
+// identified by GID may or may not have been committed
+// and must be checked (e.g. in pg_prepared_xacts) before
+// deciding what to do.
+type InDoubtError struct {
+	GID string
+	Err error
+}
+
+func (e *InDoubtError) Error() string {
+	return fmt.Sprintf(
+		"%s: GID %s: %s", ErrInDoubt.Error(), e.GID, e.Err.Error(),
+	)
+}
+
+// Unwrap returns the error that caused the doubt
+func (e *InDoubtError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, ErrInDoubt) true
+func (e *InDoubtError) Is(target error) bool {
+	return target == ErrInDoubt
+}
+
+// isTxDone reports whether err is database/sql's
+// ErrTxDone, meaning the driver already committed or
+// rolled back the transaction
+func isTxDone(err error) bool {
+	return errors.Is(err, sql.ErrTxDone)
+}
+
+// isDuplicateObject reports whether err is a server error
+// with SQLSTATE 42710 (duplicate_object), which is what
+// PostgreSQL returns for a GID that is already in use
+func isDuplicateObject(err error) bool {
+	return SQLState(err) == "42710"
+}
+
+// isUndefinedObject reports whether err is a server error
+// with SQLSTATE 42704 (undefined_object), which is what
+// PostgreSQL returns for a prepared transaction that does
+// not exist
+func isUndefinedObject(err error) bool {
+	return SQLState(err) == "42704"
+}
+
+// isUndefinedFunction reports whether err is a server
+// error with SQLSTATE 42883 (undefined_function), which is
+// what PostgreSQL returns for a function that does not
+// exist, such as the xid8 functions before PostgreSQL 13
+func isUndefinedFunction(err error) bool {
+	return SQLState(err) == "42883"
+}
+
+// isObjectNotInPrerequisiteState reports whether err is
+// a server error with SQLSTATE 55000
+// (object_not_in_prerequisite_state), which is what
+// PostgreSQL returns for PREPARE TRANSACTION when
+// prepared transactions are disabled
+func isObjectNotInPrerequisiteState(err error) bool {
+	return SQLState(err) == "55000"
+}
@@ -0,0 +1,160 @@
+package txmpg
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+func TestErrorChains(t *testing.T) {
+	ctx := context.Background()
+	serialization := fakepg.ServerError("40001", "could not serialize access")
+	tests := []struct {
+		name   string
+		run    func(t *testing.T, server *fakepg.Server, factory *Factory) error
+		want   error
+		wantPQ bool
+	}{
+		{
+			name: "Finalizer commit before Finalize",
+			run: func(t *testing.T, server *fakepg.Server, factory *Factory) error {
+				f := begin(t, factory, false)
+				defer f.Abort()
+				return f.Commit()
+			},
+			want: ErrNotFinalized,
+		},
+		{
+			name: "Finalizer2P commit before Finalize",
+			run: func(t *testing.T, server *fakepg.Server, factory *Factory) error {
+				f := begin(t, factory, true)
+				defer f.Abort()
+				return f.Commit()
+			},
+			want: ErrNotFinalized,
+		},
+		{
+			name: "second commit",
+			run: func(t *testing.T, server *fakepg.Server, factory *Factory) error {
+				f := begin(t, factory, false)
+				defer f.Abort()
+				if err := f.Finalize(); err != nil {
+					t.Fatal(err)
+				}
+				if err := f.Commit(); err != nil {
+					t.Fatal(err)
+				}
+				return f.Commit()
+			},
+			want: ErrAlreadyCommitted,
+		},
+		{
+			name: "commit on aborted transaction",
+			run: func(t *testing.T, server *fakepg.Server, factory *Factory) error {
+				f := begin(t, factory, false)
+				defer f.Abort()
+				if err := f.Finalize(); err != nil {
+					t.Fatal(err)
+				}
+				server.SetStatus("aborted")
+				return f.Commit()
+			},
+			want: ErrAborted,
+		},
+		{
+			name: "commit after Abort",
+			run: func(t *testing.T, server *fakepg.Server, factory *Factory) error {
+				f := begin(t, factory, true)
+				if err := f.Finalize(); err != nil {
+					t.Fatal(err)
+				}
+				f.Abort()
+				return f.Commit()
+			},
+			want: ErrAborted,
+		},
+		{
+			name: "server error on COMMIT",
+			run: func(t *testing.T, server *fakepg.Server, factory *Factory) error {
+				f := begin(t, factory, false)
+				defer f.Abort()
+				if err := f.Finalize(); err != nil {
+					t.Fatal(err)
+				}
+				server.FailNext("COMMIT", serialization)
+				return f.Commit()
+			},
+			want:   serialization,
+			wantPQ: true,
+		},
+		{
+			name: "GID in use",
+			run: func(t *testing.T, server *fakepg.Server, factory *Factory) error {
+				server.Prepare("orders-1")
+				f, err := factory.Begin2P(ctx, WithGID("orders-1"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Abort()
+				return f.Finalize()
+			},
+			want:   ErrGIDInUse,
+			wantPQ: true,
+		},
+		{
+			name: "in doubt",
+			run: func(t *testing.T, server *fakepg.Server, factory *Factory) error {
+				f := begin(t, factory, true)
+				defer f.Abort()
+				if err := f.Finalize(); err != nil {
+					t.Fatal(err)
+				}
+				server.FailNext("COMMIT PREPARED", errors.New("connection reset"))
+				server.FailNext("SELECT EXISTS (SELECT 1 FROM pg_prepared_xacts", errors.New("connection refused"))
+				return f.Commit()
+			},
+			want: ErrInDoubt,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, factory := fakeFactory(t, "orders")
+			err := tt.run(t, server, factory)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("error = %v, want %v", err, tt.want)
+			}
+			var pqErr *pq.Error
+			if errors.As(err, &pqErr) != tt.wantPQ {
+				t.Errorf("errors.As(%v, *pq.Error) = %t", err, !tt.wantPQ)
+			}
+			if tt.want == ErrAlreadyCommitted {
+				return
+			}
+			var txErr *Error
+			if !errors.As(err, &txErr) {
+				t.Errorf("error %v is not an *Error", err)
+			}
+		})
+	}
+}
+
+func TestGIDInUseErrorAs(t *testing.T) {
+	server, factory := fakeFactory(t, "orders")
+	server.Prepare("orders-1")
+	f, err := factory.Begin2P(context.Background(), WithGID("orders-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	err = f.Finalize()
+	var inUse *GIDInUseError
+	if !errors.As(err, &inUse) || inUse.GID != "orders-1" {
+		t.Fatalf("Finalize() = %v, want a *GIDInUseError for orders-1", err)
+	}
+	if SQLState(err) != "42710" {
+		t.Errorf("SQLState() = %q", SQLState(err))
+	}
+}
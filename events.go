@@ -0,0 +1,129 @@
+package txmpg
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// eventBuffer is the capacity of the Events() channel
+const eventBuffer = 64
+
+// EventKind identifies a lifecycle transition
+type EventKind int
+
+const (
+	// EventFinalizeStarted is sent when Finalize() starts
+	// running the deferred commits
+	EventFinalizeStarted EventKind = iota
+	// EventFinalized is sent when Finalize() has
+	// finished, with Err set if it failed
+	EventFinalized
+	// EventPrepared is sent when a Finalizer2P has
+	// prepared its transaction
+	EventPrepared
+	// EventCommitted is sent when the transaction commits
+	EventCommitted
+	// EventAborted is sent when the transaction is rolled
+	// back
+	EventAborted
+	// EventFailed is sent when Finalize() or Abort()
+	// fails, with Err set
+	EventFailed
+)
+
+var eventKindNames = map[EventKind]string{
+	EventFinalizeStarted: "finalize started",
+	EventFinalized:       "finalized",
+	EventPrepared:        "prepared",
+	EventCommitted:       "committed",
+	EventAborted:         "aborted",
+	EventFailed:          "failed",
+}
+
+// String returns the name of the kind
+func (k EventKind) String() string {
+	name, ok := eventKindNames[k]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
+// Event is a lifecycle transition of a finalizer
+type Event struct {
+	Kind EventKind
+	Info FinalizerInfo
+	Err  error
+}
+
+// eventStream delivers events to the Events() channel
+// without ever blocking the finalizer
+type eventStream struct {
+	mu      sync.Mutex
+	ch      chan Event
+	closed  bool
+	dropped atomic.Int64
+}
+
+// subscribe returns the channel, creating it on first use
+func (s *eventStream) subscribe() <-chan Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch == nil {
+		s.ch = make(chan Event, eventBuffer)
+		if s.closed {
+			close(s.ch)
+		}
+	}
+	return s.ch
+}
+
+// send delivers ev if anyone subscribed and there is room
+// in the buffer, and counts it as dropped otherwise
+func (s *eventStream) send(ev Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch == nil || s.closed {
+		return
+	}
+	select {
+	case s.ch <- ev:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// close closes the channel after the last event. It is
+// safe to call more than once.
+func (s *eventStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if s.ch != nil {
+		close(s.ch)
+	}
+}
+
+// Events returns a channel of the finalizer's lifecycle
+// transitions from the time of the first call. The
+// channel is buffered, and events are dropped rather than
+// delay the transaction when it is full; see
+// DroppedEvents(). It is closed once the transaction is
+// committed or aborted, or Abort() fails.
+func (m *engine) Events() <-chan Event {
+	return m.events.subscribe()
+}
+
+// DroppedEvents returns the number of events that were
+// dropped because the Events() channel was full
+func (m *engine) DroppedEvents() int64 {
+	return m.events.dropped.Load()
+}
+
+// emit sends an event to the Events() channel
+func (m *engine) emit(kind EventKind, err error) {
+	m.events.send(Event{Kind: kind, Info: m.Info(), Err: err})
+}
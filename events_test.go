@@ -0,0 +1,105 @@
+package txmpg
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+func TestEventsConcurrentReaders(t *testing.T) {
+	_, factory := fakeFactory(t, "orders")
+	f, err := factory.Begin2P(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := f.Events()
+	const readers = 4
+	var wg sync.WaitGroup
+	kinds := make([][]EventKind, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for event := range events {
+				kinds[i] = append(kinds[i], event.Kind)
+			}
+		}(i)
+	}
+	err = f.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Everything that could end the stream, at once
+	var enders sync.WaitGroup
+	for _, end := range []func(){
+		func() { f.Commit() },
+		f.Abort,
+		func() { f.Commit() },
+		f.Abort,
+	} {
+		enders.Add(1)
+		go func(end func()) {
+			defer enders.Done()
+			end()
+		}(end)
+	}
+	enders.Wait()
+	wg.Wait()
+	// Each event went to one of the readers
+	total := 0
+	for _, k := range kinds {
+		total += len(k)
+	}
+	if total == 0 {
+		t.Error("no events delivered")
+	}
+	// A late subscriber gets the closed channel
+	select {
+	case _, ok := <-f.Events():
+		if ok {
+			t.Error("event after the channel closed")
+		}
+	case <-time.After(time.Second):
+		t.Error("Events() is open after the transaction ended")
+	}
+}
+
+func TestEventsAbortFailedThenAborted(t *testing.T) {
+	server, factory := fakeFactory(t, "orders", WithRollbackPreparedRetry(1, time.Millisecond))
+	f, err := factory.Begin2P(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := f.Events()
+	err = f.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.FailNext("ROLLBACK PREPARED", fakepg.ServerError("53300", "too many connections"))
+	f.Abort()
+	if f.State() != StateAbortFailed {
+		t.Fatalf("State() = %s, want AbortFailed", f.State())
+	}
+	var kinds []EventKind
+	for event := range events {
+		kinds = append(kinds, event.Kind)
+	}
+	if len(kinds) == 0 || kinds[len(kinds)-1] != EventFailed {
+		t.Fatalf("events %v, want to end with EventFailed", kinds)
+	}
+	// The retried Abort() succeeds on a stream that is
+	// already closed
+	f.Abort()
+	if f.State() != StateAborted {
+		t.Fatalf("State() after retried Abort() = %s", f.State())
+	}
+	if _, ok := <-f.Events(); ok {
+		t.Error("event delivered after the stream closed")
+	}
+	if f.DroppedEvents() != 0 {
+		t.Errorf("%d events dropped", f.DroppedEvents())
+	}
+}
@@ -4,13 +4,16 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	_ "expvar"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"sort"
 	"strconv"
 	"sync"
 	"syscall"
@@ -38,6 +41,10 @@ import (
 // ./bank -0 "user=postgres dbname=bank0" -1 "user=postgres dbname=bank1" -v 2 -c 3 -t 200
 // * Run the 2-phase finalizer with verbose output
 // ./bank -0 "user=postgres dbname=bank0" -1 "user=postgres dbname=bank1" -v 2 -d
+// * Watch the counters at http://localhost:8080/debug/vars
+// ./bank -0 "user=postgres dbname=bank0" -1 "user=postgres dbname=bank1" -http localhost:8080
+// * Save the latency and outcome of every transfer for analysis
+// ./bank -0 "user=postgres dbname=bank0" -1 "user=postgres dbname=bank1" -csv out.csv
 
 func main() {
 	cs0 := flag.String("0", "", "first database connection")
@@ -46,7 +53,15 @@ func main() {
 	routines := flag.Int("c", 5, "Number of concurrent routines")
 	transactions := flag.Int("t", 100, "Number of transactions per goroutine")
 	debug := flag.Bool("d", false, "Enable transaction tracing")
+	httpAddr := flag.String("http", "", "Serve expvar counters on this address")
+	csvPath := flag.String("csv", "", "Write every transfer's latency and outcome to this CSV file")
 	flag.Parse()
+	if *httpAddr != "" {
+		txmpg.EnableExpvar()
+		go func() {
+			log.Println(http.ListenAndServe(*httpAddr, nil))
+		}()
+	}
 	c0 := connect(*cs0)
 	defer c0.Close()
 	c1 := connect(*cs1)
@@ -68,6 +83,7 @@ func main() {
 			log.Printf("=== received SIGQUIT ===\n*** goroutine dump...\n%s\n*** end\n", buf[:stacklen])
 		}
 	}()
+	start := time.Now()
 	var wg sync.WaitGroup
 	for i := 0; i < *routines; i++ {
 		wg.Add(1)
@@ -77,6 +93,50 @@ func main() {
 		}()
 	}
 	wg.Wait()
+	printSummary(time.Since(start))
+	if *manager != 1 {
+		printPreparedWindow()
+	}
+	if *csvPath != "" {
+		err := writeCSV(*csvPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// preparedWindows collects how long each 2-phase
+// transaction spent prepared before it committed
+var preparedWindows struct {
+	sync.Mutex
+	d []time.Duration
+}
+
+// recordPreparedWindow saves the prepare to commit time
+// of a committed Finalizer2P
+func recordPreparedWindow(f txmpg.TxFinalizer) {
+	f2p, ok := f.(*txmpg.Finalizer2P)
+	if !ok {
+		return
+	}
+	preparedWindows.Lock()
+	defer preparedWindows.Unlock()
+	preparedWindows.d = append(preparedWindows.d, f2p.Stats().PrepareToCommit)
+}
+
+// printPreparedWindow prints the 99th percentile of the
+// time transactions spent prepared, which is the cost of
+// coordinating the commit
+func printPreparedWindow() {
+	d := preparedWindows.d
+	if len(d) == 0 {
+		return
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	fmt.Printf(
+		"Prepare to commit p99: %s over %d commits\n",
+		d[(len(d)-1)*99/100], len(d),
+	)
 }
 
 // connect just connects using the passed conntection
@@ -156,6 +216,9 @@ func transfer(
 	amount int,
 	debug bool,
 ) bool {
+	start := time.Now()
+	outcome := outcomeCommitted
+	defer func() { recordSample(start, outcome) }()
 	fmt.Printf(
 		includeGID("Start transfer $%d from %d to %d\n"),
 		amount, a0, a1,
@@ -183,27 +246,38 @@ func transfer(
 	txm.Add("bank1", f1)
 	var avail int
 	err := f0.PgTx().QueryRowContext(ctx, "SELECT balance FROM account WHERE id = $1 FOR UPDATE", a0).Scan(&avail)
-	f0.Trace(includeGID("Selected balance = %d err = %+v\n"), avail, err)
+	f0.Trace("Selected balance = %d err = %+v", avail, err)
 	if err != nil {
+		outcome = abortReason(err)
 		return true
 	}
 	if avail < amount {
+		outcome = "insufficient funds"
 		fmt.Println(includeGID("Insufficient funds"))
+		f0.SetAbortReason("Insufficient funds")
+		f1.SetAbortReason("Insufficient funds")
 		txm.Abort("Insufficient funds")
 		return false
 	}
 	_, err = f0.PgTx().ExecContext(ctx, "UPDATE account SET balance = balance - $1 WHERE id = $2", amount, a0)
-	f0.Trace(includeGID("debited balance, err = %+v\n"), err)
+	f0.Trace("debited balance, err = %+v", err)
 	if err != nil {
+		outcome = abortReason(err)
 		return true
 	}
 	_, err = f1.PgTx().ExecContext(ctx, "UPDATE account SET balance = balance + $1 WHERE id = $2", amount, a1)
-	f1.Trace(includeGID("Credited balance, err = %+v\n"), err)
+	f1.Trace("Credited balance, err = %+v", err)
 	if err != nil {
+		outcome = abortReason(err)
 		return true
 	}
 	err = txm.Commit()
+	if err != nil {
+		outcome = "commit failed: " + abortReason(err)
+	}
 	if err == nil {
+		recordPreparedWindow(f0)
+		recordPreparedWindow(f1)
 		fmt.Printf(includeGID("Commited transfer of $%d\n"), amount)
 	}
 	return false
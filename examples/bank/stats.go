@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/williammoran/txmpg/v2"
+)
+
+// outcomeCommitted is the outcome of a successful
+// transfer; any other outcome is an abort reason
+const outcomeCommitted = "committed"
+
+// sample is the result of one transfer attempt
+type sample struct {
+	start   time.Time
+	latency time.Duration
+	outcome string
+}
+
+// samples collects the result of every transfer attempt,
+// including those that are retried
+var samples struct {
+	sync.Mutex
+	s []sample
+}
+
+// recordSample saves the outcome of a transfer attempt
+// that started at start
+func recordSample(start time.Time, outcome string) {
+	samples.Lock()
+	defer samples.Unlock()
+	samples.s = append(samples.s, sample{
+		start:   start,
+		latency: time.Since(start),
+		outcome: outcome,
+	})
+}
+
+// abortReason names the reason for a failed transfer
+// attempt, using the SQLSTATE where there is one
+func abortReason(err error) string {
+	switch txmpg.SQLState(err) {
+	case "40P01":
+		return "deadlock"
+	case "40001":
+		return "serialization failure"
+	case "57014":
+		return "query canceled"
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	return "error"
+}
+
+// printSummary prints the number of commits, their
+// throughput over elapsed and latency percentiles, and
+// the aborts by reason
+func printSummary(elapsed time.Duration) {
+	samples.Lock()
+	defer samples.Unlock()
+	var latencies []time.Duration
+	aborts := map[string]int{}
+	for _, s := range samples.s {
+		if s.outcome == outcomeCommitted {
+			latencies = append(latencies, s.latency)
+			continue
+		}
+		aborts[s.outcome]++
+	}
+	fmt.Printf(
+		"%d attempts, %d commits in %s (%.1f commits/s)\n",
+		len(samples.s), len(latencies), elapsed.Round(time.Millisecond),
+		float64(len(latencies))/elapsed.Seconds(),
+	)
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		fmt.Printf(
+			"Begin to commit p50: %s p95: %s p99: %s max: %s\n",
+			percentile(latencies, 50), percentile(latencies, 95),
+			percentile(latencies, 99), latencies[len(latencies)-1],
+		)
+	}
+	reasons := make([]string, 0, len(aborts))
+	for reason := range aborts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	fmt.Printf("Aborts: %d", len(samples.s)-len(latencies))
+	for _, reason := range reasons {
+		fmt.Printf(", %s: %d", reason, aborts[reason])
+	}
+	fmt.Println()
+	fmt.Printf("Deadlocks: %d\n", aborts["deadlock"])
+}
+
+// percentile returns the p'th percentile of sorted
+func percentile(sorted []time.Duration, p int) time.Duration {
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+// writeCSV writes every sample to path, one row per
+// transfer attempt, for offline analysis
+func writeCSV(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+	w.Write([]string{"start", "latency_us", "outcome"})
+	samples.Lock()
+	for _, s := range samples.s {
+		w.Write([]string{
+			s.start.Format(time.RFC3339Nano),
+			strconv.FormatInt(s.latency.Microseconds(), 10),
+			s.outcome,
+		})
+	}
+	samples.Unlock()
+	w.Flush()
+	err = w.Error()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/williammoran/txmpg/v2"
+)
+
+// This example walks through recovering prepared
+// transactions left behind when a coordinator crashes
+// between PREPARE and COMMIT PREPARED. It uses decision
+// records (see Finalizer2P.RecordDecision()): bank0 is the
+// decider, so a transfer is committed after a crash if
+// and only if bank0 committed.
+
+// Example command lines, which use the same databases as
+// examples/bank (max_prepared_transactions must be > 0):
+// * Crash after both databases prepared, then recover.
+//   Recovery rolls both back.
+// ./recovery -0 "user=postgres dbname=bank0" -1 "user=postgres dbname=bank1" -crash prepared
+// ./recovery -0 "user=postgres dbname=bank0" -1 "user=postgres dbname=bank1"
+// * Crash after bank0 committed, then recover. Recovery
+//   commits bank1.
+// ./recovery -0 "user=postgres dbname=bank0" -1 "user=postgres dbname=bank1" -crash decided
+// ./recovery -0 "user=postgres dbname=bank0" -1 "user=postgres dbname=bank1"
+
+const decisionTable = "txmpg_decision"
+
+func main() {
+	cs0 := flag.String("0", "", "first database connection")
+	cs1 := flag.String("1", "", "second database connection")
+	crash := flag.String("crash", "", "Exit after the transfer is \"prepared\" or \"decided\"")
+	flag.Parse()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c0 := connect(*cs0)
+	defer c0.Close()
+	c1 := connect(*cs1)
+	defer c1.Close()
+	step("Creating the decision table in bank0")
+	_, err := c0.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+decisionTable+` (
+		key text PRIMARY KEY,
+		decided timestamptz NOT NULL DEFAULT now()
+	)`)
+	check(err)
+	if *crash == "" {
+		recoverOrphans(ctx, c0, c1)
+		return
+	}
+	transfer(ctx, c0, c1, *crash)
+}
+
+// transfer runs a transfer, exiting at the point chosen
+// by crash as if the process had died there
+func transfer(ctx context.Context, c0, c1 *sql.DB, crash string) {
+	key := uuid.New().String()
+	step("Starting transfer %s", key)
+	f0 := txmpg.NewFinalizer2P(ctx, "bank0", c0, txmpg.WithCorrelationID(key))
+	f1 := txmpg.NewFinalizer2P(ctx, "bank1", c1, txmpg.WithCorrelationID(key))
+	f0.RecordDecision(decisionTable, key)
+	f1.SetDecider(f0)
+	_, err := f0.PgTx().ExecContext(ctx, "UPDATE account SET balance = balance - 10 WHERE id = 1")
+	check(err)
+	_, err = f1.PgTx().ExecContext(ctx, "UPDATE account SET balance = balance + 10 WHERE id = 1")
+	check(err)
+	check(f0.Finalize())
+	step("bank0 prepared %s", f0.GID())
+	check(f1.Finalize())
+	step("bank1 prepared %s", f1.GID())
+	if crash == "prepared" {
+		step("Crashing before the decision is made")
+		os.Exit(1)
+	}
+	check(f0.Commit())
+	step("bank0 committed, so the decision to commit is recorded")
+	if crash == "decided" {
+		step("Crashing before bank1 commits")
+		os.Exit(1)
+	}
+	check(f1.Commit())
+	step("bank1 committed")
+}
+
+// recoverOrphans lists the prepared transactions on both
+// databases and resolves them from the decision table
+func recoverOrphans(ctx context.Context, c0, c1 *sql.DB) {
+	for name, db := range map[string]*sql.DB{"bank0": c0, "bank1": c1} {
+		list, err := txmpg.ListPrepared(ctx, db, "")
+		check(err)
+		step("%s has %d prepared transactions", name, len(list))
+		for _, p := range list {
+			step("  %s prepared %s ago in %s, correlation ID %q",
+				p.GID, p.Age().Round(time.Second), p.Database, p.CorrelationID)
+		}
+	}
+	step("Resolving them from the decision table")
+	report, err := txmpg.RecoverDecisions(ctx, c0, decisionTable, []*sql.DB{c0, c1})
+	check(err)
+	for _, r := range report.Results {
+		if r.Err != nil {
+			step("  %s: %s failed: %s", r.Tx.GID, r.Decision, r.Err.Error())
+			continue
+		}
+		step("  %s: %s", r.Tx.GID, r.Decision)
+	}
+	step("Recovered %d, %d failed", len(report.Results), len(report.Failed()))
+}
+
+// connect just connects using the passed connection
+// string or panic()
+func connect(cs string) *sql.DB {
+	conn, err := sql.Open("postgres", cs)
+	check(err)
+	return conn
+}
+
+// step prints what the example is doing
+func step(format string, args ...interface{}) {
+	fmt.Printf(format+"\n", args...)
+}
+
+// check exits if err is set
+func check(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,15 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+)
+
+// BeginSQLDriver begins a DriverFinalizer on a
+// database/sql pool, so that the external tests can run
+// the driver modules' engine without a driver module
+func BeginSQLDriver(
+	ctx context.Context, name string, pool *sql.DB, twoPhase bool, opts ...Option,
+) (*DriverFinalizer, error) {
+	return BeginDriver(ctx, name, sqlPool{pool}, twoPhase, opts...)
+}
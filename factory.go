@@ -0,0 +1,63 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+)
+
+// NewFactory creates a Factory that constructs finalizers
+// on pool with the supplied name and default options
+func NewFactory(name string, pool *sql.DB, opts ...Option) *Factory {
+	return &Factory{
+		name: name,
+		pool: pool,
+		opts: append([]Option(nil), opts...),
+	}
+}
+
+// Factory carries the pool, name and default options
+// needed to construct finalizers, so they don't have to
+// be repeated at every construction site.
+// A Factory is never modified after construction, so it
+// is safe for concurrent use from any number of
+// goroutines.
+type Factory struct {
+	name string
+	pool *sql.DB
+	opts []Option
+}
+
+// Name returns the name given to finalizers created by
+// this factory
+func (f *Factory) Name() string {
+	return f.name
+}
+
+// Pool returns the connection pool finalizers are created
+// on
+func (f *Factory) Pool() *sql.DB {
+	return f.pool
+}
+
+// Begin starts a new transaction managed by a single
+// phase Finalizer. Any opts are applied after the
+// factory's defaults.
+func (f *Factory) Begin(ctx context.Context, opts ...Option) (*Finalizer, error) {
+	return newFinalizer(ctx, f.name, f.pool, f.config(opts))
+}
+
+// Begin2P starts a new transaction managed by a 2-phase
+// Finalizer2P. Any opts are applied after the factory's
+// defaults.
+func (f *Factory) Begin2P(ctx context.Context, opts ...Option) (*Finalizer2P, error) {
+	return newFinalizer2P(ctx, f.name, f.pool, f.config(opts))
+}
+
+// config combines the factory's defaults with per call
+// options
+func (f *Factory) config(opts []Option) config {
+	all := make([]Option, 0, len(f.opts)+len(opts))
+	all = append(all, f.opts...)
+	all = append(all, opts...)
+	return newConfig(all)
+}
@@ -0,0 +1,16 @@
+package txmpg
+
+import (
+	"testing"
+
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+// fakeFactory returns a Factory on a new fake server,
+// which is closed when the test ends
+func fakeFactory(t testing.TB, name string, opts ...Option) (*fakepg.Server, *Factory) {
+	t.Helper()
+	server, pool := fakepg.Open()
+	t.Cleanup(func() { pool.Close() })
+	return server, NewFactory(name, pool, opts...)
+}
@@ -0,0 +1,61 @@
+package txmpg
+
+// FaultPoint names a place where a FaultInjector can make
+// a finalizer fail
+type FaultPoint string
+
+const (
+	// FaultBeforePrepare is just before PREPARE
+	// TRANSACTION. An error is handled as if PREPARE
+	// failed.
+	FaultBeforePrepare FaultPoint = "before_prepare"
+	// FaultAfterPrepare is just after PREPARE
+	// TRANSACTION succeeded. An error is handled as if
+	// PREPARE failed, so the prepared transaction is left
+	// on the server, as if the reply had been lost.
+	FaultAfterPrepare FaultPoint = "after_prepare"
+	// FaultBeforeCommitPrepared is just before COMMIT
+	// PREPARED. An error is handled as if COMMIT PREPARED
+	// failed; one without a SQLSTATE makes the outcome in
+	// doubt.
+	FaultBeforeCommitPrepared FaultPoint = "commit_prepared"
+	// FaultAfterCommitPrepared is just after COMMIT
+	// PREPARED succeeded. An error is handled as if
+	// COMMIT PREPARED failed, although it committed.
+	FaultAfterCommitPrepared FaultPoint = "after_commit_prepared"
+	// FaultBeforeRollbackPrepared is just before each
+	// attempt at ROLLBACK PREPARED
+	FaultBeforeRollbackPrepared FaultPoint = "rollback_prepared"
+	// FaultBeforeCommit is just before a Finalizer
+	// commits
+	FaultBeforeCommit FaultPoint = "commit"
+)
+
+// FaultInjector makes finalizers fail at chosen points,
+// to test how applications handle failures that are hard
+// to cause with a real server. Inject is called at each
+// FaultPoint with the finalizer's GID; returning an error
+// makes the finalizer behave as if the statement at that
+// point had failed with it. Inject may also panic or
+// sleep. It is only called if set with
+// WithFaultInjector(), which should never happen outside
+// tests. txmpgtest.FaultScript is an implementation.
+type FaultInjector interface {
+	Inject(point FaultPoint, gid string) error
+}
+
+// WithFaultInjector installs a FaultInjector. It is for
+// testing only.
+func WithFaultInjector(fi FaultInjector) Option {
+	return func(c *config) {
+		c.faults = fi
+	}
+}
+
+// inject calls the FaultInjector, if there is one
+func (c *config) inject(point FaultPoint, gid string) error {
+	if c.faults == nil {
+		return nil
+	}
+	return c.faults.Inject(point, gid)
+}
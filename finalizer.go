@@ -3,174 +3,58 @@ package txmpg
 import (
 	"context"
 	"database/sql"
-	"fmt"
-	"log"
-	"runtime"
-
-	"github.com/lib/pq"
-	"github.com/williammoran/txmanager/v2"
 )
 
 // NewFinalizer is a constructor for a Postgres
 // transaction driver
 func NewFinalizer(
-	ctx context.Context, name string, cPool *sql.DB,
+	ctx context.Context, name string, cPool *sql.DB, opts ...Option,
 ) *Finalizer {
-	tx, err := cPool.BeginTx(ctx, nil)
-	if err != nil {
-		panic(err)
-	}
-	var id int64
-	err = tx.QueryRowContext(ctx, "SELECT txid_current()").Scan(&id)
+	finalizer, err := newFinalizer(ctx, name, cPool, newConfig(opts))
 	if err != nil {
 		panic(err)
 	}
-	var pid int64
-	err = tx.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid)
-	if err != nil {
-		panic(err)
-	}
-	finalizer := Finalizer{
-		ctx:          ctx,
-		name:         name,
-		TX:           tx,
-		serverTXID:   id,
-		serverConnID: pid,
-	}
-	return &finalizer
-}
-
-// Finalizer manages transactions on a PostgreSQL server
-type Finalizer struct {
-	ctx             context.Context
-	logger          *log.Logger
-	name            string
-	TX              *sql.Tx
-	serverTXID      int64
-	serverConnID    int64
-	id              string
-	deferredCommits []func() error
-}
-
-// SetLogger sets the logger that all status messages will
-// be delivered to
-func (m *Finalizer) SetLogger(l *log.Logger) {
-	m.logger = l
-}
-
-// PgTx returns the underlying SQL transaction object
-func (m *Finalizer) PgTx() *sql.Tx {
-	return m.TX
-}
-
-// Defer registers a function to execute at Finalize time
-func (m *Finalizer) Defer(exec func() error) {
-	m.Trace("Defer()")
-	m.deferredCommits = append(m.deferredCommits, exec)
-}
-
-// Finalize executes any deferred commits
-func (m *Finalizer) Finalize() error {
-	for _, commit := range m.deferredCommits {
-		err := commit()
-		if err != nil {
-			return m.finalizerError(
-				txmanager.WrapError(
-					err, "Running deferred commits",
-				))
-		}
-	}
-	return nil
+	return finalizer
 }
 
-// Commit finishes the transaction
-func (m *Finalizer) Commit() error {
-	var status string
-	err := m.TX.QueryRow("SELECT txid_status($1)", m.serverTXID).Scan(&status)
+// newFinalizer is the error returning implementation of
+// NewFinalizer
+func newFinalizer(
+	ctx context.Context, name string, cPool *sql.DB, cfg config,
+) (*Finalizer, error) {
+	finalizer := &Finalizer{}
+	m, err := newEngine(ctx, name, sqlPool{cPool}, false, cfg, finalizer)
 	if err != nil {
-		return txmanager.WrapError(err, "Commit() failed to get txid_status()")
-	}
-	m.Trace("transaction status at Commit() '%s'", status)
-	if status != "in progress" {
-		return fmt.Errorf("Commit on TX in status '%s'", status)
-	}
-	err = m.TX.Commit()
-	if err != nil {
-		return txmanager.WrapError(err, "Failed to commit")
-	}
-	m.Trace("Transaction committed")
-	return nil
-}
-
-// Abort rolls back the transaction
-// Abort is a NOOP if the transaction is already comitted,
-// so it's good practice to defer it
-func (m *Finalizer) Abort() {
-	var status string
-	err := m.TX.QueryRow("SELECT txid_status($1)", m.serverTXID).Scan(&status)
-	m.Trace("transaction status at Abort() '%s'", status)
-	if status == "in progress" {
-		err = m.TX.Rollback()
-		if err != nil {
-			ctxErr := m.ctx.Err()
-			if ctxErr == context.DeadlineExceeded || ctxErr == context.Canceled {
-				// If the context was cancelled for any
-				// reason, the transaction is already
-				// rolled back by the driver
-				return
-			}
-			m.panicf("Failed to roll back", err)
-		}
+		return nil, err
 	}
+	finalizer.engine = m
+	return finalizer, nil
 }
 
-// finalizerError is a helper to include detailed
-// information in errors
-func (m *Finalizer) finalizerError(err error) *txmanager.Error {
-	return txmanager.WrapError(
-		err,
-		fmt.Sprintf(
-			"TX: %s PGTXID: %d PGPID: %d message: %s",
-			m.id, m.serverTXID, m.serverConnID, err.Error(),
-		),
-	)
+// Finalizer manages transactions on a PostgreSQL server.
+// A Finalizer may be shared between goroutines: Defer(),
+// PgTx() and the accessors are safe to call concurrently
+// with each other and with Finalize(), Commit() and
+// Abort(), which are serialized. If Commit() and Abort()
+// race, whichever runs first wins: a later Abort() does
+// nothing and a later Commit() returns ErrAborted.
+// Deferred commits must not call Finalize(), Commit() or
+// Abort().
+type Finalizer struct {
+	sqlFinalizer
 }
 
-// panicf includes detailed information in the rare event
-// that this finalizer encounters an error condition that
-// it can't manage.
-func (m *Finalizer) panicf(msg string, err error, args ...interface{}) {
-	_, f, l, _ := runtime.Caller(1)
-	log.Printf("panicf called from %s:%d", f, l)
-	pqerr, ok := err.(*pq.Error)
-	if ok {
-		m.Trace("pq.Error: %+v", pqerr)
-	} else {
-		m.Trace("%T: %+v", err, err)
-	}
-	message := fmt.Sprintf(msg, args...)
-	if err != nil {
-		message = fmt.Sprintf("%s Error: %s", message, err.Error())
-	}
-	ctxErr := m.ctx.Err()
-	if ctxErr != nil {
-		panic(ctxErr)
-	}
-	log.Panicf(
-		"PANIC: TX: %s PGTXID: %d PGPID: %d message: %s",
-		m.id, m.serverTXID, m.serverConnID, message,
-	)
+// sqlFinalizer is what Finalizer and Finalizer2P add to
+// the engine for database/sql
+type sqlFinalizer struct {
+	*engine
 }
 
-// Trace logs a message with details about the IDs
-// associated with the finalizer
-func (m *Finalizer) Trace(format string, args ...interface{}) {
-	if m.logger == nil {
-		return
-	}
-	message := fmt.Sprintf(format, args...)
-	m.logger.Printf(
-		"trace: TX: %s PGTXID: %d PGPID: %d message: %s",
-		m.id, m.serverTXID, m.serverConnID, message,
-	)
+// PgTx returns the underlying SQL transaction object.
+// It returns nil once the transaction of a Finalizer has
+// been submitted to an AsyncCommitter, or that of a
+// Finalizer2P has been prepared by Finalize().
+func (m sqlFinalizer) PgTx() *sql.Tx {
+	tx, _ := m.transaction("PgTx()").(sqlTx)
+	return tx.tx
 }
@@ -3,15 +3,6 @@ package txmpg
 import (
 	"context"
 	"database/sql"
-	"errors"
-	"fmt"
-	"log"
-	"runtime"
-	"time"
-
-	"github.com/google/uuid"
-	"github.com/lib/pq"
-	"github.com/williammoran/txmanager/v2"
 )
 
 // NewFinalizer2P is a constructor for a Postgres
@@ -22,189 +13,70 @@ import (
 // management requirements of prepared transactions
 // and 2-phase commit or you will have difficulty
 // recovering when something goes wrong.
+// NewFinalizer2P panics with ErrPreparedTransactionsDisabled
+// if the server does not allow prepared transactions.
 func NewFinalizer2P(
-	ctx context.Context, name string, cPool *sql.DB,
+	ctx context.Context, name string, cPool *sql.DB, opts ...Option,
 ) *Finalizer2P {
-	tx, err := cPool.BeginTx(ctx, nil)
+	finalizer, err := newFinalizer2P(ctx, name, cPool, newConfig(opts))
 	if err != nil {
 		panic(err)
 	}
-	var id int64
-	err = tx.QueryRowContext(ctx, "SELECT txid_current()").Scan(&id)
-	if err != nil {
-		panic(err)
-	}
-	var pid int64
-	err = tx.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&pid)
+	return finalizer
+}
+
+// newFinalizer2P is the error returning implementation of
+// NewFinalizer2P
+func newFinalizer2P(
+	ctx context.Context, name string, cPool *sql.DB, cfg config,
+) (*Finalizer2P, error) {
+	finalizer := &Finalizer2P{}
+	m, err := newEngine(ctx, name, sqlPool{cPool}, true, cfg, finalizer)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	finalizer := Finalizer2P{
-		ctx:          ctx,
-		pool:         cPool,
-		name:         name,
-		TX:           tx,
-		serverTXID:   id,
-		serverConnID: pid,
-	}
-	return &finalizer
+	finalizer.engine = m
+	return finalizer, nil
 }
 
 // Finalizer2P manages transactions on a PostgreSQL
 // server using prepared transactions. Ensure that you
 // understand how to set up and manage your server for
-// prepared transactions before using this finalizer
+// prepared transactions before using this finalizer.
+// A Finalizer2P may be shared between goroutines under
+// the same rules as a Finalizer.
 type Finalizer2P struct {
-	ctx             context.Context
-	logger          *log.Logger
-	name            string
-	pool            *sql.DB
-	TX              *sql.Tx
-	serverTXID      int64
-	serverConnID    int64
-	id              string
-	deferredCommits []func() error
-}
-
-// SetLogger sets the logger that all status messages will
-// be delivered to
-func (m *Finalizer2P) SetLogger(l *log.Logger) {
-	m.logger = l
-}
-
-// PgTx returns the underlying SQL transaction object
-func (m *Finalizer2P) PgTx() *sql.Tx {
-	return m.TX
+	sqlFinalizer
 }
 
-// Defer registers a function to execute at Finalize time
-func (m *Finalizer2P) Defer(exec func() error) {
-	m.Trace("Defer()")
-	m.deferredCommits = append(m.deferredCommits, exec)
+// GID returns the global identifier of the prepared
+// transaction, or an empty string if the transaction has
+// not been prepared. If Abort() fails after Finalize(),
+// this identifies the prepared transaction that was left
+// on the server.
+func (m *Finalizer2P) GID() string {
+	return m.gid()
 }
 
-// Finalize sets up a prepared transaction. If Finalize
-// returns without error, then all data changes have been
-// written to disk on the PostgreSQL server and will not
-// be lost in the event of a crash of the server. However,
-// if Commit() is not called, the changes will not be
-// visible until the prepared transaction is commited
-// manually. This finalizer does not check for orphaned
-// prepared transactions, so be aware that extra DB
-// administration may be necessary.
-func (m *Finalizer2P) Finalize() error {
-	for _, commit := range m.deferredCommits {
-		err := commit()
-		if err != nil {
-			return m.finalizerError(
-				txmanager.WrapError(
-					err, "Running deferred commits",
-				))
-		}
-	}
-	m.id = uuid.New().String()
-	m.Trace("Create Finalizer2P ID")
-	_, err := m.TX.Exec(fmt.Sprintf("PREPARE TRANSACTION '%s'", m.id))
-	if err != nil {
-		defer func() { m.id = "" }()
-		return m.finalizerError(
-			txmanager.WrapError(err, "Doing PREPARE"),
-		)
-	}
-	m.Trace("Transaction prepared")
-	m.TX = nil
-	return nil
-}
-
-// Commit finishes the transaction by committing the
-// prepared transaction
-func (m *Finalizer2P) Commit() error {
-	if m.TX != nil {
-		return errors.New("Commit on non-finalized transaction")
-	}
-	_, err := m.pool.Exec(fmt.Sprintf("COMMIT PREPARED '%s'", m.id))
-	if err != nil {
-		m.Trace("COMMIT PREPARED error: %s", err.Error())
-		pqerr, casted := err.(*pq.Error)
-		if casted {
-			m.Trace("COMMIT PREPARED error %+#v", pqerr)
-		}
-		ctxErr := m.ctx.Err()
-		if ctxErr != nil {
-			return ctxErr
-		}
-		return txmanager.WrapError(err, "Failed to commit prepared")
-	}
-	m.Trace("Transaction committed")
-	return nil
-}
-
-// Abort rolls back the transaction
-// Abort is a NOOP if the transaction is already committed
-// so it's good practice to defer it to ensure transactions
-// are never left hanging
-func (m *Finalizer2P) Abort() {
-	if m.TX != nil {
-		m.Trace("Abort() doing TX.Rollback()")
-		err := m.TX.Rollback()
-		if err != nil {
-			if err != sql.ErrTxDone {
-				m.panicf("Failed Rollback()", err)
-			}
-			m.Trace("Abort() on failed transaction")
-		}
-		return
-	}
-	if m.id == "" {
-		m.Trace("Abort() on transaction that was never finalized")
-		return
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	_, err := m.pool.ExecContext(ctx, fmt.Sprintf("ROLLBACK PREPARED '%s'", m.id))
-	if err != nil {
-		m.panicf("Failed ROLLBACK PREPARED", err)
-	}
-	m.Trace("ROLLBACK PREPARED")
-}
-
-// finalizerError is a helper to include detailed
-// information in errors
-func (m *Finalizer2P) finalizerError(err error) *txmanager.Error {
-	return txmanager.WrapError(
-		err,
-		fmt.Sprintf(
-			"TX: %s PGTXID: %d PGPID: %d message: %s",
-			m.id, m.serverTXID, m.serverConnID, err.Error(),
-		),
-	)
-}
-
-// panicf includes detailed information in the rare event
-// that this finalizer encounters an error condition that
-// it can't manage.
-func (m *Finalizer2P) panicf(msg string, err error, args ...interface{}) {
-	_, f, l, _ := runtime.Caller(1)
-	log.Printf("panicf called from %s:%d", f, l)
-	message := fmt.Sprintf(msg, args...)
-	if err != nil {
-		message = fmt.Sprintf("%s Error: %s", message, err.Error())
-	}
-	log.Panicf(
-		"TX: %s PGTXID: %d PGPID: %d message: %s",
-		m.id, m.serverTXID, m.serverConnID, message,
-	)
-}
-
-// Trace logs a message with details about the IDs
-// associated with the finalizer
-func (m *Finalizer2P) Trace(format string, args ...interface{}) {
-	if m.logger == nil {
-		return
-	}
-	message := fmt.Sprintf(format, args...)
-	m.logger.Printf(
-		"TX: %s PGTXID: %d PGPID: %d message: %s",
-		m.id, m.serverTXID, m.serverConnID, message,
-	)
+// CommitContext finishes the transaction by committing
+// the prepared transaction, using ctx to bound the
+// COMMIT PREPARED statement. If ctx is already finished,
+// the commit is not attempted and ctx.Err() is returned.
+// If the connection is lost or ctx finishes while
+// COMMIT PREPARED is running, the outcome is checked on a
+// fresh connection: ErrCommitConfirmedGone means the
+// prepared transaction is gone, ErrCommitNotApplied means
+// it is still there and Commit() can be retried, and if
+// the check fails the error wraps an *InDoubtError,
+// which errors.As() finds. All of them wrap the driver's
+// error and ctx.Err(). Any other server error means the
+// commit failed.
+// Calling Commit again after it succeeded returns
+// ErrAlreadyCommitted without contacting the server.
+// If this finalizer is the decider and a participant's
+// Commit() already committed it, the next Commit() returns
+// nil, so that txmanager doesn't treat the commit it
+// expects to do as a failure.
+func (m *Finalizer2P) CommitContext(ctx context.Context) error {
+	return m.commitPrepared(ctx)
 }
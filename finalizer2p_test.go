@@ -0,0 +1,622 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+// commitMetrics records the durations passed to
+// Committed()
+type commitMetrics struct {
+	nopMetrics
+	mu           sync.Mutex
+	sincePrepare []time.Duration
+}
+
+func (m *commitMetrics) Committed(name string, twoPhase bool, sinceBegin, sincePrepare time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sincePrepare = append(m.sincePrepare, sincePrepare)
+}
+
+// isPrepared reports whether gid is in pg_prepared_xacts
+func isPrepared(t *testing.T, pool *sql.DB, gid string) bool {
+	t.Helper()
+	var exists bool
+	err := pool.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM pg_prepared_xacts WHERE gid = $1)", gid,
+	).Scan(&exists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exists
+}
+
+// checkReadOnlySkipPrepare checks that a transaction on
+// pool that never wrote is committed by Finalize() without
+// PREPARE TRANSACTION, and that one that ran write, which
+// must assign a transaction ID, is prepared. committed,
+// if not nil, returns the number of COMMIT PREPARED sent.
+func checkReadOnlySkipPrepare(t *testing.T, pool *sql.DB, write string, committed func() int) {
+	for _, wrote := range []bool{false, true} {
+		name := "read-only"
+		if wrote {
+			name = "wrote"
+		}
+		t.Run(name, func(t *testing.T) {
+			gid := fmt.Sprintf("txmpg-test-read-only-%d", time.Now().UnixNano())
+			f, err := newFinalizer2P(context.Background(), "reports", pool, newConfig([]Option{
+				WithReadOnlySkipPrepare(true), WithLazyTxid(true), WithGID(gid),
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Abort()
+			if wrote {
+				_, err = f.PgTx().Exec(write)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			before := 0
+			if committed != nil {
+				before = committed()
+			}
+			err = f.Finalize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prepared := isPrepared(t, pool, gid); prepared != wrote {
+				t.Errorf("%s in pg_prepared_xacts: %v, want %v", gid, prepared, wrote)
+			}
+			err = f.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isPrepared(t, pool, gid) {
+				t.Errorf("%s still prepared after Commit()", gid)
+			}
+			if committed == nil {
+				return
+			}
+			if sent := committed() - before; (sent == 1) != wrote || sent > 1 {
+				t.Errorf("%d COMMIT PREPARED sent", sent)
+			}
+		})
+	}
+}
+
+func TestReadOnlySkipPrepare(t *testing.T) {
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	checkReadOnlySkipPrepare(t, pool, "INSERT INTO reports VALUES (1)", func() int {
+		return server.Count("COMMIT PREPARED")
+	})
+}
+
+func TestReadOnlySkipPrepareServer(t *testing.T) {
+	// The server's statements can't be counted
+	checkReadOnlySkipPrepare(t, serverDB(t), "SELECT txid_current()", nil)
+}
+
+func TestReadOnlySkipPrepareDurations(t *testing.T) {
+	metrics := &commitMetrics{}
+	var warnings []string
+	_, factory := fakeFactory(
+		t, "reports",
+		WithReadOnlySkipPrepare(true),
+		WithWarnPreparedAfter(time.Second),
+		WithMetrics(metrics),
+		WithTraceHook(func(ev TraceEvent) {
+			if ev.Level >= LevelWarn {
+				warnings = append(warnings, ev.Message)
+			}
+		}),
+	)
+	f, err := factory.Begin2P(context.Background(), WithLazyTxid(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	err = f.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.GID() != "" {
+		t.Fatalf("read-only transaction was prepared as %s", f.GID())
+	}
+	err = f.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics.sincePrepare) != 1 || metrics.sincePrepare[0] != 0 {
+		t.Errorf("Committed() sincePrepare = %v, want [0]", metrics.sincePrepare)
+	}
+	if d := f.Stats().PrepareToCommit; d != 0 {
+		t.Errorf("Stats().PrepareToCommit = %s, want 0", d)
+	}
+	for _, w := range warnings {
+		if strings.Contains(w, "prepared for") {
+			t.Errorf("unexpected warning %q", w)
+		}
+	}
+}
+
+func TestPreparedLifetimeRacesCommit(t *testing.T) {
+	server, factory := fakeFactory(t, "orders")
+	for i := 0; i < 200; i++ {
+		lifetime := time.Duration(i%20) * 10 * time.Microsecond
+		f, err := factory.Begin2P(context.Background(), WithMaxPreparedLifetime(lifetime+time.Nanosecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Finalize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		gid := f.GID()
+		time.Sleep(lifetime)
+		err = f.Commit()
+		committed := contains(server.Committed(), gid)
+		rolledBack := contains(server.RolledBack(), gid)
+		switch {
+		case committed && rolledBack:
+			t.Fatalf("%s was committed and rolled back", gid)
+		case err == nil && !committed:
+			t.Fatalf("Commit() succeeded without committing %s", gid)
+		case errors.Is(err, ErrExpired) && !rolledBack:
+			t.Fatalf("Commit() = %v without rolling back %s", err, gid)
+		case err != nil && !errors.Is(err, ErrExpired):
+			t.Fatalf("Commit() = %v, want nil or ErrExpired", err)
+		}
+	}
+}
+
+// contains reports whether list holds s
+func TestResolvePreparedAlreadyResolved(t *testing.T) {
+	_, pool := fakepg.Open()
+	defer pool.Close()
+	ctx := context.Background()
+	err := finishPrepared(ctx, pool, "missing", true)
+	if !errors.Is(err, ErrAlreadyResolved) || !strings.Contains(err.Error(), "COMMIT PREPARED missing") {
+		t.Errorf("finishPrepared() = %v, want ErrAlreadyResolved with the GID", err)
+	}
+	result := resolvePrepared(ctx, pool, PreparedTx{GID: "missing"}, Rollback)
+	if result.Err != nil {
+		t.Errorf("resolvePrepared() = %v, want success", result.Err)
+	}
+}
+
+func TestPreparedTransactionsCheck(t *testing.T) {
+	ctx := context.Background()
+	server, factory := fakeFactory(t, "orders")
+	t.Cleanup(func() { ForgetServer(factory.Pool()) })
+	const show = "SHOW max_prepared_transactions"
+	server.SetMaxPreparedTransactions(0)
+	_, err := factory.Begin2P(ctx)
+	if !errors.Is(err, ErrPreparedTransactionsDisabled) {
+		t.Fatalf("Begin2P() = %v, want ErrPreparedTransactionsDisabled", err)
+	}
+	// Enabling them is noticed without a restart
+	server.SetMaxPreparedTransactions(10)
+	for i := 0; i < 2; i++ {
+		f, err := factory.Begin2P(ctx)
+		if err != nil {
+			t.Fatalf("Begin2P() = %v after enabling prepared transactions", err)
+		}
+		f.Abort()
+	}
+	if server.Count(show) != 2 {
+		t.Errorf("%s ran %d times, want the enabled setting cached", show, server.Count(show))
+	}
+	// A PREPARE TRANSACTION that finds them disabled
+	// drops the cached setting
+	server.SetMaxPreparedTransactions(0)
+	f, err := factory.Begin2P(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Finalize()
+	f.Abort()
+	if err == nil {
+		t.Fatal("Finalize() succeeded with prepared transactions disabled")
+	}
+	_, err = factory.Begin2P(ctx)
+	if !errors.Is(err, ErrPreparedTransactionsDisabled) {
+		t.Errorf("Begin2P() = %v after PREPARE failed, want ErrPreparedTransactionsDisabled", err)
+	}
+}
+
+func TestForgetServer(t *testing.T) {
+	ctx := context.Background()
+	server, factory := fakeFactory(t, "orders")
+	const show = "SHOW max_prepared_transactions"
+	for i := 0; i < 2; i++ {
+		f, err := factory.Begin2P(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Abort()
+		ForgetServer(factory.Pool())
+	}
+	if server.Count(show) != 2 {
+		t.Errorf("%s ran %d times, want it checked again after ForgetServer()", show, server.Count(show))
+	}
+}
+
+// cancelAt cancels a context at a fault point, as if it
+// finished while the statement after it was running, and
+// returns the context's error from there
+type cancelAt struct {
+	point  FaultPoint
+	cancel context.CancelFunc
+	ctx    context.Context
+}
+
+func (c cancelAt) Inject(point FaultPoint, gid string) error {
+	if point != c.point {
+		return nil
+	}
+	c.cancel()
+	return c.ctx.Err()
+}
+
+func TestCommitContextFinished(t *testing.T) {
+	server, factory := fakeFactory(t, "orders")
+	f, err := factory.Begin2P(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	err = f.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = f.CommitContext(ctx)
+	if !errors.Is(err, context.Canceled) || errors.Is(err, ErrInDoubt) {
+		t.Fatalf("CommitContext() = %v, want context.Canceled", err)
+	}
+	if server.Count("COMMIT PREPARED") != 0 || len(server.Prepared()) != 1 {
+		t.Fatalf("COMMIT PREPARED sent with a cancelled context")
+	}
+	err = f.Commit()
+	if err != nil {
+		t.Fatalf("Commit() = %v after the cancelled attempt", err)
+	}
+}
+
+func TestCommitContextCancelledDuringCommit(t *testing.T) {
+	tests := []struct {
+		name      string
+		point     FaultPoint
+		want      error
+		committed bool
+	}{
+		{"before the server committed", FaultBeforeCommitPrepared, ErrCommitNotApplied, false},
+		{"after the server committed", FaultAfterCommitPrepared, ErrCommitConfirmedGone, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			server, factory := fakeFactory(
+				t, "orders", WithFaultInjector(cancelAt{point: tt.point, cancel: cancel, ctx: ctx}),
+			)
+			f, err := factory.Begin2P(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Abort()
+			err = f.Finalize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = f.CommitContext(ctx)
+			if !errors.Is(err, tt.want) || !errors.Is(err, context.Canceled) {
+				t.Fatalf("CommitContext() = %v, want %v wrapping context.Canceled", err, tt.want)
+			}
+			if (f.State() == StateCommitted) != tt.committed {
+				t.Errorf("State() = %s", f.State())
+			}
+			if (len(server.Committed()) == 1) != tt.committed {
+				t.Errorf("%d committed on the server", len(server.Committed()))
+			}
+		})
+	}
+}
+
+func TestPrepareFailureLeavesTxForAbort(t *testing.T) {
+	server, factory := fakeFactory(t, "orders", WithPrepareTimeout(time.Second))
+	f, err := factory.Begin2P(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.FailNext("PREPARE TRANSACTION", context.DeadlineExceeded)
+	err = f.Finalize()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Finalize() = %v, want the deadline", err)
+	}
+	if f.GID() != "" || f.State() != StateFailed {
+		t.Errorf("GID() = %q, State() = %s after PREPARE failed", f.GID(), f.State())
+	}
+	f.Abort()
+	if server.Count("ROLLBACK") != 1 || server.Count("ROLLBACK PREPARED") != 0 {
+		t.Errorf("Abort() didn't roll back the open transaction: %q", server.Statements())
+	}
+	if f.State() != StateAborted {
+		t.Errorf("State() = %s after Abort()", f.State())
+	}
+}
+
+// TestPrepareTimeout stalls PREPARE TRANSACTION with a
+// deferred trigger that sleeps, which WithPrepareTimeout()
+// has to cut short
+func TestPrepareTimeout(t *testing.T) {
+	db := serverDB(t)
+	_, err := db.Exec(`
+		DROP TABLE IF EXISTS txmpg_stall;
+		CREATE TABLE txmpg_stall (id int);
+		CREATE OR REPLACE FUNCTION txmpg_stall() RETURNS trigger
+			LANGUAGE plpgsql AS 'BEGIN PERFORM pg_sleep(5); RETURN NULL; END';
+		CREATE CONSTRAINT TRIGGER txmpg_stall AFTER INSERT ON txmpg_stall
+			DEFERRABLE INITIALLY DEFERRED FOR EACH ROW EXECUTE FUNCTION txmpg_stall()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec("DROP TABLE txmpg_stall; DROP FUNCTION txmpg_stall()") })
+	f, err := NewFactory("orders", db, WithPrepareTimeout(200*time.Millisecond)).
+		Begin2P(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.ExecContext(context.Background(), "INSERT INTO txmpg_stall VALUES (1)")
+	if err != nil {
+		f.Abort()
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = f.Finalize()
+	if err == nil {
+		f.Abort()
+		t.Fatal("Finalize() succeeded despite the stall")
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("Finalize() took %s with a 200ms prepare timeout", d)
+	}
+	f.Abort()
+	if f.State() != StateAborted {
+		t.Errorf("State() = %s after Abort()", f.State())
+	}
+}
+
+func TestCommitAlreadyResolvedServer(t *testing.T) {
+	db := serverDB(t)
+	f, err := NewFactory("orders", db).Begin2P(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	_, err = f.ExecContext(context.Background(), "SELECT txid_current()")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("COMMIT PREPARED " + QuoteGID(f.GID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Commit()
+	if !errors.Is(err, ErrAlreadyResolved) || !strings.Contains(err.Error(), f.GID()) {
+		t.Fatalf("Commit() = %v, want ErrAlreadyResolved for %s", err, f.GID())
+	}
+	if f.State() != StateCommitted {
+		t.Errorf("State() = %s", f.State())
+	}
+}
+
+func TestAbortAfterOutOfBandRollback(t *testing.T) {
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	f, err := NewFactory("orders", pool, WithPanicOnAbortFailure(true)).Begin2P(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pool.Exec("ROLLBACK PREPARED " + QuoteGID(f.GID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Abort()
+	if f.State() != StateAborted || f.AbortError() != nil {
+		t.Errorf("State() = %s, AbortError() = %v", f.State(), f.AbortError())
+	}
+	if n := server.Count("ROLLBACK PREPARED"); n != 2 {
+		t.Errorf("ROLLBACK PREPARED sent %d times, want no retries", n)
+	}
+}
+
+func TestAbortAfterOutOfBandRollbackServer(t *testing.T) {
+	db := serverDB(t)
+	f, err := NewFactory("orders", db, WithPanicOnAbortFailure(true)).Begin2P(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.ExecContext(context.Background(), "SELECT txid_current()")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Finalize()
+	if err != nil {
+		f.Abort()
+		t.Fatal(err)
+	}
+	_, err = db.Exec("ROLLBACK PREPARED " + QuoteGID(f.GID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Abort()
+	if f.State() != StateAborted || f.AbortError() != nil {
+		t.Errorf("State() = %s, AbortError() = %v", f.State(), f.AbortError())
+	}
+}
+
+func TestFailedPrepareState(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(server *fakepg.Server)
+		state string
+	}{
+		{"prepared transactions disabled", func(server *fakepg.Server) {
+			server.SetMaxPreparedTransactions(0)
+		}, "55000"},
+		{"deferred constraint violated", func(server *fakepg.Server) {
+			server.FailNext("PREPARE TRANSACTION", fakepg.ServerError("23505", "duplicate key value"))
+		}, "23505"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, factory := fakeFactory(
+				t, "orders", WithPreparedTransactionsCheck(false), WithPanicOnAbortFailure(true),
+			)
+			f, err := factory.Begin2P(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.setup(server)
+			err = f.Finalize()
+			if SQLState(err) != tt.state {
+				t.Fatalf("Finalize() = %v, want SQLSTATE %s", err, tt.state)
+			}
+			if f.State() != StateFailed || f.GID() != "" {
+				t.Errorf("State() = %s, GID() = %q after PREPARE failed", f.State(), f.GID())
+			}
+			err = f.Finalize()
+			if !errors.Is(err, ErrFinalizeFailed) {
+				t.Errorf("second Finalize() = %v, want ErrFinalizeFailed", err)
+			}
+			f.Abort()
+			if f.State() != StateAborted || f.AbortError() != nil {
+				t.Errorf("State() = %s, AbortError() = %v after Abort()", f.State(), f.AbortError())
+			}
+		})
+	}
+}
+
+// TestFailedPrepareStateServer has PREPARE TRANSACTION
+// fail on a deferred unique constraint, which aborts the
+// transaction on the server
+func TestFailedPrepareStateServer(t *testing.T) {
+	db := serverDB(t)
+	_, err := db.Exec(`
+		DROP TABLE IF EXISTS txmpg_unique;
+		CREATE TABLE txmpg_unique (id int UNIQUE DEFERRABLE INITIALLY DEFERRED)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec("DROP TABLE txmpg_unique") })
+	f, err := NewFactory("orders", db, WithPanicOnAbortFailure(true)).Begin2P(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.ExecContext(context.Background(), "INSERT INTO txmpg_unique VALUES (1), (1)")
+	if err != nil {
+		f.Abort()
+		t.Fatal(err)
+	}
+	err = f.Finalize()
+	if SQLState(err) != "23505" {
+		f.Abort()
+		t.Fatalf("Finalize() = %v, want the unique violation", err)
+	}
+	if f.State() != StateFailed {
+		t.Errorf("State() = %s after PREPARE failed", f.State())
+	}
+	if err := f.Finalize(); !errors.Is(err, ErrFinalizeFailed) {
+		t.Errorf("second Finalize() = %v, want ErrFinalizeFailed", err)
+	}
+	f.Abort()
+	if f.State() != StateAborted || f.AbortError() != nil {
+		t.Errorf("State() = %s, AbortError() = %v after Abort()", f.State(), f.AbortError())
+	}
+}
+
+func TestOutstandingPrepared(t *testing.T) {
+	ctx := context.Background()
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	factory := NewFactory("orders", pool)
+	base := OutstandingPrepared()
+	check := func(step string, want int) {
+		t.Helper()
+		if n := OutstandingPrepared() - base; n != want {
+			t.Errorf("after %s, %d outstanding, want %d", step, n, want)
+		}
+	}
+	var fs []*Finalizer2P
+	for i := 0; i < 4; i++ {
+		f, err := factory.Begin2P(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Abort()
+		fs = append(fs, f)
+	}
+	check("Begin2P()", 0)
+	for i, f := range fs {
+		err := f.Finalize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(fmt.Sprintf("Finalize() %d", i), i+1)
+	}
+	err := fs[0].Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("Commit()", 3)
+	fs[1].Abort()
+	check("Abort()", 2)
+	_, err = pool.Exec("COMMIT PREPARED " + QuoteGID(fs[2].GID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs[2].Commit()
+	if !errors.Is(err, ErrAlreadyResolved) {
+		t.Fatalf("Commit() = %v, want ErrAlreadyResolved", err)
+	}
+	check("Commit() of an already committed transaction", 1)
+	_, err = pool.Exec("ROLLBACK PREPARED " + QuoteGID(fs[3].GID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs[3].Abort()
+	check("Abort() of an already rolled back transaction", 0)
+	if len(server.Prepared()) != 0 {
+		t.Errorf("%q still prepared", server.Prepared())
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,348 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+func TestCommitErrorsIdentifyTheFinalizer(t *testing.T) {
+	tests := []struct {
+		name      string
+		statement string
+	}{
+		{"commit", "COMMIT"},
+		{"status check", "SELECT pg_xact_status("},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, factory := fakeFactory(t, "orders")
+			f, err := factory.Begin(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Abort()
+			err = f.Finalize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cause := fakepg.ServerError("40001", "could not serialize access")
+			server.FailNext(tt.statement, cause)
+			err = f.Commit()
+			var txErr *Error
+			if !errors.As(err, &txErr) || !errors.Is(err, cause) {
+				t.Fatalf("Commit() = %#v, want an *Error wrapping the server error", err)
+			}
+			if !strings.Contains(err.Error(), "NAME: orders") {
+				t.Errorf("Commit() error %q doesn't identify the finalizer", err)
+			}
+		})
+	}
+}
+
+func TestFinalizeTwice(t *testing.T) {
+	failed := errors.New("deferred commit failed")
+	tests := []struct {
+		name     string
+		twoPhase bool
+		err      error
+		want     error
+	}{
+		{name: "Finalizer"},
+		{name: "Finalizer2P", twoPhase: true},
+		{name: "failed Finalizer", err: failed, want: ErrFinalizeFailed},
+		{name: "failed Finalizer2P", twoPhase: true, err: failed, want: ErrFinalizeFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, factory := fakeFactory(t, "orders")
+			f := begin(t, factory, tt.twoPhase)
+			defer f.Abort()
+			runs := 0
+			f.Defer(func() error {
+				runs++
+				return tt.err
+			})
+			err := f.Finalize()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("first Finalize() = %v, want %v", err, tt.err)
+			}
+			err = f.Finalize()
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("second Finalize() = %v, want %v", err, tt.want)
+			}
+			if runs != 1 {
+				t.Errorf("deferred commit ran %d times", runs)
+			}
+			if n := server.Count("PREPARE TRANSACTION"); tt.twoPhase && tt.err == nil && n != 1 {
+				t.Errorf("%d PREPARE TRANSACTION statements", n)
+			}
+			if tt.err != nil {
+				return
+			}
+			err = f.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Finalize() after Commit() does nothing either
+			err = f.Finalize()
+			if err != nil || runs != 1 {
+				t.Errorf("Finalize() after Commit() = %v, %d runs", err, runs)
+			}
+		})
+	}
+}
+
+func TestAbortAfterStatusQueryFails(t *testing.T) {
+	var warnings []string
+	server, factory := fakeFactory(t, "orders", WithTraceHook(func(ev TraceEvent) {
+		if ev.Level >= LevelWarn {
+			warnings = append(warnings, ev.Message)
+		}
+	}))
+	f, err := factory.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.FailNext("SELECT pg_xact_status(", errors.New("connection reset by peer"))
+	f.Abort()
+	if server.Count("ROLLBACK") != 1 {
+		t.Errorf("ROLLBACK not sent after the status check failed: %q", server.Statements())
+	}
+	if f.State() != StateAborted || f.AbortError() != nil {
+		t.Errorf("State() = %s, AbortError() = %v", f.State(), f.AbortError())
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "connection reset by peer") {
+		t.Errorf("warnings = %q, want the failed status check", warnings)
+	}
+}
+
+func TestAbortAfterConnectionKilledServer(t *testing.T) {
+	db := serverDB(t)
+	ctx := context.Background()
+	f, err := NewFactory("orders", db).Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := f.Info().PID
+	_, err = db.ExecContext(ctx, "SELECT pg_terminate_backend($1)", pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Abort()
+	if f.State() != StateAborted && f.State() != StateAbortFailed {
+		t.Errorf("State() = %s after Abort()", f.State())
+	}
+	var idle int
+	err = db.QueryRowContext(
+		ctx,
+		"SELECT count(*) FROM pg_stat_activity WHERE pid = $1 AND state LIKE 'idle in transaction%'",
+		pid,
+	).Scan(&idle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idle != 0 {
+		t.Errorf("backend %d left idle in transaction", pid)
+	}
+}
+
+func TestCommitWithFinishedContext(t *testing.T) {
+	tests := []struct {
+		name string
+		want error
+		done func() (context.Context, context.CancelFunc)
+	}{
+		{"cancelled", context.Canceled, func() (context.Context, context.CancelFunc) {
+			return context.WithCancel(context.Background())
+		}},
+		{"deadline", context.DeadlineExceeded, func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 50*time.Millisecond)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, factory := fakeFactory(t, "orders")
+			ctx, cancel := tt.done()
+			defer cancel()
+			f, err := factory.Begin(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Abort()
+			err = f.Finalize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == context.Canceled {
+				cancel()
+			}
+			<-ctx.Done()
+			start := time.Now()
+			err = f.Commit()
+			if time.Since(start) > time.Second {
+				t.Errorf("Commit() took %s", time.Since(start))
+			}
+			var txErr *Error
+			if !errors.As(err, &txErr) || !errors.Is(err, tt.want) {
+				t.Fatalf("Commit() = %v, want an *Error wrapping %v", err, tt.want)
+			}
+			if server.Count("COMMIT") != 0 {
+				t.Error("COMMIT sent with a finished context")
+			}
+		})
+	}
+}
+
+func TestBeginWithFinishedContext(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want error
+	}{
+		{"cancelled", cancelled, context.Canceled},
+		{"deadline", expired, context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		for _, twoPhase := range []bool{false, true} {
+			server, factory := fakeFactory(t, "orders")
+			var err error
+			if twoPhase {
+				_, err = factory.Begin2P(tt.ctx)
+			} else {
+				_, err = factory.Begin(tt.ctx)
+			}
+			var txErr *Error
+			if !errors.Is(err, tt.want) || !errors.As(err, &txErr) {
+				t.Errorf("%s, twoPhase %t: Begin() = %v, want an *Error wrapping %v", tt.name, twoPhase, err, tt.want)
+			}
+			if n := len(server.Statements()); n != 0 {
+				t.Errorf("%s, twoPhase %t: %d statements sent", tt.name, twoPhase, n)
+			}
+		}
+	}
+}
+
+func TestDriverFinishedTransaction(t *testing.T) {
+	tests := []struct {
+		twoPhase bool
+		finish   string
+		op       string
+		want     error
+	}{
+		{false, "cancel", "Commit", context.Canceled},
+		{false, "commit", "Commit", sql.ErrTxDone},
+		{false, "rollback", "Commit", sql.ErrTxDone},
+		{false, "cancel", "Abort", nil},
+		{false, "commit", "Abort", nil},
+		{false, "rollback", "Abort", nil},
+		{true, "cancel", "Finalize", context.Canceled},
+		{true, "commit", "Finalize", sql.ErrTxDone},
+		{true, "rollback", "Finalize", sql.ErrTxDone},
+		{true, "cancel", "Abort", nil},
+		{true, "commit", "Abort", nil},
+		{true, "rollback", "Abort", nil},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("twoPhase %t %s then %s", tt.twoPhase, tt.finish, tt.op), func(t *testing.T) {
+			server, factory := fakeFactory(t, "orders", WithPanicOnAbortFailure(true))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var f lifecycle
+			var pgTx *sql.Tx
+			if tt.twoPhase {
+				f2, err := factory.Begin2P(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f, pgTx = f2, f2.PgTx()
+			} else {
+				f1, err := factory.Begin(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f, pgTx = f1, f1.PgTx()
+			}
+			_, err := f.ExecContext(ctx, "INSERT INTO orders VALUES (1)")
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch tt.finish {
+			case "cancel":
+				cancel()
+			case "commit":
+				err = pgTx.Commit()
+			case "rollback":
+				err = pgTx.Rollback()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch tt.op {
+			case "Finalize":
+				err = f.Finalize()
+			case "Commit":
+				err = f.Finalize()
+				if err == nil {
+					err = f.Commit()
+				}
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("%s() = %v, want %v", tt.op, err, tt.want)
+			}
+			if errors.Is(err, sql.ErrTxDone) && (!errors.Is(err, ErrAborted) || f.State() != StateAborted) {
+				t.Errorf("%s() = %v in state %s, want ErrAborted", tt.op, err, f.State())
+			}
+			f.Abort()
+			if f.State() != StateAborted || f.AbortError() != nil {
+				t.Errorf("State() = %s, AbortError() = %v after Abort()", f.State(), f.AbortError())
+			}
+			if n := server.Count("COMMIT PREPARED"); n != 0 {
+				t.Errorf("%d COMMIT PREPARED", n)
+			}
+		})
+	}
+}
+
+func TestAbortRollsBackWhateverTheStatus(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(server *fakepg.Server)
+	}{
+		{"committed", func(server *fakepg.Server) { server.SetStatus("committed") }},
+		{"aborted", func(server *fakepg.Server) { server.SetStatus("aborted") }},
+		{"status check fails", func(server *fakepg.Server) {
+			server.FailNext("SELECT pg_xact_status(", fakepg.ServerError("42501", "permission denied"))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, factory := fakeFactory(t, "orders", WithPanicOnAbortFailure(true))
+			f, err := factory.Begin(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.setup(server)
+			f.Abort()
+			if server.Count("ROLLBACK") != 1 {
+				t.Errorf("ROLLBACK not sent: %q", server.Statements())
+			}
+			if f.State() != StateAborted {
+				t.Errorf("State() = %s", f.State())
+			}
+			if stats := factory.Pool().Stats(); stats.InUse != 0 || stats.Idle != 1 {
+				t.Errorf("pool has %d connections in use, %d idle", stats.InUse, stats.Idle)
+			}
+		})
+	}
+}
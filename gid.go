@@ -0,0 +1,243 @@
+package txmpg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// gidSeparator separates the UUID from the correlation
+// ID in a generated GID
+const gidSeparator = "_"
+
+// MaxGIDLength is the longest prepared transaction
+// identifier, in bytes, that PostgreSQL accepts
+const MaxGIDLength = 199
+
+// ValidateGID checks that gid can be used as a prepared
+// transaction identifier, returning an error wrapping
+// ErrInvalidGID if not
+func ValidateGID(gid string) error {
+	switch {
+	case gid == "":
+		return fmt.Errorf("%w: empty", ErrInvalidGID)
+	case len(gid) > MaxGIDLength:
+		return fmt.Errorf(
+			"%w: %d bytes is longer than %d", ErrInvalidGID, len(gid), MaxGIDLength,
+		)
+	case !utf8.ValidString(gid):
+		return fmt.Errorf("%w: not valid UTF-8", ErrInvalidGID)
+	case strings.ContainsRune(gid, 0):
+		return fmt.Errorf("%w: contains a NUL byte", ErrInvalidGID)
+	}
+	return nil
+}
+
+// readableGIDPrefix starts the GIDs generated with
+// WithReadableGID()
+const readableGIDPrefix = "txmpg:"
+
+// readableGIDOverhead is the length of a readable GID
+// without the application name and correlation ID: the
+// prefix, 13 digits of milliseconds, the UUID and two
+// colons
+const readableGIDOverhead = len(readableGIDPrefix) + 13 + 36 + 2
+
+// maxReadableCorrelationIDLength is the longest
+// correlation ID that fits in a readable GID, which only
+// leaves room for the application name after it
+const maxReadableCorrelationIDLength = MaxGIDLength - readableGIDOverhead - len(gidSeparator)
+
+// newGID returns the GID for a new prepared transaction
+// of the finalizer called name, with correlationID
+// appended if it isn't empty
+func (c *config) newGID(name, correlationID string) (string, error) {
+	if c.gid != "" {
+		return c.gid, nil
+	}
+	id := uuid.New().String()
+	if c.readableGID {
+		app := c.gidApp
+		if app == "" {
+			app = name
+		}
+		return readableGID(app, c.now(), id, correlationID)
+	}
+	if correlationID != "" {
+		return id + gidSeparator + correlationID, nil
+	}
+	return id, nil
+}
+
+// checkCorrelationID checks that id fits in the GIDs
+// generated by a finalizer, which is two-phase if
+// twoPhase is set
+func (c *config) checkCorrelationID(id string, twoPhase bool) error {
+	err := validateCorrelationID(id)
+	if err != nil {
+		return err
+	}
+	if twoPhase && c.readableGID && c.gid == "" {
+		return checkReadableCorrelationID(id)
+	}
+	return nil
+}
+
+// checkReadableCorrelationID checks that id fits in a
+// readable GID
+func checkReadableCorrelationID(id string) error {
+	if len(id) > maxReadableCorrelationIDLength {
+		return fmt.Errorf(
+			"%w: correlation ID of %d bytes is longer than the %d a readable GID has room for",
+			ErrInvalidGID, len(id), maxReadableCorrelationIDLength,
+		)
+	}
+	return nil
+}
+
+// readableGID formats a GID as
+// txmpg:<app>:<unix-millis>:<uuid>[_<correlationID>].
+// Colons in app are replaced with dashes. If the result
+// would be longer than MaxGIDLength, app is shortened.
+// The correlation ID never is, since recovery looks it
+// up, so an error wrapping ErrInvalidGID is returned if it
+// doesn't fit.
+func readableGID(app string, t time.Time, id, correlationID string) (string, error) {
+	err := checkReadableCorrelationID(correlationID)
+	if err != nil {
+		return "", err
+	}
+	app = strings.ReplaceAll(app, ":", "-")
+	room := MaxGIDLength - readableGIDOverhead
+	if correlationID != "" {
+		room -= len(gidSeparator) + len(correlationID)
+	}
+	gid := fmt.Sprintf(
+		"%s%s:%d:%s",
+		readableGIDPrefix, truncateUTF8(app, room), t.UnixMilli(), id,
+	)
+	if correlationID != "" {
+		gid += gidSeparator + correlationID
+	}
+	return gid, nil
+}
+
+// truncateUTF8 shortens s to at most n bytes without
+// splitting a character
+func truncateUTF8(s string, n int) string {
+	if n < 0 {
+		n = 0
+	}
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// WithReadableGID makes Finalizer2P generate GIDs of the
+// form txmpg:<app>:<unix-millis>:<uuid>, followed by the
+// correlation ID if there is one, so that an operator
+// looking at pg_prepared_xacts can tell where a prepared
+// transaction came from. app defaults to the finalizer's
+// name. GIDs are kept within MaxGIDLength by shortening
+// app; a correlation ID longer than 141 bytes doesn't fit,
+// so construction and SetCorrelationID() reject it.
+func WithReadableGID(app string) Option {
+	return func(c *config) {
+		c.readableGID = true
+		c.gidApp = app
+	}
+}
+
+// GIDInfo is what ParseGID() finds in a GID generated by
+// a Finalizer2P
+type GIDInfo struct {
+	// App and Created are only set for GIDs generated
+	// with WithReadableGID()
+	App     string
+	Created time.Time
+	UUID    string
+	// CorrelationID is the finalizer's correlation ID
+	// when the GID was generated
+	CorrelationID string
+}
+
+// ParseGID parses a GID generated by a Finalizer2P,
+// returning an error wrapping ErrInvalidGID if gid isn't
+// one
+func ParseGID(gid string) (GIDInfo, error) {
+	var info GIDInfo
+	rest := gid
+	if strings.HasPrefix(rest, readableGIDPrefix) {
+		parts := strings.SplitN(rest[len(readableGIDPrefix):], ":", 3)
+		if len(parts) != 3 {
+			return info, fmt.Errorf("%w: %q is incomplete", ErrInvalidGID, gid)
+		}
+		ms, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return info, fmt.Errorf("%w: %q has no timestamp", ErrInvalidGID, gid)
+		}
+		info.App = parts[0]
+		info.Created = time.UnixMilli(ms)
+		rest = parts[2]
+	}
+	const n = 36
+	if len(rest) < n {
+		return info, fmt.Errorf("%w: %q has no UUID", ErrInvalidGID, gid)
+	}
+	_, err := uuid.Parse(rest[:n])
+	if err != nil {
+		return info, fmt.Errorf("%w: %q has no UUID", ErrInvalidGID, gid)
+	}
+	info.UUID = rest[:n]
+	rest = rest[n:]
+	if rest != "" {
+		if !strings.HasPrefix(rest, gidSeparator) || len(rest) == len(gidSeparator) {
+			return info, fmt.Errorf("%w: %q has trailing text", ErrInvalidGID, gid)
+		}
+		info.CorrelationID = rest[len(gidSeparator):]
+	}
+	return info, nil
+}
+
+// NewGID returns a GID as a Finalizer2P called name with
+// correlationID and opts would generate it. It is for
+// finalizers built on other drivers, so that their GIDs
+// follow the same conventions; WithGID(),
+// WithReadableGID() and WithClock() are the options that
+// matter. It returns an error wrapping ErrInvalidGID if
+// correlationID doesn't fit in the GID.
+func NewGID(name, correlationID string, opts ...Option) (string, error) {
+	cfg := newConfig(opts)
+	err := cfg.checkCorrelationID(correlationID, true)
+	if err != nil {
+		return "", err
+	}
+	return cfg.newGID(name, correlationID)
+}
+
+// QuoteGID quotes gid as a string literal for PREPARE
+// TRANSACTION, COMMIT PREPARED and ROLLBACK PREPARED,
+// which don't accept parameters
+func QuoteGID(gid string) string {
+	return pq.QuoteLiteral(gid)
+}
+
+// WithGID sets the identifier Finalizer2P uses for its
+// prepared transaction instead of generating a random
+// UUID. The identifier must pass ValidateGID() and must
+// not be used by any other prepared transaction on the
+// server, or Finalize() fails with ErrGIDInUse.
+func WithGID(gid string) Option {
+	return func(c *config) {
+		c.gid = gid
+	}
+}
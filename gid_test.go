@@ -0,0 +1,153 @@
+package txmpg
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestValidateGID(t *testing.T) {
+	tests := []struct {
+		name  string
+		gid   string
+		valid bool
+	}{
+		{"empty", "", false},
+		{"short", "order-1", true},
+		{"one under the limit", strings.Repeat("a", MaxGIDLength-1), true},
+		{"at the limit", strings.Repeat("a", MaxGIDLength), true},
+		// The server's GIDSIZE of 200 bytes includes the
+		// terminating NUL
+		{"over the limit", strings.Repeat("a", MaxGIDLength+1), false},
+		{"multibyte at the limit", strings.Repeat("é", MaxGIDLength/2) + "a", true},
+		{"invalid UTF-8", "order-\xff", false},
+		{"NUL", "order\x001", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateGID(tt.gid)
+			if tt.valid && err != nil {
+				t.Errorf("ValidateGID() = %v, want nil", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidGID) {
+				t.Errorf("ValidateGID() = %v, want ErrInvalidGID", err)
+			}
+		})
+	}
+}
+
+func TestQuoteGID(t *testing.T) {
+	tests := []struct {
+		gid  string
+		want string
+	}{
+		{"order-1", `'order-1'`},
+		{"it's", `'it''s'`},
+		{`a\b`, ` E'a\\b'`},
+		{`it's a\b`, ` E'it''s a\\b'`},
+	}
+	for _, tt := range tests {
+		got := QuoteGID(tt.gid)
+		if got != tt.want {
+			t.Errorf("QuoteGID(%q) = %s, want %s", tt.gid, got, tt.want)
+		}
+	}
+}
+
+func TestNewGID(t *testing.T) {
+	clock := WithClock(func() time.Time { return time.UnixMilli(1700000000123) })
+	tests := []struct {
+		name          string
+		correlationID string
+		opts          []Option
+		prefix        string
+		app           string
+		wantCorr      string
+	}{
+		{name: "plain"},
+		{name: "correlated", correlationID: "order-1", wantCorr: "order-1"},
+		{
+			name: "readable", opts: []Option{WithReadableGID(""), clock},
+			prefix: "txmpg:orders:1700000000123:", app: "orders",
+		},
+		{
+			name: "readable app with colons", opts: []Option{WithReadableGID("a:b"), clock},
+			prefix: "txmpg:a-b:1700000000123:", app: "a-b",
+		},
+		{
+			name: "readable correlated", correlationID: "order-1",
+			opts:   []Option{WithReadableGID("shop"), clock},
+			prefix: "txmpg:shop:1700000000123:", app: "shop", wantCorr: "order-1",
+		},
+		{
+			name: "readable long app", correlationID: strings.Repeat("c", 50),
+			opts: []Option{WithReadableGID(strings.Repeat("a", MaxGIDLength)), clock},
+			app:  strings.Repeat("a", MaxGIDLength-readableGIDOverhead-51),
+			// The correlation ID keeps its room
+			wantCorr: strings.Repeat("c", 50),
+		},
+		{
+			name: "readable longest correlation ID", correlationID: strings.Repeat("c", MaxGIDLength-readableGIDOverhead-1),
+			opts:     []Option{WithReadableGID("shop"), clock},
+			prefix:   "txmpg::1700000000123:",
+			wantCorr: strings.Repeat("c", MaxGIDLength-readableGIDOverhead-1),
+		},
+		{
+			name: "readable multibyte correlation ID", correlationID: strings.Repeat("é", 70),
+			opts: []Option{WithReadableGID("shop"), clock},
+			// The app is shortened on a character boundary
+			app:      "s",
+			wantCorr: strings.Repeat("é", 70),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gid, err := NewGID("orders", tt.correlationID, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ValidateGID(gid)
+			if err != nil {
+				t.Fatalf("NewGID() = %q, which is invalid: %v", gid, err)
+			}
+			if !strings.HasPrefix(gid, tt.prefix) {
+				t.Errorf("NewGID() = %q, want prefix %q", gid, tt.prefix)
+			}
+			info, err := ParseGID(gid)
+			if err != nil {
+				t.Fatalf("ParseGID(%q) = %v", gid, err)
+			}
+			if info.App != tt.app || info.CorrelationID != tt.wantCorr {
+				t.Errorf("ParseGID(%q) = %+v", gid, info)
+			}
+			if !utf8.ValidString(info.CorrelationID) {
+				t.Errorf("correlation ID %q split a character", info.CorrelationID)
+			}
+		})
+	}
+}
+
+func TestNewGIDWithGID(t *testing.T) {
+	gid, err := NewGID("orders", "order-1", WithGID("fixed"), WithReadableGID(""))
+	if err != nil || gid != "fixed" {
+		t.Errorf("NewGID() = %q, %v, want the WithGID() identifier", gid, err)
+	}
+}
+
+func TestParseGIDRejects(t *testing.T) {
+	for _, gid := range []string{
+		"",
+		"not-a-uuid",
+		"txmpg:orders",
+		"txmpg:orders:soon:5f2b8f2e-3a7e-4c6a-9f43-2d1c0b8e7a61",
+		"5f2b8f2e-3a7e-4c6a-9f43-2d1c0b8e7a61x",
+		"5f2b8f2e-3a7e-4c6a-9f43-2d1c0b8e7a61_",
+	} {
+		_, err := ParseGID(gid)
+		if !errors.Is(err, ErrInvalidGID) {
+			t.Errorf("ParseGID(%q) = %v, want ErrInvalidGID", gid, err)
+		}
+	}
+}
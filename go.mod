@@ -1,6 +1,6 @@
 module github.com/williammoran/txmpg/v2
 
-go 1.14
+go 1.20
 
 require (
 	github.com/google/uuid v1.1.4
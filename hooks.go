@@ -0,0 +1,60 @@
+package txmpg
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// commitHooks holds the functions registered with
+// OnCommit()
+type commitHooks struct {
+	mu    sync.Mutex
+	hooks []func()
+}
+
+// add registers fn
+func (h *commitHooks) add(fn func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hooks = append(h.hooks, fn)
+}
+
+// run calls and forgets the registered functions, in the
+// order they were registered. A panic is reported to
+// logf and doesn't stop the others.
+func (h *commitHooks) run(logf func(level Level, format string, args ...interface{})) {
+	h.mu.Lock()
+	hooks := h.hooks
+	h.hooks = nil
+	h.mu.Unlock()
+	for i, fn := range hooks {
+		err := runCommitHook(fn)
+		if err != nil {
+			logf(LevelError, "commit hook %d: %s", i, err.Error())
+		}
+	}
+}
+
+// runCommitHook calls fn, turning a panic into an error
+func runCommitHook(fn func()) (err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = fmt.Errorf("panicked: %v\n%s", r, debug.Stack())
+		}
+	}()
+	fn()
+	return nil
+}
+
+// OnCommit registers fn to be called after the
+// transaction commits, or after COMMIT PREPARED succeeds,
+// such as to invalidate caches of the data it changed.
+// The functions are called by Commit() in the order
+// registered, and are discarded if the transaction is
+// aborted. They must not call Finalize(), Commit() or
+// Abort().
+func (m *engine) OnCommit(fn func()) {
+	m.commitHooks.add(fn)
+}
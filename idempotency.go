@@ -0,0 +1,67 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/williammoran/txmpg/v2/internal/driver"
+)
+
+// EnsureIdempotencyTable creates table, for use with
+// ClaimIdempotencyKey(), if it doesn't exist
+func EnsureIdempotencyTable(ctx context.Context, db *sql.DB, table string) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+pq.QuoteIdentifier(table)+` (
+		key text PRIMARY KEY,
+		claimed timestamptz NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return wrapError(err, "Creating idempotency table")
+	}
+	return nil
+}
+
+// ClaimIdempotencyKey inserts key into table through the
+// finalizer's transaction, so that the work done in the
+// transaction happens at most once per key. alreadyDone
+// is true if a committed transaction already claimed
+// key. If another open transaction has claimed it, this
+// blocks until that one finishes. The insert runs in a
+// savepoint, so a conflict leaves the transaction usable.
+// Once the transaction of a Finalizer has been submitted
+// to an AsyncCommitter it returns ErrHandedOff, and once
+// that of a Finalizer2P has been prepared ErrFinalized.
+func (m *engine) ClaimIdempotencyKey(ctx context.Context, table, key string) (bool, error) {
+	tx := m.transaction("ClaimIdempotencyKey()")
+	if tx == nil {
+		return false, m.errNoTransaction()
+	}
+	return claimIdempotencyKey(ctx, tx, table, key)
+}
+
+// claimIdempotencyKey does the work of
+// ClaimIdempotencyKey()
+func claimIdempotencyKey(ctx context.Context, tx driver.Querier, table, key string) (bool, error) {
+	err := tx.Exec(ctx, "SAVEPOINT txmpg_idempotency")
+	if err != nil {
+		return false, wrapError(err, "Creating idempotency savepoint")
+	}
+	err = tx.Exec(
+		ctx, "INSERT INTO "+pq.QuoteIdentifier(table)+" (key) VALUES ($1)", key,
+	)
+	if SQLState(err) == "23505" {
+		err = tx.Exec(ctx, "ROLLBACK TO SAVEPOINT txmpg_idempotency")
+		if err != nil {
+			return false, wrapError(err, "Rolling back idempotency savepoint")
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, wrapError(err, "Claiming idempotency key")
+	}
+	err = tx.Exec(ctx, "RELEASE SAVEPOINT txmpg_idempotency")
+	if err != nil {
+		return false, wrapError(err, "Releasing idempotency savepoint")
+	}
+	return false, nil
+}
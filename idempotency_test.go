@@ -0,0 +1,186 @@
+package txmpg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+func TestClaimIdempotencyKey(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name     string
+		fail     error
+		wantDone bool
+		wantErr  string
+		want     []string
+	}{
+		{
+			name: "claimed",
+			want: []string{
+				"SAVEPOINT txmpg_idempotency",
+				`INSERT INTO "keys" (key) VALUES ($1)`,
+				"RELEASE SAVEPOINT txmpg_idempotency",
+			},
+		},
+		{
+			name:     "already done",
+			fail:     fakepg.ServerError("23505", "duplicate key value"),
+			wantDone: true,
+			want: []string{
+				"SAVEPOINT txmpg_idempotency",
+				`INSERT INTO "keys" (key) VALUES ($1)`,
+				"ROLLBACK TO SAVEPOINT txmpg_idempotency",
+			},
+		},
+		{
+			name:    "insert fails",
+			fail:    fakepg.ServerError("42P01", `relation "keys" does not exist`),
+			wantErr: "42P01",
+			want: []string{
+				"SAVEPOINT txmpg_idempotency",
+				`INSERT INTO "keys" (key) VALUES ($1)`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, factory := fakeFactory(t, "orders")
+			f, err := factory.Begin(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Abort()
+			if tt.fail != nil {
+				server.FailNext("INSERT INTO", tt.fail)
+			}
+			start := len(server.Statements())
+			done, err := f.ClaimIdempotencyKey(ctx, "keys", "transfer-1")
+			if SQLState(err) != tt.wantErr || done != tt.wantDone {
+				t.Fatalf("ClaimIdempotencyKey() = %t, %v", done, err)
+			}
+			got := server.Statements()[start:]
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("statements %q, want %q", got, tt.want)
+			}
+			if tt.wantErr != "" {
+				return
+			}
+			// The transaction is still usable
+			_, err = f.ExecContext(ctx, "INSERT INTO transfers VALUES (1)")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = f.Finalize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = f.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestClaimIdempotencyKeyAfterFinalize(t *testing.T) {
+	ctx := context.Background()
+	_, factory := fakeFactory(t, "orders")
+	f, err := factory.Begin2P(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	err = f.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := f.ClaimIdempotencyKey(ctx, "keys", "transfer-1")
+	if done || !errors.Is(err, ErrFinalized) {
+		t.Errorf("ClaimIdempotencyKey() = %t, %v, want ErrFinalized", done, err)
+	}
+}
+
+func TestClaimIdempotencyKeyConcurrentServer(t *testing.T) {
+	db := serverDB(t)
+	ctx := context.Background()
+	table := "txmpg_test_keys_" + uuid.New().String()[:8]
+	err := EnsureIdempotencyTable(ctx, db, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DROP TABLE " + pq.QuoteIdentifier(table))
+	// Creating it again is harmless
+	err = EnsureIdempotencyTable(ctx, db, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory := NewFactory("idempotency", db)
+	for _, firstCommits := range []bool{true, false} {
+		t.Run(fmt.Sprintf("firstCommits=%t", firstCommits), func(t *testing.T) {
+			key := uuid.New().String()
+			first, err := factory.Begin(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer first.Abort()
+			done, err := first.ClaimIdempotencyKey(ctx, table, key)
+			if err != nil || done {
+				t.Fatalf("first ClaimIdempotencyKey() = %t, %v", done, err)
+			}
+			second, err := factory.Begin(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer second.Abort()
+			type claim struct {
+				done bool
+				err  error
+			}
+			claimed := make(chan claim)
+			go func() {
+				done, err := second.ClaimIdempotencyKey(ctx, table, key)
+				claimed <- claim{done, err}
+			}()
+			select {
+			case c := <-claimed:
+				t.Fatalf("second claim didn't wait for the first: %+v", c)
+			case <-time.After(100 * time.Millisecond):
+			}
+			if firstCommits {
+				err = first.Finalize()
+				if err == nil {
+					err = first.Commit()
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				first.Abort()
+			}
+			c := <-claimed
+			if c.err != nil || c.done != firstCommits {
+				t.Fatalf("second ClaimIdempotencyKey() = %t, %v, want %t", c.done, c.err, firstCommits)
+			}
+			// The conflict didn't poison the transaction
+			_, err = second.ExecContext(ctx, "SELECT 1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = second.Finalize()
+			if err == nil {
+				err = second.Commit()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// JournalReader reads the unresolved entries of a
+// decision journal. *Journal implements it.
+type JournalReader interface {
+	Entries(ctx context.Context) ([]JournalEntry, error)
+}
+
+var _ JournalReader = (*Journal)(nil)
+
+// InDoubtTx is a prepared transaction and what the
+// journal knows about it
+type InDoubtTx struct {
+	GID           string        `json:"gid"`
+	Database      string        `json:"database"`
+	Owner         string        `json:"owner"`
+	Prepared      time.Time     `json:"prepared"`
+	Age           time.Duration `json:"age_ns"`
+	App           string        `json:"app,omitempty"`
+	CorrelationID string        `json:"correlation_id,omitempty"`
+	// Journaled is true if the journal has an entry for
+	// the transaction, and Committed if that entry
+	// records the decision to commit. A transaction
+	// without an entry crashed before it was recorded,
+	// or its coordinator doesn't use the journal; either
+	// way, recovery rolls it back.
+	Journaled bool `json:"journaled"`
+	Committed bool `json:"committed"`
+}
+
+// TwoPhaseReport describes the prepared transactions on a
+// server and the journal entries for them
+type TwoPhaseReport struct {
+	Time     time.Time   `json:"time"`
+	Prepared []InDoubtTx `json:"prepared"`
+	// Unmatched are journal entries without a prepared
+	// transaction on the server, because they have been
+	// resolved and the entry wasn't removed, or because
+	// they belong to a participant in another database
+	Unmatched []JournalEntry `json:"unmatched"`
+}
+
+// Undecided returns the prepared transactions without a
+// decision to commit, oldest first
+func (r TwoPhaseReport) Undecided() []InDoubtTx {
+	var undecided []InDoubtTx
+	for _, p := range r.Prepared {
+		if !p.Committed {
+			undecided = append(undecided, p)
+		}
+	}
+	return undecided
+}
+
+// InDoubtReport describes the prepared transactions on the
+// server behind db and, if journal isn't nil, matches
+// them with its entries. It is meant for monitoring and
+// admin endpoints; the result can be rendered as JSON.
+func InDoubtReport(ctx context.Context, db *sql.DB, journal JournalReader) (TwoPhaseReport, error) {
+	report := TwoPhaseReport{Time: time.Now()}
+	list, err := ListPrepared(ctx, db, "")
+	if err != nil {
+		return report, err
+	}
+	var journaled []JournalEntry
+	if journal != nil {
+		journaled, err = journal.Entries(ctx)
+		if err != nil {
+			return report, err
+		}
+	}
+	entries := make(map[string]JournalEntry, len(journaled))
+	for _, e := range journaled {
+		entries[e.GID] = e
+	}
+	for _, p := range list {
+		tx := InDoubtTx{
+			GID:           p.GID,
+			Database:      p.Database,
+			Owner:         p.Owner,
+			Prepared:      p.Prepared,
+			Age:           report.Time.Sub(p.Prepared),
+			App:           p.App,
+			CorrelationID: p.CorrelationID,
+		}
+		e, ok := entries[p.GID]
+		if ok {
+			tx.Journaled = true
+			tx.Committed = e.Committed
+			delete(entries, p.GID)
+		}
+		report.Prepared = append(report.Prepared, tx)
+	}
+	for _, e := range journaled {
+		_, ok := entries[e.GID]
+		if ok {
+			report.Unmatched = append(report.Unmatched, e)
+		}
+	}
+	return report, nil
+}
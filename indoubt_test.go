@@ -0,0 +1,111 @@
+package txmpg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+// entries is a JournalReader with fixed entries
+type entries []JournalEntry
+
+func (e entries) Entries(context.Context) ([]JournalEntry, error) {
+	return e, nil
+}
+
+// failingJournal is a JournalReader that can't be read
+type failingJournal struct{ err error }
+
+func (j failingJournal) Entries(context.Context) ([]JournalEntry, error) {
+	return nil, j.err
+}
+
+func TestInDoubtReport(t *testing.T) {
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	prepared := time.Now().Add(-time.Hour)
+	server.PrepareAt("gid-committed", prepared)
+	server.PrepareAt("gid-undecided", prepared)
+	server.PrepareAt("gid-crashed", prepared)
+	resolved := JournalEntry{GID: "gid-resolved", Txn: "t3", Participant: "billing", Committed: true}
+	journal := entries{
+		{GID: "gid-committed", Txn: "t1", Participant: "orders", Committed: true},
+		{GID: "gid-undecided", Txn: "t2", Participant: "orders"},
+		resolved,
+	}
+	report, err := InDoubtReport(context.Background(), pool, journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type state struct{ journaled, committed bool }
+	got := map[string]state{}
+	for _, p := range report.Prepared {
+		got[p.GID] = state{p.Journaled, p.Committed}
+		if p.Age < time.Hour || !p.Prepared.Equal(prepared) {
+			t.Errorf("%s prepared %s, %s ago", p.GID, p.Prepared, p.Age)
+		}
+	}
+	want := map[string]state{
+		"gid-committed": {true, true},
+		"gid-undecided": {true, false},
+		// crashed before the decision was recorded
+		"gid-crashed": {false, false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Prepared = %+v, want %+v", got, want)
+	}
+	// already resolved, but the entry wasn't removed
+	if !reflect.DeepEqual(report.Unmatched, []JournalEntry{resolved}) {
+		t.Errorf("Unmatched = %+v, want %+v", report.Unmatched, resolved)
+	}
+	var undecided []string
+	for _, p := range report.Undecided() {
+		undecided = append(undecided, p.GID)
+	}
+	if !reflect.DeepEqual(undecided, []string{"gid-crashed", "gid-undecided"}) {
+		t.Errorf("Undecided() = %q", undecided)
+	}
+	b, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"prepared":[`, `"gid":"gid-crashed"`, `"journaled":false`, `"unmatched":[`, `"age_ns":`} {
+		if !strings.Contains(string(b), field) {
+			t.Errorf("JSON %s lacks %s", b, field)
+		}
+	}
+}
+
+func TestInDoubtReportWithoutJournal(t *testing.T) {
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	server.Prepare("gid-1")
+	report, err := InDoubtReport(context.Background(), pool, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Prepared) != 1 || report.Prepared[0].Journaled || report.Unmatched != nil {
+		t.Errorf("InDoubtReport() = %+v", report)
+	}
+}
+
+func TestInDoubtReportErrors(t *testing.T) {
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	server.FailNext("SELECT gid", fakepg.ServerError("42501", "permission denied"))
+	_, err := InDoubtReport(context.Background(), pool, entries{})
+	if SQLState(err) != "42501" {
+		t.Errorf("InDoubtReport() = %v, want the listing error", err)
+	}
+	unreadable := errors.New("journal unreadable")
+	_, err = InDoubtReport(context.Background(), pool, failingJournal{unreadable})
+	if !errors.Is(err, unreadable) {
+		t.Errorf("InDoubtReport() = %v, want the journal error", err)
+	}
+}
@@ -0,0 +1,78 @@
+package txmpg
+
+import "time"
+
+// FinalizerInfo describes a finalizer and its transaction
+type FinalizerInfo struct {
+	Name     string
+	TwoPhase bool
+	// TXID is the server's transaction ID
+	TXID int64
+	// PID is the server backend process ID
+	PID int64
+	// GID is the prepared transaction ID (2-phase only)
+	GID     string
+	State   State
+	Started time.Time
+	Age     time.Duration
+	// Stack is where the finalizer was constructed. It is
+	// only recorded when leak tracking is enabled.
+	Stack string
+}
+
+// Info returns a description of the finalizer
+func (m *engine) Info() FinalizerInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return FinalizerInfo{
+		Name:     m.name,
+		TwoPhase: m.twoPhase,
+		TXID:     m.serverTXID,
+		PID:      m.serverConnID,
+		GID:      m.id,
+		State:    m.state,
+		Started:  m.started,
+		Age:      m.cfg.now().Sub(m.started),
+	}
+}
+
+// Stats is a snapshot of a finalizer's activity
+type Stats struct {
+	State State
+	// DeferredCommits is the number of deferred commits
+	// registered with Defer()
+	DeferredCommits int
+	// Open is how long the transaction has been open
+	Open time.Duration
+	// Statements is the number of statements run through
+	// TracedTx() or the finalizer's ExecContext(),
+	// QueryContext() and QueryRowContext()
+	Statements int64
+	// PrepareToCommit is the time between PREPARE
+	// TRANSACTION and the completion of COMMIT PREPARED,
+	// once a Finalizer2P has committed. It is 0 for a
+	// read-only transaction committed without PREPARE.
+	PrepareToCommit time.Duration
+	// Durability is the level set by
+	// WithReplicationDurability()
+	Durability Durability
+}
+
+// Stats returns a snapshot of the finalizer's activity.
+// It is safe to call concurrently with any other method.
+func (m *engine) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var prepareToCommit time.Duration
+	if !m.committed.IsZero() && !m.prepared.IsZero() {
+		prepareToCommit = m.committed.Sub(m.prepared)
+	}
+	return Stats{
+		State:           m.state,
+		DeferredCommits: len(m.deferredCommits),
+		Open:            m.cfg.now().Sub(m.started),
+		Statements:      m.statements.count.Load(),
+		PrepareToCommit: prepareToCommit,
+		Durability:      m.cfg.durability,
+	}
+}
@@ -0,0 +1,81 @@
+// Package driver is the interface between txmpg's
+// finalizer engine and the drivers it runs on, so that
+// the database/sql finalizers and those of driver modules
+// such as txmpgpgx share one implementation. It is
+// internal so that only this repository's modules can
+// provide a driver.
+package driver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Row is the result of a query for a single row, like
+// *sql.Row or pgx.Row
+type Row interface {
+	Scan(dest ...interface{}) error
+}
+
+// Querier runs statements on a pool, a connection or in a
+// transaction
+type Querier interface {
+	Exec(ctx context.Context, query string, args ...interface{}) error
+	QueryRow(ctx context.Context, query string, args ...interface{}) Row
+}
+
+// Tx is an open transaction
+type Tx interface {
+	Querier
+	// ExecBatch runs statements without arguments in
+	// order, stopping at the first failure, which it
+	// reports as a *BatchError if it can tell which
+	// statement failed
+	ExecBatch(ctx context.Context, queries []string) error
+	Commit(ctx context.Context) error
+	Rollback(ctx context.Context) error
+}
+
+// Conn is a connection taken from a pool, which Close()
+// returns to it
+type Conn interface {
+	Querier
+	Close() error
+}
+
+// Pool is a pool of connections to a PostgreSQL server.
+// Statements run on the pool use a connection of their
+// own, outside any transaction. Pools are compared to
+// cache what the server supports, so they must be
+// comparable, and equal only if they share connections.
+type Pool interface {
+	Querier
+	// Begin starts a transaction; opts may be nil
+	Begin(ctx context.Context, opts *sql.TxOptions) (Tx, error)
+	// Conn takes a connection, waiting no longer than ctx
+	// allows
+	Conn(ctx context.Context) (Conn, error)
+	// Stats describes the pool's connections
+	Stats() sql.DBStats
+	// TxDone reports whether err means that the driver
+	// already ended the transaction, like sql.ErrTxDone
+	TxDone(err error) bool
+}
+
+// BatchError is returned by Tx.ExecBatch() when one of
+// the statements of the batch fails
+type BatchError struct {
+	// Index is the position of the statement in the batch
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("statement %d of batch: %s", e.Index, e.Err.Error())
+}
+
+// Unwrap returns the statement's error
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
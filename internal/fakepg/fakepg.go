@@ -0,0 +1,643 @@
+// Package fakepg is a database/sql driver that answers the
+// statements txmpg's finalizers send the way a PostgreSQL
+// server would, so that their behaviour can be tested
+// without one. It keeps prepared transactions in memory
+// and the keys of decision records, and understands
+// little else: any other query returns a single row
+// holding 1.
+package fakepg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Server is the state shared by the connections of a
+// fake database. It is safe for concurrent use.
+type Server struct {
+	mu sync.Mutex
+	// version is reported as server_version_num
+	version  int
+	status   string
+	nextTxid int64
+	nextPid  int64
+	prepared map[string]bool
+	// preparedAt holds the times set by PrepareAt()
+	preparedAt map[string]time.Time
+	committed  []string
+	rolledBack []string
+	statements []string
+	failures   []failure
+	answers    []answer
+	latency    time.Duration
+	roundTrips int
+	// decisions holds the committed keys of decision
+	// records, and preparedDecisions those inserted by
+	// each prepared transaction
+	decisions         map[string]bool
+	preparedDecisions map[string][]string
+	// maxPrepared is reported as max_prepared_transactions
+	maxPrepared int
+}
+
+// failure is a statement that is scripted to fail
+type failure struct {
+	prefix string
+	err    error
+}
+
+// answer is the scripted result of statements
+type answer struct {
+	prefix string
+	r      result
+}
+
+// Open returns a new fake server and a pool connected to
+// it. The server reports itself as PostgreSQL 16.
+func Open() (*Server, *sql.DB) {
+	s := &Server{
+		version:  160000,
+		nextTxid: 1000,
+		prepared: map[string]bool{},
+		// set by PrepareAt()
+		preparedAt: map[string]time.Time{},
+		// decision records
+		decisions:         map[string]bool{},
+		preparedDecisions: map[string][]string{},
+		maxPrepared:       10,
+	}
+	return s, sql.OpenDB(connector{s})
+}
+
+// SetVersion sets the server_version_num the server
+// reports, e.g. 90600 for PostgreSQL 9.6
+func (s *Server) SetVersion(version int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version = version
+}
+
+// SetStatus sets what txid_status() reports for every
+// transaction. The default is "in progress".
+func (s *Server) SetStatus(status string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = status
+}
+
+// SetMaxPreparedTransactions sets the
+// max_prepared_transactions the server reports. With 0,
+// PREPARE TRANSACTION fails as it does on PostgreSQL. The
+// default is 10.
+func (s *Server) SetMaxPreparedTransactions(max int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxPrepared = max
+}
+
+// FailNext makes the next statement that starts with
+// prefix fail with err
+func (s *Server) FailNext(prefix string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, failure{prefix: prefix, err: err})
+}
+
+// Answer makes every statement that starts with prefix
+// return rows, with columns, until Answer is called again
+// with the same prefix. Statements that FailNext() fails
+// aren't answered.
+func (s *Server) Answer(prefix string, columns []string, rows [][]driver.Value) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a := answer{prefix: prefix, r: result{columns: columns, rows: rows}}
+	for i := range s.answers {
+		if s.answers[i].prefix == prefix {
+			s.answers[i] = a
+			return
+		}
+	}
+	s.answers = append(s.answers, a)
+}
+
+// SetLatency makes every round trip to the server take d,
+// for benchmarks. Round trips are counted the way lib/pq
+// makes them: one for BEGIN, COMMIT, ROLLBACK and a
+// statement without arguments, two (parse, then bind and
+// execute) for a statement with arguments, one to prepare
+// a statement and one for each execution of it.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// RoundTrips returns the number of round trips made to
+// the server
+func (s *Server) RoundTrips() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.roundTrips
+}
+
+// roundTrip counts n round trips, waiting for the latency
+// of each
+func (s *Server) roundTrip(n int) {
+	s.mu.Lock()
+	s.roundTrips += n
+	latency := s.latency
+	s.mu.Unlock()
+	if latency > 0 {
+		time.Sleep(time.Duration(n) * latency)
+	}
+}
+
+// Prepare adds gid to the prepared transactions, as if
+// another session had prepared it
+func (s *Server) Prepare(gid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prepared[gid] = true
+}
+
+// PrepareAt is Prepare() for a transaction that
+// pg_prepared_xacts reports as prepared at at. Other
+// prepared transactions report the zero time.
+func (s *Server) PrepareAt(gid string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prepared[gid] = true
+	s.preparedAt[gid] = at
+}
+
+// Prepared returns the GIDs of the prepared transactions
+// waiting on the server
+func (s *Server) Prepared() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var gids []string
+	for gid := range s.prepared {
+		gids = append(gids, gid)
+	}
+	return gids
+}
+
+// Committed returns the GIDs committed with
+// COMMIT PREPARED, in order
+func (s *Server) Committed() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.committed...)
+}
+
+// RolledBack returns the GIDs rolled back with
+// ROLLBACK PREPARED, in order
+func (s *Server) RolledBack() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.rolledBack...)
+}
+
+// Statements returns every statement run, in order,
+// including BEGIN, COMMIT and ROLLBACK
+func (s *Server) Statements() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.statements...)
+}
+
+// Count returns the number of statements run that start
+// with prefix
+func (s *Server) Count(prefix string) int {
+	n := 0
+	for _, stmt := range s.Statements() {
+		if strings.HasPrefix(stmt, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// ServerError returns a server error with SQLSTATE code,
+// as lib/pq reports it
+func ServerError(code, message string) error {
+	return &pq.Error{Severity: "ERROR", Code: pq.ErrorCode(code), Message: message}
+}
+
+// result is the answer to a statement
+type result struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+// run records query and answers it for c. The statements
+// of a multi-statement query, separated by ";\n", are run
+// in order until one fails, and the last one answers.
+func (s *Server) run(c *conn, query string, args []driver.NamedValue) (result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var r result
+	for _, statement := range strings.Split(query, ";\n") {
+		var err error
+		r, err = s.runStatement(c, statement, args)
+		if err != nil {
+			return result{}, err
+		}
+	}
+	return r, nil
+}
+
+// runStatement records a single statement and answers it
+// for c. The caller must hold s.mu.
+func (s *Server) runStatement(c *conn, query string, args []driver.NamedValue) (result, error) {
+	s.statements = append(s.statements, query)
+	for i, f := range s.failures {
+		if strings.HasPrefix(query, f.prefix) {
+			s.failures = append(s.failures[:i:i], s.failures[i+1:]...)
+			return result{}, f.err
+		}
+	}
+	for _, a := range s.answers {
+		if strings.HasPrefix(query, a.prefix) {
+			return a.r, nil
+		}
+	}
+	if s.version < 130000 && (strings.Contains(query, "pg_current_xact_id") || strings.Contains(query, "pg_xact_status")) {
+		return result{}, ServerError("42883", "function does not exist")
+	}
+	switch {
+	case strings.Contains(query, "server_version_num"):
+		return row(strconv.Itoa(s.version), s.version >= 100000), nil
+	case query == "SHOW max_prepared_transactions":
+		return row(strconv.Itoa(s.maxPrepared)), nil
+	case query == "SELECT pg_current_xact_id()::text::bigint, pg_backend_pid()",
+		query == "SELECT txid_current(), pg_backend_pid()":
+		return row(s.assign(c), c.pid), nil
+	case strings.Contains(query, "_if_assigned(), pg_backend_pid()"),
+		strings.Contains(query, "_if_assigned()::text::bigint, pg_backend_pid()"):
+		return row(c.txidValue(), c.pid), nil
+	case strings.Contains(query, "_if_assigned()"):
+		return row(c.txidValue()), nil
+	case strings.HasPrefix(query, "SELECT pg_xact_status("),
+		strings.HasPrefix(query, "SELECT txid_status("):
+		if s.status != "" {
+			return row(s.status), nil
+		}
+		return row("in progress"), nil
+	case strings.HasPrefix(query, "PREPARE TRANSACTION "):
+		gid := unquote(strings.TrimPrefix(query, "PREPARE TRANSACTION "))
+		if s.maxPrepared == 0 {
+			c.endTx()
+			return result{}, ServerError("55000", "prepared transactions are disabled")
+		}
+		if s.prepared[gid] {
+			c.endTx()
+			return result{}, ServerError("42710", "transaction identifier is already in use")
+		}
+		s.prepared[gid] = true
+		s.preparedDecisions[gid] = c.decisions
+		c.endTx()
+		return result{}, nil
+	case strings.HasPrefix(query, "COMMIT PREPARED "):
+		gid := unquote(strings.TrimPrefix(query, "COMMIT PREPARED "))
+		if !s.prepared[gid] {
+			return result{}, ServerError("42704", "prepared transaction does not exist")
+		}
+		delete(s.prepared, gid)
+		delete(s.preparedAt, gid)
+		s.decide(s.preparedDecisions[gid])
+		delete(s.preparedDecisions, gid)
+		s.committed = append(s.committed, gid)
+		return result{}, nil
+	case strings.HasPrefix(query, "ROLLBACK PREPARED "):
+		gid := unquote(strings.TrimPrefix(query, "ROLLBACK PREPARED "))
+		if !s.prepared[gid] {
+			return result{}, ServerError("42704", "prepared transaction does not exist")
+		}
+		delete(s.prepared, gid)
+		delete(s.preparedAt, gid)
+		delete(s.preparedDecisions, gid)
+		s.rolledBack = append(s.rolledBack, gid)
+		return result{}, nil
+	case strings.Contains(query, "FROM pg_prepared_xacts WHERE gid = $1"):
+		gid, _ := args[0].Value.(string)
+		return row(s.prepared[gid]), nil
+	case strings.Contains(query, "FROM pg_prepared_xacts") &&
+		strings.Contains(query, "ORDER BY prepared"):
+		prefix, _ := args[0].Value.(string)
+		return s.listPrepared(prefix), nil
+	case query == "COMMIT":
+		s.decide(c.decisions)
+		return result{}, nil
+	case strings.HasPrefix(query, "INSERT INTO ") &&
+		strings.HasSuffix(query, " (key) VALUES ($1)"):
+		key, _ := args[0].Value.(string)
+		c.decisions = append(c.decisions, key)
+		s.assign(c)
+		return result{}, nil
+	case strings.HasPrefix(query, "SELECT EXISTS (SELECT 1 FROM ") &&
+		strings.HasSuffix(query, " WHERE key = $1)"):
+		key, _ := args[0].Value.(string)
+		return row(s.decisions[key]), nil
+	case query == "SELECT pg_export_snapshot()":
+		return row("00000003-00000002-1"), nil
+	case query == "SELECT pg_current_wal_insert_lsn()":
+		return row("0/16B3748"), nil
+	case query == "SELECT current_database()":
+		return row("fakepg"), nil
+	case isWrite(query):
+		s.assign(c)
+		return result{}, nil
+	case strings.HasPrefix(query, "SELECT"):
+		return row(int64(1)), nil
+	}
+	return result{}, nil
+}
+
+// decide commits the keys of decision records. The
+// caller must hold s.mu.
+func (s *Server) decide(keys []string) {
+	for _, key := range keys {
+		s.decisions[key] = true
+	}
+}
+
+// listPrepared answers the query of txmpg.ListPrepared()
+// with the prepared transactions whose GID starts with
+// prefix, in GID order. The caller must hold s.mu.
+func (s *Server) listPrepared(prefix string) result {
+	var gids []string
+	for gid := range s.prepared {
+		if strings.HasPrefix(gid, prefix) {
+			gids = append(gids, gid)
+		}
+	}
+	sort.Strings(gids)
+	r := result{columns: []string{"gid", "prepared", "owner", "database"}}
+	for _, gid := range gids {
+		r.rows = append(r.rows, []driver.Value{gid, s.preparedAt[gid], "fakepg", "fakepg"})
+	}
+	return r
+}
+
+// assign gives c's transaction an ID, if it doesn't have
+// one, and returns it. The caller must hold s.mu.
+func (s *Server) assign(c *conn) int64 {
+	if c.inTx && c.txid == 0 {
+		s.nextTxid++
+		c.txid = s.nextTxid
+	}
+	return c.txid
+}
+
+// isWrite reports whether query makes the server assign
+// a transaction ID
+func isWrite(query string) bool {
+	for _, verb := range []string{"INSERT", "UPDATE", "DELETE", "CREATE", "DROP"} {
+		if strings.HasPrefix(strings.ToUpper(query), verb) {
+			return true
+		}
+	}
+	return false
+}
+
+// row returns a result of one row holding values
+func row(values ...interface{}) result {
+	r := result{rows: [][]driver.Value{make([]driver.Value, len(values))}}
+	for i, v := range values {
+		r.columns = append(r.columns, "column")
+		r.rows[0][i] = v
+	}
+	return r
+}
+
+// unquote reverses pq.QuoteLiteral()
+func unquote(literal string) string {
+	literal = strings.TrimSpace(literal)
+	backslashes := strings.HasPrefix(literal, "E'")
+	literal = strings.TrimPrefix(literal, "E")
+	literal = strings.TrimSuffix(strings.TrimPrefix(literal, "'"), "'")
+	literal = strings.ReplaceAll(literal, "''", "'")
+	if backslashes {
+		literal = strings.ReplaceAll(literal, `\\`, `\`)
+	}
+	return literal
+}
+
+// connector opens connections to a Server
+type connector struct {
+	s *Server
+}
+
+func (c connector) Connect(context.Context) (driver.Conn, error) {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	c.s.nextPid++
+	return &conn{s: c.s, pid: c.s.nextPid}, nil
+}
+
+func (c connector) Driver() driver.Driver {
+	return fakeDriver{}
+}
+
+// fakeDriver only exists because driver.Connector must
+// return one; connections are made by connector
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("fakepg: use Open()")
+}
+
+// conn is a session with a Server. database/sql never
+// uses a connection from two goroutines at once, so its
+// own fields need no locking.
+type conn struct {
+	s    *Server
+	pid  int64
+	inTx bool
+	txid int64
+	// decisions are the keys of the decision records
+	// inserted by the open transaction
+	decisions []string
+}
+
+// txidValue returns the transaction's ID, or nil if none
+// has been assigned
+func (c *conn) txidValue() driver.Value {
+	if c.txid == 0 {
+		return nil
+	}
+	return c.txid
+}
+
+// endTx ends the session's transaction, as PREPARE
+// TRANSACTION does. The caller must hold s.mu.
+func (c *conn) endTx() {
+	c.inTx = false
+	c.txid = 0
+	c.decisions = nil
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	c.s.roundTrip(1)
+	return &stmt{c: c, query: query}, nil
+}
+
+func (c *conn) Close() error {
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.s.roundTrip(1)
+	_, err := c.s.run(c, "BEGIN", nil)
+	if err != nil {
+		return nil, err
+	}
+	c.inTx = true
+	c.txid = 0
+	return &tx{c: c}, nil
+}
+
+func (c *conn) ExecContext(
+	ctx context.Context, query string, args []driver.NamedValue,
+) (driver.Result, error) {
+	c.s.roundTrip(unpreparedTrips(args))
+	return c.exec(query, args)
+}
+
+func (c *conn) QueryContext(
+	ctx context.Context, query string, args []driver.NamedValue,
+) (driver.Rows, error) {
+	c.s.roundTrip(unpreparedTrips(args))
+	return c.query(query, args)
+}
+
+// unpreparedTrips is the number of round trips lib/pq
+// makes for a statement that isn't prepared
+func unpreparedTrips(args []driver.NamedValue) int {
+	if len(args) == 0 {
+		return 1
+	}
+	return 2
+}
+
+// exec runs a statement
+func (c *conn) exec(query string, args []driver.NamedValue) (driver.Result, error) {
+	_, err := c.s.run(c, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+// query runs a query
+func (c *conn) query(query string, args []driver.NamedValue) (driver.Rows, error) {
+	r, err := c.s.run(c, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &rows{r: r}, nil
+}
+
+// CheckNamedValue accepts any argument, as lib/pq does
+// for the types the finalizers send
+func (c *conn) CheckNamedValue(*driver.NamedValue) error {
+	return nil
+}
+
+// tx is a transaction on a conn
+type tx struct {
+	c *conn
+}
+
+func (t *tx) Commit() error {
+	return t.end("COMMIT")
+}
+
+func (t *tx) Rollback() error {
+	return t.end("ROLLBACK")
+}
+
+// end finishes the transaction with statement, unless
+// PREPARE TRANSACTION already did
+func (t *tx) end(statement string) error {
+	if !t.c.inTx {
+		return nil
+	}
+	t.c.s.roundTrip(1)
+	_, err := t.c.s.run(t.c, statement, nil)
+	t.c.s.mu.Lock()
+	t.c.endTx()
+	t.c.s.mu.Unlock()
+	return err
+}
+
+// stmt is a prepared statement
+type stmt struct {
+	c     *conn
+	query string
+}
+
+func (s *stmt) Close() error {
+	return nil
+}
+
+func (s *stmt) NumInput() int {
+	return -1
+}
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.c.s.roundTrip(1)
+	return s.c.exec(s.query, named(args))
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.c.s.roundTrip(1)
+	return s.c.query(s.query, named(args))
+}
+
+// named converts positional arguments
+func named(args []driver.Value) []driver.NamedValue {
+	nv := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		nv[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return nv
+}
+
+// rows iterates over a result
+type rows struct {
+	r result
+	i int
+}
+
+func (r *rows) Columns() []string {
+	return r.r.columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.i >= len(r.r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.r.rows[r.i])
+	r.i++
+	return nil
+}
@@ -0,0 +1,336 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Journal states
+const (
+	// journalPrepared means the participant is about to
+	// prepare, or has prepared, and no decision has been
+	// made. Recovery rolls it back.
+	journalPrepared = "prepared"
+	// journalCommit means the decision to commit has
+	// been made. Recovery commits it.
+	journalCommit = "commit"
+)
+
+// Journal is a durable record of the decisions made for
+// transactions spread over several Finalizer2Ps, so that
+// prepared transactions left behind by a crash between
+// PREPARE and COMMIT PREPARED can be resolved the way the
+// coordinator intended. It is a table in a database that
+// need not be one of the participants.
+//
+// The protocol is presumed abort:
+//
+//   - Before PREPARE, each participant records its GID
+//     as prepared under the transaction's correlation ID
+//   - Before COMMIT PREPARED, each participant marks
+//     every participant with that correlation ID as
+//     commit. The first one to do so makes the decision,
+//     and txmanager only commits once every participant
+//     has been finalized, so every row exists by then.
+//   - Once its prepared transaction is resolved, a
+//     participant deletes its row
+//
+// Every finalizer in a transaction must share the same
+// Journal and correlation ID, and must have a name that
+// is unique within the transaction.
+type Journal struct {
+	db     *sql.DB
+	schema string
+	name   string
+	// table is the quoted, schema qualified name
+	table string
+}
+
+// NewJournal returns a Journal kept in table in schema in
+// the database behind db. The table must already exist;
+// see EnsureJournalTable().
+func NewJournal(db *sql.DB, schema, table string) *Journal {
+	return &Journal{
+		db:     db,
+		schema: schema,
+		name:   table,
+		table:  journalTable(schema, table),
+	}
+}
+
+// journalTable quotes and qualifies a journal table name
+func journalTable(schema, table string) string {
+	return pq.QuoteIdentifier(schema) + "." + pq.QuoteIdentifier(table)
+}
+
+// journalColumns are the columns of a journal table and
+// their types as reported by information_schema
+var journalColumns = []struct{ name, dataType string }{
+	{"gid", "text"},
+	{"txn", "text"},
+	{"participant", "text"},
+	{"state", "text"},
+	{"created", "timestamp with time zone"},
+}
+
+// JournalSchemaError is returned when a journal table
+// exists but doesn't have the columns the journal needs
+type JournalSchemaError struct {
+	Table string
+	// Problems describes each missing or mismatched
+	// column
+	Problems []string
+}
+
+func (e *JournalSchemaError) Error() string {
+	return fmt.Sprintf(
+		"journal table %s has the wrong shape: %s",
+		e.Table, strings.Join(e.Problems, "; "),
+	)
+}
+
+// EnsureJournalTable creates the journal table in schema
+// and its indexes if they don't exist, then checks that
+// the table has the columns a Journal needs, returning a
+// *JournalSchemaError if it doesn't. It is safe to call
+// every time the application starts.
+func EnsureJournalTable(ctx context.Context, db *sql.DB, schema, table string) error {
+	qualified := journalTable(schema, table)
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS ` + qualified + ` (
+			gid text PRIMARY KEY,
+			txn text NOT NULL,
+			participant text NOT NULL,
+			state text NOT NULL,
+			created timestamptz NOT NULL DEFAULT now()
+		)`,
+		"CREATE INDEX IF NOT EXISTS " + pq.QuoteIdentifier(table+"_txn_idx") +
+			" ON " + qualified + " (txn)",
+		"CREATE INDEX IF NOT EXISTS " + pq.QuoteIdentifier(table+"_state_idx") +
+			" ON " + qualified + " (state)",
+	}
+	for _, stmt := range stmts {
+		_, err := db.ExecContext(ctx, stmt)
+		if err != nil {
+			return wrapError(err, "Creating journal table")
+		}
+	}
+	return checkJournalTable(ctx, db, schema, table)
+}
+
+// checkJournalTable compares the columns of the journal
+// table with journalColumns
+func checkJournalTable(ctx context.Context, db *sql.DB, schema, table string) error {
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT column_name, data_type
+		FROM information_schema.columns
+		WHERE table_schema = $1 AND table_name = $2`,
+		schema, table,
+	)
+	if err != nil {
+		return wrapError(err, "Reading journal table columns")
+	}
+	defer rows.Close()
+	found := map[string]string{}
+	for rows.Next() {
+		var name, dataType string
+		err = rows.Scan(&name, &dataType)
+		if err != nil {
+			return wrapError(err, "Scanning journal table columns")
+		}
+		found[name] = dataType
+	}
+	err = rows.Err()
+	if err != nil {
+		return wrapError(err, "Reading journal table columns")
+	}
+	var problems []string
+	for _, c := range journalColumns {
+		dataType, ok := found[c.name]
+		switch {
+		case !ok:
+			problems = append(problems, "missing column "+c.name)
+		case dataType != c.dataType:
+			problems = append(problems, fmt.Sprintf(
+				"column %s is %s, not %s", c.name, dataType, c.dataType,
+			))
+		}
+	}
+	if problems != nil {
+		return &JournalSchemaError{
+			Table:    journalTable(schema, table),
+			Problems: problems,
+		}
+	}
+	return nil
+}
+
+// WithJournal makes Finalizer2P record its prepared
+// transaction and the decision to commit it in j. The
+// finalizer must have a correlation ID when Finalize()
+// is called.
+func WithJournal(j *Journal) Option {
+	return func(c *config) {
+		c.journal = j
+	}
+}
+
+// prepare records that gid is about to be prepared by
+// participant as part of txn
+func (j *Journal) prepare(ctx context.Context, gid, txn, participant string) error {
+	_, err := j.db.ExecContext(
+		ctx,
+		"INSERT INTO "+j.table+" (gid, txn, participant, state) VALUES ($1, $2, $3, $4)",
+		gid, txn, participant, journalPrepared,
+	)
+	if err != nil {
+		return wrapError(err, "Recording prepared transaction in journal")
+	}
+	return nil
+}
+
+// decideCommit records the decision to commit every
+// participant in txn
+func (j *Journal) decideCommit(ctx context.Context, txn string) error {
+	_, err := j.db.ExecContext(
+		ctx,
+		"UPDATE "+j.table+" SET state = $1 WHERE txn = $2",
+		journalCommit, txn,
+	)
+	if err != nil {
+		return wrapError(err, "Recording commit decision in journal")
+	}
+	return nil
+}
+
+// forget deletes the record of gid once it is resolved
+func (j *Journal) forget(ctx context.Context, gid string) error {
+	_, err := j.db.ExecContext(ctx, "DELETE FROM "+j.table+" WHERE gid = $1", gid)
+	if err != nil {
+		return wrapError(err, "Removing resolved transaction from journal")
+	}
+	return nil
+}
+
+// JournalEntry is a prepared transaction recorded in a
+// Journal that hasn't been resolved
+type JournalEntry struct {
+	GID         string `json:"gid"`
+	Txn         string `json:"txn"`
+	Participant string `json:"participant"`
+	// Committed is true if the decision to commit was
+	// made
+	Committed bool      `json:"committed"`
+	Created   time.Time `json:"created"`
+}
+
+// Entries returns the unresolved transactions in the
+// journal, oldest first
+func (j *Journal) Entries(ctx context.Context) ([]JournalEntry, error) {
+	rows, err := j.db.QueryContext(
+		ctx,
+		"SELECT gid, txn, participant, state, created FROM "+j.table+" ORDER BY created",
+	)
+	if err != nil {
+		return nil, wrapError(err, "Reading journal")
+	}
+	defer rows.Close()
+	var entries []JournalEntry
+	for rows.Next() {
+		var e JournalEntry
+		var state string
+		err = rows.Scan(&e.GID, &e.Txn, &e.Participant, &state, &e.Created)
+		if err != nil {
+			return nil, wrapError(err, "Scanning journal")
+		}
+		e.Committed = state == journalCommit
+		entries = append(entries, e)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, wrapError(err, "Reading journal")
+	}
+	return entries, nil
+}
+
+// decision returns what the journal says should happen
+// to gid: Commit if the decision to commit was recorded,
+// and Rollback otherwise
+func (j *Journal) decision(ctx context.Context, gid string) (Decision, error) {
+	var state string
+	err := j.db.QueryRowContext(
+		ctx, "SELECT state FROM "+j.table+" WHERE gid = $1", gid,
+	).Scan(&state)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return Rollback, nil
+	case err != nil:
+		return Skip, wrapError(err, "Reading journal")
+	case state == journalCommit:
+		return Commit, nil
+	}
+	return Rollback, nil
+}
+
+// RecoveryResult is what RecoverFromJournal() did with
+// one journal entry
+type RecoveryResult struct {
+	Entry    JournalEntry
+	Decision Decision
+	// Err is the error from COMMIT PREPARED or ROLLBACK
+	// PREPARED, or from removing the entry. A prepared
+	// transaction that no longer exists is not an error.
+	Err error
+}
+
+// RecoverFromJournal resolves every prepared transaction
+// in j: those with a decision to commit are committed
+// and the rest are rolled back. participants maps the
+// names of the finalizers to their databases. Entries
+// that are resolved are removed from the journal; a
+// failure on one entry doesn't stop the rest.
+//
+// Recovery can't tell a crashed coordinator from one that
+// is still running, so it must only be run when no
+// finalizers are using the journal, such as at startup
+// before any transactions begin. It refuses to run if
+// the journal table doesn't have the expected columns.
+func RecoverFromJournal(
+	ctx context.Context, j *Journal, participants map[string]*sql.DB,
+) ([]RecoveryResult, error) {
+	err := checkJournalTable(ctx, j.db, j.schema, j.name)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := j.Entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var results []RecoveryResult
+	for _, e := range entries {
+		result := RecoveryResult{Entry: e, Decision: Rollback}
+		if e.Committed {
+			result.Decision = Commit
+		}
+		db, ok := participants[e.Participant]
+		if !ok {
+			result.Err = fmt.Errorf("no database for participant %q", e.Participant)
+			results = append(results, result)
+			continue
+		}
+		err = finishPrepared(ctx, db, e.GID, e.Committed)
+		if err == nil || errors.Is(err, ErrAlreadyResolved) {
+			err = j.forget(ctx, e.GID)
+		}
+		result.Err = err
+		results = append(results, result)
+	}
+	return results, nil
+}
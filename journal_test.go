@@ -0,0 +1,164 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/williammoran/txmanager/v2"
+)
+
+// crashEnv tells the test binary to run the coordinator
+// of TestJournalCrashRecovery and crash at the fault
+// point it names
+const crashEnv = "TXMPG_TEST_CRASH"
+
+// crashAt kills the process at a fault point, leaving
+// whatever it prepared on the server
+type crashAt FaultPoint
+
+func (c crashAt) Inject(point FaultPoint, gid string) error {
+	if point == FaultPoint(c) {
+		os.Exit(3)
+	}
+	return nil
+}
+
+// crashCoordinator commits a transaction over two
+// participants, a and b, that journal in journalTable and
+// insert their names into dataTable. b, or both for
+// FaultBeforeCommitPrepared, crash at point.
+func crashCoordinator(db *sql.DB, point FaultPoint, txn, journalTable, dataTable string) error {
+	ctx := context.Background()
+	journal := NewJournal(db, "public", journalTable)
+	var tx txmanager.Transaction
+	for _, name := range []string{"a", "b"} {
+		opts := []Option{WithJournal(journal), WithCorrelationID(txn)}
+		if name == "b" || point == FaultBeforeCommitPrepared {
+			opts = append(opts, WithFaultInjector(crashAt(point)))
+		}
+		f, err := newFinalizer2P(ctx, name, db, newConfig(opts))
+		if err != nil {
+			return err
+		}
+		_, err = f.PgTx().Exec("INSERT INTO "+pq.QuoteIdentifier(dataTable)+" VALUES ($1)", name)
+		if err != nil {
+			return err
+		}
+		tx.Add(name, f)
+	}
+	return tx.Commit()
+}
+
+// TestJournalCrashRecovery kills a coordinator, a child
+// process running this test binary, between PREPARE and
+// COMMIT PREPARED, and recovers from the journal.
+func TestJournalCrashRecovery(t *testing.T) {
+	if point := os.Getenv(crashEnv); point != "" {
+		db := serverDB(t)
+		err := crashCoordinator(
+			db, FaultPoint(point), os.Getenv(crashEnv+"_TXN"),
+			os.Getenv(crashEnv+"_JOURNAL"), os.Getenv(crashEnv+"_DATA"),
+		)
+		t.Fatalf("coordinator survived: %v", err)
+	}
+	db := serverDB(t)
+	ctx := context.Background()
+	tests := []struct {
+		name  string
+		point FaultPoint
+		// entries is the least number of journal entries
+		// the crash leaves, and want the number of
+		// participants committed
+		entries, want int
+	}{
+		// The decision to commit was recorded
+		{"after decision", FaultBeforeCommitPrepared, 2, 2},
+		// b prepared, but nothing was decided. a may not
+		// have been finalized yet.
+		{"before decision", FaultAfterPrepare, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			suffix := time.Now().UnixNano()
+			journalTable := fmt.Sprintf("txmpg_test_journal_%d", suffix)
+			dataTable := fmt.Sprintf("txmpg_test_data_%d", suffix)
+			txn := fmt.Sprintf("crash-%d", suffix)
+			err := EnsureJournalTable(ctx, db, "public", journalTable)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.Exec("CREATE TABLE " + pq.QuoteIdentifier(dataTable) + " (name text)")
+			if err != nil {
+				t.Fatal(err)
+			}
+			journal := NewJournal(db, "public", journalTable)
+			t.Cleanup(func() {
+				// Prepared transactions left by a failure
+				// would keep the tables from being dropped
+				entries, _ := journal.Entries(ctx)
+				for _, e := range entries {
+					finishPrepared(ctx, db, e.GID, false)
+				}
+				db.Exec("DROP TABLE " + pq.QuoteIdentifier(journalTable))
+				db.Exec("DROP TABLE " + pq.QuoteIdentifier(dataTable))
+			})
+
+			cmd := exec.Command(os.Args[0], "-test.run=^TestJournalCrashRecovery$")
+			cmd.Env = append(os.Environ(),
+				crashEnv+"="+string(tt.point),
+				crashEnv+"_TXN="+txn,
+				crashEnv+"_JOURNAL="+journalTable,
+				crashEnv+"_DATA="+dataTable,
+			)
+			out, err := cmd.CombinedOutput()
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+				t.Fatalf("coordinator exited with %v, want a crash:\n%s", err, out)
+			}
+
+			entries, err := journal.Entries(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) < tt.entries {
+				t.Fatalf("%d journal entries after the crash, want %d", len(entries), tt.entries)
+			}
+			results, err := RecoverFromJournal(ctx, journal, map[string]*sql.DB{"a": db, "b": db})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, result := range results {
+				if result.Err != nil {
+					t.Errorf("recovering %s: %v", result.Entry.GID, result.Err)
+				}
+				if (result.Decision == Commit) != (tt.want > 0) {
+					t.Errorf("%s decided %v", result.Entry.Participant, result.Decision)
+				}
+			}
+			var committed int
+			err = db.QueryRow("SELECT count(*) FROM " + pq.QuoteIdentifier(dataTable)).Scan(&committed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if committed != tt.want {
+				t.Errorf("%d participants committed, want %d", committed, tt.want)
+			}
+			for _, e := range entries {
+				if isPrepared(t, db, e.GID) {
+					t.Errorf("%s still prepared after recovery", e.GID)
+				}
+			}
+			entries, err = journal.Entries(ctx)
+			if err != nil || len(entries) != 0 {
+				t.Errorf("journal holds %v, %v after recovery", entries, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package txmpg
+
+import (
+	"log"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// leaks is the registry of finalizers with leak tracking
+// enabled that have not yet been committed or aborted
+var leaks = struct {
+	sync.Mutex
+	next   uint64
+	active map[uint64]FinalizerInfo
+}{active: map[uint64]FinalizerInfo{}}
+
+// ActiveFinalizers returns the finalizers constructed
+// with WithLeakTracking(true) that have not yet been
+// committed or aborted, oldest first
+func ActiveFinalizers() []FinalizerInfo {
+	leaks.Lock()
+	defer leaks.Unlock()
+	active := make([]FinalizerInfo, 0, len(leaks.active))
+	for _, info := range leaks.active {
+		info.Age = time.Since(info.Started)
+		active = append(active, info)
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].Started.Before(active[j].Started)
+	})
+	return active
+}
+
+// trackLeaks registers owner, the pointer to the
+// finalizer held by the application, in the leak registry
+// and arranges for a warning to the logger returned by
+// logger if it is garbage collected while still active.
+// The returned key is passed to untrackLeaks() when the
+// transaction ends.
+func trackLeaks(owner interface{}, info FinalizerInfo, logger func() *log.Logger) uint64 {
+	info.Stack = string(debug.Stack())
+	leaks.Lock()
+	leaks.next++
+	key := leaks.next
+	leaks.active[key] = info
+	leaks.Unlock()
+	runtime.SetFinalizer(owner, func(interface{}) {
+		leaked, ok := untrackLeaks(key)
+		if !ok {
+			return
+		}
+		logger := logger()
+		if logger == nil {
+			logger = log.New(log.Writer(), "", log.LstdFlags)
+		}
+		logger.Printf(
+			"warning: finalizer %s (PGPID: %d) was never committed or aborted, created at:\n%s",
+			leaked.Name, leaked.PID, leaked.Stack,
+		)
+	})
+	return key
+}
+
+// untrackLeaks removes the finalizer registered as key
+// from the leak registry, returning its information if it
+// was registered
+func untrackLeaks(key uint64) (FinalizerInfo, bool) {
+	if key == 0 {
+		return FinalizerInfo{}, false
+	}
+	leaks.Lock()
+	defer leaks.Unlock()
+	info, ok := leaks.active[key]
+	delete(leaks.active, key)
+	return info, ok
+}
@@ -0,0 +1,92 @@
+package txmpg
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer that is safe to write from
+// the goroutine that runs finalizers
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// active reports whether ActiveFinalizers() lists a
+// finalizer called name
+func active(name string) (FinalizerInfo, bool) {
+	for _, info := range ActiveFinalizers() {
+		if info.Name == name {
+			return info, true
+		}
+	}
+	return FinalizerInfo{}, false
+}
+
+func TestActiveFinalizers(t *testing.T) {
+	_, factory := fakeFactory(t, "leak-registry", WithLeakTracking(true))
+	f, err := factory.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, ok := active("leak-registry")
+	if !ok {
+		t.Fatal("ActiveFinalizers() doesn't list the open finalizer")
+	}
+	if !strings.Contains(info.Stack, "leak_test.go") || info.PID == 0 {
+		t.Errorf("info = %+v, want the PID and the creation stack", info)
+	}
+	f.Abort()
+	_, ok = active("leak-registry")
+	if ok {
+		t.Error("ActiveFinalizers() lists the aborted finalizer")
+	}
+}
+
+func TestLeakedFinalizerWarning(t *testing.T) {
+	var buf syncBuffer
+	_, factory := fakeFactory(
+		t, "leak-warning", WithLeakTracking(true), WithLogger(log.New(&buf, "", 0)),
+	)
+	func() {
+		_, err := factory.Begin(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if _, ok := active("leak-warning"); !ok {
+		t.Fatal("ActiveFinalizers() doesn't list the leaked finalizer")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(buf.String(), "was never committed or aborted") {
+		if time.Now().After(deadline) {
+			t.Fatalf("no warning after the finalizer was collected, log: %q", buf.String())
+		}
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(buf.String(), "finalizer leak-warning") {
+		t.Errorf("warning %q doesn't name the finalizer", buf.String())
+	}
+	if _, ok := active("leak-warning"); ok {
+		t.Error("ActiveFinalizers() still lists the collected finalizer")
+	}
+}
@@ -0,0 +1,48 @@
+package txmpg
+
+// Level is the severity of a trace message. A finalizer
+// only logs messages at or above its level, set with
+// WithLogLevel().
+type Level int
+
+const (
+	// LevelDebug is the detail of every step, including
+	// each statement run through TracedTx(). Messages
+	// passed to Trace() are at this level.
+	LevelDebug Level = iota
+	// LevelInfo is lifecycle transitions: commits,
+	// prepares and rollbacks
+	LevelInfo
+	// LevelWarn is failures the finalizer recovered from,
+	// or that need attention but not immediately
+	LevelWarn
+	// LevelError is failures that leave the transaction
+	// in an unknown or inconsistent state
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+// String returns the name of the level
+func (l Level) String() string {
+	name, ok := levelNames[l]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
+// WithLogLevel makes the finalizer's logger receive only
+// messages at level or above. The default is LevelDebug,
+// which logs everything. The trace hook receives every
+// message regardless, with its level in TraceEvent.
+func WithLogLevel(level Level) Option {
+	return func(c *config) {
+		c.logLevel = level
+	}
+}
@@ -0,0 +1,106 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/williammoran/txmpg/v2/internal/driver"
+)
+
+// lsnPollInterval is how often WaitForLSN() checks the
+// replica
+const lsnPollInterval = 10 * time.Millisecond
+
+// WithCommitLSN makes Commit() record a WAL position at or
+// after the transaction's commit record, for CommitLSN().
+// A replica that has replayed up to it sees the commit,
+// which WaitForLSN() can wait for. It costs a query on a
+// separate connection after each commit, because the
+// commit record is written after anything the transaction
+// itself can query. Requires PostgreSQL 10 or later.
+func WithCommitLSN(capture bool) Option {
+	return func(c *config) {
+		c.commitLSN = capture
+	}
+}
+
+// CommitLSN returns the WAL position recorded after the
+// transaction committed, if WithCommitLSN() is on, or ""
+func (m *engine) CommitLSN() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lsn
+}
+
+// recordCommitLSN looks up the current WAL insert
+// position through pool if WithCommitLSN() is on. The
+// commit has already succeeded, so a failure is only
+// logged and leaves CommitLSN() empty. The caller must
+// hold opMu.
+func (m *engine) recordCommitLSN() {
+	if !m.cfg.commitLSN {
+		return
+	}
+	lsn, err := currentLSN(m.pool, m.cfg.maintenanceTimeout)
+	if err != nil {
+		m.logf(LevelWarn, "warning: unable to get commit LSN: %s", err.Error())
+		return
+	}
+	m.mu.Lock()
+	m.lsn = lsn
+	m.mu.Unlock()
+	m.Trace("commit LSN %s", lsn)
+}
+
+// currentLSN returns the primary's current WAL insert
+// position
+func currentLSN(pool driver.Querier, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var lsn string
+	err := pool.QueryRow(ctx, "SELECT pg_current_wal_insert_lsn()").Scan(&lsn)
+	return lsn, err
+}
+
+// WaitForLSN waits until the server behind replica has
+// replayed the WAL up to lsn, as returned by CommitLSN(),
+// so that reads from it see the committed transaction. It
+// polls the replica until it catches up, ctx finishes or
+// timeout (if greater than 0) elapses. On a primary it
+// returns as soon as lsn has been written, which it
+// normally already has.
+func WaitForLSN(ctx context.Context, replica *sql.DB, lsn string, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ticker := time.NewTicker(lsnPollInterval)
+	defer ticker.Stop()
+	for {
+		var replayed bool
+		err := replica.QueryRowContext(
+			ctx,
+			`SELECT COALESCE(CASE WHEN pg_is_in_recovery()
+				THEN pg_last_wal_replay_lsn()
+				ELSE pg_current_wal_insert_lsn()
+			END >= $1::pg_lsn, false)`,
+			lsn,
+		).Scan(&replayed)
+		if err != nil && ctx.Err() == nil {
+			return wrapError(err, "Checking replayed LSN")
+		}
+		if replayed {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return wrapError(
+				ctx.Err(), fmt.Sprintf("Waiting for replica to replay LSN %s", lsn),
+			)
+		}
+	}
+}
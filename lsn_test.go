@@ -0,0 +1,176 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+func TestCommitLSN(t *testing.T) {
+	ctx := context.Background()
+	for _, twoPhase := range []bool{false, true} {
+		for _, capture := range []bool{false, true} {
+			t.Run(fmt.Sprintf("twoPhase=%t/capture=%t", twoPhase, capture), func(t *testing.T) {
+				var traces []string
+				_, factory := fakeFactory(
+					t, "orders", WithCommitLSN(capture),
+					WithTraceHook(func(e TraceEvent) { traces = append(traces, e.Message) }),
+				)
+				var f interface {
+					lifecycle
+					CommitLSN() string
+				}
+				var err error
+				if twoPhase {
+					f, err = factory.Begin2P(ctx)
+				} else {
+					f, err = factory.Begin(ctx)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Abort()
+				_, err = f.ExecContext(ctx, "INSERT INTO orders VALUES (1)")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if lsn := f.CommitLSN(); lsn != "" {
+					t.Errorf("CommitLSN() = %q before Commit()", lsn)
+				}
+				err = f.Finalize()
+				if err == nil {
+					err = f.Commit()
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := ""
+				if capture {
+					want = "0/16B3748"
+				}
+				if lsn := f.CommitLSN(); lsn != want {
+					t.Errorf("CommitLSN() = %q, want %q", lsn, want)
+				}
+				traced := strings.Contains(strings.Join(traces, "\n"), "commit LSN 0/16B3748")
+				if traced != capture {
+					t.Errorf("traces %q", traces)
+				}
+			})
+		}
+	}
+}
+
+func TestCommitLSNFails(t *testing.T) {
+	var traces []string
+	server, factory := fakeFactory(
+		t, "orders", WithCommitLSN(true),
+		WithTraceHook(func(e TraceEvent) { traces = append(traces, e.Message) }),
+	)
+	f, err := factory.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	server.FailNext("SELECT pg_current_wal_insert_lsn()", fakepg.ServerError("57P01", "terminating connection"))
+	err = f.Finalize()
+	if err == nil {
+		err = f.Commit()
+	}
+	if err != nil {
+		t.Fatalf("Commit() = %v, want the commit to stand", err)
+	}
+	if f.CommitLSN() != "" || !strings.Contains(strings.Join(traces, "\n"), "warning: unable to get commit LSN") {
+		t.Errorf("CommitLSN() = %q, traces %q", f.CommitLSN(), traces)
+	}
+}
+
+func TestWaitForLSN(t *testing.T) {
+	ctx := context.Background()
+	replayed := func(server *fakepg.Server, ok bool) {
+		server.Answer("SELECT COALESCE(", []string{"replayed"}, [][]driver.Value{{ok}})
+	}
+	t.Run("caught up", func(t *testing.T) {
+		server, pool := fakepg.Open()
+		defer pool.Close()
+		replayed(server, true)
+		err := WaitForLSN(ctx, pool, "0/16B3748", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := server.Count("SELECT COALESCE("); n != 1 {
+			t.Errorf("replica polled %d times, want 1", n)
+		}
+	})
+	t.Run("catches up", func(t *testing.T) {
+		server, pool := fakepg.Open()
+		defer pool.Close()
+		replayed(server, false)
+		time.AfterFunc(50*time.Millisecond, func() { replayed(server, true) })
+		err := WaitForLSN(ctx, pool, "0/16B3748", 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := server.Count("SELECT COALESCE("); n < 2 {
+			t.Errorf("replica polled %d times, want it polled until it caught up", n)
+		}
+	})
+	t.Run("timeout", func(t *testing.T) {
+		server, pool := fakepg.Open()
+		defer pool.Close()
+		replayed(server, false)
+		err := WaitForLSN(ctx, pool, "0/16B3748", 30*time.Millisecond)
+		if !errors.Is(err, context.DeadlineExceeded) ||
+			!strings.Contains(err.Error(), "Waiting for replica to replay LSN 0/16B3748") {
+			t.Errorf("WaitForLSN() = %v, want a timeout", err)
+		}
+	})
+	t.Run("query fails", func(t *testing.T) {
+		server, pool := fakepg.Open()
+		defer pool.Close()
+		server.FailNext("SELECT COALESCE(", fakepg.ServerError("22P02", "invalid input syntax for type pg_lsn"))
+		err := WaitForLSN(ctx, pool, "not an LSN", time.Second)
+		if SQLState(err) != "22P02" || !strings.Contains(err.Error(), "Checking replayed LSN") {
+			t.Errorf("WaitForLSN() = %v, want the server error", err)
+		}
+	})
+}
+
+func TestCommitLSNServer(t *testing.T) {
+	db := serverDB(t)
+	ctx := context.Background()
+	f, err := NewFactory("lsn", db, WithCommitLSN(true)).Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	_, err = f.ExecContext(ctx, "CREATE TEMPORARY TABLE txmpg_test_lsn (id int)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Finalize()
+	if err == nil {
+		err = f.Commit()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsn := f.CommitLSN()
+	if lsn == "" {
+		t.Fatal("CommitLSN() is empty")
+	}
+	// The server is its own replica, and is already there
+	start := time.Now()
+	err = WaitForLSN(ctx, db, lsn, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d >= lsnPollInterval*10 {
+		t.Errorf("WaitForLSN() took %s", d)
+	}
+}
@@ -0,0 +1,50 @@
+package txmpg
+
+import "time"
+
+// Metrics receives the outcomes of finalizers so they can
+// be counted, e.g. by the Prometheus implementation in
+// the txmpgprom module. twoPhase distinguishes Finalizer2P
+// from Finalizer. Implementations are called on the
+// transaction's path, so they must be fast and safe for
+// concurrent use.
+type Metrics interface {
+	// Begun is called when a finalizer has started its
+	// transaction
+	Begun(name string, twoPhase bool)
+	// Committed is called when the transaction commits,
+	// with the time since it began and, for 2-phase
+	// transactions, the time since it was prepared, which
+	// is 0 if it was read-only and never prepared
+	Committed(name string, twoPhase bool, sinceBegin, sincePrepare time.Duration)
+	// Aborted is called when the transaction is rolled
+	// back
+	Aborted(name string, twoPhase bool)
+	// FinalizeFailed is called when Finalize() fails
+	FinalizeFailed(name string, twoPhase bool)
+	// PrepareFailed is called when PREPARE TRANSACTION
+	// fails
+	PrepareFailed(name string)
+	// CommitPreparedFailed is called when COMMIT PREPARED
+	// fails or its outcome is in doubt
+	CommitPreparedFailed(name string)
+}
+
+// nopMetrics is the default Metrics, which does nothing
+type nopMetrics struct{}
+
+func (nopMetrics) Begun(string, bool)                                   {}
+func (nopMetrics) Committed(string, bool, time.Duration, time.Duration) {}
+func (nopMetrics) Aborted(string, bool)                                 {}
+func (nopMetrics) FinalizeFailed(string, bool)                          {}
+func (nopMetrics) PrepareFailed(string)                                 {}
+func (nopMetrics) CommitPreparedFailed(string)                          {}
+
+// WithMetrics reports the finalizer's outcomes to metrics.
+// Pass it to NewFactory() to instrument every finalizer
+// the factory creates.
+func WithMetrics(metrics Metrics) Option {
+	return func(c *config) {
+		c.metrics = metrics
+	}
+}
@@ -0,0 +1,100 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// MonitorConfig configures MonitorPrepared()
+type MonitorConfig struct {
+	// Prefix limits the monitor to prepared transactions
+	// whose GIDs start with it
+	Prefix string
+	// Interval is how often pg_prepared_xacts is polled.
+	// The default is one minute.
+	Interval time.Duration
+	// StaleAfter is how long a transaction has to have
+	// been prepared before OnStale is called for it
+	StaleAfter time.Duration
+	// OnStale is called for each stale transaction. It is
+	// called once per transaction unless Repeat is set,
+	// in which case it is called on every poll.
+	OnStale func(PreparedTx)
+	Repeat  bool
+	// OnError is called when a poll fails. The monitor
+	// keeps polling; database/sql reconnects as needed.
+	// The default logs the error to the standard logger.
+	OnError func(error)
+}
+
+// MonitorPrepared polls the prepared transactions on the
+// server behind db every cfg.Interval until ctx is done,
+// calling cfg.OnStale for those that have been prepared
+// longer than cfg.StaleAfter. It also keeps the count
+// reported by ServerPrepared() up to date. It returns
+// immediately; the polling happens in a new goroutine.
+func MonitorPrepared(ctx context.Context, db *sql.DB, cfg MonitorConfig) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	if cfg.OnError == nil {
+		cfg.OnError = func(err error) {
+			log.Printf("MONITOR: %s", err.Error())
+		}
+	}
+	m := &monitor{db: db, cfg: cfg, alerted: map[string]bool{}}
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			err := m.poll(ctx)
+			if err != nil && ctx.Err() == nil {
+				cfg.OnError(err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// monitor is the state of MonitorPrepared() between
+// polls
+type monitor struct {
+	db  *sql.DB
+	cfg MonitorConfig
+	// alerted holds the GIDs OnStale has been called for
+	// that were still prepared at the last poll
+	alerted map[string]bool
+}
+
+// poll checks the prepared transactions once. After a
+// failed poll, alerted is left as it was, so that the
+// next successful one carries on without repeating
+// alerts.
+func (m *monitor) poll(ctx context.Context) error {
+	list, err := ListPrepared(ctx, m.db, m.cfg.Prefix)
+	if err != nil {
+		return err
+	}
+	counters.serverPrepared.Store(int64(len(list)))
+	seen := make(map[string]bool, len(list))
+	for _, p := range list {
+		if p.Age() < m.cfg.StaleAfter {
+			continue
+		}
+		seen[p.GID] = true
+		if m.alerted[p.GID] && !m.cfg.Repeat {
+			continue
+		}
+		if m.cfg.OnStale != nil {
+			m.cfg.OnStale(p)
+		}
+	}
+	m.alerted = seen
+	return nil
+}
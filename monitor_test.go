@@ -0,0 +1,147 @@
+package txmpg
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+func TestMonitorDeduplicates(t *testing.T) {
+	defer counters.serverPrepared.Store(0)
+	for _, repeat := range []bool{false, true} {
+		server, pool := fakepg.Open()
+		defer pool.Close()
+		old := time.Now().Add(-time.Hour)
+		server.PrepareAt("txmpg:orders:a", old)
+		server.PrepareAt("txmpg:orders:b", old)
+		server.PrepareAt("txmpg:orders:young", time.Now())
+		server.PrepareAt("txmpg:billing:old", old)
+		var alerts []string
+		m := &monitor{
+			db: pool,
+			cfg: MonitorConfig{
+				Prefix:     "txmpg:orders:",
+				StaleAfter: time.Minute,
+				OnStale:    func(p PreparedTx) { alerts = append(alerts, p.GID) },
+				Repeat:     repeat,
+			},
+			alerted: map[string]bool{},
+		}
+		poll := func(step string, want ...string) {
+			t.Helper()
+			alerts = nil
+			err := m.poll(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(alerts)
+			if !reflect.DeepEqual(alerts, want) {
+				t.Errorf("Repeat %t, %s: alerted %q, want %q", repeat, step, alerts, want)
+			}
+		}
+		poll("first poll", "txmpg:orders:a", "txmpg:orders:b")
+		if n := ServerPrepared(); n != 3 {
+			t.Errorf("ServerPrepared() = %d, want 3", n)
+		}
+		if repeat {
+			poll("second poll", "txmpg:orders:a", "txmpg:orders:b")
+			continue
+		}
+		poll("second poll")
+		// A transaction that is resolved and then prepared
+		// again under the same GID is a new offender
+		_, err := pool.Exec("ROLLBACK PREPARED " + QuoteGID("txmpg:orders:a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		poll("after rollback")
+		if n := ServerPrepared(); n != 2 {
+			t.Errorf("ServerPrepared() = %d, want 2", n)
+		}
+		server.PrepareAt("txmpg:orders:a", old)
+		poll("after prepare again", "txmpg:orders:a")
+	}
+}
+
+func TestMonitorPollFailure(t *testing.T) {
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	server.PrepareAt("txmpg:orders:a", time.Now().Add(-time.Hour))
+	var alerts int
+	m := &monitor{
+		db: pool,
+		cfg: MonitorConfig{
+			StaleAfter: time.Minute,
+			OnStale:    func(PreparedTx) { alerts++ },
+		},
+		alerted: map[string]bool{},
+	}
+	ctx := context.Background()
+	err := m.poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.FailNext("SELECT gid", fakepg.ServerError("57P01", "terminating connection"))
+	err = m.poll(ctx)
+	if SQLState(err) != "57P01" {
+		t.Fatalf("poll() = %v, want the server error", err)
+	}
+	err = m.poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alerts != 1 {
+		t.Errorf("alerted %d times across a failed poll, want 1", alerts)
+	}
+}
+
+func TestMonitorPrepared(t *testing.T) {
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	server.PrepareAt("txmpg:orders:a", time.Now().Add(-time.Hour))
+	var mu sync.Mutex
+	var alerts, errs int
+	recovered := make(chan struct{})
+	// Polls fail for a while, as they do while the
+	// server is unreachable, and then succeed again
+	for i := 0; i < 3; i++ {
+		server.FailNext("SELECT gid", fakepg.ServerError("57P01", "terminating connection"))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	MonitorPrepared(ctx, pool, MonitorConfig{
+		Interval:   5 * time.Millisecond,
+		StaleAfter: time.Minute,
+		OnStale: func(PreparedTx) {
+			mu.Lock()
+			defer mu.Unlock()
+			alerts++
+			if alerts == 1 {
+				close(recovered)
+			}
+		},
+		OnError: func(error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs++
+		},
+	})
+	select {
+	case <-recovered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("monitor didn't resume after the failures")
+	}
+	// More polls, which mustn't alert again
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	mu.Lock()
+	defer mu.Unlock()
+	if errs != 3 || alerts != 1 {
+		t.Errorf("%d errors and %d alerts, want 3 and 1", errs, alerts)
+	}
+}
@@ -0,0 +1,146 @@
+package txmpg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// maxNotifyPayload is the largest payload the server
+// accepts for a notification in the default configuration
+const maxNotifyPayload = 7999
+
+// notification is a payload waiting to be sent on a
+// channel
+type notification struct {
+	channel string
+	payload string
+}
+
+// notifyQueue holds the notifications registered with
+// Notify() until they are sent
+type notifyQueue struct {
+	mu    sync.Mutex
+	notes []notification
+}
+
+// add queues payload for channel
+func (q *notifyQueue) add(channel, payload string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.notes = append(q.notes, notification{channel: channel, payload: payload})
+}
+
+// take removes and returns the queued notifications
+func (q *notifyQueue) take() []notification {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	notes := q.notes
+	q.notes = nil
+	return notes
+}
+
+// Notify queues payload to be sent on channel with
+// pg_notify(), so listeners hear about it when the
+// transaction commits. The payloads queued for a channel
+// are sent together as a JSON array of strings, in the
+// order they were queued, split over as many
+// notifications as the server's payload limit requires.
+// A single phase finalizer sends them in the transaction
+// from Finalize(), after the deferred commits. PostgreSQL
+// can't prepare a transaction that has sent
+// notifications, so a two-phase one sends them after
+// COMMIT PREPARED succeeds, on a separate connection;
+// they are lost if the process dies in between.
+func (m *engine) Notify(channel, payload string) {
+	m.notifies.add(channel, payload)
+}
+
+// flushNotifications sends the queued notifications in a
+// single statement run by exec
+func flushNotifications(
+	ctx context.Context,
+	q *notifyQueue,
+	exec func(ctx context.Context, query string, args ...interface{}) error,
+	trace func(format string, args ...interface{}),
+) error {
+	notes := q.take()
+	if len(notes) == 0 {
+		return nil
+	}
+	query, args, channels := notifyStatement(notes)
+	err := exec(ctx, query, args...)
+	if err != nil {
+		return wrapError(err, "Sending notifications")
+	}
+	trace(
+		"sent %d notifications on %d channels as %d payloads",
+		len(notes), channels, len(args)/2,
+	)
+	return nil
+}
+
+// notifyStatement returns a statement that sends notes,
+// grouped by channel in the order each channel was first
+// used, and the number of channels
+func notifyStatement(notes []notification) (string, []interface{}, int) {
+	var channels []string
+	payloads := map[string][]string{}
+	for _, n := range notes {
+		if _, ok := payloads[n.channel]; !ok {
+			channels = append(channels, n.channel)
+		}
+		payloads[n.channel] = append(payloads[n.channel], n.payload)
+	}
+	var calls []string
+	var args []interface{}
+	for _, channel := range channels {
+		for _, payload := range notifyPayloads(payloads[channel]) {
+			args = append(args, channel, payload)
+			calls = append(
+				calls,
+				fmt.Sprintf("pg_notify($%d, $%d)", len(args)-1, len(args)),
+			)
+		}
+	}
+	return "SELECT " + strings.Join(calls, ", "), args, len(channels)
+}
+
+// notifyPayloads encodes payloads as JSON arrays, each no
+// longer than maxNotifyPayload unless a single payload is
+// longer on its own
+func notifyPayloads(payloads []string) []string {
+	var arrays []string
+	var current []string
+	size := 2 // the brackets
+	for _, p := range payloads {
+		encoded, _ := json.Marshal(p)
+		if len(current) > 0 && size+1+len(encoded) > maxNotifyPayload {
+			arrays = append(arrays, "["+strings.Join(current, ",")+"]")
+			current, size = nil, 2
+		}
+		if len(current) > 0 {
+			size++
+		}
+		current = append(current, string(encoded))
+		size += len(encoded)
+	}
+	if len(current) > 0 {
+		arrays = append(arrays, "["+strings.Join(current, ",")+"]")
+	}
+	return arrays
+}
+
+// sendNotifications sends the queued notifications once
+// the transaction has committed. The commit has already
+// succeeded, so a failure is only logged.
+func (m *engine) sendNotifications() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.cfg.maintenanceTimeout)
+	defer cancel()
+	err := flushNotifications(ctx, &m.notifies, m.finalizePool().Exec, m.Trace)
+	if err != nil {
+		m.logf(LevelWarn, "warning: notifications not sent: %s", err.Error())
+	}
+}
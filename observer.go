@@ -0,0 +1,100 @@
+package txmpg
+
+import "time"
+
+// Observer is notified of the lifecycle of finalizers,
+// e.g. for audit logging. Each method is called once per
+// transition, on the transaction's path, so it must be
+// fast and must not call Finalize(), Commit() or Abort().
+// Embed NopObserver to implement only some of the
+// methods.
+type Observer interface {
+	// TxBegan is called when the transaction has started
+	TxBegan(info FinalizerInfo)
+	// TxFinalized is called when Finalize() has run the
+	// deferred commits (and for a Finalizer2P, prepared
+	// the transaction), with the error if it failed
+	TxFinalized(info FinalizerInfo, err error)
+	// TxPrepared is called when a Finalizer2P has
+	// prepared its transaction as gid
+	TxPrepared(info FinalizerInfo, gid string)
+	// TxCommitted is called when the transaction has
+	// committed, with the time since it began
+	TxCommitted(info FinalizerInfo, d time.Duration)
+	// TxAborted is called when the transaction has been
+	// rolled back, with the reason set by
+	// SetAbortReason(), if any
+	TxAborted(info FinalizerInfo, reason string)
+}
+
+// NopObserver is an Observer that does nothing
+type NopObserver struct{}
+
+// TxBegan implements Observer
+func (NopObserver) TxBegan(FinalizerInfo) {}
+
+// TxFinalized implements Observer
+func (NopObserver) TxFinalized(FinalizerInfo, error) {}
+
+// TxPrepared implements Observer
+func (NopObserver) TxPrepared(FinalizerInfo, string) {}
+
+// TxCommitted implements Observer
+func (NopObserver) TxCommitted(FinalizerInfo, time.Duration) {}
+
+// TxAborted implements Observer
+func (NopObserver) TxAborted(FinalizerInfo, string) {}
+
+// MultiObserver is an Observer that notifies each of its
+// Observers in order
+type MultiObserver []Observer
+
+// TxBegan implements Observer
+func (o MultiObserver) TxBegan(info FinalizerInfo) {
+	for _, observer := range o {
+		observer.TxBegan(info)
+	}
+}
+
+// TxFinalized implements Observer
+func (o MultiObserver) TxFinalized(info FinalizerInfo, err error) {
+	for _, observer := range o {
+		observer.TxFinalized(info, err)
+	}
+}
+
+// TxPrepared implements Observer
+func (o MultiObserver) TxPrepared(info FinalizerInfo, gid string) {
+	for _, observer := range o {
+		observer.TxPrepared(info, gid)
+	}
+}
+
+// TxCommitted implements Observer
+func (o MultiObserver) TxCommitted(info FinalizerInfo, d time.Duration) {
+	for _, observer := range o {
+		observer.TxCommitted(info, d)
+	}
+}
+
+// TxAborted implements Observer
+func (o MultiObserver) TxAborted(info FinalizerInfo, reason string) {
+	for _, observer := range o {
+		observer.TxAborted(info, reason)
+	}
+}
+
+// WithObserver adds an Observer to the finalizer. It can
+// be used more than once, and the observers are notified
+// in the order they were added. Options given to
+// NewFactory() apply to every finalizer it creates, and
+// per call observers are added after them.
+func WithObserver(observer Observer) Option {
+	return func(c *config) {
+		if _, ok := c.observer.(NopObserver); ok {
+			c.observer = observer
+			return
+		}
+		c.observer = append(MultiObserver{c.observer}, observer)
+	}
+}
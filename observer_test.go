@@ -0,0 +1,142 @@
+package txmpg
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingObserver records the Observer calls it gets
+type recordingObserver struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (o *recordingObserver) record(call string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.calls = append(o.calls, call)
+}
+
+func (o *recordingObserver) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return strings.Join(o.calls, ",")
+}
+
+func (o *recordingObserver) TxBegan(info FinalizerInfo) {
+	o.record("began")
+}
+
+func (o *recordingObserver) TxFinalized(info FinalizerInfo, err error) {
+	if err != nil {
+		o.record("finalized with error")
+		return
+	}
+	o.record("finalized")
+}
+
+func (o *recordingObserver) TxPrepared(info FinalizerInfo, gid string) {
+	if gid != info.GID {
+		o.record("prepared as " + gid)
+		return
+	}
+	o.record("prepared")
+}
+
+func (o *recordingObserver) TxCommitted(info FinalizerInfo, d time.Duration) {
+	o.record("committed")
+}
+
+func (o *recordingObserver) TxAborted(info FinalizerInfo, reason string) {
+	o.record("aborted: " + reason)
+}
+
+func TestObserverTransitions(t *testing.T) {
+	failed := errors.New("deferred commit failed")
+	tests := []struct {
+		name     string
+		twoPhase bool
+		run      func(f lifecycle)
+		want     string
+	}{
+		{
+			name: "commit",
+			run: func(f lifecycle) {
+				f.Finalize()
+				f.Commit()
+				f.Commit()
+				f.Abort()
+			},
+			want: "began,finalized,committed",
+		},
+		{
+			name:     "2P commit",
+			twoPhase: true,
+			run: func(f lifecycle) {
+				f.Finalize()
+				f.Commit()
+				f.Commit()
+				f.Abort()
+			},
+			want: "began,prepared,finalized,committed",
+		},
+		{
+			name: "abort",
+			run: func(f lifecycle) {
+				f.(interface{ SetAbortReason(string) }).SetAbortReason("cancelled order")
+				f.Abort()
+				f.Abort()
+			},
+			want: "began,aborted: cancelled order",
+		},
+		{
+			name:     "2P abort after prepare",
+			twoPhase: true,
+			run: func(f lifecycle) {
+				f.Finalize()
+				f.Abort()
+				f.Abort()
+			},
+			want: "began,prepared,finalized,aborted: ",
+		},
+		{
+			name: "failed finalize",
+			run: func(f lifecycle) {
+				f.Defer(func() error { return failed })
+				f.Finalize()
+				f.Abort()
+			},
+			want: "began,finalized with error,aborted: ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			observer := &recordingObserver{}
+			_, factory := fakeFactory(t, "orders", WithObserver(observer))
+			tt.run(begin(t, factory, tt.twoPhase))
+			if got := observer.String(); got != tt.want {
+				t.Errorf("calls %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMultiObserver(t *testing.T) {
+	a, b := &recordingObserver{}, &recordingObserver{}
+	_, factory := fakeFactory(t, "orders")
+	f, err := factory.Begin(context.Background(), WithObserver(MultiObserver{a, b}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Finalize()
+	f.Commit()
+	for _, observer := range []*recordingObserver{a, b} {
+		if got := observer.String(); got != "began,finalized,committed" {
+			t.Errorf("calls %s", got)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package txmpg
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Option configures optional behavior of a finalizer.
+// Options are passed to the constructors
+type Option func(*config)
+
+// config holds the optional settings shared by both
+// finalizer types
+type config struct {
+	constraintCheck bool
+	isolation       sql.IsolationLevel
+	snapshot        string
+	logger          *log.Logger
+	traceHook       TraceHook
+	traceFormatter  TraceFormatter
+	metrics         Metrics
+	tracer          Tracer
+	observer        Observer
+	now             func() time.Time
+	warnAfter       time.Duration
+	warnWhileOpen   bool
+	// Threshold for the time between PREPARE and COMMIT
+	warnPreparedAfter time.Duration
+	slowQuery         time.Duration
+	logLevel          Level
+	sampler           func(name string) bool
+	prepareTimeout    time.Duration
+	deferPolicy       DeferPolicy
+	trackLeaks        bool
+	fastCommit        bool
+	lazyTxid          bool
+	lazyMetadata      bool
+	skipReadOnly      bool
+	stmtCache         bool
+	synchronousCommit string
+	commitLSN         bool
+	durability        Durability
+	standbyCheck      bool
+	commitConnTimeout time.Duration
+	finalizePool      *sql.DB
+	// Limit on the number of deferred commits
+	maxDeferredCommits int
+	// Roll back as soon as the context is finished
+	abortOnContextDone bool
+	// Fail construction if txid_status() is unavailable
+	requireTxidStatus bool
+	// Skip the max_prepared_transactions check
+	skipPreparedCheck bool
+	// Identifier for the prepared transaction
+	gid           string
+	readableGID   bool
+	gidApp        string
+	correlationID string
+	// Watchdog for prepared transactions
+	maxPreparedAge       time.Duration
+	onPreparedStale      func(gid string)
+	preparedAutoRollback bool
+	maxPreparedLifetime  time.Duration
+	journal              *Journal
+	// Bounds internal statements that can't use the
+	// caller's context because it may already be finished
+	maintenanceTimeout time.Duration
+	faults             FaultInjector
+	// nil means the package default ErrorHandler
+	onError *ErrorHandler
+	// Retry policy for BeginTx
+	beginAttempts int
+	beginBackoff  time.Duration
+	// Retry policy for ROLLBACK PREPARED
+	rollbackAttempts int
+	rollbackBackoff  time.Duration
+}
+
+// newConfig applies the options over the defaults
+func newConfig(opts []Option) config {
+	cfg := config{
+		maxDeferredCommits: 1000,
+		metrics:            nopMetrics{},
+		observer:           NopObserver{},
+		now:                time.Now,
+		beginAttempts:      1,
+		maintenanceTimeout: 3 * time.Second,
+		rollbackAttempts:   3,
+		rollbackBackoff:    500 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// txOptions returns the options for BeginTx, or nil if
+// the driver defaults should be used
+func (c *config) txOptions() *sql.TxOptions {
+	if c.isolation == sql.LevelDefault {
+		return nil
+	}
+	return &sql.TxOptions{Isolation: c.isolation}
+}
+
+// preparedWatchdog reports whether Finalizer2P needs to
+// watch its prepared transaction
+func (c *config) preparedWatchdog() bool {
+	return c.onPreparedStale != nil || c.preparedAutoRollback ||
+		c.maxPreparedLifetime > 0
+}
+
+// WithConstraintCheck makes Finalize() execute
+// SET CONSTRAINTS ALL IMMEDIATE after the deferred
+// commits have run, so that violations of deferred
+// constraints are reported by Finalize() (where the
+// coordinator can still abort every participant) instead
+// of by Commit(). Finalizer2P does not need this, as
+// PREPARE TRANSACTION already checks deferred constraints.
+func WithConstraintCheck(check bool) Option {
+	return func(c *config) {
+		c.constraintCheck = check
+	}
+}
+
+// WithIsolation sets the isolation level of the
+// transaction the finalizer begins
+func WithIsolation(level sql.IsolationLevel) Option {
+	return func(c *config) {
+		c.isolation = level
+	}
+}
+
+// WithSnapshot makes the new transaction use a snapshot
+// previously exported by another transaction's
+// ExportSnapshot(). The snapshot is imported before any
+// other statement is run. PostgreSQL only allows this for
+// REPEATABLE READ or SERIALIZABLE transactions; if no
+// isolation level is set, REPEATABLE READ is used.
+func WithSnapshot(id string) Option {
+	return func(c *config) {
+		c.snapshot = id
+	}
+}
+
+// WithLogger sets the logger that all status messages
+// will be delivered to, as if SetLogger() had been called
+// right after construction
+func WithLogger(l *log.Logger) Option {
+	return func(c *config) {
+		c.logger = l
+	}
+}
+
+// WithPrepareTimeout limits how long Finalizer2P will wait
+// for PREPARE TRANSACTION to complete, in addition to the
+// finalizer's context. This allows Finalize() to fail fast
+// so the coordinator can abort all participants when a
+// server stalls.
+func WithPrepareTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.prepareTimeout = d
+	}
+}
+
+// WithPanicOnAbortFailure restores the behavior of
+// panicking when Abort() is unable to roll back the
+// transaction. By default the failure is traced and made
+// available via AbortError(). WithPanicOnAbortFailure(true)
+// is shorthand for WithErrorHandler(PanicOnError()).
+// WithPanicOnAbortFailure(false) only stops the finalizer
+// panicking: it replaces PanicOnError(), whether it came
+// from an earlier option or SetDefaultErrorHandler(), with
+// LogErrors(), and leaves any other handler in place.
+func WithPanicOnAbortFailure(p bool) Option {
+	if p {
+		return WithErrorHandler(PanicOnError())
+	}
+	return func(c *config) {
+		if c.errorHandler().panic {
+			h := LogErrors()
+			c.onError = &h
+		}
+	}
+}
+
+// WithMaintenanceTimeout limits how long the finalizer
+// waits for each statement it runs on its own behalf,
+// such as the transaction status check in Abort() and
+// ROLLBACK PREPARED. These statements can't use the
+// finalizer's context, which is usually finished by the
+// time they run, so the timeout applies independently of
+// it. The default is 3 seconds.
+func WithMaintenanceTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.maintenanceTimeout = d
+	}
+}
+
+// WithRollbackPreparedRetry sets how many times
+// Finalizer2P.Abort() attempts ROLLBACK PREPARED before
+// giving up, and the delay before the first retry. The
+// delay doubles after each failed attempt. The default is
+// 3 attempts starting with a 500ms delay.
+func WithRollbackPreparedRetry(attempts int, backoff time.Duration) Option {
+	return func(c *config) {
+		if attempts < 1 {
+			attempts = 1
+		}
+		c.rollbackAttempts = attempts
+		c.rollbackBackoff = backoff
+	}
+}
+
+// WithPreparedTransactionsCheck controls whether
+// NewFinalizer2P verifies that the server allows prepared
+// transactions. The check is on by default, and costs one
+// extra query the first time a pool is used.
+func WithPreparedTransactionsCheck(check bool) Option {
+	return func(c *config) {
+		c.skipPreparedCheck = !check
+	}
+}
+
+// WithRequireTxidStatus makes NewFinalizer fail with
+// ErrTxidStatusUnavailable when the server doesn't provide
+// txid_status() (PostgreSQL before 10). By default the
+// finalizer falls back to committing and rolling back
+// without checking the transaction status first.
+func WithRequireTxidStatus(require bool) Option {
+	return func(c *config) {
+		c.requireTxidStatus = require
+	}
+}
+
+// WithAbortOnContextDone makes a Finalizer watch its
+// context and roll back the transaction as soon as the
+// context is finished before Commit(), so the connection
+// goes back to the pool immediately rather than when the
+// caller gets around to calling Abort(). Commit() after
+// that returns ErrAborted.
+func WithAbortOnContextDone(abort bool) Option {
+	return func(c *config) {
+		c.abortOnContextDone = abort
+	}
+}
+
+// WithPreparedWatchdog makes Finalizer2P call onStale with
+// the GID of its prepared transaction if the finalizer's
+// context finishes, or maxAge elapses (if greater than 0),
+// after Finalize() and before Commit(). A prepared
+// transaction holds its locks until it is resolved, so
+// this gives monitoring a chance to notice a stuck
+// coordinator.
+func WithPreparedWatchdog(maxAge time.Duration, onStale func(gid string)) Option {
+	return func(c *config) {
+		c.maxPreparedAge = maxAge
+		c.onPreparedStale = onStale
+	}
+}
+
+// WithPreparedAutoRollback makes the prepared transaction
+// watchdog (see WithPreparedWatchdog) roll back the
+// prepared transaction instead of only reporting it.
+// This is off by default because it changes 2-phase
+// commit semantics: the coordinator may already have
+// decided to commit.
+func WithPreparedAutoRollback(rollback bool) Option {
+	return func(c *config) {
+		c.preparedAutoRollback = rollback
+	}
+}
+
+// WithMaxPreparedLifetime limits how long a Finalizer2P's
+// prepared transaction may wait for Commit(). When the
+// lifetime runs out, the transaction is presumed
+// abandoned: it is rolled back, the finalizer becomes
+// Aborted, and Commit() returns ErrExpired. Unlike
+// WithPreparedAutoRollback(), it doesn't react to the
+// context finishing. Choose a lifetime far longer than a
+// healthy coordinator needs, since a commit decision made
+// just before it runs out is lost.
+func WithMaxPreparedLifetime(d time.Duration) Option {
+	return func(c *config) {
+		c.maxPreparedLifetime = d
+	}
+}
+
+// WithLeakTracking registers the finalizer so that it is
+// reported by ActiveFinalizers() until it is committed or
+// aborted, and logs a warning if it is garbage collected
+// before that happens. Tracking records the construction
+// stack, so it adds some overhead.
+func WithLeakTracking(track bool) Option {
+	return func(c *config) {
+		c.trackLeaks = track
+	}
+}
+
+// WithFastCommit makes Finalizer.Commit() skip checking
+// the transaction status with txid_status() before
+// committing, saving a round trip per transaction. The
+// trade-off is in the error reporting: without the check,
+// a transaction that the server already aborted is only
+// detected by the error from the COMMIT itself, which is
+// less descriptive and doesn't update State() to aborted.
+// BenchmarkCommit measures the difference.
+func WithFastCommit(fast bool) Option {
+	return func(c *config) {
+		c.fastCommit = fast
+	}
+}
+
+// WithLazyTxid stops the constructors from forcing the
+// server to assign a transaction ID, which wastes XIDs on
+// transactions that never write. The ID is looked up when
+// Commit() or Abort() need it, and a transaction that
+// never had one assigned is committed without checking
+// its status. Requires PostgreSQL 10 or later; it is
+// ignored on older servers.
+func WithLazyTxid(lazy bool) Option {
+	return func(c *config) {
+		c.lazyTxid = lazy
+	}
+}
+
+// WithLazyMetadata stops the constructors from looking up
+// the transaction ID and backend PID, unless a logger or
+// trace hook is set with an option, since traces show
+// them. The transaction ID is then looked up when
+// Commit() or Finalize() need it, as with WithLazyTxid(),
+// along with the PID; until then, or until LoadMetadata()
+// is called, Info() and error messages show them as 0.
+// This saves a round trip per transaction that doesn't
+// write, or that commits with WithFastCommit(); one that
+// writes otherwise needs the lookup to check its status.
+// BenchmarkLazyMetadata measures the difference. Requires
+// PostgreSQL 10 or later; it is ignored on older servers.
+func WithLazyMetadata(lazy bool) Option {
+	return func(c *config) {
+		c.lazyMetadata = lazy
+	}
+}
+
+// WithReadOnlySkipPrepare makes Finalizer2P.Finalize()
+// commit a transaction that never wrote instead of
+// preparing it, and Commit() then has nothing left to do,
+// saving PREPARE TRANSACTION, COMMIT PREPARED and the
+// WAL they write. A transaction that wrote nothing has
+// been assigned no transaction ID, so this only works with
+// WithLazyTxid() or WithLazyMetadata(); otherwise the
+// constructor assigns one. Locks that don't need a
+// transaction ID, such as pg_advisory_xact_lock(), are
+// released at Finalize() rather than Commit().
+func WithReadOnlySkipPrepare(skip bool) Option {
+	return func(c *config) {
+		c.skipReadOnly = skip
+	}
+}
+
+// skipMetadata reports whether the constructors can skip
+// the metadata query
+func (c *config) skipMetadata(caps capabilities) bool {
+	return c.lazyMetadata && caps.txidStatus &&
+		c.logger == nil && c.traceHook == nil
+}
+
+// WithClock replaces time.Now as the source of the
+// current time for the finalizer's timestamps and
+// durations, so that tests can control them
+func WithClock(now func() time.Time) Option {
+	return func(c *config) {
+		c.now = now
+	}
+}
@@ -0,0 +1,232 @@
+// Package outbox implements the transactional outbox
+// pattern on top of txmpg: messages are written to a
+// table through the same transaction as the business
+// change they announce, and a Poller publishes them once
+// that transaction has committed.
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/williammoran/txmpg/v2"
+)
+
+// Table is the name of the outbox table. Set it before
+// any messages are written if the default doesn't suit.
+var Table = "txmpg_outbox"
+
+// Message is a message in the outbox
+type Message struct {
+	// ID and Created are assigned by Write()
+	ID      int64
+	Created time.Time
+	Topic   string
+	Key     string
+	Payload []byte
+}
+
+// EnsureTable creates the outbox table and its index if
+// they don't exist
+func EnsureTable(ctx context.Context, db *sql.DB) error {
+	table := pq.QuoteIdentifier(Table)
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS ` + table + ` (
+			id bigserial PRIMARY KEY,
+			topic text NOT NULL,
+			key text NOT NULL,
+			payload bytea NOT NULL,
+			created timestamptz NOT NULL DEFAULT now(),
+			sent timestamptz
+		)`,
+		"CREATE INDEX IF NOT EXISTS " + pq.QuoteIdentifier(Table+"_unsent_idx") +
+			" ON " + table + " (id) WHERE sent IS NULL",
+	}
+	for _, stmt := range stmts {
+		_, err := db.ExecContext(ctx, stmt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write adds msg to the outbox through f's transaction,
+// so that it is only published if f commits
+func Write(f txmpg.TxFinalizer, msg Message) error {
+	return WriteContext(context.Background(), f, msg)
+}
+
+// WriteContext is Write() with a context for the insert
+func WriteContext(ctx context.Context, f txmpg.TxFinalizer, msg Message) error {
+	tx := f.PgTx()
+	if tx == nil {
+		return txmpg.ErrFinalized
+	}
+	_, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO "+pq.QuoteIdentifier(Table)+" (topic, key, payload) VALUES ($1, $2, $3)",
+		msg.Topic, msg.Key, msg.Payload,
+	)
+	return err
+}
+
+// Delivery chooses what happens when publishing and
+// marking messages sent can't both be completed
+type Delivery int
+
+const (
+	// AtLeastOnce marks messages sent in the same
+	// transaction that read them, after they have been
+	// published. If the poller fails in between, they are
+	// published again. This is the default.
+	AtLeastOnce Delivery = iota
+	// AtMostOnce marks messages sent and commits before
+	// publishing them. If publishing fails, they are lost.
+	AtMostOnce
+)
+
+// PollerConfig configures a Poller
+type PollerConfig struct {
+	// Publish delivers a batch of messages, in the order
+	// they were written. An error leaves the batch to be
+	// published again with AtLeastOnce.
+	Publish  func(ctx context.Context, msgs []Message) error
+	Delivery Delivery
+	// BatchSize limits the messages read per poll. The
+	// default is 100.
+	BatchSize int
+	// Logger receives poll failures from Start(). The
+	// default is the standard logger.
+	Logger *log.Logger
+}
+
+// Poller publishes the messages in the outbox. Several
+// pollers may run against the same table: each batch is
+// read with FOR UPDATE SKIP LOCKED, so they don't publish
+// the same messages, though messages may then be
+// published out of order.
+type Poller struct {
+	factory *txmpg.Factory
+	cfg     PollerConfig
+}
+
+// NewPoller creates a Poller that reads the outbox in
+// transactions begun by factory
+func NewPoller(factory *txmpg.Factory, cfg PollerConfig) *Poller {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.Default()
+	}
+	return &Poller{factory: factory, cfg: cfg}
+}
+
+// RunOnce publishes one batch of unsent messages,
+// returning how many it published
+func (p *Poller) RunOnce(ctx context.Context) (int, error) {
+	f, err := p.factory.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Abort()
+	msgs, err := p.read(ctx, f.PgTx())
+	if err != nil || len(msgs) == 0 {
+		return 0, err
+	}
+	if p.cfg.Delivery == AtLeastOnce {
+		err = p.cfg.Publish(ctx, msgs)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = p.markSent(ctx, f.PgTx(), msgs)
+	if err != nil {
+		return 0, err
+	}
+	err = f.Finalize()
+	if err != nil {
+		return 0, err
+	}
+	err = f.Commit()
+	if err != nil {
+		return 0, err
+	}
+	if p.cfg.Delivery == AtMostOnce {
+		err = p.cfg.Publish(ctx, msgs)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(msgs), nil
+}
+
+// read locks and returns a batch of unsent messages
+func (p *Poller) read(ctx context.Context, tx *sql.Tx) ([]Message, error) {
+	rows, err := tx.QueryContext(
+		ctx,
+		`SELECT id, created, topic, key, payload
+		FROM `+pq.QuoteIdentifier(Table)+`
+		WHERE sent IS NULL
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED`,
+		p.cfg.BatchSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var msgs []Message
+	for rows.Next() {
+		var m Message
+		err = rows.Scan(&m.ID, &m.Created, &m.Topic, &m.Key, &m.Payload)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+// markSent marks msgs as sent
+func (p *Poller) markSent(ctx context.Context, tx *sql.Tx, msgs []Message) error {
+	ids := make([]int64, len(msgs))
+	for i, m := range msgs {
+		ids[i] = m.ID
+	}
+	_, err := tx.ExecContext(
+		ctx,
+		"UPDATE "+pq.QuoteIdentifier(Table)+" SET sent = now() WHERE id = ANY($1)",
+		pq.Array(ids),
+	)
+	return err
+}
+
+// Start runs RunOnce every interval in a new goroutine
+// until ctx is done. A full batch is followed by another
+// poll straight away.
+func (p *Poller) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			n, err := p.RunOnce(ctx)
+			if err != nil && ctx.Err() == nil {
+				p.cfg.Logger.Printf("OUTBOX: %s", err.Error())
+			}
+			if n == p.cfg.BatchSize {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
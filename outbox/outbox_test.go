@@ -0,0 +1,253 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/williammoran/txmpg/v2"
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+// unsent scripts server to return msgs as the unsent
+// messages in the outbox
+func unsent(server *fakepg.Server, msgs ...Message) {
+	var rows [][]driver.Value
+	for _, m := range msgs {
+		rows = append(rows, []driver.Value{m.ID, m.Created, m.Topic, m.Key, m.Payload})
+	}
+	server.Answer(
+		"SELECT id, created, topic, key, payload",
+		[]string{"id", "created", "topic", "key", "payload"}, rows,
+	)
+}
+
+// ids returns the IDs of msgs
+func ids(msgs []Message) []int64 {
+	var ids []int64
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func TestWrite(t *testing.T) {
+	ctx := context.Background()
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	factory := txmpg.NewFactory("orders", pool)
+	f, err := factory.Begin2P(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	err = Write(f, Message{Topic: "orders", Key: "1", Payload: []byte("{}")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `INSERT INTO "txmpg_outbox" (topic, key, payload) VALUES ($1, $2, $3)`
+	if server.Count(want) != 1 {
+		t.Errorf("statements %q lack %q", server.Statements(), want)
+	}
+	err = f.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Write(f, Message{Topic: "orders", Key: "2"})
+	if !errors.Is(err, txmpg.ErrFinalized) {
+		t.Errorf("Write() after Finalize() = %v, want ErrFinalized", err)
+	}
+}
+
+func TestPollerCrashBeforeMarkSent(t *testing.T) {
+	ctx := context.Background()
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	msgs := []Message{
+		{ID: 1, Topic: "orders", Key: "1", Payload: []byte("a")},
+		{ID: 2, Topic: "orders", Key: "2", Payload: []byte("b")},
+	}
+	unsent(server, msgs...)
+	var published [][]int64
+	crash := true
+	poller := NewPoller(txmpg.NewFactory("outbox", pool), PollerConfig{
+		Publish: func(ctx context.Context, msgs []Message) error {
+			published = append(published, ids(msgs))
+			if crash {
+				crash = false
+				panic("publisher crashed")
+			}
+			return nil
+		},
+	})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("RunOnce() didn't panic")
+			}
+		}()
+		poller.RunOnce(ctx)
+	}()
+	if server.Count("UPDATE") != 0 || server.Count("ROLLBACK") != 1 {
+		t.Fatalf("crashed poll ran %q, want a rollback", server.Statements())
+	}
+	// The messages are still unsent, and the next poll
+	// publishes them again
+	n, err := poller.RunOnce(ctx)
+	if err != nil || n != 2 {
+		t.Fatalf("RunOnce() = %d, %v", n, err)
+	}
+	if !reflect.DeepEqual(published, [][]int64{{1, 2}, {1, 2}}) {
+		t.Errorf("published %v, want the batch twice", published)
+	}
+	if server.Count("UPDATE") != 1 || server.Count("COMMIT") != 1 {
+		t.Errorf("statements %q, want the batch marked sent", server.Statements())
+	}
+}
+
+func TestPollerMarkSentFails(t *testing.T) {
+	ctx := context.Background()
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	unsent(server, Message{ID: 7, Topic: "orders", Key: "7"})
+	server.FailNext("UPDATE", fakepg.ServerError("57P01", "terminating connection"))
+	var published int
+	poller := NewPoller(txmpg.NewFactory("outbox", pool), PollerConfig{
+		Publish: func(context.Context, []Message) error {
+			published++
+			return nil
+		},
+	})
+	_, err := poller.RunOnce(ctx)
+	if txmpg.SQLState(err) != "57P01" {
+		t.Fatalf("RunOnce() = %v, want the server error", err)
+	}
+	n, err := poller.RunOnce(ctx)
+	if err != nil || n != 1 || published != 2 {
+		t.Errorf("RunOnce() = %d, %v after %d publishes, want a redelivery", n, err, published)
+	}
+}
+
+func TestPollerAtMostOnce(t *testing.T) {
+	ctx := context.Background()
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	unsent(server, Message{ID: 1, Topic: "orders", Key: "1"})
+	var committed int
+	poller := NewPoller(txmpg.NewFactory("outbox", pool), PollerConfig{
+		Delivery: AtMostOnce,
+		Publish: func(context.Context, []Message) error {
+			committed = server.Count("COMMIT")
+			return errors.New("broker unavailable")
+		},
+	})
+	_, err := poller.RunOnce(ctx)
+	if err == nil || err.Error() != "broker unavailable" {
+		t.Fatalf("RunOnce() = %v, want the publish error", err)
+	}
+	if committed != 1 || server.Count("UPDATE") != 1 {
+		t.Errorf("published before marking sent: %q", server.Statements())
+	}
+}
+
+func TestPollerEmpty(t *testing.T) {
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	unsent(server)
+	poller := NewPoller(txmpg.NewFactory("outbox", pool), PollerConfig{
+		Publish: func(context.Context, []Message) error {
+			t.Fatal("Publish() called without messages")
+			return nil
+		},
+	})
+	n, err := poller.RunOnce(context.Background())
+	if err != nil || n != 0 {
+		t.Errorf("RunOnce() = %d, %v", n, err)
+	}
+}
+
+func TestPollerServer(t *testing.T) {
+	dsn := os.Getenv("TXMPG_TEST_DSN")
+	if dsn == "" {
+		t.Skip("TXMPG_TEST_DSN is not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	defer func(table string) { Table = table }(Table)
+	Table = "txmpg_test_outbox_" + uuid.New().String()[:8]
+	err = EnsureTable(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DROP TABLE " + pq.QuoteIdentifier(Table))
+	factory := txmpg.NewFactory("outbox", db)
+	write := func(key string, commit bool) {
+		t.Helper()
+		f, err := factory.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Abort()
+		err = Write(f, Message{Topic: "orders", Key: key, Payload: []byte(key)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !commit {
+			return
+		}
+		err = f.Finalize()
+		if err == nil {
+			err = f.Commit()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("1", true)
+	write("aborted", false)
+	write("2", true)
+	write("3", true)
+	var published []string
+	crash := true
+	poller := NewPoller(factory, PollerConfig{
+		BatchSize: 2,
+		Publish: func(ctx context.Context, msgs []Message) error {
+			for _, m := range msgs {
+				published = append(published, m.Key)
+			}
+			if crash {
+				crash = false
+				return errors.New("publisher crashed")
+			}
+			return nil
+		},
+	})
+	_, err = poller.RunOnce(ctx)
+	if err == nil {
+		t.Fatal("RunOnce() didn't fail")
+	}
+	for _, want := range []int{2, 1, 0} {
+		n, err := poller.RunOnce(ctx)
+		if err != nil || n != want {
+			t.Fatalf("RunOnce() = %d, %v, want %d", n, err, want)
+		}
+	}
+	if !reflect.DeepEqual(published, []string{"1", "2", "1", "2", "3"}) {
+		t.Errorf("published %q", published)
+	}
+	var left int
+	err = db.QueryRow("SELECT count(*) FROM " + pq.QuoteIdentifier(Table) + " WHERE sent IS NULL").Scan(&left)
+	if err != nil || left != 0 {
+		t.Errorf("%d unsent, %v", left, err)
+	}
+}
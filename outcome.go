@@ -0,0 +1,133 @@
+package txmpg
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/williammoran/txmpg/v2/internal/driver"
+)
+
+// checkTxStatus interprets the txid_status() of a
+// transaction that is about to be committed: nil if it is
+// in progress, ErrAborted if the server aborted it, and
+// an error for any other status
+func checkTxStatus(status string) error {
+	switch status {
+	case "in progress":
+		return nil
+	case "aborted":
+		return ErrAborted
+	}
+	return fmt.Errorf("Commit on TX in status '%s'", status)
+}
+
+// preparedStatus checks pg_prepared_xacts on pool for
+// gid
+func (c *config) preparedStatus(pool driver.Querier, gid string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.maintenanceTimeout)
+	defer cancel()
+	var exists bool
+	err := pool.QueryRow(
+		ctx,
+		"SELECT EXISTS (SELECT 1 FROM pg_prepared_xacts WHERE gid = $1)",
+		gid,
+	).Scan(&exists)
+	return exists, err
+}
+
+// rollbackPrepared issues ROLLBACK PREPARED for gid on
+// pool, retrying with backoff as configured by
+// WithRollbackPreparedRetry(), since failures are usually
+// transient. A prepared transaction that no longer exists
+// has been resolved by someone else, which counts as
+// success.
+func (c *config) rollbackPrepared(
+	pool driver.Querier, gid string, logf func(Level, string, ...interface{}),
+) error {
+	var err error
+	delay := c.rollbackBackoff
+	for attempt := 1; attempt <= c.rollbackAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		err = c.inject(FaultBeforeRollbackPrepared, gid)
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), c.maintenanceTimeout)
+			err = pool.Exec(ctx, "ROLLBACK PREPARED "+QuoteGID(gid))
+			cancel()
+		}
+		if err == nil {
+			return nil
+		}
+		if isUndefinedObject(err) {
+			// Someone else (an operator or a reaper) has
+			// already resolved it, which is just as good
+			logf(LevelDebug, "ROLLBACK PREPARED attempt %d: prepared transaction no longer exists", attempt)
+			return nil
+		}
+		logf(LevelWarn, "ROLLBACK PREPARED attempt %d failed: %s", attempt, err.Error())
+	}
+	return err
+}
+
+// commitPreparedFailed classifies an error from
+// COMMIT PREPARED of gid, checking pg_prepared_xacts on
+// pool if need be, and reports whether the transaction
+// turned out to be committed after all.
+//
+// A prepared transaction that is missing was resolved
+// earlier, most likely by a Commit() that reached the
+// server even though it reported an error, and gets an
+// error wrapping ErrAlreadyResolved. A server error means the commit
+// definitely failed. Anything else, such as a broken
+// connection or a cancelled statement, may have happened
+// after the server committed, so the prepared transaction
+// is looked up: if it is gone, the commit took effect (or
+// someone else rolled it back) and the error wraps
+// ErrCommitConfirmedGone; if it is still there, it wraps
+// ErrCommitNotApplied; and if the check fails too, the
+// outcome is in doubt. If ctx is finished, its error is
+// wrapped as well as err. annotate adds the finalizer's
+// IDs to the errors that get them.
+func (c *config) commitPreparedFailed(
+	ctx context.Context, pool driver.Querier, name, gid string, err error,
+	logf func(Level, string, ...interface{}), annotate func(error) error,
+) (bool, error) {
+	logf(LevelWarn, "COMMIT PREPARED error: %s", err.Error())
+	se, ok := asServerError(err)
+	if ok {
+		logf(LevelWarn, "COMMIT PREPARED server error: %s", se)
+	}
+	if isUndefinedObject(err) {
+		exists, checkErr := c.preparedStatus(pool, gid)
+		if checkErr != nil {
+			logf(LevelWarn, "failed to check pg_prepared_xacts: %s", checkErr.Error())
+		}
+		if checkErr == nil && !exists {
+			logf(LevelInfo, "prepared transaction was already resolved")
+			return true, annotate(wrapError(ErrAlreadyResolved, "COMMIT PREPARED "+gid))
+		}
+	}
+	c.metrics.CommitPreparedFailed(name)
+	ctxErr := ctx.Err()
+	if ctxErr != nil {
+		err = fmt.Errorf("%w (context: %w)", err, ctxErr)
+	}
+	if !IsAmbiguousCommitError(err) {
+		return false, annotate(wrapError(err, "Failed to commit prepared"))
+	}
+	exists, checkErr := c.preparedStatus(pool, gid)
+	switch {
+	case checkErr != nil:
+		logf(LevelError, "outcome of COMMIT PREPARED is unknown: %s", checkErr.Error())
+		counters.inDoubt.Add(1)
+		return false, annotate(&InDoubtError{GID: gid, Err: err})
+	case exists:
+		logf(LevelWarn, "COMMIT PREPARED did not take effect")
+		return false, annotate(fmt.Errorf("%w: %w", ErrCommitNotApplied, err))
+	}
+	logf(LevelInfo, "prepared transaction is gone after COMMIT PREPARED error")
+	return true, annotate(fmt.Errorf("%w: %w", ErrCommitConfirmedGone, err))
+}
@@ -0,0 +1,90 @@
+package txmpg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// parallelFinalizeLimit is the most finalizers that
+// ParallelFinalize() runs at once
+const parallelFinalizeLimit = 8
+
+// FinalizeError is a failure of one of the finalizers
+// passed to ParallelFinalize()
+type FinalizeError struct {
+	// Name is the finalizer's name, or its position in
+	// the arguments if it doesn't report one
+	Name string
+	Err  error
+}
+
+func (e *FinalizeError) Error() string {
+	return fmt.Sprintf("Finalize() of %s: %s", e.Name, e.Err.Error())
+}
+
+// Unwrap returns the error from Finalize()
+func (e *FinalizeError) Unwrap() error {
+	return e.Err
+}
+
+// ParallelFinalize calls Finalize() on each of fs
+// concurrently, so that the round trips to different
+// servers overlap, and returns the failures joined as
+// *FinalizeErrors. Once one fails, or ctx finishes, the
+// finalizers that haven't started are skipped; as with a
+// serial Finalize(), the caller should then abort all of
+// them. The finalizers' deferred commits run concurrently
+// with each other's, so any application state they share
+// must be safe for concurrent use.
+func ParallelFinalize(ctx context.Context, fs ...TxFinalizer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		errs    []error
+		skipped bool
+	)
+	sem := make(chan struct{}, parallelFinalizeLimit)
+	for i, f := range fs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			skipped = true
+			break
+		}
+		wg.Add(1)
+		go func(i int, f TxFinalizer) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := f.Finalize()
+			if err == nil {
+				return
+			}
+			cancel()
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, &FinalizeError{Name: finalizerName(i, f), Err: err})
+		}(i, f)
+	}
+	wg.Wait()
+	if len(errs) == 0 && skipped {
+		// Nothing failed, so the caller's context finished
+		return wrapError(ctx.Err(), "ParallelFinalize()")
+	}
+	return errors.Join(errs...)
+}
+
+// finalizerName returns the name of f, the i'th argument
+// to ParallelFinalize()
+func finalizerName(i int, f TxFinalizer) string {
+	named, ok := f.(interface{ Info() FinalizerInfo })
+	if ok {
+		return named.Info().Name
+	}
+	return fmt.Sprintf("finalizer %d", i)
+}
@@ -0,0 +1,132 @@
+package txmpg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+// participants begins a Finalizer2P on each of n fake
+// servers, named participant 0 and so on
+func participants(t *testing.T, n int) ([]*fakepg.Server, []TxFinalizer) {
+	t.Helper()
+	var servers []*fakepg.Server
+	var fs []TxFinalizer
+	for i := 0; i < n; i++ {
+		server, factory := fakeFactory(t, fmt.Sprintf("participant %d", i))
+		f, err := factory.Begin2P(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(f.Abort)
+		_, err = f.ExecContext(context.Background(), "INSERT INTO orders VALUES (1)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, server)
+		fs = append(fs, f)
+	}
+	return servers, fs
+}
+
+func TestParallelFinalizeLatency(t *testing.T) {
+	const latency = 20 * time.Millisecond
+	finalize := func(parallel bool) time.Duration {
+		servers, fs := participants(t, 5)
+		for _, server := range servers {
+			server.SetLatency(latency)
+		}
+		start := time.Now()
+		if parallel {
+			err := ParallelFinalize(context.Background(), fs...)
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			for _, f := range fs {
+				err := f.Finalize()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		d := time.Since(start)
+		for i, server := range servers {
+			if len(server.Prepared()) != 1 {
+				t.Errorf("participant %d not prepared", i)
+			}
+		}
+		return d
+	}
+	serial := finalize(false)
+	parallel := finalize(true)
+	t.Logf("serial %s, parallel %s", serial, parallel)
+	if parallel*2 > serial {
+		t.Errorf("ParallelFinalize() took %s, serial Finalize() %s", parallel, serial)
+	}
+}
+
+func TestParallelFinalizeFailures(t *testing.T) {
+	servers, fs := participants(t, 4)
+	servers[1].FailNext("PREPARE TRANSACTION", fakepg.ServerError("40001", "could not serialize access"))
+	servers[3].FailNext("PREPARE TRANSACTION", fakepg.ServerError("57P01", "terminating connection"))
+	err := ParallelFinalize(context.Background(), fs...)
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatalf("ParallelFinalize() = %v, want the failures joined", err)
+	}
+	got := map[string]string{}
+	for _, err := range joined.Unwrap() {
+		var fe *FinalizeError
+		if !errors.As(err, &fe) {
+			t.Fatalf("%v is not a *FinalizeError", err)
+		}
+		got[fe.Name] = SQLState(fe)
+	}
+	want := map[string]string{"participant 1": "40001", "participant 3": "57P01"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("failures %v, want %v", got, want)
+	}
+	if SQLState(err) == "" {
+		t.Errorf("errors.As can't find a server error in %v", err)
+	}
+}
+
+func TestParallelFinalizeSkipsAfterFailure(t *testing.T) {
+	servers, fs := participants(t, parallelFinalizeLimit+2)
+	for _, server := range servers[1:] {
+		server.SetLatency(50 * time.Millisecond)
+	}
+	servers[0].FailNext("PREPARE TRANSACTION", fakepg.ServerError("40001", "could not serialize access"))
+	err := ParallelFinalize(context.Background(), fs...)
+	var fe *FinalizeError
+	if !errors.As(err, &fe) || fe.Name != "participant 0" {
+		t.Fatalf("ParallelFinalize() = %v, want participant 0 to fail", err)
+	}
+	// The last two were waiting for a slot when the first
+	// failed
+	for _, f := range fs[parallelFinalizeLimit:] {
+		if s := f.(lifecycle).State(); s != StateActive {
+			t.Errorf("%s is %s, want it skipped", f.(lifecycle).Info().Name, s)
+		}
+	}
+}
+
+func TestParallelFinalizeContextDone(t *testing.T) {
+	servers, fs := participants(t, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := ParallelFinalize(ctx, fs...)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("ParallelFinalize() = %v, want context.Canceled", err)
+	}
+	for i, server := range servers {
+		if n := server.Count("PREPARE"); n != 0 {
+			t.Errorf("participant %d prepared", i)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package txmpg
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+// serverDB opens the PostgreSQL server at TXMPG_TEST_DSN,
+// skipping the test if it isn't set. Finalizer2P tests
+// need max_prepared_transactions > 0 on it.
+func serverDB(t testing.TB) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("TXMPG_TEST_DSN")
+	if dsn == "" {
+		t.Skip("TXMPG_TEST_DSN is not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = db.Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
@@ -0,0 +1,98 @@
+package txmpg
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/lib/pq"
+)
+
+// PGErrorDetails holds the fields of a PostgreSQL server
+// error independently of the driver that reported it
+type PGErrorDetails struct {
+	Code       string
+	Severity   string
+	Message    string
+	Detail     string
+	Hint       string
+	Schema     string
+	Table      string
+	Column     string
+	Constraint string
+}
+
+// String formats all the fields
+func (e *PGErrorDetails) String() string {
+	return fmt.Sprintf("%+v", *e)
+}
+
+// PGDetails returns the details of the PostgreSQL server
+// error wrapped in err, if there is one. All the errors
+// returned by the finalizers keep the driver's error in
+// their chain, so errors.As() with the driver's own type
+// works too; PGDetails does the same for both lib/pq and
+// pgx, e.g. to map unique_violation (23505) on a specific
+// constraint to a response code.
+func PGDetails(err error) (*PGErrorDetails, bool) {
+	return asServerError(err)
+}
+
+// sqlStater is implemented by driver errors that expose
+// their SQLSTATE, such as pgx's *pgconn.PgError
+type sqlStater interface {
+	SQLState() string
+}
+
+// asServerError finds a server error in err's chain.
+// lib/pq's *pq.Error is recognized directly; any other
+// error with a SQLState() method (such as pgx's
+// *pgconn.PgError) is recognized by that method, and its
+// detail fields are copied by name so that this package
+// doesn't depend on other drivers.
+func asServerError(err error) (*PGErrorDetails, bool) {
+	var pqerr *pq.Error
+	if errors.As(err, &pqerr) {
+		return &PGErrorDetails{
+			Code:       string(pqerr.Code),
+			Severity:   pqerr.Severity,
+			Message:    pqerr.Message,
+			Detail:     pqerr.Detail,
+			Hint:       pqerr.Hint,
+			Schema:     pqerr.Schema,
+			Table:      pqerr.Table,
+			Column:     pqerr.Column,
+			Constraint: pqerr.Constraint,
+		}, true
+	}
+	var stater sqlStater
+	if !errors.As(err, &stater) {
+		return nil, false
+	}
+	se := PGErrorDetails{Code: stater.SQLState()}
+	v := reflect.ValueOf(stater)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Struct {
+		se.Severity = stringField(v, "Severity")
+		se.Message = stringField(v, "Message")
+		se.Detail = stringField(v, "Detail")
+		se.Hint = stringField(v, "Hint")
+		se.Schema = stringField(v, "SchemaName")
+		se.Table = stringField(v, "TableName")
+		se.Column = stringField(v, "ColumnName")
+		se.Constraint = stringField(v, "ConstraintName")
+	}
+	return &se, true
+}
+
+// stringField returns the value of the named string field
+// of v, or an empty string if there is no such field
+func stringField(v reflect.Value, name string) string {
+	f := v.FieldByName(name)
+	if !f.IsValid() || f.Kind() != reflect.String {
+		return ""
+	}
+	return f.String()
+}
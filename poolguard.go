@@ -0,0 +1,93 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/williammoran/txmpg/v2/internal/driver"
+)
+
+// PoolExhaustedError is returned by Finalizer2P.Commit()
+// when no connection became available for COMMIT PREPARED
+// within the time set by WithCommitConnTimeout(). Nothing
+// was sent to the server, so the transaction is still
+// prepared and Commit() can be retried.
+type PoolExhaustedError struct {
+	// Wait is how long Commit() waited for a connection
+	Wait time.Duration
+	// Stats describes the pool when Commit() gave up
+	Stats sql.DBStats
+}
+
+func (e *PoolExhaustedError) Error() string {
+	return fmt.Sprintf(
+		"%s: no connection after %s (open %d, in use %d, idle %d, max %d, waiting %d)",
+		ErrPoolExhausted.Error(), e.Wait, e.Stats.OpenConnections,
+		e.Stats.InUse, e.Stats.Idle, e.Stats.MaxOpenConnections, e.Stats.WaitCount,
+	)
+}
+
+// Is makes errors.Is(err, ErrPoolExhausted) true
+func (e *PoolExhaustedError) Is(target error) bool {
+	return target == ErrPoolExhausted
+}
+
+// WithCommitConnTimeout limits how long Finalizer2P.Commit()
+// waits for a connection from the pool to run
+// COMMIT PREPARED, returning a *PoolExhaustedError when it
+// runs out. Without a limit, a pool whose connections are
+// all held by transactions waiting to commit deadlocks.
+// It is off by default.
+func WithCommitConnTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.commitConnTimeout = d
+	}
+}
+
+// WithFinalizePool makes Finalizer2P run the statements
+// that resolve its prepared transaction, COMMIT PREPARED,
+// ROLLBACK PREPARED and the checks of pg_prepared_xacts,
+// on pool instead of the pool the transaction was begun
+// on. A small pool reserved for this, to the same
+// database, guarantees that finalization can't be starved
+// by the transactions waiting on it. Pass it to
+// NewFactory() to reserve it for all of a factory's
+// finalizers.
+func WithFinalizePool(pool *sql.DB) Option {
+	return func(c *config) {
+		c.finalizePool = pool
+	}
+}
+
+// finalizePool returns the pool for resolving the
+// prepared transaction
+func (m *engine) finalizePool() driver.Pool {
+	if m.cfg.finalizePool != nil {
+		return sqlPool{m.cfg.finalizePool}
+	}
+	return m.pool
+}
+
+// commitConn takes a connection from the finalize pool
+// for COMMIT PREPARED, waiting no longer than
+// WithCommitConnTimeout() allows
+func (m *engine) commitConn(ctx context.Context) (driver.Conn, error) {
+	pool := m.finalizePool()
+	if m.cfg.commitConnTimeout <= 0 {
+		return pool.Conn(ctx)
+	}
+	acquireCtx, cancel := context.WithTimeout(ctx, m.cfg.commitConnTimeout)
+	defer cancel()
+	conn, err := pool.Conn(acquireCtx)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		counters.poolExhausted.Add(1)
+		return nil, &PoolExhaustedError{
+			Wait:  m.cfg.commitConnTimeout,
+			Stats: pool.Stats(),
+		}
+	}
+	return conn, err
+}
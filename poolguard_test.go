@@ -0,0 +1,98 @@
+package txmpg
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+func TestCommitConnTimeoutPoolExhausted(t *testing.T) {
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	pool.SetMaxOpenConns(2)
+	const timeout = 50 * time.Millisecond
+	factory := NewFactory("orders", pool, WithCommitConnTimeout(timeout))
+	ctx := context.Background()
+	begin := func() *Finalizer2P {
+		f, err := factory.Begin2P(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(f.Abort)
+		return f
+	}
+	// a is prepared, which gives its connection back, and
+	// then b and c take both connections
+	a := begin()
+	err := a.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, c := begin(), begin()
+
+	start := time.Now()
+	err = a.Commit()
+	var exhausted *PoolExhaustedError
+	if !errors.As(err, &exhausted) || !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("Commit() = %v, want a *PoolExhaustedError", err)
+	}
+	if waited := time.Since(start); waited < timeout {
+		t.Errorf("Commit() gave up after %s, before %s", waited, timeout)
+	}
+	if exhausted.Stats.MaxOpenConnections != 2 || exhausted.Stats.InUse != 2 {
+		t.Errorf("Stats = %+v, want both connections in use", exhausted.Stats)
+	}
+	if a.State() != StateFinalized || !contains(server.Prepared(), a.GID()) {
+		t.Fatalf("State() = %s after PoolExhaustedError, want still prepared", a.State())
+	}
+
+	// Once b and c give their connections back, everyone
+	// commits
+	done := make(chan error, 3)
+	var wg sync.WaitGroup
+	for _, f := range []*Finalizer2P{a, b, c} {
+		wg.Add(1)
+		go func(f *Finalizer2P) {
+			defer wg.Done()
+			if f != a {
+				err := f.Finalize()
+				if err != nil {
+					done <- err
+					return
+				}
+			}
+			for {
+				err := f.Commit()
+				if !errors.Is(err, ErrPoolExhausted) {
+					done <- err
+					return
+				}
+			}
+		}(f)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case err, ok := <-done:
+			if !ok {
+				if n := len(server.Committed()); n != 3 {
+					t.Errorf("%d prepared transactions committed, want 3", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Commit() = %v", err)
+			}
+		case <-deadline:
+			t.Fatal("transactions deadlocked on the pool")
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/williammoran/txmpg/v2/internal/driver"
+)
+
+// preparedEnabled records, per pool, that the server
+// allows prepared transactions. Changing the setting
+// requires a server restart, so it is checked once, but a
+// server that has them disabled is checked each time, so
+// that enabling them doesn't need the application to be
+// restarted too. The entry is dropped if PREPARE
+// TRANSACTION reports them disabled after all, such as
+// after a failover, and by ForgetServer().
+var preparedEnabled sync.Map
+
+// ForgetServer discards what has been cached about the
+// server behind pool, so that the next finalizer begun on
+// it checks the server again. Call it after the server
+// behind pool was replaced or reconfigured, or after
+// closing a pool that won't be used again, which the
+// cache would otherwise keep alive.
+func ForgetServer(pool *sql.DB) {
+	preparedEnabled.Delete(sqlPool{pool})
+	poolCapabilities.Delete(sqlPool{pool})
+}
+
+// checkPreparedTransactions returns
+// ErrPreparedTransactionsDisabled if the server behind
+// pool has max_prepared_transactions set to 0
+func checkPreparedTransactions(ctx context.Context, pool driver.Querier) error {
+	_, ok := preparedEnabled.Load(pool)
+	if ok {
+		return nil
+	}
+	var setting string
+	err := pool.QueryRow(
+		ctx, "SHOW max_prepared_transactions",
+	).Scan(&setting)
+	if err != nil {
+		return wrapError(err, "Checking max_prepared_transactions")
+	}
+	max, err := strconv.Atoi(setting)
+	if err != nil {
+		return wrapError(err, "Parsing max_prepared_transactions")
+	}
+	if max <= 0 {
+		return ErrPreparedTransactionsDisabled
+	}
+	preparedEnabled.Store(pool, true)
+	return nil
+}
+
+// PreparedTx describes a prepared transaction waiting on
+// the server, as listed in pg_prepared_xacts
+type PreparedTx struct {
+	GID      string
+	Prepared time.Time
+	Owner    string
+	Database string
+	// App and CorrelationID are parsed from the GID if
+	// it was generated by a Finalizer2P
+	App           string
+	CorrelationID string
+}
+
+// Age returns how long the transaction has been prepared
+func (p PreparedTx) Age() time.Duration {
+	return time.Since(p.Prepared)
+}
+
+// ListPrepared returns the prepared transactions on the
+// server behind db whose GIDs start with prefix, oldest
+// first. An empty prefix lists all of them. The list
+// covers every database on the server; a prepared
+// transaction can only be committed or rolled back from
+// a connection to its own Database.
+func ListPrepared(ctx context.Context, db *sql.DB, prefix string) ([]PreparedTx, error) {
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT gid, prepared, owner, database
+		FROM pg_prepared_xacts
+		WHERE left(gid, length($1)) = $1
+		ORDER BY prepared`,
+		prefix,
+	)
+	if err != nil {
+		return nil, wrapError(err, "Listing prepared transactions")
+	}
+	defer rows.Close()
+	var list []PreparedTx
+	for rows.Next() {
+		var p PreparedTx
+		err = rows.Scan(&p.GID, &p.Prepared, &p.Owner, &p.Database)
+		if err != nil {
+			return nil, wrapError(err, "Scanning prepared transactions")
+		}
+		info, err := ParseGID(p.GID)
+		if err == nil {
+			p.App = info.App
+			p.CorrelationID = info.CorrelationID
+		}
+		list = append(list, p)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, wrapError(err, "Listing prepared transactions")
+	}
+	return list, nil
+}
+
+// finishPrepared commits or rolls back the prepared
+// transaction gid from a connection in db, which must be
+// to the database it was prepared in. It returns an
+// error wrapping ErrAlreadyResolved if the transaction no
+// longer exists.
+func finishPrepared(ctx context.Context, db *sql.DB, gid string, commit bool) error {
+	stmt := "ROLLBACK PREPARED "
+	if commit {
+		stmt = "COMMIT PREPARED "
+	}
+	_, err := db.ExecContext(ctx, stmt+QuoteGID(gid))
+	if err == nil {
+		return nil
+	}
+	if isUndefinedObject(err) {
+		err = ErrAlreadyResolved
+	}
+	return wrapError(err, "Doing "+stmt+gid)
+}
+
+// listLocalPrepared is ListPrepared() limited to the
+// transactions that can be resolved through db, those in
+// its current database
+func listLocalPrepared(ctx context.Context, db *sql.DB, prefix string) ([]PreparedTx, error) {
+	var database string
+	err := db.QueryRowContext(ctx, "SELECT current_database()").Scan(&database)
+	if err != nil {
+		return nil, wrapError(err, "Getting current database")
+	}
+	list, err := ListPrepared(ctx, db, prefix)
+	if err != nil {
+		return nil, err
+	}
+	local := list[:0]
+	for _, p := range list {
+		if p.Database == database {
+			local = append(local, p)
+		}
+	}
+	return local, nil
+}
+
+// resolvePrepared carries out decision for p. A
+// transaction that someone else resolved in the meantime
+// is not an error.
+func resolvePrepared(ctx context.Context, db *sql.DB, p PreparedTx, decision Decision) ReapResult {
+	result := ReapResult{Tx: p, Decision: decision}
+	if decision == Skip {
+		return result
+	}
+	result.Err = finishPrepared(ctx, db, p.GID, decision == Commit)
+	if errors.Is(result.Err, ErrAlreadyResolved) {
+		result.Err = nil
+	}
+	return result
+}
@@ -0,0 +1,133 @@
+package txmpg
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+func TestListPrepared(t *testing.T) {
+	ctx := context.Background()
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	factory := NewFactory("orders", pool, WithReadableGID("orders"))
+	f, err := factory.Begin2P(ctx, WithCorrelationID("req-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	err = f.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	billing, err := NewGID("billing", "", WithReadableGID("billing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Prepare(billing)
+	server.Prepare("other-app-1")
+	server.Prepare("txmpg:ordersx:not-ours")
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"txmpg:orders:", []string{f.GID()}},
+		{"txmpg:", []string{billing, f.GID(), "txmpg:ordersx:not-ours"}},
+		{"other-", []string{"other-app-1"}},
+		{"", []string{"other-app-1", billing, f.GID(), "txmpg:ordersx:not-ours"}},
+		{"nothing", nil},
+	}
+	for _, tt := range tests {
+		list, err := ListPrepared(ctx, pool, tt.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gids []string
+		for _, p := range list {
+			gids = append(gids, p.GID)
+		}
+		if !reflect.DeepEqual(gids, tt.want) {
+			t.Errorf("ListPrepared(%q) = %q, want %q", tt.prefix, gids, tt.want)
+		}
+	}
+	list, err := ListPrepared(ctx, pool, "txmpg:orders:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := list[0]
+	if p.App != "orders" || p.CorrelationID != "req-1" || p.Owner != "fakepg" || p.Database != "fakepg" {
+		t.Errorf("ListPrepared() = %+v", p)
+	}
+	list, err = ListPrepared(ctx, pool, "other-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list[0].App != "" || list[0].CorrelationID != "" {
+		t.Errorf("foreign GID parsed as %+v", list[0])
+	}
+}
+
+func TestListPreparedError(t *testing.T) {
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	server.FailNext("SELECT gid", fakepg.ServerError("42501", "permission denied"))
+	list, err := ListPrepared(context.Background(), pool, "")
+	var pqErr *pq.Error
+	if list != nil || !errors.As(err, &pqErr) || pqErr.Code != "42501" {
+		t.Fatalf("ListPrepared() = %v, %v, want the server error", list, err)
+	}
+	if !strings.Contains(err.Error(), "Listing prepared transactions") {
+		t.Errorf("error %q lacks context", err)
+	}
+}
+
+func TestListPreparedServer(t *testing.T) {
+	db := serverDB(t)
+	ctx := context.Background()
+	// The prefix holds LIKE wildcards, which must match
+	// only themselves
+	prefix := "txmpg-test_%" + uuid.New().String() + ":"
+	prepare := func(gid string) {
+		t.Helper()
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tx.Exec("PREPARE TRANSACTION " + QuoteGID(gid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// PREPARE TRANSACTION ended the transaction
+		tx.Rollback()
+		t.Cleanup(func() { db.Exec("ROLLBACK PREPARED " + QuoteGID(gid)) })
+	}
+	first, second := prefix+"first", prefix+"second"
+	prepare(first)
+	time.Sleep(10 * time.Millisecond)
+	prepare(second)
+	prepare("txmpg-testX%" + uuid.New().String())
+	list, err := ListPrepared(ctx, db, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].GID != first || list[1].GID != second {
+		t.Fatalf("ListPrepared() = %+v, want %s then %s", list, first, second)
+	}
+	var user, database string
+	err = db.QueryRow("SELECT current_user, current_database()").Scan(&user, &database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range list {
+		if p.Owner != user || p.Database != database || p.Prepared.IsZero() || p.Age() < 0 {
+			t.Errorf("ListPrepared() = %+v", p)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Decision is what to do with a prepared transaction
+// whose coordinator is gone
+type Decision int
+
+const (
+	// Rollback rolls the prepared transaction back
+	Rollback Decision = iota
+	// Commit commits the prepared transaction
+	Commit
+	// Skip leaves the prepared transaction alone
+	Skip
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Rollback:
+		return "rollback"
+	case Commit:
+		return "commit"
+	case Skip:
+		return "skip"
+	}
+	return "unknown"
+}
+
+// ReaperConfig configures a Reaper
+type ReaperConfig struct {
+	// Prefix limits the Reaper to prepared transactions
+	// whose GIDs start with it. Set it whenever other
+	// applications prepare transactions on the server.
+	Prefix string
+	// MaxAge is how long a transaction has to have been
+	// prepared before the Reaper considers it orphaned.
+	// It should be much longer than any Finalizer2P
+	// takes between PREPARE and COMMIT PREPARED.
+	MaxAge time.Duration
+	// Decide chooses what to do with each orphaned
+	// transaction. If it is nil, they are all rolled back.
+	Decide func(PreparedTx) Decision
+	// OnResult, if set, is called with the outcome for
+	// each orphaned transaction
+	OnResult func(ReapResult)
+	// Logger receives a line for each orphaned
+	// transaction. The default is the standard logger.
+	Logger *log.Logger
+}
+
+// ReapResult is what the Reaper or ResolveInDoubt() did
+// with one prepared transaction
+type ReapResult struct {
+	Tx       PreparedTx
+	Decision Decision
+	// Err is the error from COMMIT PREPARED or ROLLBACK
+	// PREPARED. A transaction that was resolved by
+	// someone else in the meantime is not an error.
+	Err error
+}
+
+// Reaper resolves prepared transactions left on a server
+// by Finalizer2Ps that never finished them, usually
+// because the process crashed between PREPARE and COMMIT
+// PREPARED. Until they are resolved they hold their locks
+// and stop VACUUM from removing old rows.
+type Reaper struct {
+	db  *sql.DB
+	cfg ReaperConfig
+}
+
+// NewReaper creates a Reaper for the database behind db.
+// Prepared transactions can only be resolved from the
+// database they were prepared in, so transactions in
+// other databases on the same server are ignored.
+func NewReaper(db *sql.DB, cfg ReaperConfig) *Reaper {
+	if cfg.Decide == nil {
+		cfg.Decide = func(PreparedTx) Decision { return Rollback }
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.Default()
+	}
+	return &Reaper{db: db, cfg: cfg}
+}
+
+// RunOnce resolves the orphaned prepared transactions
+// currently on the server and returns what it did with
+// each of them. A failure to resolve one transaction
+// doesn't stop the rest; the error is in its result.
+// RunOnce itself only fails if the transactions can't be
+// listed.
+func (r *Reaper) RunOnce(ctx context.Context) ([]ReapResult, error) {
+	list, err := listLocalPrepared(ctx, r.db, r.cfg.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	var results []ReapResult
+	for _, p := range list {
+		if p.Age() < r.cfg.MaxAge {
+			continue
+		}
+		result := resolvePrepared(ctx, r.db, p, r.cfg.Decide(p))
+		r.report(result)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// report logs result and passes it to OnResult
+func (r *Reaper) report(result ReapResult) {
+	if result.Err != nil {
+		r.cfg.Logger.Printf(
+			"REAPER: %s of GID %s prepared %s ago failed: %s",
+			result.Decision, result.Tx.GID, result.Tx.Age(), result.Err.Error(),
+		)
+	} else {
+		r.cfg.Logger.Printf(
+			"REAPER: %s of GID %s prepared %s ago",
+			result.Decision, result.Tx.GID, result.Tx.Age(),
+		)
+	}
+	if r.cfg.OnResult != nil {
+		r.cfg.OnResult(result)
+	}
+}
+
+// Start runs RunOnce every interval in a new goroutine
+// until ctx is done
+func (r *Reaper) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			_, err := r.RunOnce(ctx)
+			if err != nil && ctx.Err() == nil {
+				r.cfg.Logger.Printf("REAPER: %s", err.Error())
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
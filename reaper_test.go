@@ -0,0 +1,220 @@
+package txmpg
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+func TestReaperRunOnce(t *testing.T) {
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	old := time.Now().Add(-2 * time.Hour)
+	server.PrepareAt("txmpg:orders:rollback", old)
+	server.PrepareAt("txmpg:orders:commit", old.Add(time.Minute))
+	server.PrepareAt("txmpg:orders:skip", old.Add(2*time.Minute))
+	server.PrepareAt("txmpg:orders:young", time.Now())
+	server.PrepareAt("txmpg:billing:old", old)
+	var buf bytes.Buffer
+	var reported []ReapResult
+	reaper := NewReaper(pool, ReaperConfig{
+		Prefix: "txmpg:orders:",
+		MaxAge: time.Hour,
+		Decide: func(p PreparedTx) Decision {
+			switch p.GID {
+			case "txmpg:orders:commit":
+				return Commit
+			case "txmpg:orders:skip":
+				return Skip
+			}
+			return Rollback
+		},
+		OnResult: func(r ReapResult) { reported = append(reported, r) },
+		Logger:   log.New(&buf, "", 0),
+	})
+	results, err := reaper.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]Decision{}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Errorf("%s of %s failed: %v", r.Decision, r.Tx.GID, r.Err)
+		}
+		got[r.Tx.GID] = r.Decision
+	}
+	want := map[string]Decision{
+		"txmpg:orders:rollback": Rollback,
+		"txmpg:orders:commit":   Commit,
+		"txmpg:orders:skip":     Skip,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("RunOnce() did %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(reported, results) {
+		t.Errorf("OnResult() got %+v, want %+v", reported, results)
+	}
+	if c := server.Committed(); !reflect.DeepEqual(c, []string{"txmpg:orders:commit"}) {
+		t.Errorf("committed %q", c)
+	}
+	if r := server.RolledBack(); !reflect.DeepEqual(r, []string{"txmpg:orders:rollback"}) {
+		t.Errorf("rolled back %q", r)
+	}
+	left := server.Prepared()
+	sort.Strings(left)
+	if !reflect.DeepEqual(left, []string{"txmpg:billing:old", "txmpg:orders:skip", "txmpg:orders:young"}) {
+		t.Errorf("left %q prepared", left)
+	}
+	for _, line := range []string{
+		"REAPER: rollback of GID txmpg:orders:rollback",
+		"REAPER: commit of GID txmpg:orders:commit",
+		"REAPER: skip of GID txmpg:orders:skip",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("log %q lacks %q", buf.String(), line)
+		}
+	}
+}
+
+func TestReaperContinuesAfterFailure(t *testing.T) {
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	server.Prepare("txmpg:orders:a")
+	server.Prepare("txmpg:orders:b")
+	server.Prepare("txmpg:orders:c")
+	server.FailNext("ROLLBACK PREPARED", fakepg.ServerError("57P01", "terminating connection"))
+	var buf bytes.Buffer
+	reaper := NewReaper(pool, ReaperConfig{Logger: log.New(&buf, "", 0)})
+	results, err := reaper.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("RunOnce() = %+v, want 3 results", results)
+	}
+	var failed []string
+	for _, r := range results {
+		if r.Decision != Rollback {
+			t.Errorf("%s got %s, want the default rollback", r.Tx.GID, r.Decision)
+		}
+		if r.Err != nil {
+			failed = append(failed, r.Tx.GID)
+		}
+	}
+	if len(failed) != 1 || SQLState(results[0].Err) != "57P01" {
+		t.Fatalf("failed %q with %v, want only the first", failed, results[0].Err)
+	}
+	if left := server.Prepared(); !reflect.DeepEqual(left, failed) {
+		t.Errorf("left %q prepared, want %q", left, failed)
+	}
+	if !strings.Contains(buf.String(), "REAPER: rollback of GID "+failed[0]) ||
+		!strings.Contains(buf.String(), "failed: Doing ROLLBACK PREPARED "+failed[0]) {
+		t.Errorf("log %q lacks the failure", buf.String())
+	}
+}
+
+func TestReaperAlreadyResolved(t *testing.T) {
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	reaper := NewReaper(pool, ReaperConfig{
+		Decide: func(p PreparedTx) Decision {
+			// Someone else resolves it first
+			_, err := pool.Exec("COMMIT PREPARED " + QuoteGID(p.GID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return Rollback
+		},
+		Logger: log.New(&bytes.Buffer{}, "", 0),
+	})
+	server.Prepare("txmpg:orders:a")
+	results, err := reaper.RunOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Err != nil {
+		t.Errorf("RunOnce() = %+v, want no error", results)
+	}
+}
+
+func TestReaperStart(t *testing.T) {
+	server, pool := fakepg.Open()
+	defer pool.Close()
+	done := make(chan ReapResult, 2)
+	reaper := NewReaper(pool, ReaperConfig{
+		OnResult: func(r ReapResult) { done <- r },
+		Logger:   log.New(&bytes.Buffer{}, "", 0),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reaper.Start(ctx, 10*time.Millisecond)
+	// Left after the first run
+	time.Sleep(20 * time.Millisecond)
+	server.Prepare("txmpg:orders:a")
+	select {
+	case r := <-done:
+		if r.Tx.GID != "txmpg:orders:a" || r.Err != nil {
+			t.Errorf("reaped %+v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start() didn't reap the orphan")
+	}
+	cancel()
+	time.Sleep(30 * time.Millisecond)
+	server.Prepare("txmpg:orders:b")
+	time.Sleep(30 * time.Millisecond)
+	if len(server.Prepared()) != 1 {
+		t.Errorf("reaper still running after its context finished")
+	}
+}
+
+func TestReaperServer(t *testing.T) {
+	db := serverDB(t)
+	ctx := context.Background()
+	factory := NewFactory("reaper", db, WithReadableGID("reaper-test"))
+	orphan := func() string {
+		t.Helper()
+		f, err := factory.Begin2P(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Finalize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The process "crashes": the finalizer is
+		// dropped without Commit() or Abort()
+		gid := f.GID()
+		t.Cleanup(func() { db.Exec("ROLLBACK PREPARED " + QuoteGID(gid)) })
+		return gid
+	}
+	old := orphan()
+	time.Sleep(300 * time.Millisecond)
+	young := orphan()
+	reaper := NewReaper(db, ReaperConfig{
+		Prefix: "txmpg:reaper-test:",
+		MaxAge: 200 * time.Millisecond,
+		Logger: log.New(&bytes.Buffer{}, "", 0),
+	})
+	results, err := reaper.RunOnce(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Tx.GID != old || results[0].Err != nil {
+		t.Fatalf("RunOnce() = %+v, want %s rolled back", results, old)
+	}
+	list, err := ListPrepared(ctx, db, "txmpg:reaper-test:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].GID != young {
+		t.Errorf("left %+v prepared, want only %s", list, young)
+	}
+}
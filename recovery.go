@@ -0,0 +1,142 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// RecoveryConfig configures RecoverOnStartup(). Exactly
+// one decision source should be set; they are consulted
+// in the order Decide, Journal, DecisionTable.
+type RecoveryConfig struct {
+	// Prefix and App identify this application's
+	// prepared transactions: their GIDs must start with
+	// Prefix, and if App is set they must have been
+	// generated with WithReadableGID(App)
+	Prefix string
+	App    string
+	// Decide chooses what to do with each transaction
+	Decide func(PreparedTx) Decision
+	// Journal is a Journal the finalizers used
+	Journal *Journal
+	// DecisionTable is the table that RecordDecision()
+	// wrote to in the database behind Decider
+	DecisionTable string
+	Decider       *sql.DB
+	// RetryInterval is how long to wait before trying
+	// again to resolve the transactions that failed. The
+	// default is one second.
+	RetryInterval time.Duration
+}
+
+// ErrNoDecisionSource is returned by RecoverOnStartup()
+// when its RecoveryConfig has no way to decide what to
+// do with a prepared transaction
+var ErrNoDecisionSource = errors.New("no recovery decision source configured")
+
+// RecoverOnStartup resolves the prepared transactions left
+// on dbs by an earlier run of this application, so that
+// their locks are released before it starts work. It
+// keeps retrying the ones that fail until they are all
+// resolved or ctx is done, and reports the last outcome
+// for every GID it found. The error combines failures to
+// list the prepared transactions and, if some could not
+// be resolved, ctx.Err().
+//
+// It must run before this application begins any
+// transactions, and while no other instance of it is
+// running, since it can't tell their prepared
+// transactions from orphans.
+func RecoverOnStartup(ctx context.Context, dbs []*sql.DB, cfg RecoveryConfig) (Report, error) {
+	decide, err := cfg.decider()
+	if err != nil {
+		return Report{}, err
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = time.Second
+	}
+	var order []string
+	results := map[string]ReapResult{}
+	for {
+		var errs []error
+		failed := false
+		for _, db := range dbs {
+			list, err := listLocalPrepared(ctx, db, cfg.Prefix)
+			if err != nil {
+				errs = append(errs, err)
+				failed = true
+				continue
+			}
+			for _, p := range list {
+				if !cfg.owns(p) {
+					continue
+				}
+				decision, err := decide(ctx, p)
+				result := ReapResult{Tx: p, Decision: decision, Err: err}
+				if err == nil {
+					result = resolvePrepared(ctx, db, p, decision)
+				}
+				if result.Err == nil && decision != Skip && cfg.Journal != nil {
+					result.Err = cfg.Journal.forget(ctx, p.GID)
+				}
+				if _, ok := results[p.GID]; !ok {
+					order = append(order, p.GID)
+				}
+				results[p.GID] = result
+				failed = failed || result.Err != nil
+			}
+		}
+		if !failed {
+			return collectReport(order, results), nil
+		}
+		select {
+		case <-ctx.Done():
+			errs = append(errs, ctx.Err())
+			return collectReport(order, results), errors.Join(errs...)
+		case <-time.After(cfg.RetryInterval):
+		}
+	}
+}
+
+// owns reports whether p was prepared by this application
+func (cfg *RecoveryConfig) owns(p PreparedTx) bool {
+	info, err := ParseGID(p.GID)
+	if err != nil {
+		return false
+	}
+	return cfg.App == "" || info.App == cfg.App
+}
+
+// decider returns the configured decision source
+func (cfg *RecoveryConfig) decider() (func(context.Context, PreparedTx) (Decision, error), error) {
+	switch {
+	case cfg.Decide != nil:
+		return func(_ context.Context, p PreparedTx) (Decision, error) {
+			return cfg.Decide(p), nil
+		}, nil
+	case cfg.Journal != nil:
+		return func(ctx context.Context, p PreparedTx) (Decision, error) {
+			return cfg.Journal.decision(ctx, p.GID)
+		}, nil
+	case cfg.DecisionTable != "" && cfg.Decider != nil:
+		return func(ctx context.Context, p PreparedTx) (Decision, error) {
+			if p.CorrelationID == "" {
+				return Skip, nil
+			}
+			return lookupDecision(ctx, cfg.Decider, cfg.DecisionTable, p.CorrelationID)
+		}, nil
+	}
+	return nil, ErrNoDecisionSource
+}
+
+// collectReport lists results in the order their GIDs
+// were first found
+func collectReport(order []string, results map[string]ReapResult) Report {
+	var report Report
+	for _, gid := range order {
+		report.Results = append(report.Results, results[gid])
+	}
+	return report
+}
@@ -0,0 +1,67 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// Report is what ResolveInDoubt() did
+type Report struct {
+	// Results has one entry for each prepared transaction
+	// that was passed to the decide function
+	Results []ReapResult
+}
+
+// Failed returns the results whose COMMIT PREPARED or
+// ROLLBACK PREPARED failed
+func (r Report) Failed() []ReapResult {
+	var failed []ReapResult
+	for _, result := range r.Results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// ResolveInDoubt resolves the prepared transactions left
+// by Finalizer2Ps on each of participants. decide is
+// called for every prepared transaction in the
+// participant's database with a GID that a Finalizer2P
+// generated, and the transaction is committed, rolled
+// back or skipped as it returns. Transactions that were
+// resolved by someone else in the meantime are not
+// errors; other failures are in the Report and don't
+// stop the rest. The returned error combines failures to
+// list the prepared transactions on a participant.
+//
+// Like RecoverFromJournal(), it must only be run when no
+// coordinator is between PREPARE and COMMIT PREPARED, or
+// decide must be able to tell those transactions apart.
+func ResolveInDoubt(
+	ctx context.Context,
+	participants []*sql.DB,
+	decide func(gid string, info PreparedTx) Decision,
+) (Report, error) {
+	var report Report
+	var errs []error
+	for _, db := range participants {
+		list, err := listLocalPrepared(ctx, db, "")
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, p := range list {
+			_, err = ParseGID(p.GID)
+			if err != nil {
+				continue
+			}
+			report.Results = append(
+				report.Results,
+				resolvePrepared(ctx, db, p, decide(p.GID, p)),
+			)
+		}
+	}
+	return report, errors.Join(errs...)
+}
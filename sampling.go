@@ -0,0 +1,39 @@
+package txmpg
+
+import "math/rand"
+
+// WithTraceSampling traces only a fraction of
+// transactions, chosen at random with probability p when
+// the finalizer is constructed. A sampled transaction is
+// traced completely, and an unsampled one only logs
+// messages at LevelWarn and above.
+func WithTraceSampling(p float64) Option {
+	return WithTraceSampler(func(string) bool {
+		return rand.Float64() < p
+	})
+}
+
+// WithTraceSampler decides whether to trace a transaction
+// by calling sample with the finalizer's name when the
+// finalizer is constructed. See WithTraceSampling().
+func WithTraceSampler(sample func(name string) bool) Option {
+	return func(c *config) {
+		c.sampler = sample
+	}
+}
+
+// sampled makes the sampling decision for a new
+// finalizer
+func (c *config) sampled(name string) bool {
+	if c.sampler == nil {
+		return true
+	}
+	return c.sampler(name)
+}
+
+// Sampled reports whether the transaction was chosen to
+// be traced, so that application logging can follow the
+// same decision
+func (m *engine) Sampled() bool {
+	return m.sampled
+}
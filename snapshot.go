@@ -0,0 +1,81 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/williammoran/txmpg/v2/internal/driver"
+)
+
+// ExportSnapshot exports the transaction's snapshot so
+// that other finalizers on the same database can see
+// exactly the same data by passing the returned ID to
+// WithSnapshot(). The snapshot can only be imported while
+// this transaction is still open. Once the transaction
+// of a Finalizer has been submitted to an AsyncCommitter
+// it returns ErrHandedOff, and once that of a Finalizer2P
+// has been prepared ErrFinalized.
+func (m *engine) ExportSnapshot() (string, error) {
+	tx := m.transaction("ExportSnapshot()")
+	if tx == nil {
+		return "", m.finalizerError(
+			wrapError(m.errNoTransaction(), "ExportSnapshot()"),
+		)
+	}
+	id, err := exportSnapshot(m.ctx, tx)
+	if err != nil {
+		return "", m.finalizerError(err)
+	}
+	m.logf(LevelInfo, "Exported snapshot %s", id)
+	return id, nil
+}
+
+// exportSnapshot runs pg_export_snapshot() on tx
+func exportSnapshot(ctx context.Context, tx driver.Querier) (string, error) {
+	var id string
+	err := tx.QueryRow(ctx, "SELECT pg_export_snapshot()").Scan(&id)
+	if err != nil {
+		return "", wrapError(err, "pg_export_snapshot() failed")
+	}
+	return id, nil
+}
+
+// prepareSnapshot validates the isolation level for a
+// snapshot import, defaulting it to REPEATABLE READ. It
+// must be called before the transaction is begun.
+func (c *config) prepareSnapshot() error {
+	if c.snapshot == "" {
+		return nil
+	}
+	switch c.isolation {
+	case sql.LevelDefault:
+		c.isolation = sql.LevelRepeatableRead
+	case sql.LevelRepeatableRead, sql.LevelSerializable:
+	default:
+		return fmt.Errorf(
+			"WithSnapshot(%s) requires REPEATABLE READ or SERIALIZABLE isolation, not %s",
+			c.snapshot, c.isolation,
+		)
+	}
+	return nil
+}
+
+// importSnapshot runs SET TRANSACTION SNAPSHOT if a
+// snapshot was requested. It must be the first statement
+// executed in tx.
+func (c *config) importSnapshot(ctx context.Context, tx driver.Querier) error {
+	if c.snapshot == "" {
+		return nil
+	}
+	err := tx.Exec(
+		ctx, "SET TRANSACTION SNAPSHOT "+pq.QuoteLiteral(c.snapshot),
+	)
+	if err != nil {
+		return wrapError(
+			err, fmt.Sprintf("Importing snapshot %s", c.snapshot),
+		)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package txmpg
+
+import "context"
+
+// Tracer creates spans for distributed tracing, e.g.
+// with the OpenTelemetry implementation in the txmpgotel
+// module. A finalizer starts a "transaction" span as a
+// child of its constructor's context, which lasts until
+// the transaction is committed or aborted, and
+// "finalize" and "commit" spans as children of it.
+type Tracer interface {
+	Start(ctx context.Context, name string, info FinalizerInfo) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer. End is called with
+// the finalizer's description at the end of the span and
+// the error of the operation, if any.
+type Span interface {
+	End(info FinalizerInfo, err error)
+}
+
+// nopSpan is the span used without a Tracer
+type nopSpan struct{}
+
+func (nopSpan) End(FinalizerInfo, error) {}
+
+// WithTracer makes the finalizer create spans with
+// tracer
+func WithTracer(tracer Tracer) Option {
+	return func(c *config) {
+		c.tracer = tracer
+	}
+}
+
+// startTxSpan starts the span that covers the lifetime of
+// a finalizer's transaction, returning the context for its
+// child spans
+func (c *config) startTxSpan(ctx context.Context, info FinalizerInfo) (context.Context, Span) {
+	if c.tracer == nil {
+		return ctx, nopSpan{}
+	}
+	return c.tracer.Start(ctx, "transaction", info)
+}
+
+// startSpan starts a child span of the transaction span
+func (c *config) startSpan(ctx context.Context, name string, info FinalizerInfo) Span {
+	if c.tracer == nil {
+		return nopSpan{}
+	}
+	_, span := c.tracer.Start(ctx, name, info)
+	return span
+}
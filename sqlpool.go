@@ -0,0 +1,124 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/williammoran/txmpg/v2/internal/driver"
+)
+
+// sqlPool is the database/sql implementation of
+// driver.Pool, which Finalizer and Finalizer2P run on
+type sqlPool struct {
+	db *sql.DB
+}
+
+func (p sqlPool) Exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := p.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (p sqlPool) QueryRow(ctx context.Context, query string, args ...interface{}) driver.Row {
+	return p.db.QueryRowContext(ctx, query, args...)
+}
+
+func (p sqlPool) Begin(ctx context.Context, opts *sql.TxOptions) (driver.Tx, error) {
+	tx, err := p.db.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return sqlTx{tx: tx}, nil
+}
+
+func (p sqlPool) Conn(ctx context.Context) (driver.Conn, error) {
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sqlConn{conn: conn}, nil
+}
+
+func (p sqlPool) Stats() sql.DBStats {
+	return p.db.Stats()
+}
+
+func (p sqlPool) TxDone(err error) bool {
+	return isTxDone(err)
+}
+
+// sqlTx is the database/sql implementation of driver.Tx.
+// database/sql binds the transaction to the context of
+// BeginTx(), so Commit() and Rollback() ignore theirs.
+type sqlTx struct {
+	tx *sql.Tx
+}
+
+func (t sqlTx) Exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := t.tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (t sqlTx) QueryRow(ctx context.Context, query string, args ...interface{}) driver.Row {
+	return t.tx.QueryRowContext(ctx, query, args...)
+}
+
+// batchSavepoint is set before a batch, so that a failed
+// batch can be run again one statement at a time
+const batchSavepoint = "txmpg_batch"
+
+// ExecBatch sends queries to the server as a single
+// multi-statement query. The server runs them in order
+// and stops at the first failure, without saying which
+// statement failed, so the batch is rolled back to a
+// savepoint set in the same query and run again one
+// statement at a time to find it.
+func (t sqlTx) ExecBatch(ctx context.Context, queries []string) error {
+	_, err := t.tx.ExecContext(
+		ctx,
+		"SAVEPOINT "+batchSavepoint+";\n"+batchStatement(queries)+
+			";\nRELEASE SAVEPOINT "+batchSavepoint,
+	)
+	if err == nil {
+		return nil
+	}
+	_, rollbackErr := t.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+batchSavepoint)
+	if rollbackErr != nil {
+		return err
+	}
+	for i, query := range queries {
+		_, stmtErr := t.tx.ExecContext(ctx, query)
+		if stmtErr != nil {
+			return &driver.BatchError{Index: i, Err: stmtErr}
+		}
+	}
+	// The batch succeeded the second time, but its first
+	// failure still stands
+	return err
+}
+
+func (t sqlTx) Commit(context.Context) error {
+	return t.tx.Commit()
+}
+
+func (t sqlTx) Rollback(context.Context) error {
+	return t.tx.Rollback()
+}
+
+// sqlConn is the database/sql implementation of
+// driver.Conn
+type sqlConn struct {
+	conn *sql.Conn
+}
+
+func (c sqlConn) Exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := c.conn.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (c sqlConn) QueryRow(ctx context.Context, query string, args ...interface{}) driver.Row {
+	return c.conn.QueryRowContext(ctx, query, args...)
+}
+
+func (c sqlConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,49 @@
+package txmpg
+
+// State describes where a finalizer is in the lifecycle
+// of its transaction
+type State int
+
+const (
+	// StateActive is an open transaction that has not
+	// been finalized
+	StateActive State = iota
+	// StateFinalized is a transaction that has been
+	// successfully finalized but not committed
+	StateFinalized
+	// StateFailed is a transaction whose Finalize()
+	// failed. It can only be aborted.
+	StateFailed
+	// StateCommitted is a committed transaction
+	StateCommitted
+	// StateAborted is a transaction that was rolled back
+	StateAborted
+	// StateAbortFailed is a transaction that Abort() was
+	// unable to roll back. A Finalizer2P in this state
+	// leaves a prepared transaction on the server that
+	// must be resolved by recovery tooling.
+	StateAbortFailed
+)
+
+var stateNames = map[State]string{
+	StateActive:      "active",
+	StateFinalized:   "finalized",
+	StateFailed:      "failed",
+	StateCommitted:   "committed",
+	StateAborted:     "aborted",
+	StateAbortFailed: "abort failed",
+}
+
+func (s State) String() string {
+	name, ok := stateNames[s]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
+// terminal reports whether s ends the lifecycle of the
+// transaction
+func (s State) terminal() bool {
+	return s == StateCommitted || s == StateAborted || s == StateAbortFailed
+}
@@ -0,0 +1,365 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxTracedArgs and maxTracedArgLen limit how much of a
+// statement's arguments are traced
+const (
+	maxTracedArgs   = 10
+	maxTracedArgLen = 64
+)
+
+// statementLog counts and times the statements run
+// through a finalizer
+type statementLog struct {
+	count atomic.Int64
+	slow  time.Duration
+	now   func() time.Time
+	trace func(level Level, format string, args ...interface{})
+}
+
+// done records a statement that started at start, and
+// traces it, with a warning if it was slow. rows is the
+// number of rows affected, or -1 if unknown.
+func (s *statementLog) done(
+	start time.Time, query string, args []interface{}, rows int64, err error,
+) {
+	s.count.Add(1)
+	d := s.now().Sub(start)
+	if s.slow > 0 && d >= s.slow {
+		s.trace(
+			LevelWarn, "warning: slow statement took %s: %s args: %s",
+			d, query, formatArgs(args),
+		)
+	}
+	switch {
+	case err != nil:
+		s.trace(LevelDebug, "statement (%d args) failed after %s: %s error: %s", len(args), d, query, err.Error())
+	case rows >= 0:
+		s.trace(LevelDebug, "statement (%d args) affected %d rows in %s: %s", len(args), rows, d, query)
+	default:
+		s.trace(LevelDebug, "statement (%d args) ran in %s: %s", len(args), d, query)
+	}
+}
+
+// formatArgs formats statement arguments for traces,
+// truncating long values and long lists
+func formatArgs(args []interface{}) string {
+	parts := make([]string, 0, len(args))
+	for i, arg := range args {
+		if i == maxTracedArgs {
+			parts = append(parts, fmt.Sprintf("(%d more)", len(args)-i))
+			break
+		}
+		v := fmt.Sprintf("%v", arg)
+		if len(v) > maxTracedArgLen {
+			v = v[:maxTracedArgLen] + "..."
+		}
+		parts = append(parts, v)
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+// WithSlowQueryThreshold makes the finalizer trace a
+// warning, including the SQL and its arguments, for each
+// statement run through TracedTx() or the finalizer's
+// ExecContext(), QueryContext() or QueryRowContext() that
+// takes d or longer. Statements run directly on PgTx()
+// are not timed.
+func WithSlowQueryThreshold(d time.Duration) Option {
+	return func(c *config) {
+		c.slowQuery = d
+	}
+}
+
+// WithStatementCache makes TracedTx() and the finalizer's
+// ExecContext(), QueryContext() and QueryRowContext()
+// prepare each distinct query once per transaction and
+// reuse the prepared statement, as PrepareCached() does.
+// It saves the server parsing and planning statements
+// that a transaction runs many times. lib/pq parses a
+// statement with arguments in a round trip of its own,
+// so reusing it also halves its round trips, while a
+// statement without arguments that runs once costs an
+// extra round trip. BenchmarkStatementCache measures the
+// difference.
+func WithStatementCache(cache bool) Option {
+	return func(c *config) {
+		c.stmtCache = cache
+	}
+}
+
+// stmtCache holds the statements prepared in a
+// transaction, by query
+type stmtCache struct {
+	mu    sync.Mutex
+	tx    *sql.Tx
+	stmts map[string]*sql.Stmt
+}
+
+// get returns the statement for query prepared in tx,
+// preparing it if it isn't cached. Statements prepared in
+// an earlier transaction are discarded.
+func (c *stmtCache) get(ctx context.Context, tx *sql.Tx, query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tx != tx {
+		c.tx = tx
+		c.stmts = map[string]*sql.Stmt{}
+	}
+	stmt, ok := c.stmts[query]
+	if ok {
+		return stmt, nil
+	}
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+// reset forgets the cached statements when the
+// transaction ends; database/sql closes them
+func (c *stmtCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tx = nil
+	c.stmts = nil
+}
+
+// TracedTx wraps the finalizer's transaction so that
+// every statement is counted and traced with its SQL,
+// argument count, duration, rows affected and error, and
+// slow statements are reported as configured by
+// WithSlowQueryThreshold(). Results are passed through
+// untouched. Use Tx() for anything not wrapped here;
+// statements run that way, or through a prepared *sql.Stmt,
+// are not traced.
+type TracedTx struct {
+	tx  *sql.Tx
+	log *statementLog
+	// cache is set by WithStatementCache()
+	cache *stmtCache
+}
+
+// Tx returns the wrapped transaction
+func (t *TracedTx) Tx() *sql.Tx {
+	return t.tx
+}
+
+// ExecContext runs a statement in the transaction
+func (t *TracedTx) ExecContext(
+	ctx context.Context, query string, args ...interface{},
+) (sql.Result, error) {
+	start := t.log.now()
+	var result sql.Result
+	var err error
+	if t.cache != nil {
+		var stmt *sql.Stmt
+		stmt, err = t.cache.get(ctx, t.tx, query)
+		if err == nil {
+			result, err = stmt.ExecContext(ctx, args...)
+		}
+	} else {
+		result, err = t.tx.ExecContext(ctx, query, args...)
+	}
+	rows := int64(-1)
+	if err == nil {
+		affected, rerr := result.RowsAffected()
+		if rerr == nil {
+			rows = affected
+		}
+	}
+	t.log.done(start, query, args, rows, err)
+	return result, err
+}
+
+// Exec runs a statement in the transaction
+func (t *TracedTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.ExecContext(context.Background(), query, args...)
+}
+
+// QueryContext runs a query in the transaction
+func (t *TracedTx) QueryContext(
+	ctx context.Context, query string, args ...interface{},
+) (*sql.Rows, error) {
+	start := t.log.now()
+	var rows *sql.Rows
+	var err error
+	if t.cache != nil {
+		var stmt *sql.Stmt
+		stmt, err = t.cache.get(ctx, t.tx, query)
+		if err == nil {
+			rows, err = stmt.QueryContext(ctx, args...)
+		}
+	} else {
+		rows, err = t.tx.QueryContext(ctx, query, args...)
+	}
+	t.log.done(start, query, args, -1, err)
+	return rows, err
+}
+
+// Query runs a query in the transaction
+func (t *TracedTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return t.QueryContext(context.Background(), query, args...)
+}
+
+// Row is the result of TracedTx.QueryRowContext(). Like
+// *sql.Row, it defers errors to Scan(), and it can also
+// carry the error of a finalizer whose transaction is no
+// longer available.
+type Row struct {
+	row *sql.Row
+	err error
+}
+
+// Scan copies the columns of the row into dest, as
+// sql.Row.Scan() does
+func (r *Row) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.row.Scan(dest...)
+}
+
+// Err returns the error, if any, that Scan() would
+// return, without scanning
+func (r *Row) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.row.Err()
+}
+
+// QueryRowContext runs a query that returns at most one
+// row in the transaction. Errors are deferred to Scan(),
+// so they are not traced.
+func (t *TracedTx) QueryRowContext(
+	ctx context.Context, query string, args ...interface{},
+) *Row {
+	start := t.log.now()
+	var row *sql.Row
+	if t.cache != nil {
+		stmt, err := t.cache.get(ctx, t.tx, query)
+		if err == nil {
+			row = stmt.QueryRowContext(ctx, args...)
+		}
+	}
+	if row == nil {
+		// Without the cache, or if preparing failed, in
+		// which case the error is repeated by Scan()
+		row = t.tx.QueryRowContext(ctx, query, args...)
+	}
+	t.log.done(start, query, args, -1, nil)
+	return &Row{row: row}
+}
+
+// QueryRow runs a query that returns at most one row in
+// the transaction
+func (t *TracedTx) QueryRow(query string, args ...interface{}) *Row {
+	return t.QueryRowContext(context.Background(), query, args...)
+}
+
+// PrepareContext creates a prepared statement for use in
+// the transaction. Executions of the statement are not
+// traced.
+func (t *TracedTx) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	start := t.log.now()
+	stmt, err := t.tx.PrepareContext(ctx, query)
+	t.log.done(start, query, nil, -1, err)
+	return stmt, err
+}
+
+// Prepare creates a prepared statement for use in the
+// transaction
+func (t *TracedTx) Prepare(query string) (*sql.Stmt, error) {
+	return t.PrepareContext(context.Background(), query)
+}
+
+// TracedTx returns the transaction wrapped to trace
+// every statement. Like PgTx(), it returns nil once the
+// transaction of a Finalizer has been submitted to an
+// AsyncCommitter, or that of a Finalizer2P prepared.
+func (m sqlFinalizer) TracedTx() *TracedTx {
+	tx := m.PgTx()
+	if tx == nil {
+		return nil
+	}
+	return &TracedTx{tx: tx, log: &m.statements, cache: m.statementCache()}
+}
+
+// statementCache returns the cache for TracedTx, or nil
+// if WithStatementCache() is off
+func (m sqlFinalizer) statementCache() *stmtCache {
+	if !m.cfg.stmtCache {
+		return nil
+	}
+	return &m.stmts
+}
+
+// PrepareCached returns a statement prepared in the
+// transaction for query, preparing it the first time
+// and returning the same *sql.Stmt after that. The
+// statement must not be closed; it is closed when the
+// transaction is prepared or ends. Once the transaction of
+// a Finalizer has been submitted to an AsyncCommitter it
+// returns ErrHandedOff, and once that of a Finalizer2P has
+// been prepared ErrFinalized.
+func (m sqlFinalizer) PrepareCached(ctx context.Context, query string) (*sql.Stmt, error) {
+	tx := m.PgTx()
+	if tx == nil {
+		return nil, m.finalizerError(m.errNoTransaction())
+	}
+	return m.stmts.get(ctx, tx, query)
+}
+
+// ExecContext runs a statement in the transaction. Once
+// the transaction is no longer available it returns
+// ErrHandedOff or ErrFinalized, as PrepareCached() does.
+// See TracedTx.
+func (m sqlFinalizer) ExecContext(
+	ctx context.Context, query string, args ...interface{},
+) (sql.Result, error) {
+	tx := m.TracedTx()
+	if tx == nil {
+		return nil, m.finalizerError(m.errNoTransaction())
+	}
+	return tx.ExecContext(ctx, query, args...)
+}
+
+// QueryContext runs a query in the transaction. Once the
+// transaction is no longer available it returns
+// ErrHandedOff or ErrFinalized, as PrepareCached() does.
+// See TracedTx.
+func (m sqlFinalizer) QueryContext(
+	ctx context.Context, query string, args ...interface{},
+) (*sql.Rows, error) {
+	tx := m.TracedTx()
+	if tx == nil {
+		return nil, m.finalizerError(m.errNoTransaction())
+	}
+	return tx.QueryContext(ctx, query, args...)
+}
+
+// QueryRowContext runs a query that returns at most one
+// row in the transaction. Once the transaction is no
+// longer available the row's Scan() returns ErrHandedOff
+// or ErrFinalized, as PrepareCached() does. See TracedTx.
+func (m sqlFinalizer) QueryRowContext(
+	ctx context.Context, query string, args ...interface{},
+) *Row {
+	tx := m.TracedTx()
+	if tx == nil {
+		return &Row{err: m.finalizerError(m.errNoTransaction())}
+	}
+	return tx.QueryRowContext(ctx, query, args...)
+}
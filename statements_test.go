@@ -0,0 +1,124 @@
+package txmpg
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+)
+
+// querier is what TracedTx has in common with *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+// scanner is what *Row has in common with *sql.Row
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// runStatements runs the same statements through q and
+// returns what they produced, running QueryRow() with
+// queryRow
+func runStatements(t *testing.T, q querier, queryRow func(string, ...interface{}) scanner) []interface{} {
+	t.Helper()
+	ctx := context.Background()
+	var results []interface{}
+	result, err := q.ExecContext(ctx, "INSERT INTO orders VALUES ($1)", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	affected, err := result.RowsAffected()
+	results = append(results, affected, err)
+	rows, err := q.QueryContext(ctx, "SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var n int
+		results = append(results, rows.Scan(&n), n)
+	}
+	results = append(results, rows.Err(), rows.Close())
+	var n int
+	results = append(results, queryRow("SELECT $1", 1).Scan(&n), n)
+	stmt, err := q.PrepareContext(ctx, "SELECT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results = append(results, stmt.QueryRowContext(ctx).Scan(&n), n, stmt.Close())
+	return results
+}
+
+func TestTracedTxMatchesTx(t *testing.T) {
+	var messages []string
+	_, factory := fakeFactory(t, "orders", WithTraceHook(func(ev TraceEvent) {
+		messages = append(messages, ev.Message)
+	}))
+	f, err := factory.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	plain := runStatements(t, f.PgTx(), func(query string, args ...interface{}) scanner {
+		return f.PgTx().QueryRow(query, args...)
+	})
+	messages = nil
+	traced := runStatements(t, f.TracedTx(), func(query string, args ...interface{}) scanner {
+		return f.TracedTx().QueryRow(query, args...)
+	})
+	if len(plain) != len(traced) {
+		t.Fatalf("results %v through TracedTx(), want %v", traced, plain)
+	}
+	for i := range plain {
+		if plain[i] != traced[i] {
+			t.Errorf("result %d = %v through TracedTx(), want %v", i, traced[i], plain[i])
+		}
+	}
+	want := []string{
+		"statement (1 args) affected 1 rows in ",
+		"statement (0 args) ran in ",
+		"statement (1 args) ran in ",
+		"statement (0 args) ran in ",
+	}
+	if len(messages) != len(want) {
+		t.Fatalf("traces %q, want one per statement", messages)
+	}
+	for i, prefix := range want {
+		if !strings.HasPrefix(messages[i], prefix) {
+			t.Errorf("trace %q, want %q...", messages[i], prefix)
+		}
+	}
+	if !strings.HasSuffix(messages[0], ": INSERT INTO orders VALUES ($1)") {
+		t.Errorf("trace %q lacks the SQL", messages[0])
+	}
+	if n := f.Stats().Statements; n != 4 {
+		t.Errorf("Stats().Statements = %d, want 4", n)
+	}
+}
+
+func TestTracedTxError(t *testing.T) {
+	var messages []string
+	server, factory := fakeFactory(t, "orders", WithTraceHook(func(ev TraceEvent) {
+		messages = append(messages, ev.Message)
+	}))
+	f, err := factory.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	violation := fakepg.ServerError("23505", "duplicate key value")
+	server.FailNext("INSERT INTO orders", violation)
+	_, err = f.TracedTx().ExecContext(context.Background(), "INSERT INTO orders VALUES (1)")
+	if !errors.Is(err, violation) {
+		t.Fatalf("ExecContext() = %v, want the driver's error untouched", err)
+	}
+	last := messages[len(messages)-1]
+	if !strings.Contains(last, "failed after") || !strings.Contains(last, "duplicate key value") {
+		t.Errorf("trace %q lacks the error", last)
+	}
+}
@@ -0,0 +1,56 @@
+package txmpg
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/williammoran/txmpg/v2/internal/driver"
+)
+
+// WithSynchronousCommit makes the Finalizer run
+// SET LOCAL synchronous_commit with mode right after
+// beginning the transaction, so that this transaction
+// alone can trade durability for commit latency. mode is
+// one of "on", "off", "local", "remote_write" and
+// "remote_apply"; with "off", a transaction reported as
+// committed can be lost if the server crashes within a
+// fraction of a second. Construction fails if mode is not
+// valid, and Finalizer2P rejects the option entirely. It
+// replaces WithReplicationDurability(), and the last of
+// the two used wins.
+func WithSynchronousCommit(mode string) Option {
+	return func(c *config) {
+		c.synchronousCommit = mode
+		c.durability = DurabilityDefault
+	}
+}
+
+// validateSynchronousCommit checks the mode set by
+// WithSynchronousCommit(), if any
+func (c *config) validateSynchronousCommit() error {
+	switch c.synchronousCommit {
+	case "", "on", "off", "local", "remote_write", "remote_apply":
+		return nil
+	}
+	return fmt.Errorf(
+		"WithSynchronousCommit(%q): mode must be on, off, local, remote_write or remote_apply",
+		c.synchronousCommit,
+	)
+}
+
+// setSynchronousCommit runs SET LOCAL synchronous_commit
+// if WithSynchronousCommit() or WithReplicationDurability()
+// was used. The mode is
+// validated, so it is safe to include in the statement.
+func (c *config) setSynchronousCommit(ctx context.Context, tx driver.Querier) error {
+	if c.synchronousCommit == "" {
+		return nil
+	}
+	err := tx.Exec(
+		ctx, "SET LOCAL synchronous_commit = "+c.synchronousCommit,
+	)
+	if err != nil {
+		return wrapError(err, "Setting synchronous_commit")
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package txmpg
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestWithSynchronousCommit(t *testing.T) {
+	ctx := context.Background()
+	for _, mode := range []string{"on", "off", "local", "remote_write", "remote_apply"} {
+		t.Run(mode, func(t *testing.T) {
+			var traces []string
+			server, factory := fakeFactory(
+				t, "orders", WithSynchronousCommit(mode),
+				WithTraceHook(func(e TraceEvent) { traces = append(traces, e.Message) }),
+			)
+			f, err := factory.Begin(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Abort()
+			statements := server.Statements()
+			var set int
+			for i, stmt := range statements {
+				if stmt == "BEGIN" {
+					set = i + 1
+				}
+			}
+			want := "SET LOCAL synchronous_commit = " + mode
+			if set == 0 || set >= len(statements) || statements[set] != want {
+				t.Errorf("statements %q, want %q right after BEGIN", statements, want)
+			}
+			if !strings.Contains(strings.Join(traces, "\n"), "synchronous_commit = "+mode) {
+				t.Errorf("traces %q lack the mode", traces)
+			}
+		})
+	}
+}
+
+func TestWithSynchronousCommitRejected(t *testing.T) {
+	ctx := context.Background()
+	t.Run("invalid mode", func(t *testing.T) {
+		server, factory := fakeFactory(t, "orders", WithSynchronousCommit("of"))
+		_, err := factory.Begin(ctx)
+		if err == nil || !strings.Contains(err.Error(), `WithSynchronousCommit("of")`) {
+			t.Fatalf("Begin() = %v, want the invalid mode", err)
+		}
+		if n := server.Count("BEGIN"); n != 0 {
+			t.Errorf("%d transactions begun, want construction to fail first", n)
+		}
+	})
+	t.Run("two phase", func(t *testing.T) {
+		server, factory := fakeFactory(t, "orders", WithSynchronousCommit("off"))
+		_, err := factory.Begin2P(ctx)
+		if !errors.Is(err, ErrSynchronousCommit2P) {
+			t.Fatalf("Begin2P() = %v, want ErrSynchronousCommit2P", err)
+		}
+		if n := server.Count("BEGIN"); n != 0 {
+			t.Errorf("%d transactions begun, want construction to fail first", n)
+		}
+	})
+	t.Run("replaced by durability", func(t *testing.T) {
+		_, factory := fakeFactory(
+			t, "orders", WithSynchronousCommit("of"),
+			WithReplicationDurability(DurabilityDefault),
+		)
+		f, err := factory.Begin(ctx)
+		if err != nil {
+			t.Fatalf("Begin() = %v, want the last option to win", err)
+		}
+		f.Abort()
+	})
+}
+
+func TestWithSynchronousCommitServer(t *testing.T) {
+	db := serverDB(t)
+	ctx := context.Background()
+	var before string
+	err := db.QueryRow("SHOW synchronous_commit").Scan(&before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFactory("synccommit", db, WithSynchronousCommit("off")).Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	var during string
+	err = f.PgTx().QueryRow("SHOW synchronous_commit").Scan(&during)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Finalize()
+	if err == nil {
+		err = f.Commit()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var after string
+	err = db.QueryRow("SHOW synchronous_commit").Scan(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if during != "off" || after != before {
+		t.Errorf("synchronous_commit %s in the transaction and %s after, want off and %s", during, after, before)
+	}
+}
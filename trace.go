@@ -0,0 +1,147 @@
+package txmpg
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Phase identifies the part of the transaction lifecycle
+// that produced a trace event
+type Phase string
+
+const (
+	// PhaseBegin covers construction and the time before
+	// Finalize()
+	PhaseBegin Phase = "begin"
+	// PhaseDefer is registration of a deferred commit
+	PhaseDefer Phase = "defer"
+	// PhaseFinalize covers Finalize() and the deferred
+	// commits it runs
+	PhaseFinalize Phase = "finalize"
+	// PhasePrepare is PREPARE TRANSACTION (2-phase only)
+	PhasePrepare Phase = "prepare"
+	// PhaseCommit covers Commit()
+	PhaseCommit Phase = "commit"
+	// PhaseAbort covers Abort() and rollbacks by the
+	// watchdogs
+	PhaseAbort Phase = "abort"
+)
+
+// TraceEvent is a trace message along with the details of
+// the finalizer that produced it
+type TraceEvent struct {
+	Time  time.Time
+	Name  string
+	TXID  int64
+	PID   int64
+	GID   string
+	Phase Phase
+	Level Level
+	// CorrelationID is set by SetCorrelationID()
+	CorrelationID string
+	// Elapsed is the time since the transaction began
+	Elapsed time.Duration
+	// Message is the formatted trace message, without the
+	// finalizer details
+	Message string
+}
+
+// TraceHook receives trace events. It is called
+// synchronously on the transaction's path, so it must be
+// fast and must never block: a slow hook slows down every
+// transaction. Hand events off to a buffered channel or
+// similar if they need more processing.
+type TraceHook func(TraceEvent)
+
+// WithTraceHook sets a hook that receives every trace
+// event, as if SetTraceHook() had been called right after
+// construction. The hook is called whether or not a
+// logger is set.
+func WithTraceHook(hook TraceHook) Option {
+	return func(c *config) {
+		c.traceHook = hook
+	}
+}
+
+// formatElapsed formats the time since a transaction
+// began, rounded to the millisecond
+func formatElapsed(d time.Duration) string {
+	return d.Round(time.Millisecond).String()
+}
+
+// TraceFormatter formats a trace event as a line for the
+// finalizer's logger
+type TraceFormatter func(TraceEvent) string
+
+// TextFormatter formats trace events in the traditional
+// text format
+func TextFormatter(ev TraceEvent) string {
+	txid := "-"
+	if ev.TXID != 0 {
+		txid = strconv.FormatInt(ev.TXID, 10)
+	}
+	correlation := ""
+	if ev.CorrelationID != "" {
+		correlation = " CORRELATION: " + ev.CorrelationID
+	}
+	return fmt.Sprintf(
+		"trace: NAME: %s TX: %s PGTXID: %s PGPID: %d%s t=+%s message: %s",
+		ev.Name, ev.GID, txid, ev.PID, correlation,
+		formatElapsed(ev.Elapsed), ev.Message,
+	)
+}
+
+// jsonTraceEvent fixes the field names of JSONFormatter's
+// output. They are part of the API: don't change them.
+type jsonTraceEvent struct {
+	Time    string `json:"ts"`
+	Name    string `json:"name"`
+	TXID    int64  `json:"txid"`
+	PID     int64  `json:"pid"`
+	GID     string `json:"gid"`
+	Message string `json:"msg"`
+	Phase   Phase  `json:"phase"`
+	Level   string `json:"level"`
+	// Omitted if empty
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// Elapsed is in milliseconds
+	Elapsed float64 `json:"elapsed_ms"`
+}
+
+// JSONFormatter formats each trace event as a single line
+// JSON object with the fields ts (RFC 3339 with
+// nanoseconds), name, txid, pid, gid, msg, phase, level,
+// elapsed_ms and, if set, correlation_id
+func JSONFormatter(ev TraceEvent) string {
+	line, err := json.Marshal(jsonTraceEvent{
+		Time:          ev.Time.Format(time.RFC3339Nano),
+		Name:          ev.Name,
+		TXID:          ev.TXID,
+		PID:           ev.PID,
+		GID:           ev.GID,
+		Message:       ev.Message,
+		Phase:         ev.Phase,
+		Level:         ev.Level.String(),
+		CorrelationID: ev.CorrelationID,
+		Elapsed:       float64(ev.Elapsed) / float64(time.Millisecond),
+	})
+	if err != nil {
+		// Only strings and integers are encoded, so this
+		// can't happen
+		return TextFormatter(ev)
+	}
+	return string(line)
+}
+
+// WithTraceFormatter sets how trace events are formatted
+// for the logger, e.g. JSONFormatter for log aggregators
+// that require JSON lines. The logger's own prefix and
+// flags still apply, so use a logger with neither for
+// pure JSON output.
+func WithTraceFormatter(f TraceFormatter) Option {
+	return func(c *config) {
+		c.traceFormatter = f
+	}
+}
@@ -0,0 +1,131 @@
+package txmpg
+
+import (
+	"bytes"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// goldenTraceEvents covers each phase and level, with and
+// without a correlation ID, and messages that need
+// escaping
+func goldenTraceEvents() []TraceEvent {
+	began := time.Date(2024, 3, 1, 12, 30, 0, 123456789, time.UTC)
+	return []TraceEvent{
+		{
+			Time: began, Name: "orders", PID: 4242,
+			Phase: PhaseBegin, Level: LevelInfo, Message: "Transaction began",
+		},
+		{
+			Time: began.Add(1500 * time.Microsecond), Name: "orders", TXID: 1001, PID: 4242,
+			Phase: PhaseDefer, Level: LevelDebug, CorrelationID: "req-42",
+			Elapsed: 1500 * time.Microsecond, Message: `statement "INSERT INTO t VALUES ($1)" took 1ms`,
+		},
+		{
+			Time: began.Add(2 * time.Millisecond), Name: "orders", TXID: 1001, PID: 4242,
+			GID:   "txmpg:orders:1709296200123:5f2b8f2e-3a7e-4c6a-9f43-2d1c0b8e7a61_req-42",
+			Phase: PhasePrepare, Level: LevelInfo, CorrelationID: "req-42",
+			Elapsed: 2 * time.Millisecond, Message: "Transaction prepared",
+		},
+		{
+			Time: began.Add(time.Second).In(time.FixedZone("EST", -5*3600)), Name: "orders",
+			TXID: 1001, PID: 4242, Phase: PhaseCommit, Level: LevelWarn,
+			Elapsed: time.Second, Message: "COMMIT PREPARED error: line one\nline two\t<tab> & \"quotes\" \\ é",
+		},
+		{
+			Time: began.Add(time.Minute), Name: "payments", PID: 7,
+			Phase: PhaseAbort, Level: LevelError, Elapsed: time.Minute,
+			Message: "Abort() failed: connection reset",
+		},
+		{
+			Time: began, Name: "", Phase: PhaseFinalize, Level: Level(99),
+			Message: "",
+		},
+	}
+}
+
+func TestJSONFormatterGolden(t *testing.T) {
+	var lines []string
+	for _, ev := range goldenTraceEvents() {
+		line := JSONFormatter(ev)
+		if strings.Contains(line, "\n") {
+			t.Errorf("JSONFormatter() output spans lines: %q", line)
+		}
+		lines = append(lines, line)
+	}
+	got := strings.Join(lines, "\n") + "\n"
+	golden := filepath.Join("testdata", "trace_json.golden")
+	if *update {
+		err := os.WriteFile(golden, []byte(got), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("JSONFormatter() output differs from %s:\ngot:\n%s\nwant:\n%s", golden, got, want)
+	}
+}
+
+// manualClock is a clock for WithClock() that only moves
+// when told to
+type manualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestTraceElapsed(t *testing.T) {
+	for _, twoPhase := range []bool{false, true} {
+		clock := &manualClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+		var events []TraceEvent
+		var buf bytes.Buffer
+		_, factory := fakeFactory(
+			t, "orders",
+			WithClock(clock.Now),
+			WithLogger(log.New(&buf, "", 0)),
+			WithLogLevel(LevelDebug),
+			WithTraceHook(func(ev TraceEvent) { events = append(events, ev) }),
+		)
+		f := begin(t, factory, twoPhase)
+		defer f.Abort()
+		started := f.(interface{ Started() time.Time }).Started()
+		if !started.Equal(clock.Now()) {
+			t.Errorf("Started() = %s, want %s", started, clock.Now())
+		}
+		clock.advance(123 * time.Millisecond)
+		events = nil
+		f.Trace("checkpoint")
+		if len(events) != 1 || events[0].Elapsed != 123*time.Millisecond {
+			t.Fatalf("events = %+v, want one 123ms after the start", events)
+		}
+		if !events[0].Time.Equal(clock.Now()) {
+			t.Errorf("event time %s, want %s", events[0].Time, clock.Now())
+		}
+		if !strings.Contains(buf.String(), " t=+123ms message: checkpoint") {
+			t.Errorf("trace lines %q lack t=+123ms", buf.String())
+		}
+	}
+}
@@ -14,5 +14,11 @@ type TxFinalizer interface {
 	txmanager.TxFinalizer
 	PgTx() *sql.Tx
 	SetLogger(*log.Logger)
+	SetAbortReason(reason string)
 	Trace(format string, args ...interface{})
 }
+
+var (
+	_ TxFinalizer = (*Finalizer)(nil)
+	_ TxFinalizer = (*Finalizer2P)(nil)
+)
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/williammoran/txmanager/v2"
+	"github.com/williammoran/txmpg/v2"
+	"github.com/williammoran/txmpg/v2/txmpggorm"
+	"gorm.io/gorm"
+)
+
+// This example moves money from an account in one
+// database, written with GORM, to an account in another,
+// written with plain SQL, in a single 2-phase transaction
+// coordinated by txmanager. It uses the account tables
+// created by examples/bank:
+// ./example -0 "user=postgres dbname=bank0" -1 "user=postgres dbname=bank1"
+
+// Account is a row of the account table
+type Account struct {
+	ID      int
+	Balance int
+}
+
+// TableName makes GORM use the account table of
+// examples/bank
+func (Account) TableName() string {
+	return "account"
+}
+
+// AfterSave invalidates the cached account once the
+// transaction has committed, rather than when the row is
+// written, so that nothing re-caches the old balance in
+// between
+func (a *Account) AfterSave(tx *gorm.DB) error {
+	id := a.ID
+	return txmpggorm.AfterCommit(tx, func() {
+		fmt.Printf("Invalidating cached account %d in bank0\n", id)
+	})
+}
+
+func main() {
+	cs0 := flag.String("0", "", "first database connection")
+	cs1 := flag.String("1", "", "second database connection")
+	amount := flag.Int("a", 100, "Amount to transfer")
+	flag.Parse()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c0 := connect(*cs0)
+	defer c0.Close()
+	c1 := connect(*cs1)
+	defer c1.Close()
+	err := transfer(ctx, c0, c1, *amount)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Moved $%d from bank0 to bank1\n", *amount)
+}
+
+// transfer moves amount from account 1 in c0 to account 1
+// in c1, using GORM for c0 and plain SQL for c1
+func transfer(ctx context.Context, c0, c1 *sql.DB, amount int) error {
+	txm := txmanager.Transaction{}
+	defer txm.Abort("Defer")
+	f0 := txmpg.NewFinalizer2P(ctx, "bank0", c0)
+	f1 := txmpg.NewFinalizer2P(ctx, "bank1", c1)
+	txm.Add("bank0", f0)
+	txm.Add("bank1", f1)
+	db, err := txmpggorm.Session(f0, nil)
+	if err != nil {
+		return err
+	}
+	var from Account
+	err = db.WithContext(ctx).First(&from, 1).Error
+	if err != nil {
+		return err
+	}
+	if from.Balance < amount {
+		txm.Abort("Insufficient funds")
+		return fmt.Errorf("insufficient funds in account %d", from.ID)
+	}
+	from.Balance -= amount
+	err = db.WithContext(ctx).Save(&from).Error
+	if err != nil {
+		return err
+	}
+	_, err = f1.ExecContext(ctx, "UPDATE account SET balance = balance + $1 WHERE id = $2", amount, 1)
+	if err != nil {
+		return err
+	}
+	return txm.Commit()
+}
+
+// connect connects using the passed connection string or
+// exits
+func connect(cs string) *sql.DB {
+	conn, err := sql.Open("postgres", cs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return conn
+}
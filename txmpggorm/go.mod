@@ -0,0 +1,24 @@
+module github.com/williammoran/txmpg/v2/txmpggorm
+
+go 1.20
+
+require (
+	github.com/williammoran/txmanager/v2 v2.0.2
+	github.com/williammoran/txmpg/v2 v2.0.2
+	gorm.io/driver/postgres v1.5.4
+	gorm.io/gorm v1.25.5
+)
+
+require (
+	github.com/google/uuid v1.1.4 // indirect
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
+	github.com/jackc/pgx/v5 v5.4.3 // indirect
+	github.com/jinzhu/inflection v1.0.0 // indirect
+	github.com/jinzhu/now v1.1.5 // indirect
+	github.com/lib/pq v1.9.0 // indirect
+	golang.org/x/crypto v0.14.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+)
+
+replace github.com/williammoran/txmpg/v2 => ../
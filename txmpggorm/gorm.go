@@ -0,0 +1,76 @@
+// Package txmpggorm lets GORM take part in transactions
+// managed by txmpg finalizers, so that ORM writes commit
+// or roll back together with the other participants. It
+// is a separate module so that txmpg itself doesn't depend
+// on GORM.
+package txmpggorm
+
+import (
+	"errors"
+
+	"github.com/williammoran/txmpg/v2"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// finalizerKey is the GORM setting that holds the
+// finalizer of a session
+const finalizerKey = "txmpg:finalizer"
+
+// ErrNoTransaction is returned by Session() when the
+// finalizer no longer has an open transaction, as is the
+// case for a Finalizer2P after Finalize()
+var ErrNoTransaction = errors.New("finalizer has no open transaction")
+
+// ErrNoFinalizer is returned by AfterCommit() for a
+// *gorm.DB that didn't come from Session()
+var ErrNoFinalizer = errors.New("gorm.DB is not a txmpg session")
+
+// committer is implemented by the finalizers that can
+// run functions after they commit
+type committer interface {
+	OnCommit(fn func())
+}
+
+// Session returns a *gorm.DB that runs everything in f's
+// transaction. GORM never commits or rolls it back: the
+// transaction belongs to f, or the txmanager.Transaction
+// it was added to. GORM's own Transaction() and Begin()
+// use savepoints within it. config may be nil.
+func Session(f txmpg.TxFinalizer, config *gorm.Config) (*gorm.DB, error) {
+	tx := f.PgTx()
+	if tx == nil {
+		return nil, ErrNoTransaction
+	}
+	if config == nil {
+		config = &gorm.Config{}
+	}
+	// GORM would otherwise wrap each write in a
+	// transaction of its own
+	config.SkipDefaultTransaction = true
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: tx}), config)
+	if err != nil {
+		return nil, err
+	}
+	// A new session, so the setting is carried over to
+	// every statement run from it
+	return db.Set(finalizerKey, f).Session(&gorm.Session{}), nil
+}
+
+// AfterCommit registers fn to run once the transaction
+// behind db, a session from Session() or one derived from
+// it, commits, using the finalizer's OnCommit(). Call it
+// from model hooks such as AfterSave to invalidate caches
+// only once the change is visible to other transactions.
+func AfterCommit(db *gorm.DB, fn func()) error {
+	v, ok := db.Get(finalizerKey)
+	if !ok {
+		return ErrNoFinalizer
+	}
+	c, ok := v.(committer)
+	if !ok {
+		return ErrNoFinalizer
+	}
+	c.OnCommit(fn)
+	return nil
+}
@@ -0,0 +1,23 @@
+module github.com/williammoran/txmpg/v2/txmpgotel
+
+go 1.20
+
+require (
+	github.com/williammoran/txmpg/v2 v2.0.2
+	go.opentelemetry.io/otel v1.19.0
+	go.opentelemetry.io/otel/metric v1.19.0
+	go.opentelemetry.io/otel/sdk v1.19.0
+	go.opentelemetry.io/otel/sdk/metric v1.19.0
+	go.opentelemetry.io/otel/trace v1.19.0
+)
+
+require (
+	github.com/go-logr/logr v1.2.4 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/google/uuid v1.1.4 // indirect
+	github.com/lib/pq v1.9.0 // indirect
+	github.com/williammoran/txmanager/v2 v2.0.2 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+)
+
+replace github.com/williammoran/txmpg/v2 => ../
@@ -0,0 +1,150 @@
+package txmpgotel
+
+import (
+	"context"
+	"time"
+
+	"github.com/williammoran/txmpg/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Metrics implements txmpg.Metrics with OpenTelemetry
+// instruments:
+//
+//   - txmpg.transactions counts transactions by
+//     txmpg.outcome (begun, committed or aborted)
+//   - txmpg.failures counts failures by txmpg.operation
+//     (finalize, prepare or commit_prepared)
+//   - txmpg.phase.duration records seconds by txmpg.phase
+//     (begin_to_commit or prepare_to_commit)
+//   - txmpg.prepared.outstanding is the process wide
+//     txmpg.OutstandingPrepared(), without attributes
+//
+// All of them carry the txmpg.name and txmpg.two_phase
+// attributes. To use a specific MeterProvider:
+//
+//	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+//	metrics, err := txmpgotel.NewMetrics(provider)
+//	factory := txmpg.NewFactory("bank0", pool, txmpg.WithMetrics(metrics))
+type Metrics struct {
+	transactions metric.Int64Counter
+	failures     metric.Int64Counter
+	duration     metric.Float64Histogram
+}
+
+var _ txmpg.Metrics = (*Metrics)(nil)
+
+// NewMetrics creates the instruments with provider, or
+// the global MeterProvider if provider is nil
+func NewMetrics(provider metric.MeterProvider) (*Metrics, error) {
+	if provider == nil {
+		provider = otel.GetMeterProvider()
+	}
+	meter := provider.Meter(instrumentationName)
+	transactions, err := meter.Int64Counter(
+		"txmpg.transactions",
+		metric.WithDescription("Transactions by outcome"),
+		metric.WithUnit("{transaction}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	failures, err := meter.Int64Counter(
+		"txmpg.failures",
+		metric.WithDescription("Failed finalizer operations"),
+		metric.WithUnit("{failure}"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	duration, err := meter.Float64Histogram(
+		"txmpg.phase.duration",
+		metric.WithDescription("Duration of transaction phases"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	_, err = meter.Int64ObservableGauge(
+		"txmpg.prepared.outstanding",
+		metric.WithDescription("Prepared transactions created by this process and not yet resolved"),
+		metric.WithUnit("{transaction}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(int64(txmpg.OutstandingPrepared()))
+			return nil
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Metrics{
+		transactions: transactions,
+		failures:     failures,
+		duration:     duration,
+	}, nil
+}
+
+// metricAttributes identifies a finalizer in metrics
+func metricAttributes(name string, twoPhase bool, kv ...attribute.KeyValue) metric.MeasurementOption {
+	return metric.WithAttributes(append(
+		kv,
+		attribute.String("txmpg.name", name),
+		attribute.Bool("txmpg.two_phase", twoPhase),
+	)...)
+}
+
+// Begun implements txmpg.Metrics
+func (m *Metrics) Begun(name string, twoPhase bool) {
+	m.transactions.Add(context.Background(), 1, metricAttributes(
+		name, twoPhase, attribute.String("txmpg.outcome", "begun"),
+	))
+}
+
+// Committed implements txmpg.Metrics
+func (m *Metrics) Committed(
+	name string, twoPhase bool, sinceBegin, sincePrepare time.Duration,
+) {
+	ctx := context.Background()
+	m.transactions.Add(ctx, 1, metricAttributes(
+		name, twoPhase, attribute.String("txmpg.outcome", "committed"),
+	))
+	m.duration.Record(ctx, sinceBegin.Seconds(), metricAttributes(
+		name, twoPhase, attribute.String("txmpg.phase", "begin_to_commit"),
+	))
+	if twoPhase {
+		m.duration.Record(ctx, sincePrepare.Seconds(), metricAttributes(
+			name, twoPhase, attribute.String("txmpg.phase", "prepare_to_commit"),
+		))
+	}
+}
+
+// Aborted implements txmpg.Metrics
+func (m *Metrics) Aborted(name string, twoPhase bool) {
+	m.transactions.Add(context.Background(), 1, metricAttributes(
+		name, twoPhase, attribute.String("txmpg.outcome", "aborted"),
+	))
+}
+
+// FinalizeFailed implements txmpg.Metrics
+func (m *Metrics) FinalizeFailed(name string, twoPhase bool) {
+	m.failure(name, twoPhase, "finalize")
+}
+
+// PrepareFailed implements txmpg.Metrics
+func (m *Metrics) PrepareFailed(name string) {
+	m.failure(name, true, "prepare")
+}
+
+// CommitPreparedFailed implements txmpg.Metrics
+func (m *Metrics) CommitPreparedFailed(name string) {
+	m.failure(name, true, "commit_prepared")
+}
+
+// failure counts a failed operation
+func (m *Metrics) failure(name string, twoPhase bool, operation string) {
+	m.failures.Add(context.Background(), 1, metricAttributes(
+		name, twoPhase, attribute.String("txmpg.operation", operation),
+	))
+}
@@ -0,0 +1,236 @@
+package txmpgotel_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/williammoran/txmpg/v2"
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+	"github.com/williammoran/txmpg/v2/txmpgotel"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// meteredFactory returns a fake server and a factory on
+// it whose finalizers record metrics in reader
+func meteredFactory(t *testing.T) (*fakepg.Server, *txmpg.Factory, *sdkmetric.ManualReader) {
+	t.Helper()
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	metrics, err := txmpgotel.NewMetrics(provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, pool := fakepg.Open()
+	t.Cleanup(func() { pool.Close() })
+	return server, txmpg.NewFactory("orders", pool, txmpg.WithMetrics(metrics)), reader
+}
+
+// collect returns the metrics in reader by name
+func collect(t *testing.T, reader *sdkmetric.ManualReader) map[string]metricdata.Aggregation {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	err := reader.Collect(context.Background(), &rm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := map[string]metricdata.Aggregation{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			data[m.Name] = m.Data
+		}
+	}
+	return data
+}
+
+// matches reports whether set has every attribute of want
+func matches(set attribute.Set, want ...attribute.KeyValue) bool {
+	for _, kv := range want {
+		v, ok := set.Value(kv.Key)
+		if !ok || v != kv.Value {
+			return false
+		}
+	}
+	return true
+}
+
+// sum adds up the points of counter with the attributes
+// want
+func sum(t *testing.T, data map[string]metricdata.Aggregation, name string, want ...attribute.KeyValue) int64 {
+	t.Helper()
+	counter, ok := data[name].(metricdata.Sum[int64])
+	if !ok {
+		t.Fatalf("%s is %T, want a counter", name, data[name])
+	}
+	var n int64
+	for _, point := range counter.DataPoints {
+		if matches(point.Attributes, want...) {
+			n += point.Value
+		}
+	}
+	return n
+}
+
+func TestMetricsTransactions(t *testing.T) {
+	_, factory, reader := meteredFactory(t)
+	ctx := context.Background()
+	committed, err := factory.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustCommit(t, committed)
+	aborted, err := factory.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aborted.Abort()
+	committed2P, err := factory.Begin2P(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustCommit(t, committed2P)
+
+	data := collect(t, reader)
+	onePhase := attribute.Bool("txmpg.two_phase", false)
+	twoPhase := attribute.Bool("txmpg.two_phase", true)
+	tests := []struct {
+		attrs []attribute.KeyValue
+		want  int64
+	}{
+		{[]attribute.KeyValue{attribute.String("txmpg.outcome", "begun"), onePhase}, 2},
+		{[]attribute.KeyValue{attribute.String("txmpg.outcome", "begun"), twoPhase}, 1},
+		{[]attribute.KeyValue{attribute.String("txmpg.outcome", "committed"), onePhase}, 1},
+		{[]attribute.KeyValue{attribute.String("txmpg.outcome", "committed"), twoPhase}, 1},
+		{[]attribute.KeyValue{attribute.String("txmpg.outcome", "aborted"), onePhase}, 1},
+	}
+	for _, tt := range tests {
+		got := sum(t, data, "txmpg.transactions", append(tt.attrs, attribute.String("txmpg.name", "orders"))...)
+		if got != tt.want {
+			t.Errorf("txmpg.transactions %v = %d, want %d", tt.attrs, got, tt.want)
+		}
+	}
+
+	durations, ok := data["txmpg.phase.duration"].(metricdata.Histogram[float64])
+	if !ok {
+		t.Fatalf("txmpg.phase.duration is %T, want a histogram", data["txmpg.phase.duration"])
+	}
+	counts := map[string]uint64{}
+	for _, point := range durations.DataPoints {
+		if matches(point.Attributes, twoPhase) {
+			phase, _ := point.Attributes.Value("txmpg.phase")
+			counts[phase.AsString()] += point.Count
+		}
+	}
+	if counts["begin_to_commit"] != 1 || counts["prepare_to_commit"] != 1 {
+		t.Errorf("two-phase durations %v, want one of each phase", counts)
+	}
+}
+
+func TestMetricsFailures(t *testing.T) {
+	server, factory, reader := meteredFactory(t)
+	ctx := context.Background()
+
+	f, err := factory.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Defer(func() error { return errors.New("deferred commit failure") })
+	if f.Finalize() == nil {
+		t.Fatal("Finalize() succeeded")
+	}
+	f.Abort()
+
+	f2p, err := factory.Begin2P(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.FailNext("PREPARE TRANSACTION", fakepg.ServerError("55000", "prepared transactions are disabled"))
+	if f2p.Finalize() == nil {
+		t.Fatal("Finalize() succeeded with PREPARE failing")
+	}
+	f2p.Abort()
+
+	f2p, err = factory.Begin2P(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f2p.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.FailNext("COMMIT PREPARED", fakepg.ServerError("XX000", "internal error"))
+	if f2p.Commit() == nil {
+		t.Fatal("Commit() succeeded with COMMIT PREPARED failing")
+	}
+	f2p.Abort()
+
+	data := collect(t, reader)
+	tests := []struct {
+		operation string
+		twoPhase  bool
+		want      int64
+	}{
+		{"finalize", false, 1},
+		{"finalize", true, 1},
+		{"prepare", true, 1},
+		{"commit_prepared", true, 1},
+	}
+	for _, tt := range tests {
+		got := sum(t, data, "txmpg.failures",
+			attribute.String("txmpg.operation", tt.operation),
+			attribute.Bool("txmpg.two_phase", tt.twoPhase),
+		)
+		if got != tt.want {
+			t.Errorf("txmpg.failures %s two-phase %v = %d, want %d", tt.operation, tt.twoPhase, got, tt.want)
+		}
+	}
+}
+
+func TestMetricsPreparedOutstanding(t *testing.T) {
+	_, factory, reader := meteredFactory(t)
+	gauge := func() int64 {
+		data := collect(t, reader)
+		g, ok := data["txmpg.prepared.outstanding"].(metricdata.Gauge[int64])
+		if !ok || len(g.DataPoints) != 1 {
+			t.Fatalf("txmpg.prepared.outstanding is %#v, want a gauge with one point", data["txmpg.prepared.outstanding"])
+		}
+		return g.DataPoints[0].Value
+	}
+	before := gauge()
+	f, err := factory.Begin2P(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gauge(); got != before+1 {
+		t.Errorf("txmpg.prepared.outstanding = %d while prepared, want %d", got, before+1)
+	}
+	err = f.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := gauge(); got != before {
+		t.Errorf("txmpg.prepared.outstanding = %d after Commit(), want %d", got, before)
+	}
+}
+
+// mustCommit finalizes and commits f
+func mustCommit(t *testing.T, f interface {
+	Finalize() error
+	Commit() error
+}) {
+	t.Helper()
+	err := f.Finalize()
+	if err == nil {
+		err = f.Commit()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
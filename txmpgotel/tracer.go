@@ -0,0 +1,82 @@
+// Package txmpgotel instruments txmpg finalizers with
+// OpenTelemetry. It is a separate module so that txmpg
+// itself doesn't depend on OpenTelemetry.
+package txmpgotel
+
+import (
+	"context"
+
+	"github.com/williammoran/txmpg/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies this package to
+// OpenTelemetry providers
+const instrumentationName = "github.com/williammoran/txmpg/v2/txmpgotel"
+
+// Tracer implements txmpg.Tracer with OpenTelemetry
+// spans. Pass it to txmpg.WithTracer().
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+var _ txmpg.Tracer = (*Tracer)(nil)
+
+// NewTracer creates a Tracer using provider, or the
+// global TracerProvider if provider is nil
+func NewTracer(provider trace.TracerProvider) *Tracer {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return &Tracer{tracer: provider.Tracer(instrumentationName)}
+}
+
+// Start implements txmpg.Tracer
+func (t *Tracer) Start(
+	ctx context.Context, name string, info txmpg.FinalizerInfo,
+) (context.Context, txmpg.Span) {
+	ctx, span := t.tracer.Start(
+		ctx, "txmpg."+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attributes(info)...),
+	)
+	return ctx, otelSpan{span: span}
+}
+
+// otelSpan adapts an OpenTelemetry span to txmpg.Span
+type otelSpan struct {
+	span trace.Span
+}
+
+// End implements txmpg.Span
+func (s otelSpan) End(info txmpg.FinalizerInfo, err error) {
+	// The IDs may have been assigned after the span
+	// started
+	s.span.SetAttributes(attributes(info)...)
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
+
+// attributes describes a finalizer as span attributes
+func attributes(info txmpg.FinalizerInfo) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("db.system", "postgresql"),
+		attribute.String("txmpg.name", info.Name),
+		attribute.Bool("txmpg.two_phase", info.TwoPhase),
+		attribute.Int64("txmpg.pid", info.PID),
+		attribute.String("txmpg.state", info.State.String()),
+	}
+	if info.TXID != 0 {
+		attrs = append(attrs, attribute.Int64("txmpg.txid", info.TXID))
+	}
+	if info.GID != "" {
+		attrs = append(attrs, attribute.String("txmpg.gid", info.GID))
+	}
+	return attrs
+}
@@ -0,0 +1,138 @@
+package txmpgotel_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/williammoran/txmpg/v2"
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+	"github.com/williammoran/txmpg/v2/txmpgotel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// tracedFactory returns a factory on a fake server whose
+// finalizers record their spans in the returned exporter
+func tracedFactory(t *testing.T, opts ...txmpg.Option) (*txmpg.Factory, *tracetest.InMemoryExporter) {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	_, pool := fakepg.Open()
+	t.Cleanup(func() { pool.Close() })
+	opts = append(opts, txmpg.WithTracer(txmpgotel.NewTracer(provider)))
+	return txmpg.NewFactory("orders", pool, opts...), exporter
+}
+
+// spansByName indexes the ended spans by name
+func spansByName(t *testing.T, exporter *tracetest.InMemoryExporter) map[string]tracetest.SpanStub {
+	t.Helper()
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		if _, ok := spans[span.Name]; ok {
+			t.Fatalf("more than one %s span", span.Name)
+		}
+		spans[span.Name] = span
+	}
+	return spans
+}
+
+// attributeOf returns the value of the attribute key of span
+func attributeOf(span tracetest.SpanStub, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestTracerSpans(t *testing.T) {
+	factory, exporter := tracedFactory(t, txmpg.WithLazyTxid(true))
+	f, err := factory.Begin2P(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Info().TXID != 0 {
+		t.Fatalf("TXID = %d before the transaction wrote", f.Info().TXID)
+	}
+	f.DeferStatement("INSERT INTO orders VALUES ($1)", 1)
+	err = f.Finalize()
+	if err == nil {
+		err = f.Commit()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	spans := spansByName(t, exporter)
+	tx, ok := spans["txmpg.transaction"]
+	if !ok {
+		t.Fatalf("no transaction span in %v", spans)
+	}
+	if tx.Parent.IsValid() {
+		t.Errorf("transaction span has parent %s", tx.Parent.SpanID())
+	}
+	for _, name := range []string{"txmpg.finalize", "txmpg.commit"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Fatalf("no %s span", name)
+		}
+		if span.Parent.SpanID() != tx.SpanContext.SpanID() || span.SpanContext.TraceID() != tx.SpanContext.TraceID() {
+			t.Errorf("%s span is not a child of the transaction span", name)
+		}
+		if span.Status.Code == codes.Error {
+			t.Errorf("%s span status %v", name, span.Status)
+		}
+	}
+	// The transaction ID was assigned after the span
+	// started, and the GID at Finalize()
+	want := map[attribute.Key]attribute.Value{
+		"txmpg.name":      attribute.StringValue("orders"),
+		"txmpg.two_phase": attribute.BoolValue(true),
+		"txmpg.state":     attribute.StringValue(txmpg.StateCommitted.String()),
+		"txmpg.txid":      attribute.Int64Value(f.Info().TXID),
+		"txmpg.gid":       attribute.StringValue(f.GID()),
+	}
+	for key, value := range want {
+		got, ok := attributeOf(tx, key)
+		if !ok || got != value {
+			t.Errorf("transaction span %s = %v, want %v", key, got.Emit(), value.Emit())
+		}
+	}
+	if f.Info().TXID == 0 {
+		t.Error("TXID not assigned by the write")
+	}
+}
+
+func TestTracerErrorStatus(t *testing.T) {
+	factory, exporter := tracedFactory(t)
+	f, err := factory.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	failure := errors.New("deferred commit failure")
+	f.Defer(func() error { return failure })
+	if f.Finalize() == nil {
+		t.Fatal("Finalize() succeeded")
+	}
+	f.Abort()
+	spans := spansByName(t, exporter)
+	finalize := spans["txmpg.finalize"]
+	if finalize.Status.Code != codes.Error {
+		t.Errorf("finalize span status %v, want an error", finalize.Status)
+	}
+	recorded := false
+	for _, event := range finalize.Events {
+		recorded = recorded || event.Name == "exception"
+	}
+	if !recorded {
+		t.Error("finalize span has no exception event")
+	}
+	tx := spans["txmpg.transaction"]
+	if state, _ := attributeOf(tx, "txmpg.state"); state.AsString() != txmpg.StateAborted.String() {
+		t.Errorf("transaction span state %q, want aborted", state.AsString())
+	}
+}
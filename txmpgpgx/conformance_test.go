@@ -0,0 +1,46 @@
+package txmpgpgx_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/williammoran/txmanager/v2"
+	"github.com/williammoran/txmpg/v2/txmpgpgx"
+	"github.com/williammoran/txmpg/v2/txmpgtest"
+)
+
+// TestConformance needs a server with prepared
+// transactions enabled at TXMPG_TEST_DSN. The factories
+// can't fail the subtest they are called from, so they
+// panic instead.
+func TestConformance(t *testing.T) {
+	dsn := os.Getenv("TXMPG_TEST_DSN")
+	if dsn == "" {
+		t.Skip("TXMPG_TEST_DSN is not set")
+	}
+	pool, err := pgxpool.New(context.Background(), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	t.Run("NewFinalizer", func(t *testing.T) {
+		txmpgtest.RunFinalizerConformance(t, func(ctx context.Context) txmanager.TxFinalizer {
+			f, err := txmpgpgx.NewFinalizer(ctx, "conformance", pool)
+			if err != nil {
+				panic(err)
+			}
+			return f
+		})
+	})
+	t.Run("NewFinalizer2P", func(t *testing.T) {
+		txmpgtest.RunFinalizerConformance(t, func(ctx context.Context) txmanager.TxFinalizer {
+			f, err := txmpgpgx.NewFinalizer2P(ctx, "conformance", pool, "")
+			if err != nil {
+				panic(err)
+			}
+			return f
+		})
+	})
+}
@@ -0,0 +1,232 @@
+// Package txmpgpgx provides txmpg finalizers for
+// applications that use pgx directly rather than through
+// database/sql. They are built on the same engine as
+// txmpg.Finalizer and txmpg.Finalizer2P, so they follow
+// the same contract, state machine, deferred commit,
+// transaction status, GID and error semantics, and accept
+// the same options, except those tied to database/sql:
+// WithIsolation(), WithSnapshot(), WithStatementCache(),
+// WithSlowQueryThreshold(), WithTracer(), WithLazyTxid(),
+// WithLazyMetadata(), WithFinalizePool() and the
+// watchdogs are ignored.
+//
+// It is a separate module so that txmpg itself doesn't
+// depend on pgx.
+package txmpgpgx
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/williammoran/txmanager/v2"
+	"github.com/williammoran/txmpg/v2"
+	"github.com/williammoran/txmpg/v2/internal/driver"
+)
+
+// pgxPool runs the finalizer engine on a pgx pool
+type pgxPool struct {
+	pool *pgxpool.Pool
+}
+
+func (p pgxPool) Exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := p.pool.Exec(ctx, query, args...)
+	return err
+}
+
+func (p pgxPool) QueryRow(ctx context.Context, query string, args ...interface{}) driver.Row {
+	return p.pool.QueryRow(ctx, query, args...)
+}
+
+func (p pgxPool) Begin(ctx context.Context, opts *sql.TxOptions) (driver.Tx, error) {
+	var txOpts pgx.TxOptions
+	if opts != nil {
+		var err error
+		txOpts, err = pgxTxOptions(*opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tx, err := p.pool.BeginTx(ctx, txOpts)
+	if err != nil {
+		return nil, err
+	}
+	return pgxTx{tx: tx}, nil
+}
+
+func (p pgxPool) Conn(ctx context.Context) (driver.Conn, error) {
+	conn, err := p.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return pgxConn{conn: conn}, nil
+}
+
+// Stats describes the pool in the terms of database/sql,
+// for txmpg.PoolExhaustedError
+func (p pgxPool) Stats() sql.DBStats {
+	stat := p.pool.Stat()
+	return sql.DBStats{
+		MaxOpenConnections: int(stat.MaxConns()),
+		OpenConnections:    int(stat.TotalConns()),
+		InUse:              int(stat.AcquiredConns()),
+		Idle:               int(stat.IdleConns()),
+		WaitCount:          stat.EmptyAcquireCount(),
+		WaitDuration:       stat.AcquireDuration(),
+	}
+}
+
+// TxDone reports whether pgx already closed the
+// transaction, or rolled it back instead of committing it
+// because it had failed
+func (p pgxPool) TxDone(err error) bool {
+	return errors.Is(err, pgx.ErrTxClosed) || errors.Is(err, pgx.ErrTxCommitRollback)
+}
+
+// pgxTxOptions translates the options of database/sql
+// that txmpg.WithIsolation() sets to pgx's
+func pgxTxOptions(opts sql.TxOptions) (pgx.TxOptions, error) {
+	var txOpts pgx.TxOptions
+	switch opts.Isolation {
+	case sql.LevelDefault:
+	case sql.LevelReadUncommitted:
+		txOpts.IsoLevel = pgx.ReadUncommitted
+	case sql.LevelReadCommitted:
+		txOpts.IsoLevel = pgx.ReadCommitted
+	case sql.LevelRepeatableRead:
+		txOpts.IsoLevel = pgx.RepeatableRead
+	case sql.LevelSerializable:
+		txOpts.IsoLevel = pgx.Serializable
+	default:
+		return txOpts, fmt.Errorf("isolation level %s is not supported", opts.Isolation)
+	}
+	if opts.ReadOnly {
+		txOpts.AccessMode = pgx.ReadOnly
+	}
+	return txOpts, nil
+}
+
+// pgxConn runs COMMIT PREPARED on a connection acquired
+// from the pool
+type pgxConn struct {
+	conn *pgxpool.Conn
+}
+
+func (c pgxConn) Exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := c.conn.Exec(ctx, query, args...)
+	return err
+}
+
+func (c pgxConn) QueryRow(ctx context.Context, query string, args ...interface{}) driver.Row {
+	return c.conn.QueryRow(ctx, query, args...)
+}
+
+func (c pgxConn) Close() error {
+	c.conn.Release()
+	return nil
+}
+
+// pgxTx runs the finalizer engine's statements in a pgx
+// transaction
+type pgxTx struct {
+	tx pgx.Tx
+}
+
+func (t pgxTx) Exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := t.tx.Exec(ctx, query, args...)
+	return err
+}
+
+func (t pgxTx) QueryRow(ctx context.Context, query string, args ...interface{}) driver.Row {
+	return t.tx.QueryRow(ctx, query, args...)
+}
+
+// ExecBatch sends queries to the server as a pgx batch,
+// which runs them in order and stops at the first failure.
+// Each statement has a result of its own, which tells
+// which one failed.
+func (t pgxTx) ExecBatch(ctx context.Context, queries []string) error {
+	batch := &pgx.Batch{}
+	for _, query := range queries {
+		batch.Queue(query)
+	}
+	results := t.tx.SendBatch(ctx, batch)
+	for i := range queries {
+		_, err := results.Exec()
+		if err != nil {
+			results.Close()
+			return &driver.BatchError{Index: i, Err: err}
+		}
+	}
+	return results.Close()
+}
+
+func (t pgxTx) Commit(ctx context.Context) error {
+	return t.tx.Commit(ctx)
+}
+
+func (t pgxTx) Rollback(ctx context.Context) error {
+	return t.tx.Rollback(ctx)
+}
+
+// base is what both finalizers share
+type base struct {
+	*txmpg.DriverFinalizer
+}
+
+// PgxTx returns the transaction. Use it for all the work
+// done in the transaction. It returns nil once a
+// two-phase transaction has been prepared.
+func (b base) PgxTx() pgx.Tx {
+	tx, ok := b.DriverTx().(pgxTx)
+	if !ok {
+		return nil
+	}
+	return tx.tx
+}
+
+// CopyFrom bulk loads rows into columns of table with
+// pgx's CopyFrom, returning the number of rows loaded. The
+// load is part of the transaction, so it is discarded if
+// the transaction is aborted. table may be qualified with
+// a schema as "schema.table".
+func (b base) CopyFrom(
+	ctx context.Context, table string, columns []string, rows txmpg.RowSource,
+) (int64, error) {
+	tx := b.PgxTx()
+	if tx == nil {
+		return 0, b.WrapError(b.ErrNoTransaction(), "COPY into "+table)
+	}
+	start := time.Now()
+	n, err := tx.CopyFrom(ctx, pgx.Identifier(strings.Split(table, ".")), columns, rows)
+	if err != nil {
+		b.Trace("COPY into %s failed after %d rows in %s: %s", table, n, time.Since(start), err.Error())
+		return n, b.WrapError(err, "COPY into "+table)
+	}
+	b.Trace("COPY loaded %d rows into %s in %s", n, table, time.Since(start))
+	return n, nil
+}
+
+// Finalizer manages a single phase transaction on a pgx
+// pool, like txmpg.Finalizer
+type Finalizer struct {
+	base
+}
+
+var _ txmanager.TxFinalizer = (*Finalizer)(nil)
+
+// NewFinalizer begins a transaction on pool
+func NewFinalizer(
+	ctx context.Context, name string, pool *pgxpool.Pool, opts ...txmpg.Option,
+) (*Finalizer, error) {
+	f, err := txmpg.BeginDriver(ctx, name, pgxPool{pool}, false, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Finalizer{base{f}}, nil
+}
@@ -0,0 +1,35 @@
+package txmpgpgx
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/williammoran/txmanager/v2"
+	"github.com/williammoran/txmpg/v2"
+)
+
+// Finalizer2P manages a transaction on a pgx pool using
+// a prepared transaction, like txmpg.Finalizer2P. The same
+// server setup and recovery requirements apply. After
+// Finalize() succeeds, PgxTx() returns nil.
+type Finalizer2P struct {
+	base
+}
+
+var _ txmanager.TxFinalizer = (*Finalizer2P)(nil)
+
+// NewFinalizer2P begins a transaction on pool.
+// correlationID, if not empty, is appended to the GID as
+// txmpg.WithCorrelationID() would.
+func NewFinalizer2P(
+	ctx context.Context, name string, pool *pgxpool.Pool, correlationID string, opts ...txmpg.Option,
+) (*Finalizer2P, error) {
+	if correlationID != "" {
+		opts = append(opts[:len(opts):len(opts)], txmpg.WithCorrelationID(correlationID))
+	}
+	f, err := txmpg.BeginDriver(ctx, name, pgxPool{pool}, true, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Finalizer2P{base{f}}, nil
+}
@@ -0,0 +1,89 @@
+package txmpgpgx_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/williammoran/txmpg/v2"
+	"github.com/williammoran/txmpg/v2/txmpgpgx"
+)
+
+// testPool connects to the server at TXMPG_TEST_DSN,
+// skipping the test if it isn't set
+func testPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	dsn := os.Getenv("TXMPG_TEST_DSN")
+	if dsn == "" {
+		t.Skip("TXMPG_TEST_DSN is not set")
+	}
+	pool, err := pgxpool.New(context.Background(), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func TestDeferStatementBatchFailure(t *testing.T) {
+	pool := testPool(t)
+	f, err := txmpgpgx.NewFinalizer(context.Background(), "batch", pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	f.DeferStatement("SELECT 1")
+	f.DeferStatement("SELECT 1/0")
+	f.DeferStatement("SELECT 2")
+	err = f.Finalize()
+	var deferErr *txmpg.DeferError
+	if !errors.As(err, &deferErr) || deferErr.Index != 1 || deferErr.Succeeded != 1 {
+		t.Fatalf("Finalize() = %v, want a *DeferError for statement 1", err)
+	}
+}
+
+func TestCopyFrom(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	_, err := pool.Exec(ctx, "CREATE TABLE IF NOT EXISTS txmpgpgx_test_copy (id bigint, name text)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Exec(ctx, "DROP TABLE txmpgpgx_test_copy")
+	rows := make([][]interface{}, 5000)
+	for i := range rows {
+		rows[i] = []interface{}{int64(i), fmt.Sprintf("row %d", i)}
+	}
+	load := func(commit bool) {
+		t.Helper()
+		f, err := txmpgpgx.NewFinalizer(ctx, "copy", pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Abort()
+		n, err := f.CopyFrom(ctx, "public.txmpgpgx_test_copy", []string{"id", "name"}, txmpg.CopyFromRows(rows))
+		if err != nil || n != 5000 {
+			t.Fatalf("CopyFrom() = %d, %v", n, err)
+		}
+		if !commit {
+			return
+		}
+		err = f.Finalize()
+		if err == nil {
+			err = f.Commit()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	load(true)
+	load(false)
+	var n int
+	err = pool.QueryRow(ctx, "SELECT count(*) FROM txmpgpgx_test_copy").Scan(&n)
+	if err != nil || n != 5000 {
+		t.Errorf("%d rows loaded, %v, want only the committed 5000", n, err)
+	}
+}
@@ -0,0 +1,22 @@
+module github.com/williammoran/txmpg/v2/txmpgpgx
+
+go 1.20
+
+require (
+	github.com/jackc/pgx/v5 v5.5.0
+	github.com/williammoran/txmanager/v2 v2.0.2
+	github.com/williammoran/txmpg/v2 v2.0.2
+)
+
+require (
+	github.com/google/uuid v1.1.4 // indirect
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20221227161230-091c0ba34f0a // indirect
+	github.com/jackc/puddle/v2 v2.2.1 // indirect
+	github.com/lib/pq v1.9.0 // indirect
+	golang.org/x/crypto v0.9.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
+	golang.org/x/text v0.9.0 // indirect
+)
+
+replace github.com/williammoran/txmpg/v2 => ../
@@ -0,0 +1,25 @@
+module github.com/williammoran/txmpg/v2/txmpgprom
+
+go 1.20
+
+require (
+	github.com/prometheus/client_golang v1.17.0
+	github.com/williammoran/txmpg/v2 v2.0.2
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/google/uuid v1.1.4 // indirect
+	github.com/lib/pq v1.9.0 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
+	github.com/prometheus/client_model v0.4.1-0.20230718164431-9a2bf3000d16 // indirect
+	github.com/prometheus/common v0.44.0 // indirect
+	github.com/prometheus/procfs v0.11.1 // indirect
+	github.com/williammoran/txmanager/v2 v2.0.2 // indirect
+	golang.org/x/sys v0.11.0 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
+)
+
+replace github.com/williammoran/txmpg/v2 => ../
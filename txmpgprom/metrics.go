@@ -0,0 +1,138 @@
+// Package txmpgprom exports txmpg finalizer metrics to
+// Prometheus. It is a separate module so that txmpg
+// itself doesn't depend on the Prometheus client.
+//
+// Wire it up once, on the factory or on each constructor:
+//
+//	metrics := txmpgprom.New(prometheus.DefaultRegisterer)
+//	factory := txmpg.NewFactory("bank0", pool, txmpg.WithMetrics(metrics))
+//	http.Handle("/metrics", promhttp.Handler())
+package txmpgprom
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/williammoran/txmpg/v2"
+)
+
+// Metrics implements txmpg.Metrics with Prometheus
+// counters and histograms, labeled by finalizer name and
+// by mode ("1p" or "2p")
+type Metrics struct {
+	begun                *prometheus.CounterVec
+	committed            *prometheus.CounterVec
+	aborted              *prometheus.CounterVec
+	finalizeFailed       *prometheus.CounterVec
+	prepareFailed        *prometheus.CounterVec
+	commitPreparedFailed *prometheus.CounterVec
+	beginToCommit        *prometheus.HistogramVec
+	prepareToCommit      *prometheus.HistogramVec
+}
+
+var _ txmpg.Metrics = (*Metrics)(nil)
+
+// New creates the metrics and registers them with reg.
+// It panics if they are already registered.
+func New(reg prometheus.Registerer) *Metrics {
+	labels := []string{"name", "mode"}
+	counter := func(name, help string, labels ...string) *prometheus.CounterVec {
+		c := prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "txmpg",
+			Name:      name,
+			Help:      help,
+		}, labels)
+		reg.MustRegister(c)
+		return c
+	}
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "txmpg",
+		Name:      "outstanding_prepared",
+		Help:      "Prepared transactions created by this process and not yet resolved.",
+	}, func() float64 {
+		return float64(txmpg.OutstandingPrepared())
+	}))
+	histogram := func(name, help string, labels ...string) *prometheus.HistogramVec {
+		h := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "txmpg",
+			Name:      name,
+			Help:      help,
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 16),
+		}, labels)
+		reg.MustRegister(h)
+		return h
+	}
+	return &Metrics{
+		begun: counter(
+			"transactions_begun_total", "Transactions started.", labels...,
+		),
+		committed: counter(
+			"transactions_committed_total", "Transactions committed.", labels...,
+		),
+		aborted: counter(
+			"transactions_aborted_total", "Transactions rolled back.", labels...,
+		),
+		finalizeFailed: counter(
+			"finalize_failures_total", "Failed calls to Finalize().", labels...,
+		),
+		prepareFailed: counter(
+			"prepare_failures_total", "Failed PREPARE TRANSACTION statements.", "name",
+		),
+		commitPreparedFailed: counter(
+			"commit_prepared_failures_total",
+			"Failed or in doubt COMMIT PREPARED statements.", "name",
+		),
+		beginToCommit: histogram(
+			"begin_to_commit_seconds",
+			"Time from the start of a transaction until it committed.", labels...,
+		),
+		prepareToCommit: histogram(
+			"prepare_to_commit_seconds",
+			"Time from PREPARE TRANSACTION until COMMIT PREPARED completed.", "name",
+		),
+	}
+}
+
+// mode is the value of the mode label
+func mode(twoPhase bool) string {
+	if twoPhase {
+		return "2p"
+	}
+	return "1p"
+}
+
+// Begun implements txmpg.Metrics
+func (m *Metrics) Begun(name string, twoPhase bool) {
+	m.begun.WithLabelValues(name, mode(twoPhase)).Inc()
+}
+
+// Committed implements txmpg.Metrics
+func (m *Metrics) Committed(
+	name string, twoPhase bool, sinceBegin, sincePrepare time.Duration,
+) {
+	m.committed.WithLabelValues(name, mode(twoPhase)).Inc()
+	m.beginToCommit.WithLabelValues(name, mode(twoPhase)).Observe(sinceBegin.Seconds())
+	if twoPhase {
+		m.prepareToCommit.WithLabelValues(name).Observe(sincePrepare.Seconds())
+	}
+}
+
+// Aborted implements txmpg.Metrics
+func (m *Metrics) Aborted(name string, twoPhase bool) {
+	m.aborted.WithLabelValues(name, mode(twoPhase)).Inc()
+}
+
+// FinalizeFailed implements txmpg.Metrics
+func (m *Metrics) FinalizeFailed(name string, twoPhase bool) {
+	m.finalizeFailed.WithLabelValues(name, mode(twoPhase)).Inc()
+}
+
+// PrepareFailed implements txmpg.Metrics
+func (m *Metrics) PrepareFailed(name string) {
+	m.prepareFailed.WithLabelValues(name).Inc()
+}
+
+// CommitPreparedFailed implements txmpg.Metrics
+func (m *Metrics) CommitPreparedFailed(name string) {
+	m.commitPreparedFailed.WithLabelValues(name).Inc()
+}
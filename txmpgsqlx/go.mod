@@ -0,0 +1,14 @@
+module github.com/williammoran/txmpg/v2/txmpgsqlx
+
+go 1.20
+
+require (
+	github.com/jmoiron/sqlx v1.3.5
+	github.com/lib/pq v1.9.0
+	github.com/williammoran/txmanager/v2 v2.0.2
+	github.com/williammoran/txmpg/v2 v2.0.2
+)
+
+require github.com/google/uuid v1.1.4 // indirect
+
+replace github.com/williammoran/txmpg/v2 => ../
@@ -0,0 +1,72 @@
+// Package txmpgsqlx lets code written against sqlx work
+// in transactions managed by txmpg finalizers. It is a
+// separate module so that txmpg itself doesn't depend on
+// sqlx.
+package txmpgsqlx
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"unsafe"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
+	"github.com/williammoran/txmpg/v2"
+)
+
+// driverName is the name sqlx uses to choose the bind
+// variable syntax for the transactions of txmpg's
+// finalizers, which are always PostgreSQL
+const driverName = "postgres"
+
+// Wrap returns f's transaction as a *sqlx.Tx, or nil if
+// f no longer has an open transaction, as is the case for
+// a Finalizer2P after Finalize(). The transaction still
+// belongs to f: commit or roll it back through the
+// finalizer (or the txmanager.Transaction it was added
+// to), never through the *sqlx.Tx.
+func Wrap(f txmpg.TxFinalizer) *sqlx.Tx {
+	tx := f.PgTx()
+	if tx == nil {
+		return nil
+	}
+	return newTx(tx)
+}
+
+// newTx returns tx as a *sqlx.Tx for driverName. sqlx
+// only creates a Tx when it begins the transaction
+// itself, and keeps the driver name, which chooses the
+// bind variable syntax for Rebind() and named queries, in
+// an unexported field, so it is set here by reflection.
+func newTx(tx *sql.Tx) *sqlx.Tx {
+	stx := &sqlx.Tx{Tx: tx, Mapper: reflectx.NewMapperFunc("db", sqlx.NameMapper)}
+	field := reflect.ValueOf(stx).Elem().FieldByName("driverName")
+	reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem().SetString(driverName)
+	return stx
+}
+
+// BeginSqlx starts a transaction managed by a single
+// phase Finalizer from factory, and returns it along with
+// the transaction wrapped by Wrap()
+func BeginSqlx(
+	ctx context.Context, factory *txmpg.Factory, opts ...txmpg.Option,
+) (*txmpg.Finalizer, *sqlx.Tx, error) {
+	f, err := factory.Begin(ctx, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, Wrap(f), nil
+}
+
+// BeginSqlx2P is BeginSqlx() for a 2-phase Finalizer2P.
+// The *sqlx.Tx can't be used after Finalize().
+func BeginSqlx2P(
+	ctx context.Context, factory *txmpg.Factory, opts ...txmpg.Option,
+) (*txmpg.Finalizer2P, *sqlx.Tx, error) {
+	f, err := factory.Begin2P(ctx, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, Wrap(f), nil
+}
@@ -0,0 +1,141 @@
+package txmpgsqlx
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/williammoran/txmanager/v2"
+	"github.com/williammoran/txmpg/v2"
+)
+
+func TestNewTxBindsForPostgres(t *testing.T) {
+	tx := newTx(nil)
+	if tx.DriverName() != driverName {
+		t.Errorf("DriverName() = %q, want %q", tx.DriverName(), driverName)
+	}
+	if got := tx.Rebind("a = ? AND b = ?"); got != "a = $1 AND b = $2" {
+		t.Errorf("Rebind() = %q", got)
+	}
+	query, args, err := tx.BindNamed(
+		"INSERT INTO t (a, b) VALUES (:a, :b)", map[string]interface{}{"a": 1, "b": "x"},
+	)
+	if err != nil {
+		t.Fatalf("BindNamed() = %v", err)
+	}
+	if query != "INSERT INTO t (a, b) VALUES ($1, $2)" || len(args) != 2 {
+		t.Errorf("BindNamed() = %q, %v", query, args)
+	}
+}
+
+type account struct {
+	ID      int `db:"id"`
+	Balance int `db:"balance"`
+}
+
+// TestTwoDatabases moves money between two databases,
+// each written through sqlx, in one coordinated
+// transaction. It needs a server with prepared
+// transactions enabled at TXMPG_TEST_DSN; the second
+// database is TXMPG_TEST_DSN2, or the same one.
+func TestTwoDatabases(t *testing.T) {
+	dsn := os.Getenv("TXMPG_TEST_DSN")
+	if dsn == "" {
+		t.Skip("TXMPG_TEST_DSN is not set")
+	}
+	dsn2 := os.Getenv("TXMPG_TEST_DSN2")
+	if dsn2 == "" {
+		dsn2 = dsn
+	}
+	ctx := context.Background()
+	from := openTable(t, dsn, "txmpgsqlx_from")
+	to := openTable(t, dsn2, "txmpgsqlx_to")
+
+	f0, tx0, err := BeginSqlx2P(ctx, txmpg.NewFactory("from", from))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1, tx1, err := BeginSqlx2P(ctx, txmpg.NewFactory("to", to))
+	if err != nil {
+		f0.Abort()
+		t.Fatal(err)
+	}
+	var tx txmanager.Transaction
+	tx.Add("from", f0)
+	tx.Add("to", f1)
+
+	var src account
+	err = tx0.Get(&src, "SELECT id, balance FROM txmpgsqlx_from WHERE id = $1", 1)
+	if err != nil {
+		tx.Abort(err.Error())
+		t.Fatal(err)
+	}
+	_, err = tx0.NamedExec(
+		"UPDATE txmpgsqlx_from SET balance = balance - :amount WHERE id = :id",
+		map[string]interface{}{"id": src.ID, "amount": 10},
+	)
+	if err != nil {
+		tx.Abort(err.Error())
+		t.Fatal(err)
+	}
+	_, err = tx1.NamedExec(
+		"UPDATE txmpgsqlx_to SET balance = balance + :balance WHERE id = :id",
+		account{ID: 1, Balance: 10},
+	)
+	if err != nil {
+		tx.Abort(err.Error())
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var balances []account
+	err = sqlx.NewDb(from, driverName).Select(
+		&balances, "SELECT id, balance FROM txmpgsqlx_from ORDER BY id",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(balances) != 1 || balances[0].Balance != 90 {
+		t.Errorf("from balances = %+v, want [{1 90}]", balances)
+	}
+	err = sqlx.NewDb(to, driverName).Select(
+		&balances, "SELECT id, balance FROM txmpgsqlx_to ORDER BY id",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(balances) != 1 || balances[0].Balance != 110 {
+		t.Errorf("to balances = %+v, want [{1 110}]", balances)
+	}
+}
+
+// openTable connects to dsn and creates table with a
+// single account holding 100
+func openTable(t *testing.T, dsn, table string) *sql.DB {
+	t.Helper()
+	pool, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pool.Exec("DROP TABLE IF EXISTS " + table)
+		pool.Close()
+	})
+	_, err = pool.Exec("DROP TABLE IF EXISTS " + table)
+	if err == nil {
+		_, err = pool.Exec("CREATE TABLE " + table + " (id int PRIMARY KEY, balance int NOT NULL)")
+	}
+	if err == nil {
+		_, err = pool.Exec("INSERT INTO " + table + " VALUES (1, 100)")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
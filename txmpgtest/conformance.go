@@ -0,0 +1,147 @@
+package txmpgtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/williammoran/txmanager/v2"
+	"github.com/williammoran/txmpg/v2"
+)
+
+// deferrer is implemented by finalizers that support
+// deferred commits, like txmpg.Finalizer
+type deferrer interface {
+	Defer(exec func() error)
+}
+
+// RunFinalizerConformance checks that the finalizers made
+// by factory follow the contract the txmpg finalizers
+// follow, so that other implementations of
+// txmanager.TxFinalizer, such as txmpgpgx's, can be used
+// interchangeably with them. factory is called once per subtest with the
+// context the finalizer must use; every finalizer is
+// aborted when its subtest ends. The deferred commit
+// checks are skipped for finalizers without a Defer()
+// method.
+func RunFinalizerConformance(t *testing.T, factory func(ctx context.Context) txmanager.TxFinalizer) {
+	begin := func(t *testing.T, ctx context.Context) txmanager.TxFinalizer {
+		f := factory(ctx)
+		t.Cleanup(f.Abort)
+		return f
+	}
+	t.Run("FinalizeThenCommit", func(t *testing.T) {
+		f := begin(t, context.Background())
+		mustSucceed(t, "Finalize()", f.Finalize())
+		mustSucceed(t, "Commit()", f.Commit())
+	})
+	t.Run("CommitTwice", func(t *testing.T) {
+		f := begin(t, context.Background())
+		mustSucceed(t, "Finalize()", f.Finalize())
+		mustSucceed(t, "Commit()", f.Commit())
+		err := f.Commit()
+		if err != nil && !errors.Is(err, txmpg.ErrAlreadyCommitted) {
+			t.Errorf("second Commit() = %v, want nil or ErrAlreadyCommitted", err)
+		}
+	})
+	t.Run("CommitOnlyAfterFinalize", func(t *testing.T) {
+		f := begin(t, context.Background())
+		err := f.Commit()
+		if !errors.Is(err, txmpg.ErrNotFinalized) {
+			t.Errorf("Commit() before Finalize() = %v, want ErrNotFinalized", err)
+		}
+		d, ok := f.(deferrer)
+		if !ok {
+			return
+		}
+		d.Defer(func() error { return errors.New("deferred commit failure") })
+		if f.Finalize() == nil {
+			t.Fatal("Finalize() with a failing deferred commit succeeded")
+		}
+		err = f.Commit()
+		if !errors.Is(err, txmpg.ErrNotFinalized) {
+			t.Errorf("Commit() after failed Finalize() = %v, want ErrNotFinalized", err)
+		}
+	})
+	t.Run("AbortTwice", func(t *testing.T) {
+		f := begin(t, context.Background())
+		f.Abort()
+		f.Abort()
+		if f.Commit() == nil {
+			t.Error("Commit() after Abort() succeeded")
+		}
+	})
+	t.Run("AbortAfterFinalize", func(t *testing.T) {
+		f := begin(t, context.Background())
+		mustSucceed(t, "Finalize()", f.Finalize())
+		f.Abort()
+		if f.Commit() == nil {
+			t.Error("Commit() after Abort() succeeded")
+		}
+	})
+	t.Run("AbortAfterCommit", func(t *testing.T) {
+		f := begin(t, context.Background())
+		mustSucceed(t, "Finalize()", f.Finalize())
+		mustSucceed(t, "Commit()", f.Commit())
+		f.Abort()
+		err := f.Commit()
+		if err != nil && !errors.Is(err, txmpg.ErrAlreadyCommitted) {
+			t.Errorf("Commit() after Commit() and Abort() = %v, want nil or ErrAlreadyCommitted", err)
+		}
+	})
+	t.Run("DeferRunsOnce", func(t *testing.T) {
+		f := begin(t, context.Background())
+		d, ok := f.(deferrer)
+		if !ok {
+			t.Skip("no Defer()")
+		}
+		runs := 0
+		d.Defer(func() error {
+			runs++
+			return nil
+		})
+		mustSucceed(t, "Finalize()", f.Finalize())
+		mustSucceed(t, "second Finalize()", f.Finalize())
+		mustSucceed(t, "Commit()", f.Commit())
+		if runs != 1 {
+			t.Errorf("deferred commit ran %d times, want 1", runs)
+		}
+	})
+	t.Run("DeferFailureFailsFinalize", func(t *testing.T) {
+		f := begin(t, context.Background())
+		d, ok := f.(deferrer)
+		if !ok {
+			t.Skip("no Defer()")
+		}
+		failure := errors.New("deferred commit failure")
+		d.Defer(func() error { return failure })
+		err := f.Finalize()
+		if !errors.Is(err, failure) {
+			t.Errorf("Finalize() = %v, want the deferred commit's error", err)
+		}
+		f.Abort()
+		if f.Commit() == nil {
+			t.Error("Commit() after failed Finalize() and Abort() succeeded")
+		}
+	})
+	t.Run("CancelledContext", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		f := begin(t, ctx)
+		cancel()
+		err := f.Finalize()
+		if err == nil {
+			err = f.Commit()
+		}
+		if err == nil {
+			t.Error("Finalize() and Commit() with a cancelled context succeeded")
+		}
+	})
+}
+
+// mustSucceed stops the test if err is set
+func mustSucceed(t *testing.T, op string, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s failed: %s", op, err.Error())
+	}
+}
@@ -0,0 +1,101 @@
+package txmpgtest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/williammoran/txmpg/v2"
+)
+
+// FaultScript is a txmpg.FaultInjector that follows a
+// script of faults set up by the test. It is safe for
+// concurrent use. Install it with
+// txmpg.WithFaultInjector(script).
+type FaultScript struct {
+	mu     sync.Mutex
+	faults map[txmpg.FaultPoint][]*fault
+	hits   map[txmpg.FaultPoint]int
+}
+
+// fault is one scripted fault. once faults are removed
+// after they fire.
+type fault struct {
+	err   error
+	panic interface{}
+	sleep time.Duration
+	once  bool
+}
+
+// NewFaultScript creates a FaultScript with no faults
+func NewFaultScript() *FaultScript {
+	return &FaultScript{
+		faults: map[txmpg.FaultPoint][]*fault{},
+		hits:   map[txmpg.FaultPoint]int{},
+	}
+}
+
+// FailOnce makes the next finalizer to reach point fail
+// with err
+func (s *FaultScript) FailOnce(point txmpg.FaultPoint, err error) *FaultScript {
+	return s.add(point, &fault{err: err, once: true})
+}
+
+// Fail makes every finalizer that reaches point fail with
+// err
+func (s *FaultScript) Fail(point txmpg.FaultPoint, err error) *FaultScript {
+	return s.add(point, &fault{err: err})
+}
+
+// PanicOnce makes the next finalizer to reach point panic
+// with v
+func (s *FaultScript) PanicOnce(point txmpg.FaultPoint, v interface{}) *FaultScript {
+	return s.add(point, &fault{panic: v, once: true})
+}
+
+// SleepOnce makes the next finalizer to reach point sleep
+// for d, e.g. to let a context expire
+func (s *FaultScript) SleepOnce(point txmpg.FaultPoint, d time.Duration) *FaultScript {
+	return s.add(point, &fault{sleep: d, once: true})
+}
+
+// add appends f to the faults for point
+func (s *FaultScript) add(point txmpg.FaultPoint, f *fault) *FaultScript {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[point] = append(s.faults[point], f)
+	return s
+}
+
+// Hits returns the number of times point was reached,
+// whether or not a fault fired
+func (s *FaultScript) Hits(point txmpg.FaultPoint) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits[point]
+}
+
+// Inject fires the first fault scripted for point. It is
+// the txmpg.FaultInjector method.
+func (s *FaultScript) Inject(point txmpg.FaultPoint, gid string) error {
+	s.mu.Lock()
+	s.hits[point]++
+	faults := s.faults[point]
+	if len(faults) == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	f := faults[0]
+	if f.once {
+		s.faults[point] = faults[1:]
+	}
+	s.mu.Unlock()
+	if f.sleep > 0 {
+		time.Sleep(f.sleep)
+	}
+	if f.panic != nil {
+		panic(f.panic)
+	}
+	return f.err
+}
+
+var _ txmpg.FaultInjector = (*FaultScript)(nil)
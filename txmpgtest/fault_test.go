@@ -0,0 +1,268 @@
+package txmpgtest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/williammoran/txmpg/v2"
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+	"github.com/williammoran/txmpg/v2/txmpgtest"
+)
+
+// finalize2P begins a Finalizer2P that has written a row
+// and finalizes it
+func finalize2P(t *testing.T, factory *txmpg.Factory) (*txmpg.Finalizer2P, error) {
+	t.Helper()
+	ctx := context.Background()
+	f, err := factory.Begin2P(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(f.Abort)
+	_, err = f.ExecContext(ctx, "INSERT INTO orders VALUES (1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, f.Finalize()
+}
+
+func TestFaultPrepare(t *testing.T) {
+	injected := errors.New("injected")
+	tests := []struct {
+		name  string
+		point txmpg.FaultPoint
+		// left is whether the prepared transaction
+		// survives the failure on the server
+		left bool
+	}{
+		{"before PREPARE", txmpg.FaultBeforePrepare, false},
+		{"after PREPARE", txmpg.FaultAfterPrepare, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := txmpgtest.NewFaultScript().FailOnce(tt.point, injected)
+			server, factory := factory(t, txmpg.WithFaultInjector(script))
+			f, err := finalize2P(t, factory)
+			var txErr *txmpg.Error
+			if !errors.As(err, &txErr) || !errors.Is(err, injected) {
+				t.Fatalf("Finalize() = %v, want an *Error wrapping the fault", err)
+			}
+			if f.State() != txmpg.StateFailed {
+				t.Errorf("State() = %s after a failed PREPARE", f.State())
+			}
+			if script.Hits(tt.point) != 1 {
+				t.Errorf("Hits(%s) = %d", tt.point, script.Hits(tt.point))
+			}
+			if f.GID() != "" {
+				t.Errorf("GID() = %q after a failed PREPARE", f.GID())
+			}
+			err = f.Commit()
+			if !errors.Is(err, txmpg.ErrNotFinalized) {
+				t.Errorf("Commit() = %v, want ErrNotFinalized", err)
+			}
+			f.Abort()
+			if f.State() != txmpg.StateAborted {
+				t.Errorf("State() = %s after Abort()", f.State())
+			}
+			if got := len(server.Prepared()); (got == 1) != tt.left {
+				t.Errorf("%d prepared transactions on the server", got)
+			}
+			if server.Count("COMMIT PREPARED") != 0 {
+				t.Error("COMMIT PREPARED was sent")
+			}
+		})
+	}
+}
+
+func TestFaultCommitPrepared(t *testing.T) {
+	tests := []struct {
+		name  string
+		point txmpg.FaultPoint
+		err   error
+		want  error
+		state txmpg.State
+		// prepared is the number of prepared transactions
+		// left on the server
+		prepared int
+	}{
+		{
+			name: "server error", point: txmpg.FaultBeforeCommitPrepared,
+			err:   fakepg.ServerError("53300", "too many connections"),
+			state: txmpg.StateFinalized, prepared: 1,
+		},
+		{
+			// An error without a SQLSTATE leaves the outcome
+			// in doubt until the server is checked
+			name: "lost before the server", point: txmpg.FaultBeforeCommitPrepared,
+			err:  errors.New("connection reset"),
+			want: txmpg.ErrCommitNotApplied, state: txmpg.StateFinalized, prepared: 1,
+		},
+		{
+			name: "lost after the server", point: txmpg.FaultAfterCommitPrepared,
+			err:  errors.New("connection reset"),
+			want: txmpg.ErrCommitConfirmedGone, state: txmpg.StateCommitted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := txmpgtest.NewFaultScript().FailOnce(tt.point, tt.err)
+			server, factory := factory(t, txmpg.WithFaultInjector(script))
+			f, err := finalize2P(t, factory)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = f.Commit()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Commit() = %v, want the fault", err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("Commit() = %v, want %v", err, tt.want)
+			}
+			if errors.Is(err, txmpg.ErrInDoubt) {
+				t.Errorf("Commit() = %v, which the server resolved", err)
+			}
+			if f.State() != tt.state {
+				t.Errorf("State() = %s, want %s", f.State(), tt.state)
+			}
+			if got := len(server.Prepared()); got != tt.prepared {
+				t.Errorf("%d prepared transactions on the server, want %d", got, tt.prepared)
+			}
+			if tt.state != txmpg.StateFinalized {
+				return
+			}
+			// The transaction is still prepared, so Commit()
+			// can be retried
+			err = f.Commit()
+			if err != nil {
+				t.Fatalf("second Commit() = %v", err)
+			}
+			if f.State() != txmpg.StateCommitted || len(server.Committed()) != 1 {
+				t.Errorf("State() = %s, %d committed", f.State(), len(server.Committed()))
+			}
+		})
+	}
+}
+
+func TestFaultRollbackPrepared(t *testing.T) {
+	injected := fakepg.ServerError("53300", "too many connections")
+	tests := []struct {
+		name     string
+		script   *txmpgtest.FaultScript
+		hits     int
+		state    txmpg.State
+		prepared int
+	}{
+		{
+			name:   "retried",
+			script: txmpgtest.NewFaultScript().FailOnce(txmpg.FaultBeforeRollbackPrepared, injected),
+			hits:   2, state: txmpg.StateAborted,
+		},
+		{
+			name:   "every attempt fails",
+			script: txmpgtest.NewFaultScript().Fail(txmpg.FaultBeforeRollbackPrepared, injected),
+			hits:   3, state: txmpg.StateAbortFailed, prepared: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var handled []error
+			server, factory := factory(
+				t,
+				txmpg.WithFaultInjector(tt.script),
+				txmpg.WithRollbackPreparedRetry(3, time.Millisecond),
+				txmpg.WithErrorHandler(txmpg.ErrorCallback(func(_ txmpg.FinalizerInfo, err error) {
+					handled = append(handled, err)
+				})),
+			)
+			f, err := finalize2P(t, factory)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Abort()
+			if got := tt.script.Hits(txmpg.FaultBeforeRollbackPrepared); got != tt.hits {
+				t.Errorf("%d attempts at ROLLBACK PREPARED, want %d", got, tt.hits)
+			}
+			if f.State() != tt.state {
+				t.Errorf("State() = %s, want %s", f.State(), tt.state)
+			}
+			if got := len(server.Prepared()); got != tt.prepared {
+				t.Errorf("%d prepared transactions on the server, want %d", got, tt.prepared)
+			}
+			if tt.state == txmpg.StateAborted {
+				if f.AbortError() != nil || len(handled) != 0 {
+					t.Errorf("AbortError() = %v, handled %v", f.AbortError(), handled)
+				}
+				return
+			}
+			if !errors.Is(f.AbortError(), injected) {
+				t.Errorf("AbortError() = %v, want the fault", f.AbortError())
+			}
+			if len(handled) != 1 || !errors.Is(handled[0], injected) {
+				t.Errorf("error handler got %v", handled)
+			}
+			err = f.Commit()
+			if !errors.Is(err, txmpg.ErrAborted) {
+				t.Errorf("Commit() = %v, want ErrAborted", err)
+			}
+		})
+	}
+}
+
+func TestFaultCommit(t *testing.T) {
+	injected := fakepg.ServerError("40001", "could not serialize access")
+	script := txmpgtest.NewFaultScript().FailOnce(txmpg.FaultBeforeCommit, injected)
+	server, factory := factory(t, txmpg.WithFaultInjector(script))
+	f, err := factory.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Abort()
+	err = f.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Commit()
+	if !errors.Is(err, injected) {
+		t.Fatalf("Commit() = %v, want the fault", err)
+	}
+	if f.State() == txmpg.StateCommitted || server.Count("COMMIT") != 0 {
+		t.Errorf("State() = %s after a failed commit", f.State())
+	}
+	f.Abort()
+	if f.State() != txmpg.StateAborted || server.Count("ROLLBACK") != 1 {
+		t.Errorf("State() = %s after Abort()", f.State())
+	}
+}
+
+func TestFaultScriptPanicAndSleep(t *testing.T) {
+	script := txmpgtest.NewFaultScript().
+		PanicOnce(txmpg.FaultBeforePrepare, "boom").
+		SleepOnce(txmpg.FaultBeforeCommitPrepared, 10*time.Millisecond)
+	_, factory := factory(t, txmpg.WithFaultInjector(script))
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("recovered %v, want the scripted panic", r)
+			}
+		}()
+		finalize2P(t, factory)
+	}()
+	// The panic fired once, so the next finalizer prepares
+	f, err := finalize2P(t, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = f.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 10*time.Millisecond {
+		t.Errorf("Commit() took %s, want the scripted sleep", d)
+	}
+	if script.Hits(txmpg.FaultBeforePrepare) != 2 {
+		t.Errorf("Hits(%s) = %d", txmpg.FaultBeforePrepare, script.Hits(txmpg.FaultBeforePrepare))
+	}
+}
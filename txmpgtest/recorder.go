@@ -0,0 +1,86 @@
+// Package txmpgtest provides helpers for testing code
+// that uses txmpg
+package txmpgtest
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/williammoran/txmpg/v2"
+)
+
+// TraceRecorder stores the trace events of finalizers in
+// memory so tests can make assertions about them. It is
+// safe for concurrent use. Install it with
+// txmpg.WithTraceHook(recorder.Hook) or SetTraceHook().
+type TraceRecorder struct {
+	mu     sync.Mutex
+	events []txmpg.TraceEvent
+}
+
+// NewTraceRecorder creates an empty TraceRecorder
+func NewTraceRecorder() *TraceRecorder {
+	return &TraceRecorder{}
+}
+
+// Hook records ev. It is a txmpg.TraceHook.
+func (r *TraceRecorder) Hook(ev txmpg.TraceEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+}
+
+// Events returns a copy of the recorded events
+func (r *TraceRecorder) Events() []txmpg.TraceEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]txmpg.TraceEvent(nil), r.events...)
+}
+
+// Has reports whether any event was recorded in phase
+func (r *TraceRecorder) Has(phase txmpg.Phase) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, ev := range r.events {
+		if ev.Phase == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// Sequence returns the phases of the recorded events in
+// order, with repeats of the same phase collapsed, e.g.
+// begin, finalize, prepare, commit
+func (r *TraceRecorder) Sequence() []txmpg.Phase {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var phases []txmpg.Phase
+	for _, ev := range r.events {
+		if len(phases) > 0 && phases[len(phases)-1] == ev.Phase {
+			continue
+		}
+		phases = append(phases, ev.Phase)
+	}
+	return phases
+}
+
+// Reset discards the recorded events
+func (r *TraceRecorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = nil
+}
+
+// Dump logs every recorded event to t, for use when a
+// test fails
+func (r *TraceRecorder) Dump(t testing.TB) {
+	t.Helper()
+	for _, ev := range r.Events() {
+		t.Logf(
+			"%s %s [%s/%s] txid=%d pid=%d gid=%s: %s",
+			ev.Time.Format("15:04:05.000000"), ev.Name, ev.Phase, ev.Level,
+			ev.TXID, ev.PID, ev.GID, ev.Message,
+		)
+	}
+}
@@ -0,0 +1,97 @@
+package txmpgtest_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/williammoran/txmpg/v2"
+	"github.com/williammoran/txmpg/v2/internal/fakepg"
+	"github.com/williammoran/txmpg/v2/txmpgtest"
+)
+
+// factory returns a Factory on a new fake server
+func factory(t *testing.T, opts ...txmpg.Option) (*fakepg.Server, *txmpg.Factory) {
+	t.Helper()
+	server, pool := fakepg.Open()
+	t.Cleanup(func() { pool.Close() })
+	return server, txmpg.NewFactory("orders", pool, opts...)
+}
+
+func TestTraceRecorderSequence(t *testing.T) {
+	tests := []struct {
+		name   string
+		twoP   bool
+		commit bool
+		want   []txmpg.Phase
+	}{
+		{
+			name: "commit", commit: true,
+			want: []txmpg.Phase{txmpg.PhaseBegin, txmpg.PhaseDefer, txmpg.PhaseFinalize, txmpg.PhaseCommit},
+		},
+		{
+			name: "abort",
+			want: []txmpg.Phase{txmpg.PhaseBegin, txmpg.PhaseDefer, txmpg.PhaseFinalize, txmpg.PhaseAbort},
+		},
+		{
+			name: "2P commit", twoP: true, commit: true,
+			want: []txmpg.Phase{
+				txmpg.PhaseBegin, txmpg.PhaseDefer, txmpg.PhaseFinalize,
+				txmpg.PhasePrepare, txmpg.PhaseCommit,
+			},
+		},
+		{
+			name: "2P abort", twoP: true,
+			want: []txmpg.Phase{
+				txmpg.PhaseBegin, txmpg.PhaseDefer, txmpg.PhaseFinalize,
+				txmpg.PhasePrepare, txmpg.PhaseAbort,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := txmpgtest.NewTraceRecorder()
+			_, factory := factory(t, txmpg.WithTraceHook(recorder.Hook))
+			var f txmpg.TxFinalizer
+			var err error
+			if tt.twoP {
+				f, err = factory.Begin2P(context.Background())
+			} else {
+				f, err = factory.Begin(context.Background())
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.(interface{ Defer(func() error) }).Defer(func() error { return nil })
+			err = f.Finalize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.commit {
+				err = f.Commit()
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				f.Abort()
+			}
+			got := recorder.Sequence()
+			if !reflect.DeepEqual(got, tt.want) {
+				recorder.Dump(t)
+				t.Errorf("Sequence() = %v, want %v", got, tt.want)
+			}
+			if !recorder.Has(tt.want[len(tt.want)-1]) {
+				t.Errorf("Has(%s) = false", tt.want[len(tt.want)-1])
+			}
+			for _, ev := range recorder.Events() {
+				if ev.Name != "orders" || ev.Time.IsZero() {
+					t.Errorf("event without name or time: %+v", ev)
+				}
+			}
+			recorder.Reset()
+			if len(recorder.Events()) != 0 || recorder.Has(txmpg.PhaseBegin) {
+				t.Error("Reset() left events")
+			}
+		})
+	}
+}
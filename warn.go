@@ -0,0 +1,72 @@
+package txmpg
+
+import "time"
+
+// WithWarnAfter makes the finalizer trace a warning when
+// its transaction has been open longer than d by the time
+// it is committed or aborted. Long open transactions hold
+// locks and keep vacuum from cleaning up, so they are
+// worth hearing about.
+func WithWarnAfter(d time.Duration) Option {
+	return func(c *config) {
+		c.warnAfter = d
+	}
+}
+
+// WithWarnWhileOpen makes the WithWarnAfter() warning
+// fire as soon as the threshold passes, while the
+// transaction is still open, instead of when it ends
+func WithWarnWhileOpen(early bool) Option {
+	return func(c *config) {
+		c.warnWhileOpen = early
+	}
+}
+
+// startWarnTimer starts the timer for WithWarnWhileOpen()
+func (m *engine) startWarnTimer() {
+	if m.cfg.warnAfter <= 0 || !m.cfg.warnWhileOpen {
+		return
+	}
+	m.warnTimer = time.AfterFunc(m.cfg.warnAfter, func() {
+		if !m.State().terminal() {
+			m.logf(LevelWarn, "warning: transaction still open after %s", m.cfg.warnAfter)
+		}
+	})
+}
+
+// warnIfLong traces the WithWarnAfter() warning when the
+// transaction ends, unless the timer already did
+func (m *engine) warnIfLong() {
+	if m.warnTimer != nil {
+		m.warnTimer.Stop()
+		return
+	}
+	open := m.cfg.now().Sub(m.started)
+	if m.cfg.warnAfter > 0 && open > m.cfg.warnAfter {
+		m.logf(
+			LevelWarn, "warning: transaction was open for %s, longer than %s, and ran %d statements",
+			open, m.cfg.warnAfter, m.statements.count.Load(),
+		)
+	}
+}
+
+// WithWarnPreparedAfter makes Finalizer2P trace a warning
+// when more than d passed between PREPARE TRANSACTION and
+// the completion of COMMIT PREPARED. The prepared
+// transaction holds its locks for all of that time.
+func WithWarnPreparedAfter(d time.Duration) Option {
+	return func(c *config) {
+		c.warnPreparedAfter = d
+	}
+}
+
+// warnIfPreparedLong traces the WithWarnPreparedAfter()
+// warning if d is over the threshold
+func (m *engine) warnIfPreparedLong(d time.Duration) {
+	if m.cfg.warnPreparedAfter > 0 && d > m.cfg.warnPreparedAfter {
+		m.logf(
+			LevelWarn, "warning: transaction was prepared for %s before it committed, longer than %s",
+			d, m.cfg.warnPreparedAfter,
+		)
+	}
+}